@@ -0,0 +1,138 @@
+// Command udpwsproxy-replay replays the client side of a session recorded
+// with udpwsproxy -record-dir through a live proxy.
+//
+//	udpwsproxy-replay [flags] capture.cap ws://proxy:6080/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasthttp/websocket"
+
+	"udpwsproxy/proxy"
+)
+
+func main() {
+	speedPtr := flag.Float64(
+		"speed",
+		1,
+		"replay speed relative to the recording, 0 sends as fast as possible",
+	)
+	dataTypePtr := flag.String(
+		"data",
+		"",
+		"message type to send: text or binary, default from the capture",
+	)
+	lingerPtr := flag.Duration(
+		"linger",
+		time.Second,
+		"how long to wait for replies after the last message",
+	)
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"Usage: udpwsproxy-replay [flags] capture.cap ws://proxy/")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *speedPtr < 0 {
+		log.Fatalln("speed must not be negative. Use -h to help")
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer file.Close()
+	capture, err := proxy.NewCaptureReader(file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	header := capture.Header
+
+	dataType := *dataTypePtr
+	if dataType == "" {
+		dataType = header.DataFromClient
+	}
+	if dataType == "" {
+		dataType = header.DataToClient
+	}
+	msgType := websocket.TextMessage
+	switch dataType {
+	case proxy.DataTypeBinary:
+		msgType = websocket.BinaryMessage
+	case proxy.DataTypeText, "":
+	default:
+		log.Fatalln("unsupported data type", dataType, "Use -h to help")
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(flag.Arg(1), nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer conn.Close()
+	log.Println("* Replaying client", header.Client, "recorded",
+		header.Started.Format(time.RFC3339), "against", header.Backend)
+
+	var received uint64
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			atomic.AddUint64(&received, 1)
+		}
+	}()
+
+	start := time.Now()
+	var datagrams, messages int
+	for {
+		rec, err := capture.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Println("read capture error:", err)
+			break
+		}
+		if rec.Dir != proxy.CaptureToBackend {
+			continue
+		}
+		msgs := [][]byte{rec.Payload}
+		if header.Framing == proxy.FramingLength16 {
+			if msgs, err = proxy.SplitFrames(rec.Payload); err != nil {
+				log.Println("datagram at", rec.Offset, "error:", err)
+			}
+		}
+		if *speedPtr > 0 {
+			at := time.Duration(float64(rec.Offset) / *speedPtr)
+			time.Sleep(time.Until(start.Add(at)))
+		}
+		for _, msg := range msgs {
+			if err = conn.WriteMessage(msgType, msg); err != nil {
+				log.Fatalln("send error:", err)
+			}
+			messages++
+		}
+		datagrams++
+	}
+
+	time.Sleep(*lingerPtr)
+	conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second),
+	)
+	log.Printf("replayed %d messages from %d datagrams in %s, received %d messages",
+		messages, datagrams, time.Since(start).Round(time.Millisecond),
+		atomic.LoadUint64(&received))
+}
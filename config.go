@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+
+	"udpwsproxy/proxy"
+)
+
+// repeatableFlags take one value per use, so a list in the config file
+// sets them once per entry instead of joined with commas.
+var repeatableFlags = map[string]bool{"route": true, "route-options": true, "listen": true}
+
+// reloadableFlags are the settings a SIGHUP applies to the running proxy,
+// see proxy.ReloadConfig.
+var reloadableFlags = []string{
+	"auth-token",
+	"allowed-origins",
+	"skip-origin-check",
+	"max-conns",
+	"max-bytes-per-conn",
+	"rate-limit",
+	"global-rate-limit",
+}
+
+// commandLineFlags returns the names of the flags given on the command
+// line, which win over the config file.
+func commandLineFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// loadConfigFile sets flags from the YAML file at path, whose keys are flag
+// names. Lists and mappings stand for comma-separated values, a mapping's
+// entries being key=value. Flags in skip are left alone, and so are those
+// not in only, unless only is nil.
+func loadConfigFile(path string, skip map[string]bool, only []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var settings map[string]any
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if only != nil {
+		// Settings removed from the file go back to their defaults.
+		for _, name := range only {
+			if _, ok := settings[name]; !ok && !skip[name] {
+				flag.Set(name, flag.Lookup(name).DefValue)
+			}
+		}
+	}
+	for name, value := range settings {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		if skip[name] || (only != nil && !contains(only, name)) {
+			continue
+		}
+		values := configValues(value)
+		if !repeatableFlags[name] {
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, v := range values {
+			if err := flag.Set(name, v); err != nil {
+				return fmt.Errorf("%s: %s: %v", path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValues flattens a config file value into flag values.
+func configValues(value any) []string {
+	switch value := value.(type) {
+	case nil:
+		return []string{""}
+	case []any:
+		var values []string
+		for _, v := range value {
+			values = append(values, fmt.Sprint(v))
+		}
+		return values
+	case map[string]any:
+		var values []string
+		for k, v := range value {
+			values = append(values, k+"="+fmt.Sprint(v))
+		}
+		// Sorted, so every load sets them in the same order.
+		sort.Strings(values)
+		return values
+	}
+	return []string{fmt.Sprint(value)}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadOnHUP re-reads the config file on every SIGHUP and hands the
+// reloadable settings, as build makes them from the flags, to p. Live
+// connections are kept. A file that fails to load or validate is logged and
+// changes nothing.
+func reloadOnHUP(path string, cmdline map[string]bool, p *proxy.Proxy, build func() (proxy.ReloadConfig, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		err := loadConfigFile(path, cmdline, reloadableFlags)
+		var rc proxy.ReloadConfig
+		if err == nil {
+			rc, err = build()
+		}
+		if err == nil {
+			err = p.Reload(rc)
+		}
+		if err != nil {
+			log.Println("reload", path, "error:", err)
+			continue
+		}
+		log.Println("* Reloaded", path)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// handoffSignal is not available without SIGUSR2.
+var handoffSignal os.Signal
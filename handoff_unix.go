@@ -0,0 +1,12 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// handoffSignal makes serve close its listeners and drain, for a new
+// process serving the same inherited sockets to take over.
+var handoffSignal os.Signal = syscall.SIGUSR2
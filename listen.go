@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exitAddrInUse is the exit status when the listen address is taken,
+// distinct from the 1 of other startup errors so scripts can tell it apart.
+const exitAddrInUse = 3
+
+// defaultListenAddr is where the proxy listens without -listen.
+const defaultListenAddr = ":6080"
+
+// listenOptions tune the HTTP listener, see listen.
+type listenOptions struct {
+	reusePort  bool
+	socketMode os.FileMode
+	// noDelay disables Nagle's algorithm on accepted TCP connections.
+	noDelay bool
+	// keepAlive is the TCP keepalive period, 0 disables keepalives.
+	keepAlive time.Duration
+}
+
+// listenSpec is one -listen value: an address followed by comma-separated
+// options. tls or plain turn TLS on or off for the listener, which
+// otherwise uses it whenever a certificate is configured; each
+// route=path limits the upgrades it serves to those paths. webtransport
+// serves WebTransport over HTTP/3 on the UDP port instead, which needs
+// TLS.
+type listenSpec struct {
+	addr         string
+	tls          string // "tls", "plain" or "" for the default
+	routes       []string
+	webTransport bool
+}
+
+func parseListenSpec(s string) (listenSpec, error) {
+	parts := strings.Split(s, ",")
+	spec := listenSpec{addr: strings.TrimSpace(parts[0])}
+	if spec.addr == "" {
+		return listenSpec{}, errors.New("missing listen address")
+	}
+	for _, opt := range parts[1:] {
+		opt = strings.TrimSpace(opt)
+		path, isRoute := strings.CutPrefix(opt, "route=")
+		switch {
+		case opt == "tls" || opt == "plain":
+			if spec.tls != "" && spec.tls != opt {
+				return listenSpec{}, fmt.Errorf("listen %s: tls and plain are mutually exclusive", spec.addr)
+			}
+			spec.tls = opt
+		case isRoute && strings.HasPrefix(path, "/"):
+			spec.routes = append(spec.routes, path)
+		case opt == "webtransport":
+			spec.webTransport = true
+		default:
+			return listenSpec{}, fmt.Errorf("listen %s: unknown option %q", spec.addr, opt)
+		}
+	}
+	if spec.webTransport {
+		if spec.tls == "plain" {
+			return listenSpec{}, fmt.Errorf("listen %s: webtransport needs tls", spec.addr)
+		}
+		if strings.HasPrefix(spec.addr, "unix:") || strings.HasPrefix(spec.addr, "fd:") {
+			return listenSpec{}, fmt.Errorf("listen %s: webtransport needs a UDP address", spec.addr)
+		}
+	}
+	return spec, nil
+}
+
+// String formats the spec the way -listen takes it.
+func (s listenSpec) String() string {
+	out := s.addr
+	if s.tls != "" {
+		out += "," + s.tls
+	}
+	for _, path := range s.routes {
+		out += ",route=" + path
+	}
+	if s.webTransport {
+		out += ",webtransport"
+	}
+	return out
+}
+
+// listenPacket opens the UDP socket of a webtransport listener on addr.
+func listenPacket(addr string, opts listenOptions) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	if opts.reusePort && reusePortSupported {
+		lc.Control = reusePort
+	}
+	return lc.ListenPacket(context.Background(), "udp", addr)
+}
+
+// listen opens the HTTP listener on addr, a TCP address, unix:/path for
+// a Unix socket or fd:N for a listening socket inherited as file
+// descriptor N. The socket file gets opts.socketMode when it is non-zero
+// and is removed again when the listener is closed.
+func listen(addr string, opts listenOptions) (net.Listener, error) {
+	if fd, isFD := strings.CutPrefix(addr, "fd:"); isFD {
+		n, err := strconv.Atoi(fd)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid listen file descriptor %q", fd)
+		}
+		if opts.reusePort {
+			return nil, errors.New("reuseport needs a TCP listen address")
+		}
+		return fileListener(n, addr, opts)
+	}
+	path, isUnix := strings.CutPrefix(addr, "unix:")
+	if !isUnix {
+		var lc net.ListenConfig
+		if opts.reusePort {
+			if reusePortSupported {
+				lc.Control = reusePort
+			} else {
+				log.Println("reuseport is not supported on this platform, ignoring it")
+			}
+		}
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return tcpOptionsListener{ln, opts}, nil
+	}
+
+	if opts.reusePort {
+		return nil, errors.New("reuseport needs a TCP listen address")
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if opts.socketMode != 0 {
+		if err := os.Chmod(path, opts.socketMode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	// Closing a Unix listener unlinks its socket file, which serve does on
+	// SIGINT and SIGTERM.
+	return ln, nil
+}
+
+// removeStaleSocket deletes a socket file left behind by a process that
+// did not shut down cleanly. A socket something still listens on is left
+// alone, so binding it fails as usual.
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// tcpOptionsListener applies the TCP options to accepted connections.
+type tcpOptionsListener struct {
+	net.Listener
+	opts listenOptions
+}
+
+func (l tcpOptionsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(l.opts.noDelay)
+		tcpConn.SetKeepAlive(l.opts.keepAlive > 0)
+		if l.opts.keepAlive > 0 {
+			tcpConn.SetKeepAlivePeriod(l.opts.keepAlive)
+		}
+	}
+	return conn, err
+}
+
+// systemdListeners returns the listeners passed by systemd socket
+// activation, in the order of the unit's Listen directives, or nil when
+// the process was not socket-activated.
+func systemdListeners(opts listenOptions) ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	// Keep the sockets from leaking into child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	const listenFDsStart = 3
+	lns := make([]net.Listener, 0, n)
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		ln, err := fileListener(fd, "systemd-socket", opts)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// fileListener serves the listening socket open as file descriptor fd.
+// The listener works on a close-on-exec duplicate and fd itself is closed,
+// so the socket does not leak into child processes.
+func fileListener(fd int, name string, opts listenOptions) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return tcpOptionsListener{ln, opts}, nil
+}
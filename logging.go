@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// setupLogging makes a handler for format, writing records at level and
+// above to stderr, the default for slog and, through it, the log package
+// that the startup lines still use.
+func setupLogging(format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch format {
+	case "plain":
+		h = newPlainHandler(os.Stderr, lvl)
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unsupported log format %q", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// accessLog logs each request at info level once it is done, in place of
+// the fiber logger's fixed line format.
+func accessLog(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+	status := c.Response().StatusCode()
+	var fe *fiber.Error
+	if errors.As(err, &fe) {
+		status = fe.Code
+	}
+	slog.Info("request", "status", status, "latency_seconds", time.Since(start).Seconds(),
+		"ip", c.IP(), "method", c.Method(), "path", c.Path())
+	return err
+}
+
+// plainHandler writes records the way the log package does, the message
+// after the date and time, followed by the attributes as key=value. Info
+// records carry no level, so lines from the log package come out as they
+// always did.
+type plainHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level slog.Level
+	attrs []byte
+}
+
+func newPlainHandler(w io.Writer, level slog.Level) *plainHandler {
+	return &plainHandler{mu: new(sync.Mutex), w: w, level: level}
+}
+
+func (h *plainHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *plainHandler) Handle(_ context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	b.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	if r.Level != slog.LevelInfo {
+		b.WriteString(r.Level.String())
+		b.WriteByte(' ')
+	}
+	b.WriteString(r.Message)
+	b.Write(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&b, a)
+		return true
+	})
+	b.WriteByte('\n')
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(b.Bytes())
+	return err
+}
+
+func (h *plainHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b bytes.Buffer
+	b.Write(h.attrs)
+	for _, a := range attrs {
+		appendAttr(&b, a)
+	}
+	return &plainHandler{mu: h.mu, w: h.w, level: h.level, attrs: b.Bytes()}
+}
+
+// WithGroup is not needed by the proxy, attributes stay ungrouped.
+func (h *plainHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// appendAttr writes a as " key=value", quoting values with spaces or
+// quotes in them.
+func appendAttr(b *bytes.Buffer, a slog.Attr) {
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	v := a.Value.Resolve().String()
+	if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+		v = fmt.Sprintf("%q", v)
+	}
+	fmt.Fprintf(b, " %s=%s", a.Key, v)
+}
@@ -1,155 +1,1847 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/websocket/v2"
-)
 
-const (
-	localKeyBackendURL = "localKeyBackendURL"
-	localKeyDataType   = "localKeyDataType"
-	dataTypeText       = "text"
-	dataTypeBinary     = "binary"
+	"udpwsproxy/proxy"
 )
 
 func main() {
-	listenAddrPtr := flag.String("listen", ":6080", "listen address")
-	backendAddrPtr := flag.String("backend", "", "backend addr")
+	var listenSpecs []listenSpec
+	flag.Func(
+		"listen",
+		"listen address, unix:/path for a Unix socket or fd:N for an inherited listening socket, then options: tls or plain, route=path for each upgrade path served, and webtransport to serve WebTransport over HTTP/3 on the UDP port instead, e.g. :8443,tls,route=/dns; repeatable (default :6080); the UDP address in reverse mode",
+		func(s string) error {
+			spec, err := parseListenSpec(s)
+			if err != nil {
+				return err
+			}
+			listenSpecs = append(listenSpecs, spec)
+			return nil
+		},
+	)
+	modePtr := flag.String(
+		"mode",
+		"forward",
+		"forward bridges WebSocket clients to UDP backends; reverse listens on UDP and tunnels each peer to -ws-backend",
+	)
+	configPtr := flag.String(
+		"config",
+		"",
+		"YAML file of settings named like the flags, which the command line overrides; SIGHUP reloads the auth token, origins and limits from it",
+	)
+	logFormatPtr := flag.String(
+		"log-format",
+		"plain",
+		"log output: plain lines, text as key=value pairs, or json, one object per line",
+	)
+	logLevelPtr := flag.String(
+		"log-level",
+		"info",
+		"lowest level logged: debug, info, warn or error",
+	)
+	wsBackendPtr := flag.String(
+		"ws-backend",
+		"",
+		"ws:// or wss:// URL of the udpwsproxy to tunnel to in reverse mode",
+	)
+	backendAddrPtr := flag.String(
+		"backend",
+		"",
+		"backend addr, or a comma-separated list to round-robin across; a udp://, tcp:// or quic:// prefix, or unix: or unixgram: before a socket path, sets -backend-proto",
+	)
+	routes := make(map[string]string)
+	flag.Func(
+		"route",
+		"path=addr sending clients that upgrade on path to the backend addr, e.g. /dns=1.1.1.1:53; repeatable",
+		func(s string) error {
+			path, addr, ok := strings.Cut(s, "=")
+			if !ok || !strings.HasPrefix(path, "/") || addr == "" {
+				return errors.New("want path=addr")
+			}
+			routes[path] = addr
+			return nil
+		},
+	)
+	routeOptions := make(map[string]proxy.RouteOptions)
+	routeOptionSpecs := make(map[string]string)
+	flag.Func(
+		"route-options",
+		"path=options overriding settings for the clients of a -route path or /, options being data=type, buffer=bytes and idle=duration, and client-data=type for each data type clients may pick with ?data=, max-buffer=bytes and max-idle=duration capping their ?buffer= and ?idle=, e.g. /lines=data=text,idle=5m; repeatable",
+		func(s string) error {
+			path, spec, _ := strings.Cut(s, "=")
+			if !strings.HasPrefix(path, "/") {
+				return errors.New("want path=options")
+			}
+			opts, err := parseRouteOptions(spec)
+			if err != nil {
+				return err
+			}
+			routeOptions[path], routeOptionSpecs[path] = opts, spec
+			return nil
+		},
+	)
+	targetAllowPtr := flag.String(
+		"target-allow",
+		"",
+		"let clients pick the backend with ?target=host:port among these comma-separated host:ports rules, host a name, IP or CIDR and ports a port, lo-hi or *",
+	)
+	allowBackendPtr := flag.String(
+		"allow-backend",
+		"",
+		"comma separated CIDRs or addresses that client-chosen targets and redirects must resolve to",
+	)
+	allowClientPtr := flag.String(
+		"allow-client",
+		"",
+		"comma separated CIDRs or addresses of the only clients allowed to connect",
+	)
+	denyClientPtr := flag.String(
+		"deny-client",
+		"",
+		"comma separated CIDRs or addresses of clients refused with 403, winning over -allow-client",
+	)
+	allowCertPtr := flag.String(
+		"allow-cert",
+		"",
+		"comma separated patterns, e.g. *.devices.example, of the only client certificate identities, common name or else first DNS or email SAN, allowed to connect; needs client-ca",
+	)
+	denyCertPtr := flag.String(
+		"deny-cert",
+		"",
+		"comma separated patterns of client certificate identities refused with 403, winning over -allow-cert; needs client-ca",
+	)
 	dataTypePtr := flag.String(
 		"data",
-		"text",
-		"backend data type: text or binary",
+		proxy.DataTypeText,
+		"backend data type: text, binary, or base64 (also text-base64) or json encoded in text messages",
+	)
+	dataToClientPtr := flag.String(
+		"data-to-client",
+		"",
+		"data type backend datagrams are sent to the client as, text, binary, base64 or json, default -data",
+	)
+	dataFromClientPtr := flag.String(
+		"data-from-client",
+		"",
+		"only accept this message type from clients, text or binary, default both",
+	)
+	dataSubprotocolsPtr := flag.Bool(
+		"data-subprotocols",
+		false,
+		"let clients pick the data type by offering udpproxy.text, udpproxy.binary, udpproxy.base64 or udpproxy.json",
+	)
+	writeErrorPolicyPtr := flag.String(
+		"write-error-policy",
+		proxy.WriteErrorPolicyClose,
+		"on transient backend write errors: close or drop",
+	)
+	allowedSizesPtr := flag.String(
+		"allowed-sizes",
+		"",
+		"client datagram lengths sent to the backend, e.g. 20-1200,1472; empty allows any",
+	)
+	sizePolicyPtr := flag.String(
+		"size-policy",
+		proxy.SizePolicyDrop,
+		"on client datagrams outside allowed-sizes: drop or close",
+	)
+	requireMagicPtr := flag.String(
+		"require-magic",
+		"",
+		"close connections whose first datagram does not start with this prefix, before dialing the backend",
+	)
+	stripMagicPtr := flag.Bool(
+		"strip-magic",
+		false,
+		"remove the require-magic prefix before forwarding the first datagram",
+	)
+	protocolsPtr := flag.String(
+		"protocols",
+		"h1",
+		"HTTP versions to serve the WebSocket handshake over; only h1 is supported",
+	)
+	backendSessionOffsetPtr := flag.Int(
+		"backend-session-offset",
+		0,
+		"offset of the session ID in the backend's first reply",
+	)
+	backendSessionLengthPtr := flag.Int(
+		"backend-session-length",
+		0,
+		"length of the session ID in the backend's first reply, logged and listed in hex; 0 disables",
+	)
+	tlsCertPtr := flag.String("tls-cert", "", "TLS certificate file, enables wss")
+	tlsKeyPtr := flag.String("tls-key", "", "TLS private key file")
+	autocertPtr := flag.String(
+		"autocert",
+		"",
+		"comma-separated domains to get Let's Encrypt certificates for, enables wss; the listener must be reachable on port 443",
+	)
+	autocertCachePtr := flag.String(
+		"autocert-cache",
+		"autocert",
+		"directory caching the autocert account key and certificates",
+	)
+	autocertEmailPtr := flag.String(
+		"autocert-email",
+		"",
+		"contact email given to Let's Encrypt for expiry notices",
+	)
+	clientCAPtr := flag.String(
+		"client-ca",
+		"",
+		"CA bundle used to verify TLS client certificates",
+	)
+	flag.StringVar(clientCAPtr, "tls-client-ca", *clientCAPtr, "alias for -client-ca")
+	requireClientCertPtr := flag.Bool(
+		"require-client-cert",
+		false,
+		"reject TLS clients without a certificate signed by client-ca",
+	)
+	batchReadsPtr := flag.Int(
+		"batch-reads",
+		0,
+		"read up to N backend datagrams per syscall (Linux recvmmsg), 0 disables",
+	)
+	udpBufferPtr := flag.Int(
+		"udp-buffer",
+		65535,
+		"largest backend datagram in bytes relayed in full, longer ones are truncated",
+	)
+	heartbeatPtr := flag.Duration(
+		"client-heartbeat",
+		0,
+		"send client-heartbeat-payload to the client after this much backend silence, 0 disables",
+	)
+	heartbeatPayloadPtr := flag.String(
+		"client-heartbeat-payload",
+		"",
+		"data message sent to the client as heartbeat",
+	)
+	pingIntervalPtr := flag.Duration(
+		"ping-interval",
+		0,
+		"send clients a WebSocket ping this often and close those that stop answering, 0 disables",
+	)
+	pongTimeoutPtr := flag.Duration(
+		"pong-timeout",
+		0,
+		"how long a ping may go unanswered before the client is taken for dead, default ping-interval",
+	)
+	udpBindDevicePtr := flag.String(
+		"udp-bind-device",
+		"",
+		"network interface backend UDP sockets egress from (Linux, needs CAP_NET_RAW)",
+	)
+	dscpPtr := flag.String(
+		"dscp",
+		"",
+		"DSCP class for backend UDP datagrams, e.g. EF or 46",
+	)
+	ttlPtr := flag.Int(
+		"ttl",
+		0,
+		"IP TTL, or IPv6 hop limit, of backend datagrams; 0 keeps the system default",
+	)
+	udpBindAddrPtr := flag.String(
+		"udp-bind-addr",
+		"",
+		"local IP address backend sockets are bound to, for hosts with several",
+	)
+	udpPortRangePtr := flag.String(
+		"udp-port-range",
+		"",
+		"bind backend sockets to a free local port in this range, e.g. 40000-40999, instead of an ephemeral one",
+	)
+	multicastInterfacePtr := flag.String(
+		"multicast-interface",
+		"",
+		"network interface to join multicast group backends on, default the system's choice",
+	)
+	udpBroadcastPtr := flag.Bool(
+		"udp-broadcast",
+		false,
+		"the backends are broadcast addresses; send with SO_BROADCAST and take replies from any host (Linux)",
+	)
+	udpPSKPtr := flag.String(
+		"udp-psk",
+		"",
+		"64 hex digit key to encrypt and authenticate backend datagrams with XChaCha20-Poly1305; the backend must do the same",
+	)
+	udpPSKFilePtr := flag.String(
+		"udp-psk-file",
+		"",
+		"file holding the udp-psk key, which keeps it out of the process list",
+	)
+	dtlsPtr := flag.Bool(
+		"dtls",
+		false,
+		"secure backend UDP sockets with DTLS, by -dtls-psk or certificates",
+	)
+	dtlsPSKPtr := flag.String(
+		"dtls-psk",
+		"",
+		"hex pre-shared key authenticating the DTLS backends instead of certificates",
+	)
+	dtlsPSKFilePtr := flag.String(
+		"dtls-psk-file",
+		"",
+		"file holding the dtls-psk key, which keeps it out of the process list",
+	)
+	dtlsPSKIdentityPtr := flag.String(
+		"dtls-psk-identity",
+		"udpwsproxy",
+		"PSK identity presented to DTLS backends",
+	)
+	dtlsCAPtr := flag.String(
+		"dtls-ca",
+		"",
+		"CA bundle verifying DTLS backend certificates, default system roots",
+	)
+	dtlsCertPtr := flag.String(
+		"dtls-cert",
+		"",
+		"client certificate presented to DTLS backends that ask for one",
+	)
+	dtlsKeyPtr := flag.String(
+		"dtls-key",
+		"",
+		"key of -dtls-cert",
+	)
+	dtlsServerNamePtr := flag.String(
+		"dtls-server-name",
+		"",
+		"server name expected in DTLS backend certificates, default the backend IP address",
+	)
+	dtlsInsecurePtr := flag.Bool(
+		"dtls-insecure-skip-verify",
+		false,
+		"do not verify DTLS backend certificates",
+	)
+	udpRcvBufPtr := flag.Int(
+		"udp-rcvbuf",
+		0,
+		"receive buffer size in bytes for backend UDP sockets, 0 keeps the system default",
+	)
+	udpSndBufPtr := flag.Int(
+		"udp-sndbuf",
+		0,
+		"send buffer size in bytes for backend UDP sockets, 0 keeps the system default",
+	)
+	affinityPtr := flag.String(
+		"affinity",
+		proxy.AffinityNone,
+		"with several backends, send reconnecting clients to the same one, keyed by: session (?session= query) or ip",
+	)
+	lbStrategyPtr := flag.String(
+		"lb-strategy",
+		proxy.LBRoundRobin,
+		"how new clients are spread across backends: round-robin, hash to consistently hash the affinity key for sharded backends, or least-conn",
+	)
+	geoIPDBPtr := flag.String(
+		"geoip-db",
+		"",
+		"MaxMind DB file (e.g. GeoLite2-Country.mmdb) to look up client regions in for region-backends",
+	)
+	regionByPtr := flag.String(
+		"region-by",
+		proxy.RegionByContinent,
+		"what a client's region is: continent (EU, NA, ...) or country (DE, JP, ...)",
+	)
+	regionBackendsPtr := flag.String(
+		"region-backends",
+		"",
+		"backends by client region as region=addr, comma separated; each addr must be in -backend, other clients are spread as usual",
+	)
+	affinityTTLPtr := flag.Duration(
+		"affinity-ttl",
+		5*time.Minute,
+		"how long a client's backend is remembered after its last connect or disconnect",
+	)
+	probeIntervalPtr := flag.Duration(
+		"backend-probe",
+		0,
+		"probe backends this often and leave the ones that are down out of rotation, 0 disables",
+	)
+	probeTimeoutPtr := flag.Duration(
+		"backend-probe-timeout",
+		time.Second,
+		"how long a probe waits for an ICMP unreachable or a reply",
+	)
+	probePayloadPtr := flag.String(
+		"backend-probe-payload",
+		"",
+		"datagram sent to the backend as probe",
+	)
+	maxConnsPtr := flag.Int(
+		"max-conns",
+		0,
+		"maximum concurrent connections, 0 is unlimited",
+	)
+	backendMaxConnsPtr := flag.String(
+		"backend-max-conns",
+		"",
+		"per-backend connection limits as addr=n, comma separated; a full backend gets 503 right away",
+	)
+	admissionWaitPtr := flag.Duration(
+		"admission-wait",
+		2*time.Second,
+		"how long upgrades over max-conns wait for a slot before getting 503",
+	)
+	maxPendingHandshakesPtr := flag.Int(
+		"max-pending-handshakes",
+		0,
+		"maximum upgrades in progress at once, the rest get 503; 0 is unlimited",
+	)
+	maxBytesPtr := flag.Uint64(
+		"max-bytes-per-conn",
+		0,
+		"close connections after forwarding this many bytes, 0 disables",
+	)
+	maxBytesModePtr := flag.String(
+		"max-bytes-mode",
+		proxy.QuotaModeEach,
+		"apply max-bytes-per-conn to each direction or to both combined: each or combined",
+	)
+	clientRatePtr := flag.String(
+		"rate-limit",
+		"",
+		"per client IP limits as up-packets=n,up-bytes=n,down-packets=n,down-bytes=n per second, any subset; datagrams over them are dropped",
+	)
+	globalRatePtr := flag.String(
+		"global-rate-limit",
+		"",
+		"limits like rate-limit across all clients together",
+	)
+	userPtr := flag.String(
+		"user",
+		"",
+		"switch to this user, name or uid, once the listener is bound (Unix)",
+	)
+	groupPtr := flag.String(
+		"group",
+		"",
+		"switch to this group, name or gid, once the listener is bound; defaults to the user's primary group",
+	)
+	lameDuckPtr := flag.Duration(
+		"lameduck",
+		0,
+		"on SIGINT or SIGTERM, first fail /readyz for this long while still accepting connections",
+	)
+	shutdownGracePtr := flag.Duration(
+		"shutdown-grace",
+		10*time.Second,
+		"on SIGINT or SIGTERM, wait this long for connections to end before closing them",
+	)
+	flag.DurationVar(shutdownGracePtr, "drain-timeout", *shutdownGracePtr, "alias for -shutdown-grace")
+	metricsPtr := flag.Bool("metrics", false, "serve Prometheus metrics on /metrics")
+	strictTestPtr := flag.Bool(
+		"strict-test",
+		false,
+		"for CI smoke tests only: exit with status 1 as soon as a connection ends on an error",
+	)
+	flowCollectorPtr := flag.String(
+		"flow-collector",
+		"",
+		"host:port of an IPFIX collector to send a UDP flow record to for each closed connection",
+	)
+	filtersPtr := flag.String(
+		"filter",
+		"",
+		"comma-separated filters every datagram passes through in order, which may drop it; built in: rtp, dropping all but well-formed RTP and RTCP",
+	)
+	sessionLogPtr := flag.String(
+		"session-log",
+		"",
+		"file to append a record to for each closed session, with its client, backend, duration, traffic and close reason",
+	)
+	sessionLogFormatPtr := flag.String(
+		"session-log-format",
+		proxy.SessionLogJSON,
+		"session-log record format: json or clf (Common Log Format-like lines)",
+	)
+	sessionLogMaxSizePtr := flag.Int64(
+		"session-log-max-size",
+		100<<20,
+		"rotate the session-log once it grows past this many bytes, 0 never rotates",
+	)
+	sessionLogMaxFilesPtr := flag.Int(
+		"session-log-max-files",
+		5,
+		"number of rotated session-log files kept, as file.1, file.2 and so on",
+	)
+	adminTokenPtr := flag.String(
+		"admin-token",
+		"",
+		"serve the admin API on /admin to requests bearing this token, empty disables",
+	)
+	pauseBufferPtr := flag.Int(
+		"pause-buffer",
+		64,
+		"client datagrams held per paused connection, later ones are dropped",
+	)
+	pauseMessagePtr := flag.String(
+		"pause-message",
+		"",
+		"data message sent to clients when forwarding is paused",
+	)
+	resumeMessagePtr := flag.String(
+		"resume-message",
+		"",
+		"data message sent to clients when forwarding is resumed",
+	)
+	recordDirPtr := flag.String(
+		"record-dir",
+		"",
+		"record every session to a capture file in this directory, for udpwsproxy-replay; captures contain full payloads",
+	)
+	capturePtr := flag.String(
+		"capture",
+		"",
+		"capture sessions to pcapng files in this directory, one per client ID, for Wireshark; captures contain full payloads",
+	)
+	captureOnDemandPtr := flag.Bool(
+		"capture-on-demand",
+		false,
+		"with -capture, only capture sessions started through the admin API's POST /connections/<id>/capture",
+	)
+	udpReconnectPtr := flag.Int(
+		"udp-reconnect",
+		0,
+		"re-dial the backend socket up to this many times, with backoff, on transient errors such as connection refused instead of closing the client, 0 disables",
+	)
+	udpFailoverPtr := flag.String(
+		"udp-failover",
+		"",
+		"backend=addr pairs, comma separated, moving a session's socket to addr once udp-reconnect gave up on backend",
+	)
+	dialRetriesPtr := flag.Int(
+		"dial-retries",
+		0,
+		"retry resolving and dialing a client's backend up to this many times on transient errors such as DNS timeouts",
+	)
+	dialBackoffPtr := flag.Duration(
+		"dial-backoff",
+		100*time.Millisecond,
+		"wait before the first dial retry, doubling for each further one",
+	)
+	resolveIntervalPtr := flag.Duration(
+		"resolve-interval",
+		0,
+		"re-resolve backend host names this often and dial new sockets to the latest address, 0 resolves for every dial",
+	)
+	resolveMigratePtr := flag.Bool(
+		"resolve-migrate",
+		false,
+		"move live sessions to a backend's new address when re-resolving finds it changed",
+	)
+	backendLoopbackPtr := flag.Bool(
+		"backend-loopback",
+		false,
+		"send a copy of every backend datagram back to the backend, for protocols expecting acknowledgments",
+	)
+	backendLoopbackRatePtr := flag.Int(
+		"backend-loopback-rate",
+		100,
+		"maximum datagrams per second and connection looped back by backend-loopback",
+	)
+	reportRelayAddrPtr := flag.Bool(
+		"report-relay-addr",
+		false,
+		"send the client the local UDP address used toward the backend as a first text message",
+	)
+	resumeGracePtr := flag.Duration(
+		"resume-grace",
+		0,
+		"keep the backend socket of a client whose connection broke this long, for it to resume with ?resume=<token>; 0 disables",
+	)
+	idleTimeoutPtr := flag.Duration(
+		"idle-timeout",
+		0,
+		"close connections without traffic in either direction for this long, 0 disables",
+	)
+	startupGracePtr := flag.Duration(
+		"startup-grace",
+		0,
+		"after connect, wait this long before idle-timeout and read-watchdog start counting silence",
+	)
+	maxLifetimePtr := flag.Duration(
+		"max-lifetime",
+		0,
+		"close connections older than this, 0 disables",
+	)
+	reaperIntervalPtr := flag.Duration(
+		"reaper-interval",
+		10*time.Second,
+		"how often to scan for connections over idle-timeout or max-lifetime",
+	)
+	readWatchdogPtr := flag.Duration(
+		"read-watchdog",
+		0,
+		"close the backend socket when a read is still blocked this long after it should have returned, 0 disables",
+	)
+	initPacketPtr := flag.String(
+		"backend-init",
+		"",
+		"datagram sent to the backend when a client connects",
+	)
+	sendClientInfoPtr := flag.Bool(
+		"send-client-info",
+		false,
+		"send the backend a PROXY protocol v2 header with the client's address and ID as the first datagram",
+	)
+	clientInfoHeadersPtr := flag.String(
+		"client-info-headers",
+		"",
+		"comma separated upgrade request headers, e.g. X-Forwarded-For, to add to the send-client-info datagram",
+	)
+	finalPacketPtr := flag.String(
+		"final-packet-on-close",
+		"",
+		"datagram sent to the backend when a client disconnects; {id}, {code} and {reason} are replaced with the client ID and close code and reason",
+	)
+	redirectPatternPtr := flag.String(
+		"redirect-pattern",
+		"",
+		"regexp matched against the backend's first reply to backend-init; its first group is a host:port to re-dial, and the reply is not forwarded",
+	)
+	redirectTimeoutPtr := flag.Duration(
+		"redirect-timeout",
+		2*time.Second,
+		"how long to wait for the reply checked by redirect-pattern",
+	)
+	jitterBufferPtr := flag.Duration(
+		"jitter-buffer",
+		0,
+		"pace bursty backend datagrams to the client, adding up to this much latency, 0 disables",
+	)
+	payloadLogSamplePtr := flag.Float64(
+		"payload-log-sample",
+		0,
+		"hex-dump this fraction (0-1) of datagrams in each direction; payloads may be sensitive",
+	)
+	payloadLogMaxPtr := flag.Int(
+		"payload-log-max",
+		64,
+		"truncate payload hex dumps to this many bytes",
+	)
+	authTokenPtr := flag.String(
+		"auth-token",
+		"",
+		"require clients to present this token as Authorization: Bearer or ?token=; with a JWT option either will do",
+	)
+	authWebhookPtr := flag.String(
+		"auth-webhook",
+		"",
+		"URL asked with a GET carrying the upgrade's headers whether to let a client in: 2xx allows, 401/403 refuse",
+	)
+	jwtSecretPtr := flag.String(
+		"jwt-secret",
+		"",
+		"require a JWT signed with this HMAC secret, from Authorization: Bearer or ?token=",
+	)
+	jwksURLPtr := flag.String(
+		"jwt-jwks-url",
+		"",
+		"require a JWT signed with an RSA or ECDSA key from this JWKS URL",
+	)
+	reusePortPtr := flag.Bool(
+		"reuseport",
+		false,
+		"set SO_REUSEPORT on the listen socket so several instances can share the port (Linux)",
+	)
+	proxyProtocolPtr := flag.Bool(
+		"proxy-protocol",
+		false,
+		"expect a PROXY protocol v1 or v2 header on connections from -trusted-proxies, or from everyone when it is empty",
+	)
+	trustedProxiesPtr := flag.String(
+		"trusted-proxies",
+		"",
+		"comma separated CIDRs or addresses of the load balancers and reverse proxies in front, whose client addresses are believed",
+	)
+	realIPHeaderPtr := flag.String(
+		"real-ip-header",
+		"",
+		"take the client address from this header, X-Forwarded-For or X-Real-IP, on requests from -trusted-proxies",
+	)
+	txCoalesceWindowPtr := flag.Duration(
+		"tx-coalesce-window",
+		0,
+		"combine client messages within this window into one datagram of 2-byte length-prefixed frames, 0 sends each message as is",
+	)
+	wsBatchWindowPtr := flag.Duration(
+		"ws-batch-window",
+		0,
+		"for binary clients, combine backend datagrams within this window into one message of 2-byte length-prefixed frames, and split client messages the same way",
+	)
+	maxHeaderSizePtr := flag.Int(
+		"max-header-size",
+		4096,
+		"largest HTTP request line plus headers in bytes; bigger upgrade requests get 431",
+	)
+	wsReadBufferPtr := flag.Int(
+		"ws-read-buffer",
+		1024,
+		"WebSocket read buffer size per connection in bytes; it does not limit message size",
+	)
+	wsWriteBufferPtr := flag.Int(
+		"ws-write-buffer",
+		1024,
+		"WebSocket write buffer size per connection in bytes; it does not limit message size",
+	)
+	compressionPtr := flag.Bool(
+		"compression",
+		false,
+		"negotiate permessage-deflate with clients that offer it",
+	)
+	compressionMinSizePtr := flag.Int(
+		"compression-min-size",
+		256,
+		"compress messages to clients from this many bytes on, smaller ones are sent as they are",
+	)
+	corsOriginsPtr := flag.String(
+		"cors-origins",
+		"",
+		"comma separated origins, or *, to send CORS headers to on the upgrade and answer preflight requests for",
+	)
+	allowedOriginsPtr := flag.String(
+		"allowed-origins",
+		"",
+		"comma separated origin globs like https://*.example, or /regexps/, refusing browser upgrades from other origins with 403",
+	)
+	skipOriginCheckPtr := flag.Bool(
+		"skip-origin-check",
+		false,
+		"accept upgrades from any origin despite -allowed-origins, for development",
+	)
+	requireSubprotocolPtr := flag.String(
+		"require-subprotocol",
+		"",
+		"refuse clients not offering this WebSocket subprotocol with 400",
+	)
+	controlProtocolPtr := flag.Bool(
+		"control-protocol",
+		false,
+		"select the udp-proxy-v1 subprotocol for clients offering it, which then open with a JSON hello and options handshake",
+	)
+	requireHeaderPtr := flag.String(
+		"require-header",
+		"",
+		"comma separated headers, each Name or Name=Value, refusing upgrades without them with 400",
+	)
+	backendProtoPtr := flag.String(
+		"backend-proto",
+		"",
+		"protocol toward the backend: udp (default), tcp, quic, unix or unixgram",
+	)
+	tcpFramingPtr := flag.String(
+		"tcp-framing",
+		proxy.TCPFramingRaw,
+		"how messages map onto a TCP or unix stream backend: raw (the stream as is, like websockify), length16 (2-byte length-prefixed) or newline (one text message per line)",
+	)
+	quicModePtr := flag.String(
+		"quic-mode",
+		proxy.QUICModeDatagram,
+		"how messages map onto QUIC: datagram (unreliable, RFC 9221) or stream (one stream, 2-byte length-prefixed)",
+	)
+	quicALPNPtr := flag.String(
+		"quic-alpn",
+		"udpwsproxy",
+		"ALPN protocol offered to QUIC backends",
+	)
+	quicCAPtr := flag.String(
+		"quic-ca",
+		"",
+		"CA bundle verifying QUIC backend certificates, default system roots",
+	)
+	quicServerNamePtr := flag.String(
+		"quic-server-name",
+		"",
+		"server name expected in QUIC backend certificates, default the backend host",
+	)
+	quicInsecurePtr := flag.Bool(
+		"quic-insecure-skip-verify",
+		false,
+		"do not verify QUIC backend certificates",
+	)
+	sendHighWaterPtr := flag.Int(
+		"send-highwater",
+		0,
+		"queue at most this many bytes toward each client, see send-policy; 0 writes synchronously",
+	)
+	sendPolicyPtr := flag.String(
+		"send-policy",
+		"close",
+		"what a backend datagram over send-highwater does: close the connection, drop-oldest queued ones or drop-newest",
+	)
+	closeFlushMaxPtr := flag.Int(
+		"close-flush-max",
+		0,
+		"when the backend side ends, still deliver up to this many datagrams queued by -send-highwater or -jitter-buffer, 0 drops them",
+	)
+	listenSocketModePtr := flag.String(
+		"listen-socket-mode",
+		"",
+		"octal permissions for a unix: listen socket, e.g. 0660, default from the umask",
+	)
+	breakerThresholdPtr := flag.Int(
+		"breaker-threshold",
+		0,
+		"refuse upgrades to a backend with 503 after this many consecutive dial failures, 0 disables",
+	)
+	breakerWindowPtr := flag.Duration(
+		"breaker-window",
+		30*time.Second,
+		"window in which breaker-threshold failures must happen",
+	)
+	breakerCooldownPtr := flag.Duration(
+		"breaker-cooldown",
+		10*time.Second,
+		"how long a tripped breaker refuses upgrades before letting a probe through",
+	)
+	seqOffsetPtr := flag.Int(
+		"seq-offset",
+		0,
+		"byte offset of a sequence number in backend datagrams, see seq-size",
+	)
+	seqSizePtr := flag.Int(
+		"seq-size",
+		0,
+		"size in bytes (1, 2, 4 or 8) of a sequence number to track gaps, reordering and loss on, 0 disables",
+	)
+	seqLittleEndianPtr := flag.Bool(
+		"seq-little-endian",
+		false,
+		"read the seq-size sequence number as little-endian",
+	)
+	seqLossWindowPtr := flag.Int(
+		"seq-loss-window",
+		1024,
+		"how many of the latest sequence numbers the per-connection loss estimate covers",
+	)
+	warmPoolPtr := flag.Int(
+		"warm-pool",
+		0,
+		"keep this many pre-dialed UDP sockets per backend for fast connection setup, 0 disables",
+	)
+	wsTCPNoDelayPtr := flag.Bool(
+		"ws-tcp-nodelay",
+		true,
+		"disable Nagle's algorithm on client TCP connections",
+	)
+	wsTCPKeepAlivePtr := flag.Duration(
+		"ws-tcp-keepalive",
+		15*time.Second,
+		"TCP keepalive period on client connections, 0 disables",
 	)
 	flag.Parse()
-
-	if backendAddrPtr == nil || *backendAddrPtr == "" {
-		log.Fatalln("Missing backend parameter. Use -h to help")
+	cmdline := commandLineFlags()
+	if *configPtr != "" {
+		if err := loadConfigFile(*configPtr, cmdline, nil); err != nil {
+			log.Fatalln(err, "Use -h to help")
+		}
 	}
-	if *dataTypePtr != dataTypeText && *dataTypePtr != dataTypeBinary {
-		log.Fatalln("Unsupported value for data parameter. Use -h to help")
+	if err := setupLogging(*logFormatPtr, *logLevelPtr); err != nil {
+		log.Fatalln(err, "Use -h to help")
 	}
 
-	log.Println("* Listen on:", *listenAddrPtr)
-	log.Println("* Proxy to backend:", *backendAddrPtr)
-	log.Println("* Backend data type:", *dataTypePtr)
-
-	app := fiber.New(fiber.Config{
-		Immutable: true,
-	})
+	if listenSpecs == nil {
+		listenSpecs = []listenSpec{{addr: defaultListenAddr}}
+	}
 
-	app.Use(logger.New())
-	app.Get(
-		"/",
-		wsCheckMiddleware(*backendAddrPtr, *dataTypePtr),
-		websocket.New(wsHandler),
-	)
-	app.Listen(*listenAddrPtr)
-}
+	switch *modePtr {
+	case "forward":
+	case "reverse":
+		if *wsBackendPtr == "" {
+			log.Fatalln("Missing ws-backend parameter. Use -h to help")
+		}
+		if len(listenSpecs) > 1 || listenSpecs[0].tls != "" || listenSpecs[0].routes != nil ||
+			listenSpecs[0].webTransport {
+			log.Fatalln("reverse mode takes a single listen address. Use -h to help")
+		}
+		serveReverse(listenSpecs[0].addr, proxy.ReverseConfig{
+			WSBackend:     *wsBackendPtr,
+			DataType:      *dataTypePtr,
+			IdleTimeout:   *idleTimeoutPtr,
+			UDPBufferSize: *udpBufferPtr,
+		})
+		return
+	default:
+		log.Fatalln("Unsupported mode", *modePtr+". Use -h to help")
+	}
+	if *backendAddrPtr == "" && len(routes) == 0 && *targetAllowPtr == "" {
+		log.Fatalln("Missing backend, route or target-allow parameter. Use -h to help")
+	}
+	backendProto := *backendProtoPtr
+	var backendAddrs []string
+	for _, addr := range strings.Split(*backendAddrPtr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addr, err := backendScheme(addr, &backendProto)
+			if err != nil {
+				log.Fatalln(err, "Use -h to help")
+			}
+			backendAddrs = append(backendAddrs, addr)
+		}
+	}
+	for path, addr := range routes {
+		addr, err := backendScheme(addr, &backendProto)
+		if err != nil {
+			log.Fatalln(err, "Use -h to help")
+		}
+		routes[path] = addr
+	}
+	if backendProto == "" {
+		backendProto = proxy.BackendProtoUDP
+	}
+	var backendMaxConns map[string]int
+	for _, entry := range strings.Split(*backendMaxConnsPtr, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		addr, n, ok := strings.Cut(entry, "=")
+		limit, err := strconv.Atoi(n)
+		if !ok || err != nil {
+			log.Fatalln("Invalid backend-max-conns entry", entry+". Use -h to help")
+		}
+		if backendMaxConns == nil {
+			backendMaxConns = make(map[string]int)
+		}
+		backendMaxConns[addr] = limit
+	}
+	var udpFailover map[string]string
+	for _, entry := range strings.Split(*udpFailoverPtr, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		backend, addr, ok := strings.Cut(entry, "=")
+		if !ok || backend == "" || addr == "" {
+			log.Fatalln("Invalid udp-failover entry", entry+". Use -h to help")
+		}
+		if udpFailover == nil {
+			udpFailover = make(map[string]string)
+		}
+		udpFailover[backend] = addr
+	}
+	var regionBackends map[string]string
+	for _, entry := range strings.Split(*regionBackendsPtr, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		region, addr, ok := strings.Cut(entry, "=")
+		if !ok || region == "" || addr == "" {
+			log.Fatalln("Invalid region-backends entry", entry+". Use -h to help")
+		}
+		if regionBackends == nil {
+			regionBackends = make(map[string]string)
+		}
+		regionBackends[strings.ToUpper(region)] = addr
+	}
+	udpPSK, err := hexKey("udp-psk", *udpPSKPtr, *udpPSKFilePtr)
+	if err != nil {
+		log.Fatalln(err, "Use -h to help")
+	}
+	dtlsPSK, err := hexKey("dtls-psk", *dtlsPSKPtr, *dtlsPSKFilePtr)
+	if err != nil {
+		log.Fatalln(err, "Use -h to help")
+	}
+	var clientInfoHeaders []string
+	for _, name := range strings.Split(*clientInfoHeadersPtr, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			clientInfoHeaders = append(clientInfoHeaders, name)
+		}
+	}
+	var allowCerts, denyCerts []string
+	for _, pattern := range strings.Split(*allowCertPtr, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			allowCerts = append(allowCerts, pattern)
+		}
+	}
+	for _, pattern := range strings.Split(*denyCertPtr, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			denyCerts = append(denyCerts, pattern)
+		}
+	}
+	var corsOrigins []string
+	for _, origin := range strings.Split(*corsOriginsPtr, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			corsOrigins = append(corsOrigins, origin)
+		}
+	}
+	dataType := *dataTypePtr
+	if *dataToClientPtr != "" {
+		if isFlagSet("data") && *dataToClientPtr != dataType {
+			log.Fatalln("data and data-to-client disagree. Use -h to help")
+		}
+		dataType = *dataToClientPtr
+	}
+	var socketMode os.FileMode
+	if *listenSocketModePtr != "" {
+		mode, err := strconv.ParseUint(*listenSocketModePtr, 8, 32)
+		if err != nil || mode > 0777 {
+			log.Fatalln("Invalid listen-socket-mode. Use -h to help")
+		}
+		socketMode = os.FileMode(mode)
+	}
+	var dscp int
+	if *dscpPtr != "" {
+		var err error
+		if dscp, err = proxy.ParseDSCP(*dscpPtr); err != nil {
+			log.Fatalln(err, "Use -h to help")
+		}
+	}
+	var udpPortMin, udpPortMax int
+	if *udpPortRangePtr != "" {
+		var err error
+		if udpPortMin, udpPortMax, err = proxy.ParsePortRange(*udpPortRangePtr); err != nil {
+			log.Fatalln(err, "Use -h to help")
+		}
+	}
+	var requireHeaders []proxy.RequiredHeader
+	if *requireHeaderPtr != "" {
+		var err error
+		if requireHeaders, err = proxy.ParseRequiredHeaders(*requireHeaderPtr); err != nil {
+			log.Fatalln(err, "Use -h to help")
+		}
+	}
+	var targetAllow []proxy.TargetRule
+	if *targetAllowPtr != "" {
+		var err error
+		if targetAllow, err = proxy.ParseTargetRules(*targetAllowPtr); err != nil {
+			log.Fatalln(err, "Use -h to help")
+		}
+	}
+	allowBackends, err := proxy.ParsePrefixes(*allowBackendPtr)
+	if err != nil {
+		log.Fatalln(err, "Use -h to help")
+	}
+	allowClients, err := proxy.ParsePrefixes(*allowClientPtr)
+	if err != nil {
+		log.Fatalln(err, "Use -h to help")
+	}
+	denyClients, err := proxy.ParsePrefixes(*denyClientPtr)
+	if err != nil {
+		log.Fatalln(err, "Use -h to help")
+	}
+	// reloadable builds the settings a SIGHUP can change from the flags,
+	// once at startup and again on every reload of the config file.
+	reloadable := func() (proxy.ReloadConfig, error) {
+		rc := proxy.ReloadConfig{
+			AuthToken:       *authTokenPtr,
+			SkipOriginCheck: *skipOriginCheckPtr,
+			MaxConns:        *maxConnsPtr,
+			MaxBytesPerConn: *maxBytesPtr,
+		}
+		var err error
+		if rc.ClientRateLimit, err = proxy.ParseRateLimit(*clientRatePtr); err != nil {
+			return rc, err
+		}
+		if rc.GlobalRateLimit, err = proxy.ParseRateLimit(*globalRatePtr); err != nil {
+			return rc, err
+		}
+		if *allowedOriginsPtr != "" {
+			if rc.AllowedOrigins, err = proxy.ParseOriginPatterns(*allowedOriginsPtr); err != nil {
+				return rc, err
+			}
+		}
+		return rc, nil
+	}
+	rc, err := reloadable()
+	if err != nil {
+		log.Fatalln(err, "Use -h to help")
+	}
+	var allowedSizes []proxy.SizeRange
+	if *allowedSizesPtr != "" {
+		var err error
+		if allowedSizes, err = proxy.ParseSizeRanges(*allowedSizesPtr); err != nil {
+			log.Fatalln(err, "Use -h to help")
+		}
+	}
+	if err := checkProtocols(*protocolsPtr); err != nil {
+		log.Fatalln(err, "Use -h to help")
+	}
+	if (*tlsCertPtr == "") != (*tlsKeyPtr == "") {
+		log.Fatalln("tls-cert and tls-key must be set together. Use -h to help")
+	}
+	var autocertDomains []string
+	for _, domain := range strings.Split(*autocertPtr, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			autocertDomains = append(autocertDomains, domain)
+		}
+	}
+	if *tlsCertPtr != "" && autocertDomains != nil {
+		log.Fatalln("tls-cert and autocert are mutually exclusive. Use -h to help")
+	}
+	var filters []proxy.NewFilter
+	for _, name := range strings.Split(*filtersPtr, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		newFilter, err := proxy.LookupFilter(name)
+		if err != nil {
+			log.Fatalln(err, "Use -h to help")
+		}
+		filters = append(filters, newFilter)
+	}
+	tlsEnabled := *tlsCertPtr != "" || autocertDomains != nil
+	if !tlsEnabled && (*clientCAPtr != "" || *requireClientCertPtr) {
+		log.Fatalln("client-ca and require-client-cert need TLS enabled. Use -h to help")
+	}
+	if *clientCAPtr == "" && (allowCerts != nil || denyCerts != nil) {
+		log.Fatalln("allow-cert and deny-cert need client-ca. Use -h to help")
+	}
+	for _, spec := range listenSpecs {
+		if spec.tls == "tls" && !tlsEnabled {
+			log.Fatalln("listen", spec.addr, "needs tls-cert or autocert for tls. Use -h to help")
+		}
+		if spec.webTransport && !tlsEnabled {
+			log.Fatalln("listen", spec.addr, "needs tls-cert or autocert for webtransport. Use -h to help")
+		}
+		for _, path := range spec.routes {
+			_, routed := routes[path]
+			defaultRoute := path == "/" && (len(backendAddrs) > 0 || *targetAllowPtr != "")
+			if !routed && !defaultRoute {
+				log.Fatalln("listen", spec.addr, "route", path, "is not served. Use -h to help")
+			}
+		}
+	}
 
-func wsCheckMiddleware(backendURL string, dataType string) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		if !websocket.IsWebSocketUpgrade(c) {
-			return fiber.ErrUpgradeRequired
+	for path := range routeOptions {
+		_, routed := routes[path]
+		defaultRoute := path == "/" && (len(backendAddrs) > 0 || *targetAllowPtr != "")
+		if !routed && !defaultRoute {
+			log.Fatalln("route-options", path, "is not served. Use -h to help")
 		}
-		c.Locals(localKeyBackendURL, backendURL)
-		c.Locals(localKeyDataType, dataType)
-		return c.Next()
 	}
-}
 
-func wsHandler(c *websocket.Conn) {
-	clientID := strconv.FormatUint(uint64(time.Now().UnixMicro()), 36)
-	defer func() {
-		c.Close()
-		log.Println("=\\= client", clientID, "disconnected")
-	}()
+	cfg := proxy.Config{
+		Backends:             backendAddrs,
+		Routes:               routes,
+		RouteOptions:         routeOptions,
+		TargetAllow:          targetAllow,
+		AllowBackends:        allowBackends,
+		AllowClients:         allowClients,
+		DenyClients:          denyClients,
+		AllowCerts:           allowCerts,
+		DenyCerts:            denyCerts,
+		DataType:             dataType,
+		DataFromClient:       *dataFromClientPtr,
+		DataSubprotocols:     *dataSubprotocolsPtr,
+		BackendProto:         backendProto,
+		TCPFraming:           *tcpFramingPtr,
+		QUICMode:             *quicModePtr,
+		WarmPool:             *warmPoolPtr,
+		Affinity:             *affinityPtr,
+		AffinityTTL:          *affinityTTLPtr,
+		LBStrategy:           *lbStrategyPtr,
+		GeoIPDB:              *geoIPDBPtr,
+		RegionBy:             *regionByPtr,
+		RegionBackends:       regionBackends,
+		WriteErrorPolicy:     *writeErrorPolicyPtr,
+		AllowedSizes:         allowedSizes,
+		SizePolicy:           *sizePolicyPtr,
+		RequireMagic:         []byte(*requireMagicPtr),
+		StripMagic:           *stripMagicPtr,
+		BackendSessionOffset: *backendSessionOffsetPtr,
+		BackendSessionLength: *backendSessionLengthPtr,
+		BatchReads:           *batchReadsPtr,
+		UDPBufferSize:        *udpBufferPtr,
+		TxCoalesceWindow:     *txCoalesceWindowPtr,
+		WSBatchWindow:        *wsBatchWindowPtr,
+		HeartbeatInterval:    *heartbeatPtr,
+		HeartbeatPayload:     []byte(*heartbeatPayloadPtr),
+		PingInterval:         *pingIntervalPtr,
+		PongTimeout:          *pongTimeoutPtr,
+		PauseBuffer:          *pauseBufferPtr,
+		PauseMessage:         []byte(*pauseMessagePtr),
+		ResumeMessage:        []byte(*resumeMessagePtr),
+		JitterBuffer:         *jitterBufferPtr,
+		SendHighWater:        *sendHighWaterPtr,
+		SendPolicy:           *sendPolicyPtr,
+		CloseFlushMax:        *closeFlushMaxPtr,
+		SeqOffset:            *seqOffsetPtr,
+		SeqSize:              *seqSizePtr,
+		SeqLittleEndian:      *seqLittleEndianPtr,
+		SeqLossWindow:        *seqLossWindowPtr,
+		PayloadLogSample:     *payloadLogSamplePtr,
+		PayloadLogMax:        *payloadLogMaxPtr,
+		JWTSecret:            []byte(*jwtSecretPtr),
+		JWKSURL:              *jwksURLPtr,
+		AuthToken:            rc.AuthToken,
+		AuthWebhook:          *authWebhookPtr,
+		UDPBindDevice:        *udpBindDevicePtr,
+		UDPBindAddr:          *udpBindAddrPtr,
+		UDPPortMin:           udpPortMin,
+		UDPPortMax:           udpPortMax,
+		MulticastInterface:   *multicastInterfacePtr,
+		UDPBroadcast:         *udpBroadcastPtr,
+		TTL:                  *ttlPtr,
+		DSCP:                 dscp,
+		UDPPSK:               udpPSK,
+		UDPRcvBuf:            *udpRcvBufPtr,
+		UDPSndBuf:            *udpSndBufPtr,
+		ProbeInterval:        *probeIntervalPtr,
+		ProbeTimeout:         *probeTimeoutPtr,
+		ProbePayload:         []byte(*probePayloadPtr),
+		BreakerThreshold:     *breakerThresholdPtr,
+		BreakerWindow:        *breakerWindowPtr,
+		BreakerCooldown:      *breakerCooldownPtr,
+		MaxConns:             rc.MaxConns,
+		BackendMaxConns:      backendMaxConns,
+		AdmissionWait:        *admissionWaitPtr,
+		MaxPendingHandshakes: *maxPendingHandshakesPtr,
+		MaxBytesPerConn:      rc.MaxBytesPerConn,
+		MaxBytesMode:         *maxBytesModePtr,
+		ClientRateLimit:      rc.ClientRateLimit,
+		GlobalRateLimit:      rc.GlobalRateLimit,
+		InitPacket:           []byte(*initPacketPtr),
+		SendClientInfo:       *sendClientInfoPtr,
+		ClientInfoHeaders:    clientInfoHeaders,
+		FinalPacket:          []byte(*finalPacketPtr),
+		RedirectTimeout:      *redirectTimeoutPtr,
+		UDPReconnect:         *udpReconnectPtr,
+		UDPFailover:          udpFailover,
+		DialRetries:          *dialRetriesPtr,
+		DialBackoff:          *dialBackoffPtr,
+		ResolveInterval:      *resolveIntervalPtr,
+		ResolveMigrate:       *resolveMigratePtr,
+		BackendLoopback:      *backendLoopbackPtr,
+		BackendLoopbackRate:  *backendLoopbackRatePtr,
+		ReportRelayAddr:      *reportRelayAddrPtr,
+		ResumeGrace:          *resumeGracePtr,
+		RecordDir:            *recordDirPtr,
+		PcapDir:              *capturePtr,
+		PcapOnDemand:         *captureOnDemandPtr,
+		IdleTimeout:          *idleTimeoutPtr,
+		MaxLifetime:          *maxLifetimePtr,
+		ReaperInterval:       *reaperIntervalPtr,
+		StartupGrace:         *startupGracePtr,
+		ReadWatchdog:         *readWatchdogPtr,
+		WSReadBuffer:         *wsReadBufferPtr,
+		WSWriteBuffer:        *wsWriteBufferPtr,
+		Compression:          *compressionPtr,
+		CompressionMinSize:   *compressionMinSizePtr,
+		CORSOrigins:          corsOrigins,
+		AllowedOrigins:       rc.AllowedOrigins,
+		SkipOriginCheck:      rc.SkipOriginCheck,
+		RequireSubprotocol:   *requireSubprotocolPtr,
+		ControlProtocol:      *controlProtocolPtr,
+		RequireHeaders:       requireHeaders,
+		FlowCollector:        *flowCollectorPtr,
+		SessionLog:           *sessionLogPtr,
+		SessionLogFormat:     *sessionLogFormatPtr,
+		SessionLogMaxSize:    *sessionLogMaxSizePtr,
+		SessionLogMaxFiles:   *sessionLogMaxFilesPtr,
+		Filters:              filters,
+	}
+	if backendProto == proxy.BackendProtoQUIC {
+		quicTLS, err := newQUICTLSConfig(
+			*quicALPNPtr,
+			*quicCAPtr,
+			*quicServerNamePtr,
+			*quicInsecurePtr,
+		)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cfg.QUICTLS = quicTLS
+	}
+	if *dtlsPtr {
+		dtlsConfig, err := newDTLSConfig(
+			dtlsPSK,
+			*dtlsPSKIdentityPtr,
+			*dtlsCAPtr,
+			*dtlsCertPtr,
+			*dtlsKeyPtr,
+			*dtlsServerNamePtr,
+			*dtlsInsecurePtr,
+		)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cfg.BackendDTLS = dtlsConfig
+	} else if dtlsPSK != nil {
+		log.Fatalln("dtls-psk needs -dtls. Use -h to help")
+	}
+	if *redirectPatternPtr != "" {
+		re, err := regexp.Compile(*redirectPatternPtr)
+		if err != nil {
+			log.Fatalln("Invalid redirect-pattern:", err)
+		}
+		cfg.Redirect = proxy.RedirectPattern(re)
+	}
+	if *metricsPtr {
+		cfg.MetricsPath = "/metrics"
+	}
+	if *strictTestPtr {
+		cfg.OnConnError = func(clientID string, err error) {
+			log.Fatalln("strict-test: client", clientID, "failed:", err)
+		}
+	}
+	cfg.ReadyPath = "/readyz"
+	cfg.LivePath = "/healthz"
+	if *adminTokenPtr != "" {
+		cfg.AdminPath = "/admin"
+		cfg.AdminToken = *adminTokenPtr
+	}
+	p, err := proxy.New(cfg)
+	if err != nil {
+		log.Fatalln(err, "Use -h to help")
+	}
+	defer p.Close()
+	if *configPtr != "" {
+		go reloadOnHUP(*configPtr, cmdline, p, reloadable)
+	}
 
-	log.Println("==> client", clientID, "connected")
-	url := c.Locals(localKeyBackendURL).(string)
+	if *configPtr != "" {
+		log.Println("* Settings from", *configPtr+", SIGHUP reloads them")
+	}
+	for _, spec := range listenSpecs {
+		log.Println("* Listen on:", spec)
+	}
+	if *backendAddrPtr != "" {
+		log.Println("* Proxy to backend:", *backendAddrPtr)
+	}
+	for path, addr := range routes {
+		log.Println("* Proxy", path, "to backend:", addr)
+	}
+	for path, spec := range routeOptionSpecs {
+		log.Println("* Options for", path+":", spec)
+	}
+	if rc.SkipOriginCheck && rc.AllowedOrigins != nil {
+		log.Println("* Origin check skipped, upgrades from any origin are accepted")
+	} else if rc.AllowedOrigins != nil {
+		log.Println("* Upgrades allowed from origins:", *allowedOriginsPtr)
+	}
+	if targetAllow != nil {
+		log.Println("* Clients may pick targets allowed by:", *targetAllowPtr)
+	}
+	if allowBackends != nil {
+		log.Println("* Client-chosen backends must be in:", *allowBackendPtr)
+	}
+	if allowClients != nil || denyClients != nil {
+		log.Println("* Client access: allow", *allowClientPtr, "deny", *denyClientPtr)
+	}
+	if allowCerts != nil || denyCerts != nil {
+		log.Println("* Client certificates: allow", *allowCertPtr, "deny", *denyCertPtr)
+	}
+	log.Println("* Backend data type:", dataType)
+	if *dataFromClientPtr != "" {
+		log.Println("* Accept only", *dataFromClientPtr, "messages from clients")
+	}
+	if *dataSubprotocolsPtr {
+		log.Println("* Clients may pick the data type by subprotocol")
+	}
+	if *dtlsPtr && dtlsPSK != nil {
+		log.Println("* Backend over DTLS, authenticated by PSK as", *dtlsPSKIdentityPtr)
+	} else if *dtlsPtr {
+		log.Println("* Backend over DTLS, authenticated by certificate")
+	}
+	if backendProto == proxy.BackendProtoQUIC {
+		log.Println("* Backend over QUIC", *quicModePtr+"s")
+	} else if backendProto == proxy.BackendProtoTCP {
+		log.Println("* Backend over TCP,", *tcpFramingPtr, "framing")
+	} else if backendProto == proxy.BackendProtoUnix {
+		log.Println("* Backend over a unix stream socket,", *tcpFramingPtr, "framing")
+	} else if backendProto == proxy.BackendProtoUnixgram {
+		log.Println("* Backend over a unix datagram socket")
+	}
+	if len(backendAddrs) > 1 && *lbStrategyPtr == proxy.LBHash {
+		log.Println("* Consistent hashing of clients by", *affinityPtr)
+	} else if len(backendAddrs) > 1 && *lbStrategyPtr == proxy.LBLeastConn {
+		log.Println("* New clients go to the backend with the fewest connections")
+	}
+	if len(backendAddrs) > 1 && *lbStrategyPtr != proxy.LBHash &&
+		*affinityPtr != proxy.AffinityNone {
+		log.Println("* Backend affinity by", *affinityPtr, "for", *affinityTTLPtr)
+	}
+	if regionBackends != nil {
+		log.Println("* Backends by client", *regionByPtr+":", *regionBackendsPtr)
+	}
+	if *pingIntervalPtr > 0 {
+		log.Println("* Ping clients every", *pingIntervalPtr)
+	}
+	log.Println("* Backend write error policy:", *writeErrorPolicyPtr)
+	if allowedSizes != nil {
+		log.Println("* Allowed client datagram sizes:", *allowedSizesPtr,
+			"policy:", *sizePolicyPtr)
+	}
+	if *requireMagicPtr != "" {
+		log.Println("* Require magic prefix:", *requireMagicPtr, "strip:", *stripMagicPtr)
+	}
+	if *batchReadsPtr > 1 {
+		log.Println("* Batch backend reads:", *batchReadsPtr)
+	}
+	if *txCoalesceWindowPtr > 0 {
+		log.Println("* Coalesce client messages within:", *txCoalesceWindowPtr)
+	}
+	if *wsBatchWindowPtr > 0 {
+		log.Println("* Batch backend datagrams within:", *wsBatchWindowPtr)
+	}
+	if *heartbeatPtr > 0 {
+		log.Println("* Client heartbeat every:", *heartbeatPtr)
+	}
+	if *reusePortPtr && reusePortSupported {
+		log.Println("* Listen socket uses SO_REUSEPORT")
+	}
+	if *seqSizePtr > 0 {
+		order := "big-endian"
+		if *seqLittleEndianPtr {
+			order = "little-endian"
+		}
+		log.Println("* Track", *seqSizePtr, "byte", order, "backend sequence at offset", *seqOffsetPtr)
+	}
+	if *sendHighWaterPtr > 0 {
+		log.Println("* Send high-water mark:", *sendHighWaterPtr, "bytes, policy", *sendPolicyPtr)
+	}
+	if *jitterBufferPtr > 0 {
+		log.Println("* Jitter buffer:", *jitterBufferPtr)
+	}
+	if *closeFlushMaxPtr > 0 {
+		log.Println("* Close flush: up to", *closeFlushMaxPtr, "datagrams")
+	}
+	if *payloadLogSamplePtr > 0 {
+		log.Println("* Payload hex dumps for a sample of:", *payloadLogSamplePtr)
+	}
+	if *warmPoolPtr > 0 {
+		log.Println("* Warm pool per backend:", *warmPoolPtr)
+	}
+	if *udpBindDevicePtr != "" {
+		log.Println("* Backend UDP bound to device:", *udpBindDevicePtr)
+	}
+	if dscp > 0 {
+		log.Println("* Backend DSCP:", dscp)
+	}
+	if *ttlPtr > 0 {
+		log.Println("* Backend TTL:", *ttlPtr)
+	}
+	if *multicastInterfacePtr != "" {
+		log.Println("* Multicast backends joined on:", *multicastInterfacePtr)
+	}
+	if *udpBroadcastPtr {
+		log.Println("* Backends are broadcast addresses")
+	}
+	if *udpBindAddrPtr != "" || *udpPortRangePtr != "" {
+		log.Println("* Backend sockets bound to address", *udpBindAddrPtr, "ports", *udpPortRangePtr)
+	}
+	if udpPSK != nil {
+		log.Println("* Backend datagrams encrypted with the UDP PSK")
+	}
+	if *udpRcvBufPtr > 0 || *udpSndBufPtr > 0 {
+		log.Println("* Backend socket buffers requested: rcvbuf", *udpRcvBufPtr,
+			"sndbuf", *udpSndBufPtr)
+	}
+	if *requireSubprotocolPtr != "" {
+		log.Println("* Require subprotocol:", *requireSubprotocolPtr)
+	}
+	if *controlProtocolPtr {
+		log.Println("* Control protocol:", proxy.ControlSubprotocol)
+	}
+	if *requireHeaderPtr != "" {
+		log.Println("* Require headers:", *requireHeaderPtr)
+	}
+	if *sendClientInfoPtr {
+		log.Println("* Send client info to the backend, headers:", *clientInfoHeadersPtr)
+	}
+	if *strictTestPtr {
+		log.Println("* Strict test mode: the first connection error exits with status 1")
+	}
+	if *flowCollectorPtr != "" {
+		log.Println("* Flow records to:", *flowCollectorPtr)
+	}
+	if *filtersPtr != "" {
+		log.Println("* Filters:", *filtersPtr)
+	}
+	if *sessionLogPtr != "" {
+		log.Println("* Session log to:", *sessionLogPtr, "format", *sessionLogFormatPtr)
+	}
+	if *jwtSecretPtr != "" || *jwksURLPtr != "" {
+		log.Println("* Require JWT")
+	}
+	if *authTokenPtr != "" {
+		log.Println("* Require the auth token")
+	}
+	if *authWebhookPtr != "" {
+		log.Println("* Ask", *authWebhookPtr, "before each upgrade")
+	}
+	if *probeIntervalPtr > 0 {
+		log.Println("* Probe backends every:", *probeIntervalPtr)
+	}
+	if *breakerThresholdPtr > 0 {
+		log.Println("* Backend circuit breaker after", *breakerThresholdPtr,
+			"failures within", *breakerWindowPtr, "cooling down", *breakerCooldownPtr)
+	}
+	if len(corsOrigins) > 0 {
+		log.Println("* CORS origins:", strings.Join(corsOrigins, ", "))
+	}
+	if *recordDirPtr != "" {
+		log.Println("* Recording sessions to:", *recordDirPtr)
+	}
+	if *capturePtr != "" {
+		if *captureOnDemandPtr {
+			log.Println("* Capturing sessions on demand to:", *capturePtr)
+		} else {
+			log.Println("* Capturing sessions to:", *capturePtr)
+		}
+	}
+	if *backendSessionLengthPtr > 0 {
+		log.Println("* Backend session ID:", *backendSessionLengthPtr, "bytes at offset",
+			*backendSessionOffsetPtr)
+	}
+	if *adminTokenPtr != "" {
+		log.Println("* Admin API on /admin, pause buffer:", *pauseBufferPtr, "datagrams")
+	}
+	if *compressionPtr {
+		log.Println("* permessage-deflate offered, compressing messages from", *compressionMinSizePtr, "bytes")
+	}
+	if *udpReconnectPtr > 0 {
+		log.Println("* Reconnect backend sockets up to", *udpReconnectPtr, "times")
+	}
+	for backend, addr := range udpFailover {
+		log.Println("* Fail over from backend", backend, "to", addr)
+	}
+	if *resolveIntervalPtr > 0 {
+		log.Println("* Re-resolve backends every", *resolveIntervalPtr, "migrate sessions:", *resolveMigratePtr)
+	}
+	if *backendLoopbackPtr {
+		log.Println("* Loop backend datagrams back, at most", *backendLoopbackRatePtr, "per second")
+	}
+	if *maxConnsPtr > 0 {
+		log.Println("* Max connections:", *maxConnsPtr)
+	}
+	for addr, limit := range backendMaxConns {
+		log.Println("* Max connections to", addr+":", limit)
+	}
+	if *maxBytesPtr > 0 {
+		log.Println("* Max bytes per connection:", *maxBytesPtr, *maxBytesModePtr)
+	}
+	if *clientRatePtr != "" {
+		log.Println("* Rate limit per client IP:", *clientRatePtr)
+	}
+	if *globalRatePtr != "" {
+		log.Println("* Global rate limit:", *globalRatePtr)
+	}
+	if *idleTimeoutPtr > 0 {
+		log.Println("* Idle timeout:", *idleTimeoutPtr)
+	}
+	if *startupGracePtr > 0 {
+		log.Println("* Startup grace:", *startupGracePtr)
+	}
+	if *resumeGracePtr > 0 {
+		log.Println("* Session resume grace:", *resumeGracePtr)
+	}
+	if *maxLifetimePtr > 0 {
+		log.Println("* Max connection lifetime:", *maxLifetimePtr)
+	}
+	if *readWatchdogPtr > 0 {
+		log.Println("* Read watchdog:", *readWatchdogPtr)
+	}
+	if *redirectPatternPtr != "" {
+		log.Println("* Follow backend redirects matching:", *redirectPatternPtr)
+	}
+	if *tlsCertPtr != "" {
+		log.Println("* TLS enabled, require client cert:", *requireClientCertPtr)
+	}
+	if autocertDomains != nil {
+		log.Println("* TLS with Let's Encrypt certificates for", *autocertPtr+
+			", cached in", *autocertCachePtr+", require client cert:", *requireClientCertPtr)
+	}
 
-	udpServer, err := net.ResolveUDPAddr("udp", url)
+	if *maxHeaderSizePtr <= 0 {
+		log.Fatalln("max-header-size must be positive. Use -h to help")
+	}
+	trustedProxies, err := proxy.ParsePrefixes(*trustedProxiesPtr)
 	if err != nil {
-		log.Fatalln(err)
+		log.Fatalln(err, "Use -h to help")
+	}
+	switch {
+	case *realIPHeaderPtr == "":
+	case !strings.EqualFold(*realIPHeaderPtr, fiber.HeaderXForwardedFor) && !strings.EqualFold(*realIPHeaderPtr, "X-Real-IP"):
+		log.Fatalln("real-ip-header must be X-Forwarded-For or X-Real-IP. Use -h to help")
+	case len(trustedProxies) == 0:
+		log.Fatalln("real-ip-header needs -trusted-proxies. Use -h to help")
+	}
+	var tlsConfig *tls.Config
+	if *tlsCertPtr != "" {
+		tlsConfig, err = newTLSConfig(
+			*tlsCertPtr,
+			*tlsKeyPtr,
+			*clientCAPtr,
+			*requireClientCertPtr,
+		)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if autocertDomains != nil {
+		tlsConfig, err = newAutocertTLSConfig(
+			autocertDomains,
+			*autocertCachePtr,
+			*autocertEmailPtr,
+			*clientCAPtr,
+			*requireClientCertPtr,
+		)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
-	udpConn, err := net.DialUDP("udp", nil, udpServer)
+	if *realIPHeaderPtr != "" {
+		log.Println("* Client addresses from", *realIPHeaderPtr, "of", *trustedProxiesPtr)
+	}
+	if *proxyProtocolPtr {
+		from := *trustedProxiesPtr
+		if from == "" {
+			from = "every peer"
+		}
+		log.Println("* PROXY protocol expected from", from)
+	}
+
+	opts := listenOptions{
+		reusePort:  *reusePortPtr,
+		socketMode: socketMode,
+		noDelay:    *wsTCPNoDelayPtr,
+		keepAlive:  *wsTCPKeepAlivePtr,
+	}
+	// Sockets passed by systemd stand in for the -listen entries, in order,
+	// leaving out webtransport ones, which bind their UDP socket themselves.
+	inherited, err := systemdListeners(opts)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	defer udpConn.Close()
-
-	clientErrChan := make(chan error, 1)
-	backendErrChan := make(chan error, 1)
-
-	go forwardWS2UDP(c, udpConn, clientErrChan)
-	go forwardUDP2WS(udpConn, c, backendErrChan)
+	tcpListeners := 0
+	for _, spec := range listenSpecs {
+		if !spec.webTransport {
+			tcpListeners++
+		}
+	}
+	if len(inherited) > tcpListeners {
+		log.Println("systemd passed", len(inherited), "sockets for", tcpListeners, "listeners, closing the rest")
+		for _, ln := range inherited[tcpListeners:] {
+			ln.Close()
+		}
+		inherited = inherited[:tcpListeners]
+	}
+	// Every listener gets an app of its own, so it can serve a subset of
+	// the routes. They all share p, and with it the sessions and limits.
+	var servers []httpServer
+	used := 0
+	for i, spec := range listenSpecs {
+		app := fiber.New(fiber.Config{
+			Immutable:             true,
+			ReadBufferSize:        *maxHeaderSizePtr,
+			ErrorHandler:          logOversizedHeaders(*maxHeaderSizePtr),
+			DisableStartupMessage: i > 0,
+		})
+		if *realIPHeaderPtr != "" {
+			app.Use(proxy.RealIP(*realIPHeaderPtr, trustedProxies))
+		}
+		switch {
+		case !slog.Default().Enabled(context.Background(), slog.LevelInfo):
+		case *logFormatPtr == "plain":
+			app.Use(logger.New())
+		default:
+			app.Use(accessLog)
+		}
+		if spec.routes != nil {
+			app.Use(restrictRoutes(spec.routes, routes))
+		}
+		p.RegisterRoutes(app, "/")
 
-	var msg string
+		if spec.webTransport {
+			pc, err := listenPacket(spec.addr, opts)
+			if err != nil {
+				listenFailed(spec.addr, err)
+			}
+			log.Println("* WebTransport on", pc.LocalAddr())
+			servers = append(servers, httpServer{app: app, wt: p.NewWebTransportServer(app, tlsConfig), pc: pc})
+			continue
+		}
+		var ln net.Listener
+		if used < len(inherited) {
+			ln = inherited[used]
+			used++
+			log.Println("* Using socket", used, "passed by systemd, ignoring", spec.addr)
+		} else if ln, err = listen(spec.addr, opts); err != nil {
+			listenFailed(spec.addr, err)
+		}
+		if *proxyProtocolPtr {
+			// The header comes ahead of the TLS handshake.
+			ln = proxy.ProxyProtocolListener(ln, trustedProxies)
+		}
+		if tlsConfig != nil && spec.tls != "plain" {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		servers = append(servers, httpServer{app: app, ln: ln})
+	}
 
-	select {
-	case err = <-clientErrChan:
-		msg = "forward client to backend server error"
-	case err = <-backendErrChan:
-		msg = "forward backend to client server error"
+	// Binding and reading the TLS key are what may need root.
+	if *userPtr != "" || *groupPtr != "" {
+		if err = dropPrivileges(*userPtr, *groupPtr); err != nil {
+			log.Fatalln("drop privileges:", err)
+		}
+		log.Println("* Running as uid", os.Getuid(), "gid", os.Getgid())
 	}
+	serve(servers, p, *lameDuckPtr, *shutdownGracePtr)
+}
 
-	if websocket.IsUnexpectedCloseError(
-		err,
-		websocket.CloseGoingAway,
-		websocket.CloseNoStatusReceived) {
-		log.Println(msg, "error:", err)
+// listenFailed exits on the error opening the listener on addr, with
+// exitAddrInUse when the address is taken.
+func listenFailed(addr string, err error) {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		log.Println("address", addr, "already in use — is another instance running?")
+		os.Exit(exitAddrInUse)
 	}
+	log.Fatalln(err)
 }
 
-func forwardWS2UDP(
-	wsConn *websocket.Conn,
-	udpConn *net.UDPConn,
-	errChan chan error,
-) {
-	for {
-		_, msg, err := wsConn.ReadMessage()
-		if err != nil {
-			errChan <- err
-			break
+// isFlagSet reports whether the named flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
+	})
+	return set
+}
 
-		_, err = udpConn.Write(msg)
+// hexKey returns the hex key given by the flag name or, from a file, by
+// name-file. At most one of them may be set; neither is no key.
+func hexKey(name, key, file string) ([]byte, error) {
+	if key != "" && file != "" {
+		return nil, fmt.Errorf("%s and %s-file are mutually exclusive", name, name)
+	}
+	if file != "" {
+		b, err := os.ReadFile(file)
 		if err != nil {
-			errChan <- err
-			break
+			return nil, err
 		}
+		key = strings.TrimSpace(string(b))
 	}
+	if key == "" {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return b, nil
 }
 
-func forwardUDP2WS(
-	udpConn *net.UDPConn,
-	wsConn *websocket.Conn,
-	errChan chan error,
-) {
-	dataType := wsConn.Locals(localKeyDataType).(string)
-	wsMsgType := websocket.TextMessage
-	if dataType == dataTypeBinary {
-		wsMsgType = websocket.BinaryMessage
+// backendScheme takes a udp://, tcp:// or quic:// prefix, or a unix: or
+// unixgram: one before a socket path, off addr and records its protocol in
+// proto, which it must agree with once set: all backends use the same
+// protocol.
+func backendScheme(addr string, proto *string) (string, error) {
+	scheme, rest, ok := strings.Cut(addr, "://")
+	for _, unix := range []string{proxy.BackendProtoUnix, proxy.BackendProtoUnixgram} {
+		if path, isUnix := strings.CutPrefix(addr, unix+":"); isUnix {
+			scheme, rest, ok = unix, strings.TrimPrefix(path, "//"), true
+		}
+	}
+	if !ok {
+		return addr, nil
+	}
+	switch scheme {
+	case proxy.BackendProtoUDP, proxy.BackendProtoTCP, proxy.BackendProtoQUIC,
+		proxy.BackendProtoUnix, proxy.BackendProtoUnixgram:
+	default:
+		return "", fmt.Errorf("unsupported backend scheme %q in %s", scheme, addr)
 	}
+	if *proto != "" && *proto != scheme {
+		return "", fmt.Errorf("backend %s does not use %s like the others", addr, *proto)
+	}
+	*proto = scheme
+	return rest, nil
+}
 
-	buf := make([]byte, 1024)
-	for {
-		n, err := udpConn.Read(buf)
-		if err != nil {
-			errChan <- err
-			break
+// restrictRoutes answers 404 to upgrades on the WebSocket paths not in
+// served, for a listener given route= options: the default path / and the
+// -route paths. Other endpoints, such as metrics, stay reachable.
+func restrictRoutes(served []string, routes map[string]string) fiber.Handler {
+	blocked := map[string]bool{"/": true}
+	for path := range routes {
+		blocked[routeKey(path)] = true
+	}
+	for _, path := range served {
+		delete(blocked, routeKey(path))
+	}
+	return func(c *fiber.Ctx) error {
+		if blocked[routeKey(c.Path())] {
+			return fiber.ErrNotFound
 		}
+		return c.Next()
+	}
+}
 
-		err = wsConn.WriteMessage(wsMsgType, buf[:n])
+// parseRouteOptions parses the comma-separated options of -route-options.
+func parseRouteOptions(spec string) (proxy.RouteOptions, error) {
+	var opts proxy.RouteOptions
+	for _, opt := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(opt), "=")
+		if !ok || value == "" {
+			return opts, fmt.Errorf("want key=value, got %q", opt)
+		}
+		var err error
+		switch key {
+		case "data":
+			opts.DataType = value
+		case "client-data":
+			opts.ClientDataTypes = append(opts.ClientDataTypes, value)
+		case "buffer":
+			opts.UDPBufferSize, err = strconv.Atoi(value)
+		case "max-buffer":
+			opts.MaxUDPBufferSize, err = strconv.Atoi(value)
+		case "idle":
+			opts.IdleTimeout, err = time.ParseDuration(value)
+		case "max-idle":
+			opts.MaxIdleTimeout, err = time.ParseDuration(value)
+		default:
+			return opts, fmt.Errorf("unknown option %q", key)
+		}
 		if err != nil {
-			errChan <- err
-			break
+			return opts, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return opts, nil
+}
+
+// routeKey normalizes path the way Fiber matches routes by default, case
+// and trailing slash insensitively.
+func routeKey(path string) string {
+	path = strings.ToLower(path)
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return path
+}
+
+// logOversizedHeaders is Fiber's default error handler, logging requests
+// refused for headers over limit bytes. Those never reach a route, so the
+// request logger does not see them.
+func logOversizedHeaders(limit int) fiber.ErrorHandler {
+	return func(c *fiber.Ctx, err error) error {
+		if errors.Is(err, fiber.ErrRequestHeaderFieldsTooLarge) {
+			log.Println("rejected request from", c.IP(), "with headers over", limit, "bytes")
 		}
+		return fiber.DefaultErrorHandler(c, err)
 	}
 }
@@ -0,0 +1,84 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to userName and groupName, either of
+// which may be a name or a numeric ID. Without a group, the user's primary
+// group is used. It is meant to run once the listener is bound, so a
+// privileged port can be served by an unprivileged user; leaving root also
+// clears the process's capabilities.
+func dropPrivileges(userName, groupName string) error {
+	uid, gid := -1, -1
+	if userName != "" {
+		u, err := lookupUser(userName)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("user %s: non-numeric uid %s", userName, u.Uid)
+		}
+		if groupName == "" {
+			if u.Gid == "" {
+				return fmt.Errorf("user %s has no passwd entry, set a group", userName)
+			}
+			if gid, err = strconv.Atoi(u.Gid); err != nil {
+				return fmt.Errorf("user %s: non-numeric gid %s", userName, u.Gid)
+			}
+		}
+	}
+	if groupName != "" {
+		g, err := lookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("group %s: non-numeric gid %s", groupName, g.Gid)
+		}
+	}
+
+	// The group goes first, since changing it needs the privileges that
+	// changing the user gives up.
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid %d: %w", gid, err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid %d: %w", uid, err)
+		}
+		if uid != 0 && syscall.Setuid(0) == nil {
+			return errors.New("regained root after dropping privileges")
+		}
+	}
+	return nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		// An ID with no passwd entry still identifies a user.
+		return &user.User{Uid: name}, nil
+	}
+	return user.Lookup(name)
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return &user.Group{Gid: name}, nil
+	}
+	return user.LookupGroup(name)
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ParsePrefixes parses a comma-separated list of CIDR prefixes and plain
+// addresses, such as 10.0.0.0/8,192.0.2.1, for Config.AllowClients,
+// Config.DenyClients, Config.AllowBackends and the trusted proxies of
+// RealIP and ProxyProtocolListener.
+func ParsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(part); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or prefix %q", part)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAllowed reports whether Config.AllowClients and Config.DenyClients
+// let the client of c upgrade.
+func (p *Proxy) clientAllowed(c *fiber.Ctx) bool {
+	if len(p.cfg.AllowClients) == 0 && len(p.cfg.DenyClients) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(c.IP())
+	if err != nil {
+		// Clients on a Unix socket have no IP; only an allow list stops them.
+		return len(p.cfg.AllowClients) == 0
+	}
+	if prefixesContain(p.cfg.DenyClients, addr) {
+		return false
+	}
+	return len(p.cfg.AllowClients) == 0 || prefixesContain(p.cfg.AllowClients, addr)
+}
+
+// certAllowed reports whether Config.AllowCerts and Config.DenyCerts let a
+// client whose certificate has identity upgrade, "" standing for a client
+// without a verified certificate.
+func (p *Proxy) certAllowed(identity string) bool {
+	if identity != "" && identityMatches(p.cfg.DenyCerts, identity) {
+		return false
+	}
+	if len(p.cfg.AllowCerts) == 0 {
+		return true
+	}
+	return identity != "" && identityMatches(p.cfg.AllowCerts, identity)
+}
+
+// checkCertPatterns reports the first malformed pattern of the lists.
+func checkCertPatterns(lists ...[]string) error {
+	for _, patterns := range lists {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid certificate pattern %q", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// identityMatches reports whether identity matches one of the path.Match
+// patterns, which were checked by New.
+func identityMatches(patterns []string, identity string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, identity); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// backendAllowed reports whether the backend addr, which resolved to
+// udpAddr, may be dialed under Config.AllowBackends. The configured
+// backends always may; the others are ones a client steered the proxy to.
+func (p *Proxy) backendAllowed(addr string, udpAddr *net.UDPAddr) bool {
+	if len(p.cfg.AllowBackends) == 0 || containsAddr(p.allBackends, addr) {
+		return true
+	}
+	ip, ok := netip.AddrFromSlice(udpAddr.IP)
+	return ok && prefixesContain(p.cfg.AllowBackends, ip)
+}
+
+// targetAddrAllowed checks a client's target against Config.AllowBackends
+// up front, so that one resolving outside it gets 403 rather than an
+// upgrade that closes at once. The dial checks again.
+func (p *Proxy) targetAddrAllowed(target string) bool {
+	if len(p.cfg.AllowBackends) == 0 {
+		return true
+	}
+	udpAddr, err := p.resolveBackend(target)
+	return err != nil || p.backendAllowed(target, udpAddr)
+}
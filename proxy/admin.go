@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// registerAdminRoutes mounts the admin API under Config.AdminPath.
+func (p *Proxy) registerAdminRoutes(app *fiber.App) {
+	admin := app.Group(p.cfg.AdminPath, p.adminAuth)
+	admin.Get("/connections", p.connectionsHandler)
+	admin.Delete("/connections/:id", p.disconnectHandler)
+	if p.cfg.PcapDir != "" {
+		admin.Post("/connections/:id/capture", p.captureHandler)
+		admin.Delete("/connections/:id/capture", p.captureHandler)
+	}
+	admin.Get("/stats", func(c *fiber.Ctx) error {
+		return c.JSON(p.Stats())
+	})
+	admin.Post("/pause", p.pauseHandler(true))
+	admin.Post("/resume", p.pauseHandler(false))
+}
+
+// adminAuth lets only requests bearing Config.AdminToken through.
+func (p *Proxy) adminAuth(c *fiber.Ctx) error {
+	token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(p.cfg.AdminToken)) != 1 {
+		return fiber.ErrUnauthorized
+	}
+	return c.Next()
+}
+
+// connectionInfo is one entry of the admin connections listing.
+type connectionInfo struct {
+	ID             string    `json:"id"`
+	Remote         string    `json:"remote"`
+	Identity       string    `json:"identity,omitempty"`
+	Backend        string    `json:"backend"`
+	BackendAddr    string    `json:"backend_addr"`
+	BackendSession string    `json:"backend_session,omitempty"`
+	Started        time.Time `json:"started"`
+	UptimeSeconds  float64   `json:"uptime_seconds"`
+	// IdleSeconds is the time since the last datagram either way.
+	IdleSeconds      float64 `json:"idle_seconds"`
+	Paused           bool    `json:"paused"`
+	Capturing        bool    `json:"capturing"`
+	BytesToBackend   uint64  `json:"bytes_to_backend"`
+	BytesToClient    uint64  `json:"bytes_to_client"`
+	PacketsToBackend uint64  `json:"packets_to_backend"`
+	PacketsToClient  uint64  `json:"packets_to_client"`
+	// SeqLossPercent is the estimated recent loss when sequence tracking
+	// is on.
+	SeqLossPercent *float64 `json:"seq_loss_percent,omitempty"`
+}
+
+// connectionsHandler lists the live connections, oldest first.
+func (p *Proxy) connectionsHandler(c *fiber.Ctx) error {
+	sessions := p.sessions.snapshot()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].startedAt.Before(sessions[j].startedAt)
+	})
+	now := p.now()
+	list := make([]connectionInfo, len(sessions))
+	for i, s := range sessions {
+		list[i] = connectionInfo{
+			ID:               s.id,
+			Remote:           s.remoteAddr,
+			Identity:         s.identity,
+			Backend:          s.backend,
+			BackendAddr:      s.udpConn.RemoteAddr().String(),
+			BackendSession:   s.backendSessionID(),
+			Started:          s.startedAt,
+			UptimeSeconds:    now.Sub(s.startedAt).Seconds(),
+			IdleSeconds:      now.Sub(time.Unix(0, atomic.LoadInt64(&s.lastActive))).Seconds(),
+			Paused:           s.pause.isPaused(),
+			Capturing:        atomic.LoadInt32(&s.pcapping) == 1,
+			BytesToBackend:   atomic.LoadUint64(&s.bytesToBackend),
+			BytesToClient:    atomic.LoadUint64(&s.bytesToClient),
+			PacketsToBackend: atomic.LoadUint64(&s.packetsToBackend),
+			PacketsToClient:  atomic.LoadUint64(&s.packetsToClient),
+		}
+		if s.seq != nil {
+			loss := 100 * s.seq.lossRatio()
+			list[i].SeqLossPercent = &loss
+		}
+	}
+	return c.JSON(list)
+}
+
+// Disconnect closes the connection with the given client ID with
+// CloseDisconnected, reporting whether there was one.
+func (p *Proxy) Disconnect(id string) bool {
+	s := p.sessions.get(id)
+	if s == nil {
+		return false
+	}
+	slog.Info("disconnecting client", "client", id)
+	s.kill(CloseDisconnected, "disconnected")
+	return true
+}
+
+// disconnectHandler closes the connection with the client ID in the path.
+func (p *Proxy) disconnectHandler(c *fiber.Ctx) error {
+	if !p.Disconnect(c.Params("id")) {
+		return fiber.NewError(fiber.StatusNotFound, "no such client")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
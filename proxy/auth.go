@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// authWebhookTimeout bounds a call to Config.AuthWebhook.
+const authWebhookTimeout = 2 * time.Second
+
+// hasAuthToken reports whether the client presented token, the
+// Config.AuthToken in effect.
+func (p *Proxy) hasAuthToken(c *fiber.Ctx, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(tokenFromRequest(c)), []byte(token)) == 1
+}
+
+// checkAuthWebhook asks Config.AuthWebhook whether to let the upgrade
+// through, forwarding the request's headers along with X-Original-URI,
+// X-Forwarded-For and, for a verified client certificate,
+// X-Client-Cert-Identity and X-Client-Cert-Subject. A 2xx answer allows
+// it, 401 and 403 are passed on to the client, and anything else, or no
+// answer in time, refuses it with 503.
+func (p *Proxy) checkAuthWebhook(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), authWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.AuthWebhook, nil)
+	if err != nil {
+		return err
+	}
+	c.Request().Header.VisitAll(func(k, v []byte) {
+		name := string(k)
+		if webhookSkipsHeader(name) {
+			return
+		}
+		req.Header.Add(name, string(v))
+	})
+	req.Header.Set("X-Original-URI", c.OriginalURL())
+	req.Header.Set("X-Forwarded-For", c.IP())
+	if state := c.Context().TLSConnectionState(); state != nil && len(state.PeerCertificates) > 0 {
+		req.Header.Set("X-Client-Cert-Identity", clientCertIdentity(c))
+		req.Header.Set("X-Client-Cert-Subject", state.PeerCertificates[0].Subject.String())
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Error("auth webhook error", "error", err)
+		return fiber.NewError(fiber.StatusServiceUnavailable, "auth unavailable")
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fiber.NewError(resp.StatusCode, "denied by auth webhook")
+	}
+	slog.Warn("auth webhook answered", "status", resp.Status)
+	return fiber.NewError(fiber.StatusServiceUnavailable, "auth unavailable")
+}
+
+// webhookSkipsHeader reports whether the header is left out of webhook
+// calls: hop-by-hop headers, the WebSocket handshake ones, those that
+// describe the upgrade request itself rather than the client, and the
+// certificate ones, which only the proxy may set.
+func webhookSkipsHeader(name string) bool {
+	switch strings.ToLower(name) {
+	case "connection", "upgrade", "keep-alive", "te", "trailer",
+		"transfer-encoding", "host", "content-length",
+		"x-client-cert-identity", "x-client-cert-subject":
+		return true
+	}
+	return strings.HasPrefix(strings.ToLower(name), "sec-websocket-")
+}
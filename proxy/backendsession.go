@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"log/slog"
+)
+
+// observeBackendSession extracts the backend's session ID from its first
+// reply, per Config.BackendSessionOffset and BackendSessionLength, and logs
+// it next to the client ID. Later replies are ignored, and a first reply
+// too short to hold the ID leaves the session without one.
+func (s *session) observeBackendSession(reply []byte) {
+	s.backendSessionOnce.Do(func() {
+		cfg := &s.proxy.cfg
+		end := cfg.BackendSessionOffset + cfg.BackendSessionLength
+		if len(reply) < end {
+			metricBackendSessionShort.inc()
+			slog.Warn("first backend reply too short for a session ID",
+				"client", s.id, "bytes", len(reply))
+			return
+		}
+		id := hex.EncodeToString(reply[cfg.BackendSessionOffset:end])
+		s.backendSession.Store(id)
+		metricBackendSessions.inc()
+		slog.Info("backend session", "client", s.id, "backend_session", id)
+	})
+}
+
+// backendSessionID returns the hex backend session ID, or "" if there is
+// none (yet).
+func (s *session) backendSessionID() string {
+	id, _ := s.backendSession.Load().(string)
+	return id
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategies for Config.LBStrategy.
+const (
+	LBRoundRobin = "round-robin"
+	LBHash       = "hash"
+	LBLeastConn  = "least-conn"
+)
+
+// Affinity keys for Config.Affinity.
+const (
+	AffinityNone    = ""
+	AffinitySession = "session"
+	AffinityIP      = "ip"
+)
+
+// backendPool picks a backend for each new client, round-robin across the
+// configured addresses. With affinity enabled, a client reconnecting within
+// the affinity TTL gets the backend it used last time. With LBHash, clients
+// with an affinity key always get the backend the key hashes to instead.
+// With LBLeastConn, new clients get the backend with the fewest active
+// connections as reported by load. Whatever the strategy, backends up
+// reports as down are skipped while any other is up.
+type backendPool struct {
+	addrs    []string
+	next     uint32
+	affinity *affinityMap
+	ring     *hashRing
+	load     func(addr string) int
+	up       func(addr string) bool
+}
+
+func newBackendPool(
+	addrs []string,
+	strategy string,
+	affinity string,
+	affinityTTL time.Duration,
+	now func() time.Time,
+	load func(addr string) int,
+	up func(addr string) bool,
+) *backendPool {
+	p := &backendPool{addrs: addrs, up: up}
+	switch strategy {
+	case LBHash:
+		p.ring = newHashRing(addrs)
+		return p
+	case LBLeastConn:
+		p.load = load
+	}
+	if len(addrs) > 1 && affinity != AffinityNone && affinityTTL > 0 {
+		p.affinity = &affinityMap{
+			now:     now,
+			ttl:     affinityTTL,
+			entries: make(map[string]affinityEntry),
+		}
+	}
+	return p
+}
+
+// pick returns the backend for a client identified by key, which may be
+// empty when the client has no affinity key.
+func (p *backendPool) pick(key string) string {
+	if p.ring != nil && key != "" {
+		return p.ring.get(key, p.up)
+	}
+	if p.affinity != nil && key != "" {
+		if addr, ok := p.affinity.get(key); ok && p.up(addr) {
+			p.affinity.put(key, addr)
+			return addr
+		}
+	}
+
+	var addr string
+	if p.load != nil {
+		addr = p.leastLoaded()
+	} else {
+		addr = p.roundRobin()
+	}
+	if p.affinity != nil && key != "" {
+		p.affinity.put(key, addr)
+	}
+	return addr
+}
+
+// roundRobin returns the next backend in turn that is up, or the next one
+// if none is.
+func (p *backendPool) roundRobin() string {
+	start := int(atomic.AddUint32(&p.next, 1) - 1)
+	for i := range p.addrs {
+		if addr := p.addrs[(start+i)%len(p.addrs)]; p.up(addr) {
+			return addr
+		}
+	}
+	return p.addrs[start%len(p.addrs)]
+}
+
+// leastLoaded returns the backend up with the fewest active connections,
+// or the least loaded of all if none is up. The scan starts one backend
+// further each time, so ties go round-robin.
+func (p *backendPool) leastLoaded() string {
+	start := int(atomic.AddUint32(&p.next, 1) - 1)
+	best, bestLoad, bestUp := "", 0, false
+	for i := range p.addrs {
+		addr := p.addrs[(start+i)%len(p.addrs)]
+		n, up := p.load(addr), p.up(addr)
+		if best == "" || (up && !bestUp) || (up == bestUp && n < bestLoad) {
+			best, bestLoad, bestUp = addr, n, up
+		}
+	}
+	return best
+}
+
+// has reports whether addr is one of the configured backends.
+func (p *backendPool) has(addr string) bool {
+	return containsAddr(p.addrs, addr)
+}
+
+func containsAddr(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// release restarts the affinity TTL when a client disconnects, so the TTL
+// is measured from the end of the last session rather than its start.
+func (p *backendPool) release(key string, addr string) {
+	if p.affinity != nil && key != "" {
+		p.affinity.put(key, addr)
+	}
+}
+
+type affinityEntry struct {
+	addr    string
+	expires time.Time
+}
+
+// affinityMap is a small TTL cache. Expired entries are ignored on lookup
+// and swept from the map at most once per TTL, on insert.
+type affinityMap struct {
+	mu        sync.Mutex
+	now       func() time.Time
+	ttl       time.Duration
+	entries   map[string]affinityEntry
+	lastSweep time.Time
+}
+
+func (m *affinityMap) get(key string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok || m.now().After(e.expires) {
+		return "", false
+	}
+	return e.addr, true
+}
+
+func (m *affinityMap) put(key string, addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	m.entries[key] = affinityEntry{addr: addr, expires: now.Add(m.ttl)}
+
+	if now.Sub(m.lastSweep) < m.ttl {
+		return
+	}
+	m.lastSweep = now
+	for k, e := range m.entries {
+		if now.After(e.expires) {
+			delete(m.entries, k)
+		}
+	}
+}
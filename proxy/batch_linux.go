@@ -0,0 +1,50 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const batchReadsSupported = true
+
+// msgTrunc is the flag the kernel sets on a datagram cut to the buffer.
+const msgTrunc = syscall.MSG_TRUNC
+
+type batchReader interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// newBatchUDPReader reads up to size datagrams per recvmmsg syscall.
+func newBatchUDPReader(udpConn *net.UDPConn, size int, bufSize int) udpReader {
+	var br batchReader
+	if addr, ok := udpConn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		br = ipv4.NewPacketConn(udpConn)
+	} else {
+		br = ipv6.NewPacketConn(udpConn)
+	}
+
+	msgs := make([]ipv4.Message, size)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, bufSize)}
+	}
+	payloads := make([][]byte, size)
+
+	return func() ([][]byte, error) {
+		n, err := br.ReadBatch(msgs, 0)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			payloads[i] = msgs[i].Buffers[0][:msgs[i].N]
+			if msgs[i].Flags&msgTrunc != 0 {
+				metricUDPTruncated.inc()
+			}
+		}
+		return payloads[:n], nil
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package proxy
+
+import "net"
+
+const batchReadsSupported = false
+
+// msgTrunc is 0 where truncated datagrams are not detected.
+const msgTrunc = 0
+
+func newBatchUDPReader(udpConn *net.UDPConn, size int, bufSize int) udpReader {
+	return newSingleUDPReader(udpConn, bufSize)
+}
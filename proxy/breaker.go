@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerWindow   = 30 * time.Second
+	defaultBreakerCooldown = 10 * time.Second
+)
+
+// Breaker states, as exported by udpwsproxy_backend_breaker_state.
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops new connections to a backend after threshold
+// consecutive dial failures within window. Once cooldown has passed, one
+// connection is let through as a probe; its success closes the breaker and
+// its failure opens it for another cooldown.
+type circuitBreaker struct {
+	addr      string
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu           sync.Mutex
+	state        int
+	failures     int
+	firstFailure time.Time
+	changedAt    time.Time
+}
+
+func newCircuitBreakers(addrs []string, threshold int, window, cooldown time.Duration, now func() time.Time) map[string]*circuitBreaker {
+	breakers := make(map[string]*circuitBreaker, len(addrs))
+	for _, addr := range addrs {
+		breakers[addr] = &circuitBreaker{
+			addr:      addr,
+			threshold: threshold,
+			window:    window,
+			cooldown:  cooldown,
+			now:       now,
+		}
+		metricBreakerState.set(addr, breakerClosed)
+	}
+	return breakers
+}
+
+// allow reports whether a new connection may dial the backend. In the
+// half-open state only the probe is allowed; should the probe never report
+// back, e.g. because its upgrade failed, another one is let through after
+// a further cooldown.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerClosed {
+		return true
+	}
+	if b.now().Sub(b.changedAt) < b.cooldown {
+		return false
+	}
+	b.setState(breakerHalfOpen)
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	if b.state != breakerClosed {
+		b.setState(breakerClosed)
+	}
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if b.state == breakerHalfOpen {
+		b.setState(breakerOpen)
+		return
+	}
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.state == breakerClosed && b.failures >= b.threshold {
+		b.setState(breakerOpen)
+	}
+}
+
+// isOpen reports whether the breaker refuses connections for now. Once the
+// cooldown is over it does not, as a probe connection would be let
+// through.
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerOpen && b.now().Sub(b.changedAt) < b.cooldown
+}
+
+// setState must be called with mu held.
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	b.changedAt = b.now()
+	metricBreakerState.set(b.addr, int64(state))
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// captureMagic starts every capture file, followed by the JSON header on
+// one line and then the records.
+const captureMagic = "udpwsproxy-capture 1\n"
+
+// Framings for CaptureHeader.Framing.
+const (
+	// FramingNone means every client-to-backend datagram is one client
+	// message.
+	FramingNone = "none"
+	// FramingLength16 means client messages were coalesced, each framed
+	// by a 2-byte big-endian length; see SplitFrames.
+	FramingLength16 = "length16"
+)
+
+// Capture record directions.
+const (
+	CaptureToBackend byte = 1
+	CaptureToClient  byte = 2
+)
+
+var errBadCapture = errors.New("not a udpwsproxy capture")
+
+// CaptureHeader describes the session a capture file was recorded from.
+type CaptureHeader struct {
+	Client  string    `json:"client"`
+	Backend string    `json:"backend"`
+	Started time.Time `json:"started"`
+	// DataFromClient is the type client messages had to be, "" if either
+	// was accepted; DataToClient is the type of messages sent to the
+	// client.
+	DataFromClient string `json:"data_from_client"`
+	DataToClient   string `json:"data_to_client"`
+	Framing        string `json:"framing"`
+}
+
+// CaptureRecord is one datagram as seen on the backend socket.
+type CaptureRecord struct {
+	// Offset is the time since the session started.
+	Offset  time.Duration
+	Dir     byte
+	Payload []byte
+}
+
+// CaptureWriter records a session. It is safe for concurrent use by both
+// forwarding directions. The first write error sticks.
+type CaptureWriter struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	err error
+}
+
+// NewCaptureWriter writes the file header for h to w.
+func NewCaptureWriter(w io.Writer, h CaptureHeader) (*CaptureWriter, error) {
+	header, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	cw := &CaptureWriter{w: bufio.NewWriter(w)}
+	cw.w.WriteString(captureMagic)
+	cw.w.Write(header)
+	if err = cw.w.WriteByte('\n'); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// Write appends r. Records are an 8-byte offset in nanoseconds, the
+// direction byte and a 4-byte payload length, all big-endian, followed by
+// the payload.
+func (cw *CaptureWriter) Write(r CaptureRecord) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.err != nil {
+		return cw.err
+	}
+	var head [13]byte
+	binary.BigEndian.PutUint64(head[:8], uint64(r.Offset))
+	head[8] = r.Dir
+	binary.BigEndian.PutUint32(head[9:], uint32(len(r.Payload)))
+	cw.w.Write(head[:])
+	_, cw.err = cw.w.Write(r.Payload)
+	return cw.err
+}
+
+// Flush writes any buffered records to the underlying writer.
+func (cw *CaptureWriter) Flush() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.err
+}
+
+// CaptureReader reads a file written by CaptureWriter.
+type CaptureReader struct {
+	Header CaptureHeader
+	r      *bufio.Reader
+}
+
+// NewCaptureReader reads and checks the file header.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	cr := &CaptureReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(cr.r, magic); err != nil || string(magic) != captureMagic {
+		return nil, errBadCapture
+	}
+	line, err := cr.r.ReadBytes('\n')
+	if err != nil {
+		return nil, errBadCapture
+	}
+	if err = json.Unmarshal(line, &cr.Header); err != nil {
+		return nil, fmt.Errorf("capture header: %w", err)
+	}
+	return cr, nil
+}
+
+// Next returns the next record, or io.EOF after the last one. A file cut
+// short, e.g. by a crash, ends with io.ErrUnexpectedEOF.
+func (cr *CaptureReader) Next() (CaptureRecord, error) {
+	var head [13]byte
+	if _, err := io.ReadFull(cr.r, head[:]); err != nil {
+		return CaptureRecord{}, err
+	}
+	r := CaptureRecord{
+		Offset:  time.Duration(binary.BigEndian.Uint64(head[:8])),
+		Dir:     head[8],
+		Payload: make([]byte, binary.BigEndian.Uint32(head[9:])),
+	}
+	if _, err := io.ReadFull(cr.r, r.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return CaptureRecord{}, err
+	}
+	return r, nil
+}
+
+// sessionCapture is a capture file being recorded for one session.
+type sessionCapture struct {
+	file *os.File
+	w    *CaptureWriter
+}
+
+// openCapture starts recording sess under Config.RecordDir. Recording is
+// best effort: failures are logged and the session goes on unrecorded.
+func (p *Proxy) openCapture(sess *session, h CaptureHeader) *sessionCapture {
+	path := filepath.Join(p.cfg.RecordDir, sess.id+".cap")
+	file, err := os.Create(path)
+	if err != nil {
+		slog.Warn("record error", "client", sess.id, "error", err)
+		return nil
+	}
+	w, err := NewCaptureWriter(file, h)
+	if err != nil {
+		file.Close()
+		slog.Warn("record error", "client", sess.id, "error", err)
+		return nil
+	}
+	return &sessionCapture{file: file, w: w}
+}
+
+// record adds a datagram that went dir; errors surface on close.
+func (s *session) record(dir byte, payload []byte) {
+	s.recordPcap(dir, payload)
+	if s.capture == nil {
+		return
+	}
+	s.capture.w.Write(CaptureRecord{
+		Offset:  s.proxy.now().Sub(s.startedAt),
+		Dir:     dir,
+		Payload: payload,
+	})
+}
+
+func (c *sessionCapture) close(id string) {
+	err := c.w.Flush()
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		slog.Warn("record error", "client", id, "error", err)
+	}
+}
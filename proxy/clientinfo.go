@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// clientInfo describes the client's environment as seen on the upgrade
+// request, for the connect log. It never contains payload data.
+type clientInfo struct {
+	remoteAddr   string
+	userAgent    string
+	subprotocols string
+	extensions   string
+	tls          string
+	// certSubject is the verified client certificate's subject, and
+	// certIdentity its identity, see clientCertIdentity.
+	certSubject  string
+	certIdentity string
+	headers      []any
+
+	// localAddr, tlsVersion and clientInfoHeaders are for
+	// clientInfoPacket, the latter holding "Name: value" for each
+	// Config.ClientInfoHeaders entry present.
+	localAddr         string
+	tlsVersion        string
+	clientInfoHeaders []string
+}
+
+// newClientInfo describes the client making the upgrade c. headers are the
+// required headers' values as found by checkRequiredHeaders.
+func (p *Proxy) newClientInfo(c *fiber.Ctx, headers []any) clientInfo {
+	info := clientInfo{
+		remoteAddr:   c.Context().RemoteAddr().String(),
+		localAddr:    c.Context().LocalAddr().String(),
+		userAgent:    c.Get(fiber.HeaderUserAgent),
+		subprotocols: c.Get("Sec-WebSocket-Protocol"),
+		extensions:   c.Get("Sec-WebSocket-Extensions"),
+		headers:      headers,
+	}
+	if state := c.Context().TLSConnectionState(); state != nil {
+		info.tlsVersion = tlsVersionName(state.Version)
+		info.tls = info.tlsVersion + "/" + tls.CipherSuiteName(state.CipherSuite)
+		if len(state.PeerCertificates) > 0 {
+			info.certSubject = state.PeerCertificates[0].Subject.String()
+			info.certIdentity = clientCertIdentity(c)
+		}
+	}
+	for _, name := range p.cfg.ClientInfoHeaders {
+		if v := c.Get(name); v != "" {
+			info.clientInfoHeaders = append(info.clientInfoHeaders, name+": "+v)
+		}
+	}
+	return info
+}
+
+// attrs returns the info as log attributes. compression and subprotocol
+// are what the upgrade actually negotiated.
+func (info clientInfo) attrs(subprotocol string, compression bool) []any {
+	attrs := []any{
+		slog.String("remote", info.remoteAddr),
+		slog.String("ua", info.userAgent),
+		slog.String("subprotocols", info.subprotocols),
+		slog.String("subprotocol", subprotocol),
+		slog.String("extensions", info.extensions),
+		slog.Bool("compression", compression),
+	}
+	if info.tls != "" {
+		attrs = append(attrs, slog.String("tls", info.tls))
+	}
+	if info.certSubject != "" {
+		attrs = append(attrs, slog.String("cert_subject", info.certSubject))
+	}
+	return append(attrs, info.headers...)
+}
+
+// offersDeflate reports whether a Sec-WebSocket-Extensions header offers
+// permessage-deflate, which the upgrader then accepts.
+func offersDeflate(extensions string) bool {
+	for _, ext := range strings.Split(extensions, ",") {
+		name, _, _ := strings.Cut(ext, ";")
+		if strings.TrimSpace(name) == "permessage-deflate" {
+			return true
+		}
+	}
+	return false
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// clientCertIdentity returns the verified client certificate's common name,
+// falling back to its first DNS or email SAN, or "" without a client cert.
+func clientCertIdentity(c *fiber.Ctx) string {
+	state := c.Context().TLSConnectionState()
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := state.PeerCertificates[0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// offersSubprotocol reports whether the client listed name in
+// Sec-WebSocket-Protocol.
+func offersSubprotocol(c *fiber.Ctx, name string) bool {
+	for _, proto := range strings.Split(c.Get("Sec-WebSocket-Protocol"), ",") {
+		if strings.TrimSpace(proto) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"strconv"
+	"time"
+)
+
+// Clock is the time source for the proxy's own bookkeeping, such as idle
+// and lifetime checks, rate limits and client IDs, so tests can substitute
+// a fake one. Socket deadlines always come from the real clock, which the
+// kernel measures them against.
+type Clock interface {
+	Now() time.Time
+}
+
+// IDGenerator hands out client IDs.
+type IDGenerator interface {
+	NewID() string
+}
+
+// timeIDGenerator derives client IDs from the current time in base 36.
+type timeIDGenerator struct {
+	clock Clock
+}
+
+func (g timeIDGenerator) NewID() string {
+	return strconv.FormatUint(uint64(g.clock.Now().UnixMicro()), 36)
+}
+
+// now returns the configured clock's time, defaulting to the real clock.
+func (p *Proxy) now() time.Time {
+	if p.cfg.Clock == nil {
+		return time.Now()
+	}
+	return p.cfg.Clock.Now()
+}
+
+// newClientID returns an ID from the configured generator, defaulting to
+// one derived from the configured clock.
+func (p *Proxy) newClientID() string {
+	if p.cfg.IDGenerator == nil {
+		return timeIDGenerator{clock: clockFunc(p.now)}.NewID()
+	}
+	return p.cfg.IDGenerator.NewID()
+}
+
+// clockFunc adapts a plain function to the Clock interface.
+type clockFunc func() time.Time
+
+func (f clockFunc) Now() time.Time { return f() }
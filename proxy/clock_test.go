@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	fastws "github.com/fasthttp/websocket"
+)
+
+// sequenceIDs hands out client IDs client-1, client-2 and so on.
+type sequenceIDs struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (g *sequenceIDs) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n++
+	return fmt.Sprintf("client-%d", g.n)
+}
+
+// TestReaperFakeClock drives idle and lifetime reaping by the injected
+// Clock alone: the reaper ticks in real time, but hours pass only when the
+// test advances the clock. Sessions are named by the injected IDGenerator.
+func TestReaperFakeClock(t *testing.T) {
+	const (
+		reaperInterval = 10 * time.Millisecond
+		// ticks is how many reaper runs a session must survive.
+		ticks = 10
+	)
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	h := startHarness(t, Config{
+		DataType:       DataTypeBinary,
+		IdleTimeout:    time.Hour,
+		MaxLifetime:    3 * time.Hour,
+		ReaperInterval: reaperInterval,
+		Clock:          clockFunc(clock.now),
+		IDGenerator:    &sequenceIDs{},
+	})
+	ping := [][]byte{[]byte("ping")}
+	readClose := func(conn *fastws.Conn, code int) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(testIOTimeout))
+		_, _, err := conn.ReadMessage()
+		if err := checkClose(err, code); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("idle timeout", func(t *testing.T) {
+		conn := h.dial(t)
+		defer conn.Close()
+		if err := exchange(conn, fastws.BinaryMessage, fastws.BinaryMessage, ping, 1, same); err != nil {
+			t.Fatal(err)
+		}
+		if id := h.session(t).id; id != "client-1" {
+			t.Errorf("session ID %q, want client-1 from the IDGenerator", id)
+		}
+		// Real time passing does not make the session idle.
+		time.Sleep(ticks * reaperInterval)
+		if err := exchange(conn, fastws.BinaryMessage, fastws.BinaryMessage, ping, 1, same); err != nil {
+			t.Fatalf("reaped before the clock moved: %v", err)
+		}
+		clock.advance(time.Hour + time.Minute)
+		readClose(conn, CloseIdleTimeout)
+		h.waitIdle(t)
+	})
+
+	t.Run("max lifetime", func(t *testing.T) {
+		conn := h.dial(t)
+		defer conn.Close()
+		if err := exchange(conn, fastws.BinaryMessage, fastws.BinaryMessage, ping, 1, same); err != nil {
+			t.Fatal(err)
+		}
+		if id := h.session(t).id; id != "client-2" {
+			t.Errorf("session ID %q, want client-2 from the IDGenerator", id)
+		}
+		// Traffic every half hour keeps the session from going idle, so
+		// only its lifetime ends it.
+		for lived := time.Duration(0); lived < 3*time.Hour; lived += 30 * time.Minute {
+			clock.advance(30 * time.Minute)
+			time.Sleep(ticks * reaperInterval)
+			if err := exchange(conn, fastws.BinaryMessage, fastws.BinaryMessage, ping, 1, same); err != nil {
+				t.Fatalf("reaped after %s of 3h: %v", lived+30*time.Minute, err)
+			}
+		}
+		clock.advance(time.Minute)
+		readClose(conn, CloseMaxLifetime)
+		h.waitIdle(t)
+	})
+}
@@ -0,0 +1,43 @@
+package proxy
+
+// Application close codes, from the private 4000-4999 range, telling
+// clients why the proxy ended a session. Upgrades refused before the
+// WebSocket is established, e.g. for a bad token or an unhealthy backend,
+// get an HTTP status instead.
+const (
+	// CloseBackendUnavailable: the backend could not be resolved, dialed or
+	// initialized. Retry with backoff.
+	CloseBackendUnavailable = 4000
+	// CloseBackendError: the backend connection failed mid-session. Retry
+	// with backoff.
+	CloseBackendError = 4001
+	// CloseQuotaExceeded: MaxBytesPerConn was reached. Retrying gets a
+	// fresh quota.
+	CloseQuotaExceeded = 4002
+	// CloseClientTooSlow: the client fell more than SendHighWater bytes
+	// behind. Retry, ideally after checking the client's network.
+	CloseClientTooSlow = 4003
+	// CloseIdleTimeout: nothing was forwarded for IdleTimeout. Reconnect
+	// when there is traffic again.
+	CloseIdleTimeout = 4004
+	// CloseMaxLifetime: the session reached MaxLifetime. Reconnect right
+	// away.
+	CloseMaxLifetime = 4005
+	// CloseShuttingDown: the proxy is shutting down. Reconnect, possibly to
+	// another instance.
+	CloseShuttingDown = 4006
+	// ClosePongTimeout: the client did not answer a ping within
+	// PongTimeout. It rarely arrives, as the connection is most likely
+	// dead; reconnect.
+	ClosePongTimeout = 4007
+	// CloseDisconnected: an operator disconnected the client through the
+	// admin API. Reconnecting is up to the client.
+	CloseDisconnected = 4008
+)
+
+// backendError marks an error of the backend connection, as opposed to
+// one of the client's.
+type backendError struct{ err error }
+
+func (e backendError) Error() string { return "backend: " + e.err.Error() }
+func (e backendError) Unwrap() error { return e.err }
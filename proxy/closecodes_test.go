@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fastws "github.com/fasthttp/websocket"
+)
+
+// TestCloseCodes checks each way the proxy ends a session tells the client
+// why, with the close code documented for it.
+func TestCloseCodes(t *testing.T) {
+	ping := []byte("ping")
+	tests := []struct {
+		name string
+		cfg  Config
+		// noEcho starts the proxy without the echo server, on cfg as it is.
+		noEcho bool
+		// act makes the proxy end the session, once it is forwarding
+		// unless noEcho is set.
+		act  func(t *testing.T, h *harness, conn *fastws.Conn)
+		code int
+	}{{
+		name: "backend unavailable",
+		cfg: Config{
+			DataType:     DataTypeBinary,
+			BackendProto: BackendProtoUnix,
+			Backends:     []string{filepath.Join(t.TempDir(), "missing.sock")},
+		},
+		noEcho: true,
+		code:   CloseBackendUnavailable,
+	}, {
+		name: "backend error",
+		cfg:  Config{DataType: DataTypeBinary},
+		act: func(t *testing.T, h *harness, conn *fastws.Conn) {
+			h.echo.Close()
+			if err := conn.WriteMessage(fastws.BinaryMessage, ping); err != nil {
+				t.Fatal(err)
+			}
+		},
+		code: CloseBackendError,
+	}, {
+		name: "quota exceeded",
+		cfg:  Config{DataType: DataTypeBinary, MaxBytesPerConn: 1000},
+		act: func(t *testing.T, h *harness, conn *fastws.Conn) {
+			for i := 0; i < 2; i++ {
+				if err := conn.WriteMessage(fastws.BinaryMessage, make([]byte, 600)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		},
+		code: CloseQuotaExceeded,
+	}, {
+		name: "idle timeout",
+		cfg:  Config{DataType: DataTypeBinary, IdleTimeout: 200 * time.Millisecond, ReaperInterval: 50 * time.Millisecond},
+		code: CloseIdleTimeout,
+	}, {
+		name: "max lifetime",
+		cfg:  Config{DataType: DataTypeBinary, MaxLifetime: 200 * time.Millisecond, ReaperInterval: 50 * time.Millisecond},
+		code: CloseMaxLifetime,
+	}, {
+		name: "shutting down",
+		cfg:  Config{DataType: DataTypeBinary},
+		act:  func(t *testing.T, h *harness, conn *fastws.Conn) { h.p.Close() },
+		code: CloseShuttingDown,
+	}, {
+		name: "pong timeout",
+		cfg:  Config{DataType: DataTypeBinary, PingInterval: 50 * time.Millisecond, PongTimeout: 100 * time.Millisecond},
+		act: func(t *testing.T, h *harness, conn *fastws.Conn) {
+			conn.SetPingHandler(func(string) error { return nil })
+		},
+		code: ClosePongTimeout,
+	}, {
+		name: "disconnected",
+		cfg:  Config{DataType: DataTypeBinary},
+		act: func(t *testing.T, h *harness, conn *fastws.Conn) {
+			if !h.p.Disconnect(h.session(t).id) {
+				t.Fatal("session not found")
+			}
+		},
+		code: CloseDisconnected,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h *harness
+			if tt.noEcho {
+				h = startProxy(t, tt.cfg)
+			} else {
+				h = startHarness(t, tt.cfg)
+			}
+			conn := h.dial(t)
+			defer conn.Close()
+			if !tt.noEcho {
+				if err := exchange(conn, fastws.BinaryMessage, fastws.BinaryMessage, [][]byte{ping}, 1, same); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.act != nil {
+				tt.act(t, h, conn)
+			}
+			// Reading also answers pings, as a live client would.
+			conn.SetReadDeadline(time.Now().Add(testIOTimeout))
+			var err error
+			for err == nil {
+				_, _, err = conn.ReadMessage()
+			}
+			if err := checkClose(err, tt.code); err != nil {
+				t.Fatal(err)
+			}
+			h.waitIdle(t)
+		})
+	}
+}
+
+// TestCloseCodeClientTooSlow has a client send without reading until the
+// echoes back up past SendHighWater. With the connection clogged the close
+// frame may never get through, so the test checks the code kill sent.
+func TestCloseCodeClientTooSlow(t *testing.T) {
+	h := startHarness(t, Config{DataType: DataTypeBinary, SendHighWater: 64 << 10})
+	conn := h.dial(t)
+	defer conn.Close()
+	sess := h.session(t)
+	msg := make([]byte, 1024)
+	// Writing stops once the proxy closes the connection, or at the
+	// deadline.
+	conn.SetWriteDeadline(time.Now().Add(testIOTimeout))
+	for conn.WriteMessage(fastws.BinaryMessage, msg) == nil {
+	}
+	if err := h.waitIdleWithin(settleTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if code := atomic.LoadInt32(&sess.killCode); code != CloseClientTooSlow {
+		t.Fatalf("killed with %d, want %d", code, CloseClientTooSlow)
+	}
+}
+
+// TestCloseCodesAuth checks a client failing authentication is refused
+// before the upgrade, so it gets a status rather than a close code.
+func TestCloseCodesAuth(t *testing.T) {
+	h := startHarness(t, Config{DataType: DataTypeBinary, JWTSecret: []byte("s3cret")})
+	conn, resp, err := fastws.DefaultDialer.Dial(h.url, nil)
+	if err == nil {
+		conn.Close()
+		t.Fatal("upgraded without a token")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("response %v, want status %d", resp, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// txCoalesceMaxDatagram caps coalesced datagrams at what fits an
+	// Ethernet MTU, so coalescing never causes IP fragmentation. A single
+	// larger message is still sent, alone.
+	txCoalesceMaxDatagram = 1472
+	// wsBatchMaxMessage caps batched client messages, which need not fit a
+	// packet but should not hold up the first datagram for long.
+	wsBatchMaxMessage = 16384
+)
+
+var (
+	errFrameTooLarge  = errors.New("message too large for a 2-byte length prefix")
+	errTruncatedFrame = errors.New("truncated frame")
+)
+
+// SplitFrames splits a datagram coalesced by TxCoalesceWindow, or a
+// message batched by WSBatchWindow, back into the messages it carries.
+// The messages alias datagram.
+func SplitFrames(datagram []byte) ([][]byte, error) {
+	var msgs [][]byte
+	for len(datagram) > 0 {
+		if len(datagram) < 2 {
+			return msgs, errTruncatedFrame
+		}
+		n := int(binary.BigEndian.Uint16(datagram))
+		if len(datagram) < 2+n {
+			return msgs, errTruncatedFrame
+		}
+		msgs = append(msgs, datagram[2:2+n])
+		datagram = datagram[2+n:]
+	}
+	return msgs, nil
+}
+
+// coalescer combines messages arriving within a window into one: client
+// messages into a backend datagram for TxCoalesceWindow, backend datagrams
+// into a client message for WSBatchWindow. Each message is framed as a
+// 2-byte big-endian length followed by the message itself.
+type coalescer struct {
+	window  time.Duration
+	limit   int
+	write   func(datagram []byte, frames int) (bool, error)
+	onError func(error)
+
+	mu     sync.Mutex
+	buf    []byte
+	frames int
+	timer  *time.Timer
+	err    error
+}
+
+func newCoalescer(
+	window time.Duration,
+	limit int,
+	write func(datagram []byte, frames int) (bool, error),
+	onError func(error),
+) *coalescer {
+	return &coalescer{window: window, limit: limit, write: write, onError: onError}
+}
+
+// add frames msg into the pending datagram. The window starts with the
+// first message of a datagram, so no message waits longer than window.
+func (c *coalescer) add(msg []byte) error {
+	if len(msg) > 0xffff {
+		return errFrameTooLarge
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if c.frames > 0 && len(c.buf)+2+len(msg) > c.limit {
+		if err := c.flushLocked(); err != nil {
+			return err
+		}
+	}
+	c.buf = binary.BigEndian.AppendUint16(c.buf, uint16(len(msg)))
+	c.buf = append(c.buf, msg...)
+	c.frames++
+	if len(c.buf) >= c.limit {
+		return c.flushLocked()
+	}
+	if c.frames == 1 {
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.window, c.flushOnTimer)
+		} else {
+			c.timer.Reset(c.window)
+		}
+	}
+	return nil
+}
+
+func (c *coalescer) flushOnTimer() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || c.frames == 0 {
+		return
+	}
+	if err := c.flushLocked(); err != nil {
+		c.onError(err)
+	}
+}
+
+// flushLocked writes the pending datagram. Write errors stick, so the
+// forwarding loop sees them even when they happened on the timer.
+func (c *coalescer) flushLocked() error {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	_, err := c.write(c.buf, c.frames)
+	c.buf = c.buf[:0]
+	c.frames = 0
+	if err != nil {
+		c.err = err
+	}
+	return err
+}
+
+// close sends whatever is still pending and stops the timer.
+func (c *coalescer) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil && c.frames > 0 {
+		c.flushLocked()
+	}
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplitFrames(t *testing.T) {
+	tests := []struct {
+		name     string
+		datagram []byte
+		want     []string
+		wantErr  error
+	}{
+		{"empty", nil, nil, nil},
+		{"one", []byte("\x00\x03abc"), []string{"abc"}, nil},
+		{"several", []byte("\x00\x01a\x00\x02bc\x00\x00\x00\x01d"), []string{"a", "bc", "", "d"}, nil},
+		{"cut in a length", []byte("\x00\x01a\x00"), []string{"a"}, errTruncatedFrame},
+		{"cut in a message", []byte("\x00\x01a\x00\x05bc"), []string{"a"}, errTruncatedFrame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, err := SplitFrames(tt.datagram)
+			if err != tt.wantErr {
+				t.Fatalf("error %v, want %v", err, tt.wantErr)
+			}
+			if got := fmt.Sprintf("%q", msgs); got != fmt.Sprintf("%q", tt.want) {
+				t.Errorf("messages %s, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// coalescerRecorder records what a coalescer writes, and fails the writes
+// once err is set.
+type coalescerRecorder struct {
+	mu        sync.Mutex
+	datagrams [][]byte
+	err       error
+	written   chan struct{}
+	errors    chan error
+}
+
+func newCoalescerRecorder() *coalescerRecorder {
+	return &coalescerRecorder{written: make(chan struct{}, 16), errors: make(chan error, 16)}
+}
+
+func (r *coalescerRecorder) write(datagram []byte, frames int) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer func() { r.written <- struct{}{} }()
+	if r.err != nil {
+		return false, r.err
+	}
+	msgs, err := SplitFrames(datagram)
+	if err != nil || len(msgs) != frames {
+		return false, fmt.Errorf("datagram of %d frames written as %d: %v", len(msgs), frames, err)
+	}
+	r.datagrams = append(r.datagrams, bytes.Clone(datagram))
+	return true, nil
+}
+
+func (r *coalescerRecorder) onError(err error) { r.errors <- err }
+
+// messages returns the messages of each datagram written, joined by
+// commas.
+func (r *coalescerRecorder) messages() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var got []string
+	for _, d := range r.datagrams {
+		msgs, _ := SplitFrames(d)
+		parts := make([]string, len(msgs))
+		for i, msg := range msgs {
+			parts[i] = string(msg)
+		}
+		got = append(got, strings.Join(parts, ","))
+	}
+	return got
+}
+
+// TestCoalescerLimit uses a window too long to end, so only the limit and
+// close flush.
+func TestCoalescerLimit(t *testing.T) {
+	big := strings.Repeat("x", 20)
+	tests := []struct {
+		name  string
+		limit int
+		msgs  []string
+		// want holds the messages of every datagram, as of the last add
+		// and after close.
+		want, wantClosed []string
+	}{
+		{"under the limit", 32, []string{"a", "b", "c"}, nil, []string{"a,b,c"}},
+		{"reaching the limit", 9, []string{"a", "b", "c"}, []string{"a,b,c"}, []string{"a,b,c"}},
+		{"over the limit", 8, []string{"a", "b", "c"}, []string{"a,b"}, []string{"a,b", "c"}},
+		{"larger than the limit alone", 8, []string{"a", big, "b"}, []string{"a", big}, []string{"a", big, "b"}},
+		{"empty messages", 8, []string{"", "", "", "", ""}, []string{",,,"}, []string{",,,", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newCoalescerRecorder()
+			c := newCoalescer(time.Hour, tt.limit, r.write, r.onError)
+			for _, msg := range tt.msgs {
+				if err := c.add([]byte(msg)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := r.messages(); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("written %q, want %q", got, tt.want)
+			}
+			c.close()
+			if got := r.messages(); fmt.Sprint(got) != fmt.Sprint(tt.wantClosed) {
+				t.Errorf("after close, written %q, want %q", got, tt.wantClosed)
+			}
+		})
+	}
+}
+
+func TestCoalescerWindow(t *testing.T) {
+	const window = 20 * time.Millisecond
+	r := newCoalescerRecorder()
+	c := newCoalescer(window, 1472, r.write, r.onError)
+	defer c.close()
+	for round := 0; round < 2; round++ {
+		start := time.Now()
+		c.add([]byte("a"))
+		c.add([]byte("b"))
+		select {
+		case <-r.written:
+		case <-time.After(testIOTimeout):
+			t.Fatalf("round %d: window never flushed", round)
+		}
+		if waited := time.Since(start); waited < window {
+			t.Errorf("round %d: flushed after %s, before the %s window", round, waited, window)
+		}
+	}
+	if got := r.messages(); fmt.Sprint(got) != "[a,b a,b]" {
+		t.Errorf("written %q, want two datagrams of a,b", got)
+	}
+}
+
+func TestCoalescerErrors(t *testing.T) {
+	t.Run("too large", func(t *testing.T) {
+		r := newCoalescerRecorder()
+		c := newCoalescer(time.Hour, 1472, r.write, r.onError)
+		defer c.close()
+		if err := c.add(make([]byte, 0x10000)); err != errFrameTooLarge {
+			t.Errorf("error %v, want %v", err, errFrameTooLarge)
+		}
+	})
+	t.Run("write error sticks", func(t *testing.T) {
+		r := newCoalescerRecorder()
+		r.err = errors.New("backend gone")
+		c := newCoalescer(time.Hour, 4, r.write, r.onError)
+		defer c.close()
+		if err := c.add([]byte("abcd")); err != r.err {
+			t.Fatalf("error %v, want %v", err, r.err)
+		}
+		if err := c.add([]byte("a")); err != r.err {
+			t.Errorf("error %v after a failed write, want %v", err, r.err)
+		}
+	})
+	t.Run("write error on the timer", func(t *testing.T) {
+		r := newCoalescerRecorder()
+		r.err = errors.New("backend gone")
+		c := newCoalescer(time.Millisecond, 1472, r.write, r.onError)
+		defer c.close()
+		if err := c.add([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-r.errors:
+			if err != r.err {
+				t.Fatalf("onError got %v, want %v", err, r.err)
+			}
+		case <-time.After(testIOTimeout):
+			t.Fatal("window never flushed")
+		}
+		if err := c.add([]byte("b")); err != r.err {
+			t.Errorf("error %v after a failed write, want %v", err, r.err)
+		}
+	})
+}
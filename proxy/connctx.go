@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// localKeyConn is the Locals key the middleware hands a connection's
+// connCtx to the handler under.
+const localKeyConn = "localKeyConn"
+
+// connCtx is everything the middleware decided about a connection. It
+// travels as one pointer so the handler does a single checked type
+// assertion instead of one per value. It must not implement io.Closer, see
+// wsHandler.
+type connCtx struct {
+	backend string
+	// limitKey is what the connection counts under in the limits.
+	limitKey string
+	// route is the WebSocket path the client upgraded on.
+	route       string
+	affinityKey string
+	// region is the client's GeoIP region, "" if unknown or not looked up.
+	region   string
+	clientIP string
+	dataType string
+	// dataClaimed is set when dataType is a token's data claim.
+	dataClaimed bool
+	// udpBufSize and idleTimeout are the session's own, see
+	// sessionSettings.
+	udpBufSize  int
+	idleTimeout time.Duration
+	// control is set for clients of the control protocol, and
+	// backendFixed when they may not pick a target. noBatch is set by
+	// their options.
+	control      bool
+	backendFixed bool
+	noBatch      bool
+	identity     string
+	info         clientInfo
+	slot         *connSlot
+	// resumed is the parked backend socket a resume token claimed.
+	resumed *parkedConn
+	// handshakeDone frees the pending handshake slot.
+	handshakeDone func()
+}
+
+// connCtxOf returns the connCtx stored by the middleware, or nil if the
+// handler was mounted without it.
+func connCtxOf(c *websocket.Conn) *connCtx {
+	cc, _ := c.Locals(localKeyConn).(*connCtx)
+	return cc
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// corsMaxAge is how long browsers may cache a preflight result.
+const corsMaxAge = 10 * 60
+
+// corsAllowOrigin returns the Access-Control-Allow-Origin value for origin,
+// or "" when it is not one of Config.CORSOrigins. A "*" entry allows any
+// origin without credentials; listed origins are echoed so credentials
+// work.
+func (p *Proxy) corsAllowOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	wildcard := false
+	for _, o := range p.cfg.CORSOrigins {
+		if o == origin {
+			return origin
+		}
+		wildcard = wildcard || o == "*"
+	}
+	if wildcard {
+		return "*"
+	}
+	return ""
+}
+
+// setCORSHeaders adds the CORS headers for the request's origin to the
+// response and reports whether the origin is allowed.
+func (p *Proxy) setCORSHeaders(c *fiber.Ctx) bool {
+	c.Vary(fiber.HeaderOrigin)
+	allow := p.corsAllowOrigin(c.Get(fiber.HeaderOrigin))
+	if allow == "" {
+		return false
+	}
+	c.Set(fiber.HeaderAccessControlAllowOrigin, allow)
+	if allow != "*" {
+		c.Set(fiber.HeaderAccessControlAllowCredentials, "true")
+	}
+	return true
+}
+
+// corsPreflight answers OPTIONS requests from an origin to the WebSocket
+// path.
+func (p *Proxy) corsPreflight(c *fiber.Ctx) error {
+	if !p.setCORSHeaders(c) {
+		return fiber.NewError(fiber.StatusForbidden, "origin not allowed")
+	}
+	c.Set(fiber.HeaderAccessControlAllowMethods, allowedMethods)
+	if headers := c.Get(fiber.HeaderAccessControlRequestHeaders); headers != "" {
+		c.Set(fiber.HeaderAccessControlAllowHeaders, headers)
+	}
+	c.Set(fiber.HeaderAccessControlMaxAge, strconv.Itoa(corsMaxAge))
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+)
+
+// Data types that encode datagrams into text messages, for clients that
+// cannot handle binary messages or want room for metadata.
+const (
+	// DataTypeBase64 carries each datagram base64 encoded in a text
+	// message.
+	DataTypeBase64 = "base64"
+	// DataTypeJSON carries each datagram as {"data":"<base64>"} in a text
+	// message.
+	DataTypeJSON = "json"
+
+	// dataTypeTextBase64 is websockify's name for DataTypeBase64, accepted
+	// as a spelling of it.
+	dataTypeTextBase64 = "text-base64"
+)
+
+// dataSubprotocolPrefix names the subprotocols clients select a data type
+// with when Config.DataSubprotocols is set, e.g. udpproxy.base64.
+const dataSubprotocolPrefix = "udpproxy."
+
+var errBadEncoding = errors.New("message does not match the data type encoding")
+
+var dataTypes = []string{DataTypeText, DataTypeBinary, DataTypeBase64, DataTypeJSON}
+
+// canonicalDataType maps the alternative spellings of data types to the
+// constants.
+func canonicalDataType(dataType string) string {
+	if dataType == dataTypeTextBase64 {
+		return DataTypeBase64
+	}
+	return dataType
+}
+
+func isDataType(dataType string) bool {
+	for _, t := range dataTypes {
+		if t == dataType {
+			return true
+		}
+	}
+	return false
+}
+
+// dataSubprotocols lists the subprotocols for every data type, for the
+// upgrader to select from.
+func dataSubprotocols() []string {
+	protos := make([]string, len(dataTypes))
+	for i, t := range dataTypes {
+		protos[i] = dataSubprotocolPrefix + t
+	}
+	return protos
+}
+
+// offeredDataType returns the data type of the first data subprotocol the
+// client offers, the one the upgrader will select, or "" if it offers none.
+// Offering an unknown one is an error rather than silently falling back.
+func offeredDataType(c *fiber.Ctx) (string, error) {
+	for _, proto := range strings.Split(c.Get("Sec-WebSocket-Protocol"), ",") {
+		dataType, ok := strings.CutPrefix(strings.TrimSpace(proto), dataSubprotocolPrefix)
+		if !ok {
+			continue
+		}
+		if !isDataType(dataType) {
+			return "", fiber.NewError(fiber.StatusBadRequest,
+				"unsupported subprotocol "+strings.TrimSpace(proto))
+		}
+		return dataType, nil
+	}
+	return "", nil
+}
+
+// dataEnvelope is the DataTypeJSON message. Payload marshals as base64.
+type dataEnvelope struct {
+	Data []byte `json:"data"`
+}
+
+// encodeMessage turns a backend datagram into a WebSocket message of
+// dataType.
+func encodeMessage(dataType string, payload []byte) (int, []byte) {
+	switch dataType {
+	case DataTypeBinary:
+		return websocket.BinaryMessage, payload
+	case DataTypeBase64:
+		msg := make([]byte, base64.StdEncoding.EncodedLen(len(payload)))
+		base64.StdEncoding.Encode(msg, payload)
+		return websocket.TextMessage, msg
+	case DataTypeJSON:
+		msg, _ := json.Marshal(dataEnvelope{Data: payload})
+		return websocket.TextMessage, msg
+	}
+	return websocket.TextMessage, payload
+}
+
+// decodeMessage turns a client message back into a datagram. Text and
+// binary messages pass through as they are; the encoded types must arrive
+// as text messages.
+func decodeMessage(dataType string, msgType int, msg []byte) ([]byte, error) {
+	switch dataType {
+	case DataTypeBase64:
+		if msgType != websocket.TextMessage {
+			return nil, errWrongDataType
+		}
+		payload := make([]byte, base64.StdEncoding.DecodedLen(len(msg)))
+		n, err := base64.StdEncoding.Decode(payload, msg)
+		if err != nil {
+			return nil, errBadEncoding
+		}
+		return payload[:n], nil
+	case DataTypeJSON:
+		if msgType != websocket.TextMessage {
+			return nil, errWrongDataType
+		}
+		var env dataEnvelope
+		if err := json.Unmarshal(msg, &env); err != nil {
+			return nil, errBadEncoding
+		}
+		return env.Data, nil
+	}
+	return msg, nil
+}
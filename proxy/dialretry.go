@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// defaultDialBackoff is the wait before the first connect retry; it doubles
+// with every further one.
+const defaultDialBackoff = 100 * time.Millisecond
+
+// isTransientDialError reports whether resolving or dialing a backend may
+// work when tried again shortly, e.g. a DNS server timing out or the
+// network being briefly unreachable, as opposed to a name that does not
+// exist.
+func isTransientDialError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return isReconnectable(err)
+}
+
+// connectBackend resolves and dials addr for a client, retrying transient
+// failures up to Config.DialRetries times with a doubling backoff from
+// Config.DialBackoff. It gives up early once the proxy is closed. On error,
+// step names what failed last, resolve or dial.
+func (p *Proxy) connectBackend(clientID, addr string) (conn backendConn, step string, err error) {
+	backoff := p.cfg.DialBackoff
+	for attempt := 0; ; attempt++ {
+		if conn, step, err = p.dialBackendName(addr); err == nil {
+			return conn, "", nil
+		}
+		if attempt >= p.cfg.DialRetries || !isTransientDialError(err) {
+			return nil, step, err
+		}
+		slog.Warn(step+" backend error, retrying", "client", clientID, "backend", addr,
+			"error", err, "backoff", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-p.done:
+			return nil, step, err
+		}
+		backoff *= 2
+	}
+}
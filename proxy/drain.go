@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// drainReportInterval is how often Shutdown logs the connections left.
+	drainReportInterval = time.Second
+	// drainCloseTimeout bounds the wait for the connections Shutdown
+	// closed to finish forwarding and log their end, checked every
+	// drainClosePoll.
+	drainCloseTimeout = 2 * time.Second
+	drainClosePoll    = 10 * time.Millisecond
+)
+
+// Shutdown drains the proxy: new upgrades get 503 while the live
+// connections are left to end on their own, with a count of the remaining
+// ones logged every second. Once they are all gone, or ctx is done and the
+// stragglers are closed with CloseShuttingDown and given a moment to finish
+// forwarding, the background work is stopped as by Close, and so is the
+// server ListenAndServe started. It returns ctx's error if the connections
+// had to be closed.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&p.draining, 0, 1) {
+		metricDraining.add(1)
+	}
+	ticker := time.NewTicker(drainReportInterval)
+	defer ticker.Stop()
+	for {
+		n := p.sessions.count()
+		if n == 0 {
+			slog.Info("draining: all connections closed")
+			err := p.Close()
+			p.stopServer()
+			return err
+		}
+		slog.Info("draining", "remaining", n)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			slog.Info("draining: closing the remaining connections", "remaining", p.sessions.count())
+			p.Close()
+			p.waitHandlers(drainCloseTimeout)
+			p.stopServer()
+			return ctx.Err()
+		}
+	}
+}
+
+// waitHandlers waits up to timeout for the WebSocket handlers to return.
+func (p *Proxy) waitHandlers(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&p.handlers) > 0 {
+		if time.Now().After(deadline) {
+			slog.Warn("draining: connections did not close in time", "remaining", atomic.LoadInt32(&p.handlers))
+			return
+		}
+		time.Sleep(drainClosePoll)
+	}
+}
+
+// LameDuck fails the readiness probe and HEAD on the WebSocket path with
+// 503 while still accepting connections, so load balancers stop routing to
+// the proxy before Shutdown starts refusing upgrades.
+func (p *Proxy) LameDuck() {
+	atomic.StoreInt32(&p.lameDuck, 1)
+}
+
+// errDraining refuses upgrades once Shutdown was called.
+var errDraining = fiber.NewError(fiber.StatusServiceUnavailable, "shutting down")
+
+func (p *Proxy) isDraining() bool {
+	return atomic.LoadInt32(&p.draining) == 1
+}
+
+// isReady reports whether the proxy wants new connections.
+func (p *Proxy) isReady() bool {
+	return atomic.LoadInt32(&p.lameDuck) == 0 && !p.isDraining() && p.backendsReachable()
+}
+
+// backendsReachable reports whether any backend can take clients, as far
+// as the health probes and circuit breakers know. Without either, or
+// without fixed backends, there is nothing to go by and it reports true.
+func (p *Proxy) backendsReachable() bool {
+	var addrs []string
+	if p.health != nil {
+		for addr := range p.health.state {
+			addrs = append(addrs, addr)
+		}
+	} else {
+		for addr := range p.breakers {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return true
+	}
+	for _, addr := range addrs {
+		if p.health != nil && !p.health.healthy(addr) {
+			continue
+		}
+		if b := p.breakers[addr]; b != nil && b.isOpen() {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// liveHandler serves Config.LivePath. It answers as long as the HTTP server
+// does, draining or not.
+func liveHandler(c *fiber.Ctx) error {
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// readyHandler serves Config.ReadyPath.
+func (p *Proxy) readyHandler(c *fiber.Ctx) error {
+	if !p.isReady() {
+		return c.SendStatus(fiber.StatusServiceUnavailable)
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ParseDSCP accepts a numeric code point (0-63) or a well-known class name
+// such as EF, CS5 or AF41.
+func ParseDSCP(s string) (int, error) {
+	name := strings.ToUpper(s)
+	switch {
+	case name == "EF":
+		return 46, nil
+	case len(name) == 3 && strings.HasPrefix(name, "CS") &&
+		name[2] >= '0' && name[2] <= '7':
+		return int(name[2]-'0') << 3, nil
+	case len(name) == 4 && strings.HasPrefix(name, "AF") &&
+		name[2] >= '1' && name[2] <= '4' && name[3] >= '1' && name[3] <= '3':
+		return int(name[2]-'0')<<3 | int(name[3]-'0')<<1, nil
+	}
+
+	dscp, err := strconv.Atoi(s)
+	if err != nil || dscp < 0 || dscp > 63 {
+		return 0, errors.New("dscp must be 0-63 or a class name like EF or AF41")
+	}
+	return dscp, nil
+}
+
+// setDSCP marks packets sent on conn with the given DSCP code point, using
+// the IPv4 TOS byte or the IPv6 traffic class depending on the backend.
+func setDSCP(conn net.Conn, dscp int) error {
+	tos := dscp << 2
+	if remoteIP(conn).To4() != nil {
+		return ipv4.NewConn(conn).SetTOS(tos)
+	}
+	return ipv6.NewConn(conn).SetTrafficClass(tos)
+}
+
+// setTTL sets the IPv4 TTL or the IPv6 hop limit of packets sent on conn,
+// the multicast ones for a multicast group.
+func setTTL(conn net.Conn, ttl int) error {
+	ip := remoteIP(conn)
+	if pc, ok := conn.(net.PacketConn); ok && ip.IsMulticast() {
+		if ip.To4() != nil {
+			return ipv4.NewPacketConn(pc).SetMulticastTTL(ttl)
+		}
+		return ipv6.NewPacketConn(pc).SetMulticastHopLimit(ttl)
+	}
+	if ip.To4() != nil {
+		return ipv4.NewConn(conn).SetTTL(ttl)
+	}
+	return ipv6.NewConn(conn).SetHopLimit(ttl)
+}
+
+// remoteIP is the backend's IP, nil for a socket not connected to one.
+func remoteIP(conn net.Conn) net.IP {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pion/dtls/v2"
+)
+
+const defaultDTLSHandshakeTimeout = 5 * time.Second
+
+// dtlsClient runs the DTLS handshake with the backend on udpConn, which it
+// closes if that fails. Without a ServerName or a PSK, certificates are
+// checked against the backend's IP address.
+func (p *Proxy) dtlsClient(udpConn *net.UDPConn) (backendConn, error) {
+	cfg := p.cfg.BackendDTLS
+	if cfg.ServerName == "" && cfg.PSK == nil {
+		clone := *cfg
+		clone.ServerName = udpConn.RemoteAddr().(*net.UDPAddr).IP.String()
+		cfg = &clone
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDTLSHandshakeTimeout)
+	defer cancel()
+	conn, err := dtls.ClientWithContext(ctx, udpConn, cfg)
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("dtls handshake %s: %w", udpConn.RemoteAddr(), err)
+	}
+	return dtlsConn{conn}, nil
+}
+
+// dtlsConn reports deadlines as os.ErrDeadlineExceeded, as the forwarding
+// loops expect, rather than as DTLS's own timeout error.
+type dtlsConn struct {
+	*dtls.Conn
+}
+
+func (c dtlsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return n, os.ErrDeadlineExceeded
+	}
+	return n, err
+}
@@ -0,0 +1,405 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	fastws "github.com/fasthttp/websocket"
+)
+
+// randomDatagrams returns n datagrams of random bytes, of random lengths
+// from 1 to maxLen.
+func randomDatagrams(rng *rand.Rand, n, maxLen int) [][]byte {
+	msgs := make([][]byte, n)
+	for i := range msgs {
+		msgs[i] = randomBytes(rng, 1+rng.Intn(maxLen))
+	}
+	return msgs
+}
+
+func randomBytes(rng *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	rng.Read(b)
+	return b
+}
+
+func TestEndToEnd(t *testing.T) {
+	letters := func(rng *rand.Rand, n, maxLen int) [][]byte {
+		const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789 "
+		msgs := make([][]byte, n)
+		for i := range msgs {
+			msgs[i] = make([]byte, 1+rng.Intn(maxLen))
+			for j := range msgs[i] {
+				msgs[i][j] = alphabet[rng.Intn(len(alphabet))]
+			}
+		}
+		return msgs
+	}
+	encoded := func(rng *rand.Rand, n, maxLen int) [][]byte {
+		msgs := randomDatagrams(rng, n, maxLen)
+		for i, msg := range msgs {
+			msgs[i] = []byte(base64.StdEncoding.EncodeToString(msg))
+		}
+		return msgs
+	}
+	tests := []struct {
+		name    string
+		cfg     Config
+		msgType int
+		msgs    [][]byte
+		window  int
+		want    func([]byte) []byte
+	}{{
+		name:    "integrity",
+		cfg:     Config{DataType: DataTypeBinary},
+		msgType: fastws.BinaryMessage,
+		msgs:    randomDatagrams(rand.New(rand.NewSource(1)), 1000, 1472),
+		window:  16,
+	}, {
+		name:    "text",
+		cfg:     Config{DataType: DataTypeText},
+		msgType: fastws.TextMessage,
+		msgs:    letters(rand.New(rand.NewSource(2)), 200, 512),
+		window:  16,
+	}, {
+		// The echo server gets the datagrams decoded.
+		name:    "base64",
+		cfg:     Config{DataType: DataTypeBase64},
+		msgType: fastws.TextMessage,
+		msgs:    encoded(rand.New(rand.NewSource(3)), 200, 1024),
+		window:  16,
+	}, {
+		name:    "largest IPv4 datagram",
+		cfg:     Config{DataType: DataTypeBinary},
+		msgType: fastws.BinaryMessage,
+		msgs:    [][]byte{randomBytes(rand.New(rand.NewSource(4)), maxDatagram)},
+		window:  1,
+	}, {
+		name:    "cut to UDPBufferSize",
+		cfg:     Config{DataType: DataTypeBinary, UDPBufferSize: 1024},
+		msgType: fastws.BinaryMessage,
+		msgs:    [][]byte{randomBytes(rand.New(rand.NewSource(5)), 4096)},
+		window:  1,
+		want:    func(msg []byte) []byte { return msg[:1024] },
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := startHarness(t, tt.cfg)
+			conn := h.dial(t)
+			want := tt.want
+			if want == nil {
+				want = same
+			}
+			err := exchange(conn, tt.msgType, tt.msgType, tt.msgs, tt.window, want)
+			closeNormally(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.waitIdle(t)
+		})
+	}
+}
+
+func TestEndToEndWrongMessageType(t *testing.T) {
+	h := startHarness(t, Config{DataType: DataTypeText, DataFromClient: DataTypeText})
+	conn := h.dial(t)
+	defer conn.Close()
+	if err := conn.WriteMessage(fastws.BinaryMessage, []byte("binary")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(testIOTimeout))
+	_, _, err := conn.ReadMessage()
+	if err := checkClose(err, fastws.CloseUnsupportedData); err != nil {
+		t.Fatal(err)
+	}
+	h.waitIdle(t)
+}
+
+// TestEndToEndConcurrent tags every datagram with its client, so one
+// getting another's back fails.
+func TestEndToEndConcurrent(t *testing.T) {
+	const sessions = 32
+	h := startHarness(t, Config{DataType: DataTypeBinary})
+	errs := make(chan error, sessions)
+	var wg sync.WaitGroup
+	for i := 0; i < sessions; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, _, err := fastws.DefaultDialer.Dial(h.url, nil)
+			if err != nil {
+				errs <- fmt.Errorf("session %d: %w", i, err)
+				return
+			}
+			defer closeNormally(conn)
+			msgs := randomDatagrams(rand.New(rand.NewSource(int64(i))), 200, 1024)
+			for _, msg := range msgs {
+				msg[0] = byte(i)
+			}
+			if err := exchange(conn, fastws.BinaryMessage, fastws.BinaryMessage, msgs, 2, same); err != nil {
+				errs <- fmt.Errorf("session %d: %w", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	h.waitIdle(t)
+}
+
+// TestEndToEndTeardown checks clients closing free their sessions, and
+// closing the proxy closes the rest with CloseShuttingDown.
+func TestEndToEndTeardown(t *testing.T) {
+	h := startHarness(t, Config{DataType: DataTypeBinary})
+	ping := [][]byte{[]byte("ping")}
+	var conns []*fastws.Conn
+	for i := 0; i < 8; i++ {
+		conn := h.dial(t)
+		defer conn.Close()
+		conns = append(conns, conn)
+		// The echo proves the session is forwarding.
+		if err := exchange(conn, fastws.BinaryMessage, fastws.BinaryMessage, ping, 1, same); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, conn := range conns[:4] {
+		closeNormally(conn)
+	}
+	deadline := time.Now().Add(settleTimeout)
+	for h.p.Stats().ActiveConnections != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections open after closing 4 of 8", h.p.Stats().ActiveConnections)
+		}
+		time.Sleep(settlePoll)
+	}
+	h.p.Close()
+	for _, conn := range conns[4:] {
+		conn.SetReadDeadline(time.Now().Add(testIOTimeout))
+		_, _, err := conn.ReadMessage()
+		if err := checkClose(err, CloseShuttingDown); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.waitIdle(t)
+}
+
+// benchVariants are the forwarding paths the end-to-end benchmarks run
+// over. Clients of the framed ones send WSBatchWindow frames.
+var benchVariants = []struct {
+	name   string
+	cfg    Config
+	framed bool
+}{
+	{name: "binary", cfg: Config{DataType: DataTypeBinary}},
+	{name: "text", cfg: Config{DataType: DataTypeText}},
+	{name: "batch-reads", cfg: Config{DataType: DataTypeBinary, BatchReads: 32}},
+	{name: "ws-batch", cfg: Config{DataType: DataTypeBinary, WSBatchWindow: time.Millisecond}, framed: true},
+}
+
+// benchSize is the datagram size of the end-to-end benchmarks.
+const benchSize = 512
+
+// benchWindow is the datagrams BenchmarkThroughput keeps awaiting their
+// echo.
+const benchWindow = 64
+
+// benchMessage returns the message a client of the variant sends,
+// carrying a benchSize datagram, and its type.
+func benchMessage(cfg Config, framed bool) ([]byte, int) {
+	payload := make([]byte, benchSize)
+	for i := range payload {
+		payload[i] = 'a' + byte(i%26)
+	}
+	switch {
+	case cfg.DataType == DataTypeText:
+		return payload, fastws.TextMessage
+	case framed:
+		return append(binary.BigEndian.AppendUint16(nil, benchSize), payload...), fastws.BinaryMessage
+	}
+	return payload, fastws.BinaryMessage
+}
+
+// readDatagrams reads one message and returns the datagrams it carries.
+func readDatagrams(conn *fastws.Conn, framed bool) (int, error) {
+	conn.SetReadDeadline(time.Now().Add(testIOTimeout))
+	_, msg, err := conn.ReadMessage()
+	if err != nil || !framed {
+		return 1, err
+	}
+	frames, err := SplitFrames(msg)
+	return len(frames), err
+}
+
+// BenchmarkLatency measures the round trip of one datagram at a time, and
+// reports its median and 99th percentile.
+func BenchmarkLatency(b *testing.B) {
+	for _, v := range benchVariants {
+		b.Run(v.name, func(b *testing.B) {
+			h := startHarness(b, v.cfg)
+			conn := h.dial(b)
+			defer closeNormally(conn)
+			msg, msgType := benchMessage(v.cfg, v.framed)
+			rtts := make([]time.Duration, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				if err := conn.WriteMessage(msgType, msg); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := readDatagrams(conn, v.framed); err != nil {
+					b.Fatal(err)
+				}
+				rtts[i] = time.Since(start)
+			}
+			b.StopTimer()
+			sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+			b.ReportMetric(float64(rtts[len(rtts)/2].Nanoseconds()), "p50-ns")
+			b.ReportMetric(float64(rtts[len(rtts)*99/100].Nanoseconds()), "p99-ns")
+		})
+	}
+}
+
+// BenchmarkThroughput keeps benchWindow datagrams in flight, and reports
+// the datagrams echoed per second.
+func BenchmarkThroughput(b *testing.B) {
+	for _, v := range benchVariants {
+		b.Run(v.name, func(b *testing.B) {
+			h := startHarness(b, v.cfg)
+			conn := h.dial(b)
+			defer closeNormally(conn)
+			msg, msgType := benchMessage(v.cfg, v.framed)
+			inFlight := make(chan struct{}, benchWindow)
+			done := make(chan struct{})
+			defer close(done)
+			sendErr := make(chan error, 1)
+			b.SetBytes(benchSize)
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					select {
+					case inFlight <- struct{}{}:
+					case <-done:
+						return
+					}
+					if err := conn.WriteMessage(msgType, msg); err != nil {
+						sendErr <- err
+						return
+					}
+				}
+				sendErr <- nil
+			}()
+			for received := 0; received < b.N; {
+				n, err := readDatagrams(conn, v.framed)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for i := 0; i < n; i++ {
+					<-inFlight
+				}
+				received += n
+			}
+			b.StopTimer()
+			if err := <-sendErr; err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "datagrams/s")
+		})
+	}
+}
+
+// setupPoolSize is the WarmPool of BenchmarkConnectSetup's pooled runs.
+const setupPoolSize = 16
+
+// BenchmarkConnectSetup times a client's upgrade up to its first echo,
+// with and without a warm pool, against a backend given as an IP address
+// and as a name to resolve. Each connection is closed, and the pool let
+// refill, off the clock.
+func BenchmarkConnectSetup(b *testing.B) {
+	for _, backend := range []string{"ip", "name"} {
+		for _, pool := range []int{0, setupPoolSize} {
+			b.Run(fmt.Sprintf("%s/warm-pool-%d", backend, pool), func(b *testing.B) {
+				addr := setupBackend(b, backend)
+				h := startProxy(b, Config{DataType: DataTypeBinary, Backends: []string{addr}, WarmPool: pool})
+				ping := [][]byte{[]byte("ping")}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					if pool > 0 {
+						waitPoolFull(b, h.p.pools[addr])
+					}
+					b.StartTimer()
+					conn := h.dial(b)
+					if err := exchange(conn, fastws.BinaryMessage, fastws.BinaryMessage, ping, 1, same); err != nil {
+						b.Fatal(err)
+					}
+					b.StopTimer()
+					closeNormally(conn)
+					b.StartTimer()
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkBackendSetup times the part of connection setup a warm pool
+// saves: getting the client's backend socket, with and without the pool.
+func BenchmarkBackendSetup(b *testing.B) {
+	for _, backend := range []string{"ip", "name"} {
+		for _, pool := range []int{0, setupPoolSize} {
+			b.Run(fmt.Sprintf("%s/warm-pool-%d", backend, pool), func(b *testing.B) {
+				addr := setupBackend(b, backend)
+				p, err := New(Config{DataType: DataTypeBinary, Backends: []string{addr}, WarmPool: pool})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer p.Close()
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var conn backendConn
+					if pool > 0 {
+						b.StopTimer()
+						waitPoolFull(b, p.pools[addr])
+						b.StartTimer()
+						conn = p.pools[addr].get()
+					} else if conn, _, err = p.connectBackend("bench", addr); err != nil {
+						b.Fatal(err)
+					}
+					b.StopTimer()
+					conn.Close()
+					b.StartTimer()
+				}
+			})
+		}
+	}
+}
+
+// setupBackend starts an echo server for the setup benchmarks, and returns
+// its address as an IP address or, for backend "name", as localhost.
+func setupBackend(b *testing.B, backend string) string {
+	echo := startEcho(b)
+	if backend == "name" {
+		return fmt.Sprintf("localhost:%d", echo.LocalAddr().(*net.UDPAddr).Port)
+	}
+	return echo.LocalAddr().String()
+}
+
+// waitPoolFull waits for pool to have refilled.
+func waitPoolFull(b *testing.B, pool *warmPool) {
+	deadline := time.Now().Add(settleTimeout)
+	for len(pool.conns) < cap(pool.conns) {
+		if time.Now().After(deadline) {
+			b.Fatalf("warm pool at %d of %d", len(pool.conns), cap(pool.conns))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Direction is the way a datagram passed to a Filter is going.
+type Direction int
+
+// Directions for Filter.
+const (
+	ToBackend Direction = iota + 1
+	ToClient
+)
+
+func (d Direction) String() string {
+	if d == ToBackend {
+		return "to-backend"
+	}
+	return "to-client"
+}
+
+// SessionInfo describes the session a Filter is made for.
+type SessionInfo struct {
+	ClientID string
+	ClientIP string
+	Route    string
+	Backend  string
+}
+
+// Filter sees every datagram a session forwards, once the rate limits,
+// and for client datagrams the size limits, let it through. It returns
+// the datagram to forward instead, which may be payload itself, changed
+// in place, or nil to drop it; a non-nil empty slice is forwarded as an
+// empty datagram. An error closes the session with
+// websocket.ClosePolicyViolation. The two directions call Filter from
+// different goroutines.
+type Filter interface {
+	Filter(dir Direction, payload []byte) ([]byte, error)
+}
+
+// FilterFunc adapts a plain function to the Filter interface.
+type FilterFunc func(dir Direction, payload []byte) ([]byte, error)
+
+func (f FilterFunc) Filter(dir Direction, payload []byte) ([]byte, error) {
+	return f(dir, payload)
+}
+
+// NewFilter makes the Filter for one session, so a filter may keep state
+// per session, such as a sequence number to inject.
+type NewFilter func(info SessionInfo) Filter
+
+// filterError is a Filter's error, which closes the session.
+type filterError struct {
+	err error
+}
+
+func (e filterError) Error() string { return "filter: " + e.err.Error() }
+func (e filterError) Unwrap() error { return e.err }
+
+var (
+	filtersMu sync.Mutex
+	filters   = make(map[string]NewFilter)
+)
+
+// RegisterFilter makes newFilter available under name, for LookupFilter
+// and udpwsproxy's -filter flag. It panics if name is taken, like
+// registering a database/sql driver twice.
+func RegisterFilter(name string, newFilter NewFilter) {
+	filtersMu.Lock()
+	defer filtersMu.Unlock()
+	if _, dup := filters[name]; dup {
+		panic("proxy: filter " + name + " registered twice")
+	}
+	filters[name] = newFilter
+}
+
+// LookupFilter returns the filter registered under name.
+func LookupFilter(name string) (NewFilter, error) {
+	filtersMu.Lock()
+	defer filtersMu.Unlock()
+	newFilter, ok := filters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown filter %q", name)
+	}
+	return newFilter, nil
+}
+
+// FilterNames lists the registered filters.
+func FilterNames() []string {
+	filtersMu.Lock()
+	defer filtersMu.Unlock()
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// filterChain runs a session's filters in the order of Config.Filters. A
+// nil chain forwards everything.
+type filterChain []Filter
+
+func (p *Proxy) newFilterChain(info SessionInfo) filterChain {
+	if len(p.cfg.Filters) == 0 {
+		return nil
+	}
+	chain := make(filterChain, len(p.cfg.Filters))
+	for i, newFilter := range p.cfg.Filters {
+		chain[i] = newFilter(info)
+	}
+	return chain
+}
+
+// apply returns payload as the filters leave it, nil if one dropped it.
+func (c filterChain) apply(dir Direction, payload []byte) ([]byte, error) {
+	for _, f := range c {
+		var err error
+		if payload, err = f.Filter(dir, payload); err != nil {
+			return nil, filterError{err}
+		}
+		if payload == nil {
+			metricFilterDropped.inc()
+			return nil, nil
+		}
+	}
+	return payload, nil
+}
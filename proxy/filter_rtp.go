@@ -0,0 +1,56 @@
+package proxy
+
+import "encoding/binary"
+
+func init() {
+	RegisterFilter("rtp", func(SessionInfo) Filter { return FilterFunc(filterRTP) })
+}
+
+const (
+	rtpVersion    = 2
+	rtpHeaderSize = 12
+	rtcpMinSize   = 8
+)
+
+// filterRTP drops every datagram that is not a well-formed RTP packet
+// (RFC 3550) or an RTCP packet multiplexed with them (RFC 5761).
+func filterRTP(_ Direction, b []byte) ([]byte, error) {
+	if !wellFormedRTP(b) {
+		return nil, nil
+	}
+	return b, nil
+}
+
+func wellFormedRTP(b []byte) bool {
+	if len(b) < rtcpMinSize || b[0]>>6 != rtpVersion {
+		return false
+	}
+	// RTCP packet types 192-223 read as marker bit and payload types
+	// 64-95, which RTP must not use alongside them.
+	if pt := b[1] & 0x7f; pt >= 64 && pt < 96 {
+		return len(b)%4 == 0
+	}
+	if len(b) < rtpHeaderSize {
+		return false
+	}
+	n := rtpHeaderSize + 4*int(b[0]&0x0f)
+	if len(b) < n {
+		return false
+	}
+	if b[0]&0x10 != 0 {
+		if len(b) < n+4 {
+			return false
+		}
+		n += 4 + 4*int(binary.BigEndian.Uint16(b[n+2:]))
+		if len(b) < n {
+			return false
+		}
+	}
+	if b[0]&0x20 != 0 {
+		padding := int(b[len(b)-1])
+		if padding == 0 || n+padding > len(b) {
+			return false
+		}
+	}
+	return true
+}
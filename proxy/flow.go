@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IPFIX (RFC 7011) constants for the flow records sent to
+// Config.FlowCollector.
+const (
+	ipfixVersion     = 10
+	ipfixTemplateSet = 2
+	// ipfixTemplateBase is the first of the four templates, one per
+	// combination of client and backend address family.
+	ipfixTemplateBase = 256
+	// ipfixReversePEN marks the reverse direction counters of
+	// bidirectional flows (RFC 5103).
+	ipfixReversePEN = 29305
+	protocolUDP     = 17
+)
+
+// ipfixField is a field specifier: an information element ID, its length,
+// and whether it is the reverse direction variant.
+type ipfixField struct {
+	id      uint16
+	length  uint16
+	reverse bool
+}
+
+// flowExporter sends one IPFIX message per closed connection to a UDP
+// collector. A send is a single write on a connected UDP socket, which
+// does not wait for the collector; a failed one is logged and counted.
+type flowExporter struct {
+	conn net.Conn
+
+	mu  sync.Mutex
+	seq uint32
+}
+
+func newFlowExporter(addr string) (*flowExporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &flowExporter{conn: conn}, nil
+}
+
+// flowRecord is one closed connection: the client on one side, the
+// backend on the other, and what went each way.
+type flowRecord struct {
+	client, backend  netip.AddrPort
+	start, end       time.Time
+	bytesToBackend   uint64
+	packetsToBackend uint64
+	bytesToClient    uint64
+	packetsToClient  uint64
+}
+
+// flowRecordOf describes s, which has ended. Addresses that are not IP,
+// such as a Unix socket client, are exported as the unspecified address.
+func flowRecordOf(s *session, end time.Time) flowRecord {
+	return flowRecord{
+		client:           addrPortOf(s.remoteAddr),
+		backend:          addrPortOf(s.udpConn.RemoteAddr().String()),
+		start:            s.startedAt,
+		end:              end,
+		bytesToBackend:   atomic.LoadUint64(&s.bytesToBackend),
+		packetsToBackend: atomic.LoadUint64(&s.packetsToBackend),
+		bytesToClient:    atomic.LoadUint64(&s.bytesToClient),
+		packetsToClient:  atomic.LoadUint64(&s.packetsToClient),
+	}
+}
+
+func addrPortOf(addr string) netip.AddrPort {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// export sends r with its template, so the collector needs no earlier
+// message to decode it.
+func (e *flowExporter) export(r flowRecord) {
+	e.mu.Lock()
+	msg := r.appendIPFIX(nil, e.seq)
+	e.seq++
+	_, err := e.conn.Write(msg)
+	e.mu.Unlock()
+	if err != nil {
+		metricFlowErrors.inc()
+		slog.Error("flow export error", "error", err)
+		return
+	}
+	metricFlowRecords.inc()
+}
+
+// template returns the template ID and fields for r's address families.
+func (r flowRecord) template() (uint16, []ipfixField) {
+	id := uint16(ipfixTemplateBase)
+	clientAddr, backendAddr := ipfixField{8, 4, false}, ipfixField{12, 4, false}
+	if r.client.Addr().Is6() {
+		id++
+		clientAddr = ipfixField{27, 16, false}
+	}
+	if r.backend.Addr().Is6() {
+		id += 2
+		backendAddr = ipfixField{28, 16, false}
+	}
+	return id, []ipfixField{
+		clientAddr,
+		{7, 2, false}, // sourceTransportPort
+		backendAddr,
+		{11, 2, false},  // destinationTransportPort
+		{4, 1, false},   // protocolIdentifier
+		{152, 8, false}, // flowStartMilliseconds
+		{153, 8, false}, // flowEndMilliseconds
+		{1, 8, false},   // octetDeltaCount
+		{2, 8, false},   // packetDeltaCount
+		{1, 8, true},    // reverseOctetDeltaCount
+		{2, 8, true},    // reversePacketDeltaCount
+	}
+}
+
+// appendIPFIX appends an IPFIX message holding r's template set and r as
+// its data set, with seq as the count of records sent before.
+func (r flowRecord) appendIPFIX(b []byte, seq uint32) []byte {
+	be := binary.BigEndian
+	id, fields := r.template()
+
+	start := len(b)
+	b = be.AppendUint16(b, ipfixVersion)
+	b = be.AppendUint16(b, 0) // length, set below
+	b = be.AppendUint32(b, uint32(r.end.Unix()))
+	b = be.AppendUint32(b, seq)
+	b = be.AppendUint32(b, 0) // observation domain
+
+	set := len(b)
+	b = be.AppendUint16(b, ipfixTemplateSet)
+	b = be.AppendUint16(b, 0)
+	b = be.AppendUint16(b, id)
+	b = be.AppendUint16(b, uint16(len(fields)))
+	for _, f := range fields {
+		if f.reverse {
+			b = be.AppendUint16(b, f.id|0x8000)
+			b = be.AppendUint16(b, f.length)
+			b = be.AppendUint32(b, ipfixReversePEN)
+		} else {
+			b = be.AppendUint16(b, f.id)
+			b = be.AppendUint16(b, f.length)
+		}
+	}
+	be.PutUint16(b[set+2:], uint16(len(b)-set))
+
+	set = len(b)
+	b = be.AppendUint16(b, id)
+	b = be.AppendUint16(b, 0)
+	b = append(b, r.client.Addr().AsSlice()...)
+	b = be.AppendUint16(b, r.client.Port())
+	b = append(b, r.backend.Addr().AsSlice()...)
+	b = be.AppendUint16(b, r.backend.Port())
+	b = append(b, protocolUDP)
+	b = be.AppendUint64(b, uint64(r.start.UnixMilli()))
+	b = be.AppendUint64(b, uint64(r.end.UnixMilli()))
+	b = be.AppendUint64(b, r.bytesToBackend)
+	b = be.AppendUint64(b, r.packetsToBackend)
+	b = be.AppendUint64(b, r.bytesToClient)
+	b = be.AppendUint64(b, r.packetsToClient)
+	be.PutUint16(b[set+2:], uint16(len(b)-set))
+
+	be.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// closeFlushTimeout bounds how long a closing connection spends delivering
+// queued backend datagrams, the same time its close frame gets.
+const closeFlushTimeout = time.Second
+
+// closeFlush caps the datagrams still delivered to a client once the
+// backend side of its connection is done. Until start is called,
+// everything is admitted.
+type closeFlush struct {
+	closing int32
+	left    int64
+}
+
+// start admits at most max more datagrams; the rest are dropped.
+func (f *closeFlush) start(max int) {
+	atomic.StoreInt64(&f.left, int64(max))
+	atomic.StoreInt32(&f.closing, 1)
+}
+
+// admit reports whether the next datagram may be delivered, counting it as
+// dropped otherwise.
+func (f *closeFlush) admit() bool {
+	if atomic.LoadInt32(&f.closing) == 0 || atomic.AddInt64(&f.left, -1) >= 0 {
+		return true
+	}
+	metricCloseFlushDropped.inc()
+	return false
+}
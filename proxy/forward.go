@@ -0,0 +1,515 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// backendConn is the per-client connection to a backend, one message per
+// Read and Write. It is a *net.UDPConn for UDP backends, see dialBackend.
+type backendConn interface {
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	Close() error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+}
+
+// clientConn is the client's side of a session, one message per
+// ReadMessage and WriteMessage. It is a *websocket.Conn, or a
+// *webTransportConn for WebTransport clients.
+type clientConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	WriteJSON(v interface{}) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	EnableWriteCompression(enable bool)
+	Subprotocol() string
+	Close() error
+}
+
+var errWrongDataType = errors.New("unexpected message type")
+
+// aLongTimeAgo is a deadline that makes blocked reads and writes return
+// immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// cancelOnDone unblocks both sides' pending I/O once ctx is canceled, so the
+// forwarding goroutines notice the cancellation without waiting for a socket
+// close or for traffic.
+func cancelOnDone(ctx context.Context, wsConn clientConn, udpConn backendConn) {
+	<-ctx.Done()
+	wsConn.SetReadDeadline(aLongTimeAgo)
+	wsConn.SetWriteDeadline(aLongTimeAgo)
+	udpConn.SetDeadline(aLongTimeAgo)
+}
+
+// report hands err to the handler unless the session is already being torn
+// down, in which case the error is only a consequence of the cancellation.
+func report(ctx context.Context, errChan chan error, err error) {
+	if ctx.Err() == nil {
+		errChan <- err
+	}
+}
+
+func forwardWS2UDP(
+	ctx context.Context,
+	wsConn clientConn,
+	udpConn backendConn,
+	errChan chan error,
+	sess *session,
+) {
+	cfg := &sess.proxy.cfg
+	timed := cfg.MetricsPath != ""
+	consecutive := 0
+
+	// writeBackend sends one datagram carrying frames client messages and
+	// applies the write error policy. It reports whether the datagram was
+	// sent; a nil error with false means it was dropped.
+	writeBackend := func(datagram []byte, frames int) (bool, error) {
+		var start time.Time
+		if timed {
+			start = time.Now()
+		}
+		_, err := udpConn.Write(datagram)
+		if timed {
+			latencyUDPWrite.since(start)
+		}
+		if err == nil {
+			consecutive = 0
+			sess.record(CaptureToBackend, datagram)
+			return true, nil
+		}
+		if cfg.WriteErrorPolicy == WriteErrorPolicyDrop && isTransientWriteError(err) {
+			consecutive++
+			if consecutive < maxConsecutiveWriteErrors {
+				atomic.AddUint64(&sess.dropped, uint64(frames))
+				metricDropped.add(uint64(frames))
+				return false, nil
+			}
+		}
+		return false, err
+	}
+
+	var tx *coalescer
+	if cfg.TxCoalesceWindow > 0 {
+		tx = newCoalescer(cfg.TxCoalesceWindow, txCoalesceMaxDatagram, writeBackend, func(err error) {
+			report(ctx, errChan, backendError{err})
+		})
+		defer tx.close()
+	}
+
+	dataType := sess.dataType
+	wantMsgType := clientMsgType(cfg, dataType)
+
+	// forward sends one client datagram on, by way of the pause gate.
+	forward := func(msg []byte) error {
+		sent := true
+		var err error
+		if tx != nil {
+			err = tx.add(msg)
+		} else {
+			sent, err = writeBackend(msg, 1)
+		}
+		if err != nil {
+			return backendError{err}
+		}
+		if !sent {
+			return nil
+		}
+		sess.touch()
+		sess.logPayload(dirToBackend, msg)
+		return sess.addToBackend(len(msg))
+	}
+	sess.pause.attach(forward, func(err error) {
+		// Called on resume, while this loop may be reporting too.
+		if ctx.Err() == nil {
+			select {
+			case errChan <- err:
+			default:
+			}
+		}
+	})
+
+	// A batched client message carries several datagrams, see SplitFrames.
+	batched := sess.batched
+	var msgs [][]byte
+
+	// The handler may have read the first message already, for the magic
+	// prefix check.
+	msg, pending := sess.firstMessage, sess.firstMessage != nil
+read:
+	for {
+		var err error
+		if pending {
+			pending = false
+		} else if msg, err = readClientMessage(wsConn, dataType, wantMsgType); err != nil {
+			report(ctx, errChan, err)
+			break
+		}
+		if !batched {
+			msgs = append(msgs[:0], msg)
+		} else if msgs, err = SplitFrames(msg); err != nil {
+			report(ctx, errChan, err)
+			break
+		}
+		for _, msg := range msgs {
+			if len(cfg.AllowedSizes) > 0 && !sizeAllowed(cfg.AllowedSizes, len(msg)) {
+				metricSizeRejected.inc()
+				if cfg.SizePolicy == SizePolicyClose {
+					report(ctx, errChan, errSizeNotAllowed)
+					break read
+				}
+				continue
+			}
+			if !sess.rate.allow(true, len(msg), sess.proxy.now()) {
+				metricRateLimited.inc()
+				continue
+			}
+			if msg, err = sess.filters.apply(ToBackend, msg); err != nil {
+				report(ctx, errChan, err)
+				break read
+			}
+			if msg == nil {
+				continue
+			}
+
+			held, err := sess.pause.pass(msg)
+			if err != nil {
+				report(ctx, errChan, err)
+				break read
+			}
+			if held {
+				sess.touch()
+			}
+		}
+	}
+}
+
+// clientMsgType returns the only message type accepted from the client, or
+// 0 for any.
+func clientMsgType(cfg *Config, dataType string) int {
+	if cfg.DataFromClient != "" && (dataType == DataTypeText || dataType == DataTypeBinary) {
+		return wsMessageType(cfg.DataFromClient)
+	}
+	return 0
+}
+
+// readClientMessage reads the next client message and decodes it into a
+// datagram.
+func readClientMessage(wsConn clientConn, dataType string, wantMsgType int) ([]byte, error) {
+	msgType, msg, err := wsConn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if wantMsgType != 0 && msgType != wantMsgType {
+		return nil, errWrongDataType
+	}
+	return decodeMessage(dataType, msgType, msg)
+}
+
+// isTransientWriteError reports whether a backend write error is likely to
+// clear up on its own, e.g. a momentarily full socket send buffer, as
+// opposed to a permanent failure such as a closed socket.
+func isTransientWriteError(err error) bool {
+	switch {
+	case errors.Is(err, syscall.ENOBUFS),
+		errors.Is(err, syscall.ENOMEM),
+		errors.Is(err, syscall.EAGAIN),
+		errors.Is(err, syscall.EINTR):
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Temporary()
+	}
+	return false
+}
+
+// writeClient writes a data message to the client, compressed when that
+// was negotiated and it is at least Config.CompressionMinSize bytes.
+func writeClient(wsConn clientConn, cfg *Config, msgType int, data []byte) error {
+	if cfg.Compression {
+		wsConn.EnableWriteCompression(len(data) >= cfg.CompressionMinSize)
+	}
+	return wsConn.WriteMessage(msgType, data)
+}
+
+func forwardUDP2WS(
+	ctx context.Context,
+	udpConn backendConn,
+	wsConn clientConn,
+	errChan chan error,
+	sess *session,
+) {
+	cfg := &sess.proxy.cfg
+	timed := cfg.MetricsPath != ""
+	dataType := sess.dataType
+
+	read := newSingleUDPReader(udpConn, sess.udpBufSize)
+	if conn, ok := udpConn.(*net.UDPConn); ok && cfg.BatchReads > 1 {
+		read = newBatchUDPReader(conn, cfg.BatchReads, sess.udpBufSize)
+	}
+
+	write := func(payload []byte) error {
+		msgType, data := encodeMessage(dataType, payload)
+		return writeClient(wsConn, cfg, msgType, data)
+	}
+	// With WSBatchWindow, datagrams go out framed, several to a message.
+	// Pause notices, written outside the batch, are framed alone.
+	var batch *coalescer
+	if sess.batched {
+		batch = newCoalescer(cfg.WSBatchWindow, wsBatchMaxMessage, func(msg []byte, _ int) (bool, error) {
+			sess.wsMu.Lock()
+			defer sess.wsMu.Unlock()
+			return true, writeClient(wsConn, cfg, websocket.BinaryMessage, msg)
+		}, func(err error) {
+			report(ctx, errChan, err)
+		})
+		write = func(payload []byte) error {
+			msg := binary.BigEndian.AppendUint16(nil, uint16(len(payload)))
+			return writeClient(wsConn, cfg, websocket.BinaryMessage, append(msg, payload...))
+		}
+	}
+	sess.wsMu.Lock()
+	sess.clientWrite = write
+	sess.wsMu.Unlock()
+	defer func() {
+		sess.wsMu.Lock()
+		sess.clientWrite = nil
+		sess.wsMu.Unlock()
+	}()
+	// A client connecting during a pause-all is told right away.
+	sess.notifyPause()
+
+	// deliver writes one message to the client. Heartbeats do not count as
+	// activity or toward the byte quota.
+	var flush closeFlush
+	deliver := func(payload []byte, heartbeat bool) error {
+		if !flush.admit() {
+			return nil
+		}
+		var start time.Time
+		if timed {
+			start = time.Now()
+		}
+		var err error
+		if batch != nil {
+			err = batch.add(payload)
+		} else {
+			sess.wsMu.Lock()
+			err = write(payload)
+			sess.wsMu.Unlock()
+		}
+		if timed {
+			latencyWSWrite.since(start)
+		}
+		if err != nil {
+			return err
+		}
+		if heartbeat {
+			return nil
+		}
+		sess.touch()
+		sess.logPayload(dirToClient, payload)
+		return sess.addToClient(len(payload))
+	}
+	send := deliver
+	// stops close the queues in front of deliver, in the order they were
+	// put there, returning when each has drained.
+	var stops []func() <-chan struct{}
+	if cfg.JitterBuffer > 0 {
+		jitter := newJitterBuffer(cfg.JitterBuffer)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			jitter.run(func(pkt jitterPacket) error {
+				return deliver(pkt.payload, pkt.heartbeat)
+			})
+		}()
+		stops = append(stops, func() <-chan struct{} {
+			jitter.close()
+			return done
+		})
+		send = jitter.push
+	}
+	var loopback *loopbackLimiter
+	if cfg.BackendLoopback {
+		loopback = newLoopbackLimiter(cfg.BackendLoopbackRate, sess.proxy.now())
+	}
+	if cfg.SendHighWater > 0 {
+		queue := newSendQueue(cfg.SendHighWater, cfg.SendPolicy, func(n int) {
+			atomic.AddUint64(&sess.sendDropped, uint64(n))
+			metricSendDropped.add(uint64(n))
+		})
+		done := make(chan struct{})
+		next := send
+		go func() {
+			defer close(done)
+			queue.run(next)
+		}()
+		stops = append(stops, func() <-chan struct{} {
+			queue.close()
+			return done
+		})
+		send = queue.push
+	}
+
+	err := pumpUDP2WS(ctx, cfg, udpConn, read, send, sess, loopback)
+
+	// Datagrams still queued when the backend side ends are worth
+	// delivering ahead of the close, up to CloseFlushMax of them within
+	// closeFlushTimeout. Once the client side failed they are dropped.
+	var backendErr backendError
+	flushing := len(stops) > 0 && cfg.CloseFlushMax > 0 &&
+		ctx.Err() == nil && errors.As(err, &backendErr)
+	if flushing {
+		flush.start(cfg.CloseFlushMax)
+	} else {
+		flush.start(0)
+	}
+	deadline := time.NewTimer(closeFlushTimeout)
+	defer deadline.Stop()
+	for i := len(stops) - 1; i >= 0; i-- {
+		done := stops[i]()
+		if !flushing {
+			continue
+		}
+		select {
+		case <-done:
+		case <-deadline.C:
+			slog.Warn("close flush timed out", "client", sess.id)
+			flushing = false
+		}
+	}
+	if batch != nil {
+		batch.close()
+	}
+	report(ctx, errChan, err)
+}
+
+// pumpUDP2WS forwards backend datagrams to send until reading or sending
+// fails, and returns that error.
+func pumpUDP2WS(
+	ctx context.Context,
+	cfg *Config,
+	udpConn backendConn,
+	read udpReader,
+	send func(payload []byte, heartbeat bool) error,
+	sess *session,
+	loopback *loopbackLimiter,
+) error {
+	timed := cfg.MetricsPath != ""
+	watched := cfg.ReadWatchdog > 0
+	observeSession := cfg.BackendSessionLength > 0
+	for {
+		// The read deadline restarts after every datagram, so heartbeats are
+		// only sent once the backend has been quiet for a full interval.
+		if cfg.HeartbeatInterval > 0 {
+			udpConn.SetReadDeadline(time.Now().Add(cfg.HeartbeatInterval))
+		}
+		var start time.Time
+		if timed {
+			start = time.Now()
+		}
+		if watched {
+			sess.beginRead()
+		}
+		payloads, err := read()
+		if watched {
+			sess.endRead()
+		}
+		if timed {
+			latencyUDPRead.since(start)
+		}
+		if err != nil && cfg.HeartbeatInterval > 0 && ctx.Err() == nil &&
+			errors.Is(err, os.ErrDeadlineExceeded) {
+			if err = send(cfg.HeartbeatPayload, true); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return backendError{err}
+		}
+
+		for _, payload := range payloads {
+			if observeSession {
+				sess.observeBackendSession(payload)
+			}
+			sess.record(CaptureToClient, payload)
+			if loopback != nil {
+				sess.loopback(loopback, payload)
+			}
+			if sess.seq != nil {
+				sess.seq.observe(payload)
+			}
+			if !sess.rate.allow(false, len(payload), sess.proxy.now()) {
+				metricRateLimited.inc()
+				continue
+			}
+			if payload, err = sess.filters.apply(ToClient, payload); err != nil {
+				return err
+			}
+			if payload == nil {
+				continue
+			}
+			if err = send(payload, false); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// wsMessageType maps the text and binary data types to their WebSocket
+// message type.
+func wsMessageType(dataType string) int {
+	if dataType == DataTypeBinary {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// udpReader returns the next datagram(s) read from the backend. The returned
+// slices are only valid until the following call.
+type udpReader func() ([][]byte, error)
+
+func newSingleUDPReader(udpConn backendConn, bufSize int) udpReader {
+	buf := make([]byte, bufSize)
+	payloads := make([][]byte, 1)
+	if conn, ok := udpConn.(*net.UDPConn); ok && msgTrunc != 0 {
+		return func() ([][]byte, error) {
+			n, _, flags, _, err := conn.ReadMsgUDP(buf, nil)
+			if err != nil {
+				return nil, err
+			}
+			if flags&msgTrunc != 0 {
+				metricUDPTruncated.inc()
+			}
+			payloads[0] = buf[:n]
+			return payloads, nil
+		}
+	}
+	return func() ([][]byte, error) {
+		n, err := udpConn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		payloads[0] = buf[:n]
+		return payloads, nil
+	}
+}
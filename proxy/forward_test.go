@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	fastws "github.com/fasthttp/websocket"
+)
+
+// teardownBound is how soon both forwarding goroutines must have exited
+// once either side of a session ended.
+const teardownBound = time.Second
+
+func TestTeardownEitherSide(t *testing.T) {
+	tests := []struct {
+		name string
+		// end ends one side of the session on conn.
+		end func(h *harness, conn *fastws.Conn) error
+		// code is the close code the client must get, 0 for none.
+		code int
+	}{{
+		name: "client closes",
+		end: func(_ *harness, conn *fastws.Conn) error {
+			closeNormally(conn)
+			return nil
+		},
+	}, {
+		name: "client vanishes",
+		end: func(_ *harness, conn *fastws.Conn) error {
+			return conn.Close()
+		},
+	}, {
+		// With the echo server gone, the next datagram's ICMP port
+		// unreachable fails the backend read.
+		name: "backend fails",
+		end: func(h *harness, conn *fastws.Conn) error {
+			h.echo.Close()
+			return conn.WriteMessage(fastws.BinaryMessage, []byte("ping"))
+		},
+		code: CloseBackendError,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := startHarness(t, Config{DataType: DataTypeBinary})
+			conn := h.dial(t)
+			defer conn.Close()
+			ping := [][]byte{[]byte("ping")}
+			if err := exchange(conn, fastws.BinaryMessage, fastws.BinaryMessage, ping, 1, same); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.end(h, conn); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != 0 {
+				conn.SetReadDeadline(time.Now().Add(teardownBound))
+				_, _, err := conn.ReadMessage()
+				if err := checkClose(err, tt.code); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := h.waitIdleWithin(teardownBound); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// discardClient stands in for the client of forwardUDP2WS, signalling each
+// message written to it and discarding it.
+type discardClient struct {
+	clientConn
+	written chan struct{}
+}
+
+func (c *discardClient) WriteMessage(int, []byte) error {
+	c.written <- struct{}{}
+	return nil
+}
+
+func (c *discardClient) EnableWriteCompression(bool) {}
+
+// BenchmarkForwardUDP2WS runs the backend read loop alone, against a
+// client that discards what it is sent. The allocations reported are the
+// loop's and those of the echo round trip feeding it.
+func BenchmarkForwardUDP2WS(b *testing.B) {
+	for _, bench := range []struct {
+		name       string
+		batchReads int
+	}{
+		{"single-reads", 0},
+		{"batch-reads", 32},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			backend := startEcho(b)
+			p, err := New(Config{
+				Backends:   []string{backend.LocalAddr().String()},
+				DataType:   DataTypeBinary,
+				BatchReads: bench.batchReads,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer p.Close()
+			udpConn, err := net.DialUDP("udp", nil, backend.LocalAddr().(*net.UDPAddr))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer udpConn.Close()
+			client := &discardClient{written: make(chan struct{}, benchWindow)}
+			sess := &session{
+				id:         "bench",
+				proxy:      p,
+				dataType:   DataTypeBinary,
+				udpBufSize: p.cfg.UDPBufferSize,
+				udpConn:    udpConn,
+				pause:      newPauseGate(0, false),
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				forwardUDP2WS(ctx, udpConn, client, make(chan error, 1), sess)
+			}()
+			defer func() {
+				cancel()
+				udpConn.Close()
+				<-done
+			}()
+
+			// The echo server sends each datagram back for the loop to
+			// read, benchWindow of them at a time.
+			msg := make([]byte, benchSize)
+			inFlight := make(chan struct{}, benchWindow)
+			sendErr := make(chan error, 1)
+			b.SetBytes(benchSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					select {
+					case inFlight <- struct{}{}:
+					case <-ctx.Done():
+						return
+					}
+					if _, err := udpConn.Write(msg); err != nil {
+						sendErr <- err
+						return
+					}
+				}
+				sendErr <- nil
+			}()
+			for i := 0; i < b.N; i++ {
+				select {
+				case <-client.written:
+				case <-time.After(testIOTimeout):
+					b.Fatalf("datagram %d of %d lost", i, b.N)
+				}
+				<-inFlight
+			}
+			b.StopTimer()
+			if err := <-sendErr; err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
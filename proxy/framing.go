@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+)
+
+// writeFrame writes b to w behind its 2-byte big-endian length, in one
+// write so concurrent writers cannot interleave.
+func writeFrame(w io.Writer, b []byte) (int, error) {
+	if len(b) > 0xffff {
+		return 0, errFrameTooLarge
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	if _, err := w.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// frameReader reads messages framed by writeFrame off a stream. A
+// partially read frame survives a read deadline, so heartbeats cannot
+// desynchronize the framing. A frame longer than the buffer read into is
+// cut to it, as a datagram is, and counted in metricUDPTruncated.
+type frameReader struct {
+	frame []byte
+	have  int
+	// warned is set once a cut frame was logged, so a backend sending
+	// only long frames logs once per connection.
+	warned bool
+}
+
+func (f *frameReader) read(r io.Reader, b []byte) (int, error) {
+	if f.frame == nil {
+		f.frame = make([]byte, 2+0xffff)
+	}
+	for {
+		need := 2
+		if f.have >= 2 {
+			need += int(binary.BigEndian.Uint16(f.frame))
+		}
+		if f.have == need && f.have >= 2 {
+			n := copy(b, f.frame[2:need])
+			f.have = 0
+			if n < need-2 {
+				metricUDPTruncated.inc()
+				if !f.warned {
+					f.warned = true
+					slog.Warn("backend frame longer than the udp buffer cut to it",
+						"frame_size", need-2, "udp_buffer", len(b))
+				}
+			}
+			return n, nil
+		}
+		n, err := r.Read(f.frame[f.have:need])
+		f.have += n
+		if err != nil {
+			return 0, err
+		}
+	}
+}
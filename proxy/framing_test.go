@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+)
+
+func TestWriteFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		wantErr error
+	}{
+		{"empty", 0, nil},
+		{"small", 5, nil},
+		{"largest", 0xffff, nil},
+		{"too large", 0x10000, errFrameTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := bytes.Repeat([]byte{'x'}, tt.size)
+			var buf bytes.Buffer
+			n, err := writeFrame(&buf, msg)
+			if err != tt.wantErr {
+				t.Fatalf("error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if buf.Len() != 0 {
+					t.Errorf("%d bytes written for a rejected frame", buf.Len())
+				}
+				return
+			}
+			if n != tt.size {
+				t.Errorf("wrote %d, want %d", n, tt.size)
+			}
+			want := append([]byte{byte(tt.size >> 8), byte(tt.size)}, msg...)
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("frame % x..., want % x...", buf.Bytes()[:2], want[:2])
+			}
+		})
+	}
+}
+
+// scriptedReader returns each of its reads in turn, a chunk of the stream
+// or an error.
+type scriptedReader struct {
+	reads []interface{}
+}
+
+func (r *scriptedReader) Read(b []byte) (int, error) {
+	if len(r.reads) == 0 {
+		return 0, io.EOF
+	}
+	switch next := r.reads[0].(type) {
+	case error:
+		r.reads = r.reads[1:]
+		return 0, next
+	case []byte:
+		n := copy(b, next)
+		if n == len(next) {
+			r.reads = r.reads[1:]
+		} else {
+			r.reads[0] = next[n:]
+		}
+		return n, nil
+	}
+	panic("bad read")
+}
+
+func TestFrameReader(t *testing.T) {
+	framed := func(msgs ...string) []byte {
+		var buf bytes.Buffer
+		for _, msg := range msgs {
+			writeFrame(&buf, []byte(msg))
+		}
+		return buf.Bytes()
+	}
+	stream := framed("hello", "", "world")
+	deadline := os.ErrDeadlineExceeded
+
+	tests := []struct {
+		name string
+		r    io.Reader
+		// want holds the message read or the error got, in order.
+		want []interface{}
+		// bufSize is the buffer read into, 64 bytes if zero.
+		bufSize int
+		// truncated is how many frames are cut to the buffer.
+		truncated uint64
+	}{{
+		name: "whole stream",
+		r:    bytes.NewReader(stream),
+		want: []interface{}{"hello", "", "world", io.EOF},
+	}, {
+		name: "one byte at a time",
+		r:    iotest.OneByteReader(bytes.NewReader(stream)),
+		want: []interface{}{"hello", "", "world", io.EOF},
+	}, {
+		name: "deadline inside the length",
+		r:    &scriptedReader{reads: []interface{}{stream[:1], deadline, stream[1:]}},
+		want: []interface{}{deadline, "hello", "", "world"},
+	}, {
+		name: "deadline inside the payload",
+		r:    &scriptedReader{reads: []interface{}{stream[:4], deadline, deadline, stream[4:]}},
+		want: []interface{}{deadline, deadline, "hello", "", "world"},
+	}, {
+		name: "deadline between frames",
+		r:    &scriptedReader{reads: []interface{}{stream[:7], deadline, stream[7:]}},
+		want: []interface{}{"hello", deadline, "", "world"},
+	}, {
+		name:      "frames bigger than the buffer",
+		r:         bytes.NewReader(stream),
+		bufSize:   3,
+		want:      []interface{}{"hel", "", "wor", io.EOF},
+		truncated: 2,
+	}, {
+		name:      "frame as big as the buffer",
+		r:         bytes.NewReader(stream),
+		bufSize:   5,
+		want:      []interface{}{"hello", "", "world", io.EOF},
+		truncated: 0,
+	}, {
+		name: "stream ends inside a frame",
+		r:    bytes.NewReader(stream[:4]),
+		want: []interface{}{io.EOF},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.bufSize
+			if size == 0 {
+				size = 64
+			}
+			var f frameReader
+			buf := make([]byte, size)
+			before := atomic.LoadUint64(&metricUDPTruncated.value)
+			for i, want := range tt.want {
+				n, err := f.read(tt.r, buf)
+				switch want := want.(type) {
+				case error:
+					if !errors.Is(err, want) {
+						t.Fatalf("read %d: error %v, want %v", i, err, want)
+					}
+				case string:
+					if err != nil {
+						t.Fatalf("read %d: %v, want %q", i, err, want)
+					}
+					if string(buf[:n]) != want {
+						t.Fatalf("read %d: %q, want %q", i, buf[:n], want)
+					}
+				}
+			}
+			if got := atomic.LoadUint64(&metricUDPTruncated.value) - before; got != tt.truncated {
+				t.Errorf("%d frames counted truncated, want %d", got, tt.truncated)
+			}
+		})
+	}
+}
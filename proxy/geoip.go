@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/netip"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Regions for Config.RegionBy.
+const (
+	RegionByContinent = "continent"
+	RegionByCountry   = "country"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// geoDB looks up IP addresses in a MaxMind DB file (format version 2), such
+// as GeoLite2-Country or GeoLite2-City. Only what region lookups need is
+// implemented: the search tree and decoding the data section.
+type geoDB struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint64
+	recordSize int
+	ipVersion  int
+	// ipv4Start is the node IPv4 lookups start at: the root in an IPv4
+	// database, the ::/96 subtree in an IPv6 one.
+	ipv4Start uint64
+}
+
+// openGeoDB reads the database at path into memory.
+func openGeoDB(path string) (*geoDB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New(path + ": not a MaxMind DB file")
+	}
+	meta, _, err := decodeMMDB(buf[i+len(mmdbMetadataMarker):], 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: metadata: %w", path, err)
+	}
+	m, _ := meta.(map[string]any)
+	nodeCount, _ := m["node_count"].(uint64)
+	recordSize, _ := m["record_size"].(uint64)
+	ipVersion, _ := m["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, recordSize)
+	}
+	treeSize := nodeCount * recordSize / 4
+	if treeSize+16 > uint64(i) {
+		return nil, errors.New(path + ": search tree out of bounds")
+	}
+	db := &geoDB{
+		tree:       buf[:treeSize],
+		data:       buf[treeSize+16 : i],
+		nodeCount:  nodeCount,
+		recordSize: int(recordSize),
+		ipVersion:  int(ipVersion),
+	}
+	if db.ipVersion == 6 {
+		for n := 0; n < 96 && db.ipv4Start < nodeCount; n++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *geoDB) record(node uint64, bit int) uint64 {
+	b := db.tree[node*uint64(db.recordSize)/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[3*bit:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		if bit == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	default:
+		return uint64(binary.BigEndian.Uint32(b[4*bit:]))
+	}
+}
+
+// lookup returns the record for addr, or nil if the database has none.
+func (db *geoDB) lookup(addr netip.Addr) (any, error) {
+	addr = addr.Unmap()
+	node, bits := uint64(0), 128
+	if addr.Is4() {
+		node, bits = db.ipv4Start, 32
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+	ip := addr.AsSlice()
+	for i := 0; i < bits && node < db.nodeCount; i++ {
+		node = db.record(node, int(ip[i/8]>>(7-i%8)&1))
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	offset := int(node - db.nodeCount - 16)
+	if offset >= len(db.data) {
+		return nil, errors.New("geoip: data pointer out of bounds")
+	}
+	v, _, err := decodeMMDB(db.data, offset)
+	return v, err
+}
+
+// region returns addr's continent or country code, depending on by, or ""
+// when the database does not know it.
+func (db *geoDB) region(addr netip.Addr, by string) (string, error) {
+	v, err := db.lookup(addr)
+	if err != nil {
+		return "", err
+	}
+	m, _ := v.(map[string]any)
+	if by == RegionByCountry {
+		country, _ := m["country"].(map[string]any)
+		code, _ := country["iso_code"].(string)
+		return code, nil
+	}
+	continent, _ := m["continent"].(map[string]any)
+	code, _ := continent["code"].(string)
+	return code, nil
+}
+
+var errMMDBTruncated = errors.New("geoip: truncated data")
+
+// decodeMMDB decodes the value at offset in buf, a MaxMind DB data section,
+// returning it and the offset just past it. Maps become map[string]any,
+// arrays []any, strings string, unsigned and signed integers uint64 and
+// int64, and floats float64.
+func decodeMMDB(buf []byte, offset int) (any, int, error) {
+	if offset >= len(buf) {
+		return nil, 0, errMMDBTruncated
+	}
+	ctrl := buf[offset]
+	offset++
+	typ := int(ctrl >> 5)
+	if typ == 1 {
+		// A pointer into the data section; its size bits are part of it.
+		ss, v := int(ctrl>>3&3), int(ctrl&7)
+		if offset+ss+1 > len(buf) {
+			return nil, 0, errMMDBTruncated
+		}
+		var ptr int
+		switch ss {
+		case 0:
+			ptr = v<<8 | int(buf[offset])
+		case 1:
+			ptr = 2048 + (v<<16 | int(buf[offset])<<8 | int(buf[offset+1]))
+		case 2:
+			ptr = 526336 + (v<<24 | int(buf[offset])<<16 | int(buf[offset+1])<<8 | int(buf[offset+2]))
+		default:
+			ptr = int(binary.BigEndian.Uint32(buf[offset:]))
+		}
+		val, _, err := decodeMMDB(buf, ptr)
+		return val, offset + ss + 1, err
+	}
+	if typ == 0 {
+		if offset >= len(buf) {
+			return nil, 0, errMMDBTruncated
+		}
+		typ = 7 + int(buf[offset])
+		offset++
+	}
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(buf) {
+			return nil, 0, errMMDBTruncated
+		}
+		extra := 0
+		for _, b := range buf[offset : offset+n] {
+			extra = extra<<8 | int(b)
+		}
+		size = [...]int{29, 285, 65821}[n-1] + extra
+		offset += n
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]any, size)
+		for i := 0; i < size; i++ {
+			k, next, err := decodeMMDB(buf, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("geoip: map key is not a string")
+			}
+			v, next, err := decodeMMDB(buf, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], offset = v, next
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]any, size)
+		for i := range a {
+			v, next, err := decodeMMDB(buf, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a[i], offset = v, next
+		}
+		return a, offset, nil
+	case 14: // boolean, the size is the value
+		return size != 0, offset, nil
+	}
+
+	if offset+size > len(buf) {
+		return nil, 0, errMMDBTruncated
+	}
+	b := buf[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("geoip: bad double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4: // bytes
+		return append([]byte(nil), b...), offset, nil
+	case 5, 6, 9, 10: // uint16, uint32, uint64, uint128 (truncated to 64 bits)
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case 8: // int32
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(n)), offset, nil
+		}
+		return int64(n), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("geoip: bad float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	}
+	return nil, 0, fmt.Errorf("geoip: unsupported data type %d", typ)
+}
+
+// clientRegion looks the client's IP up in Config.GeoIPDB. It returns ""
+// without a database, or when the lookup fails or finds nothing.
+func (p *Proxy) clientRegion(c *fiber.Ctx) string {
+	if p.geo == nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(c.IP())
+	if err != nil {
+		return ""
+	}
+	region, err := p.geo.region(addr, p.cfg.RegionBy)
+	if err != nil {
+		slog.Warn("geoip lookup error", "addr", addr, "error", err)
+	}
+	return region
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+)
+
+// ControlSubprotocol selects the control protocol, see
+// Config.ControlProtocol. Later versions will be udp-proxy-v2 and so on.
+const ControlSubprotocol = "udp-proxy-v1"
+
+// controlSubprotocolPrefix is shared by every version of the control
+// protocol, so an unsupported one is told apart from other subprotocols.
+const controlSubprotocolPrefix = "udp-proxy-v"
+
+// controlVersion is the version ControlSubprotocol stands for.
+const controlVersion = 1
+
+// handshakeTimeout is how long a control protocol client has to send its
+// options.
+const handshakeTimeout = 10 * time.Second
+
+// helloMessage opens the control protocol, telling the client what the
+// proxy supports.
+type helloMessage struct {
+	Type      string   `json:"type"`
+	Version   int      `json:"version"`
+	DataTypes []string `json:"data_types"`
+	// Batching is whether WSBatchWindow batches binary clients.
+	Batching bool `json:"batching"`
+	// Targets is whether the client may pick its target.
+	Targets     bool `json:"targets"`
+	Resume      bool `json:"resume"`
+	MaxDatagram int  `json:"max_datagram"`
+}
+
+// optionsMessage is the client's answer to the hello, each field left out
+// keeping what the upgrade selected. Unknown fields are refused, so a
+// client relying on an option this version lacks finds out.
+type optionsMessage struct {
+	Type   string `json:"type"`
+	Target string `json:"target,omitempty"`
+	Data   string `json:"data,omitempty"`
+	// Batch false opts out of WSBatchWindow.
+	Batch *bool `json:"batch,omitempty"`
+}
+
+// readyMessage confirms the options in effect, before any data.
+type readyMessage struct {
+	Type   string `json:"type"`
+	Data   string `json:"data"`
+	Batch  bool   `json:"batch"`
+	Target string `json:"target,omitempty"`
+}
+
+// offersControl reports whether the client offers ControlSubprotocol. One
+// offering only other versions of it gets 400 rather than a session it
+// cannot speak.
+func offersControl(c *fiber.Ctx) (bool, error) {
+	var unsupported string
+	for _, proto := range strings.Split(c.Get("Sec-WebSocket-Protocol"), ",") {
+		proto = strings.TrimSpace(proto)
+		if proto == ControlSubprotocol {
+			return true, nil
+		}
+		if strings.HasPrefix(proto, controlSubprotocolPrefix) && unsupported == "" {
+			unsupported = proto
+		}
+	}
+	if unsupported != "" {
+		return false, fiber.NewError(fiber.StatusBadRequest,
+			"unsupported protocol version "+unsupported)
+	}
+	return false, nil
+}
+
+// handshake runs the control protocol's opening exchange: the hello, the
+// client's options and the ready. It applies the data type and batching
+// options to cc and returns the target the client asked for, if any, for
+// the caller to switch to. A client sending bad options is closed with
+// 1008 and false returned.
+func (p *Proxy) handshake(c clientConn, clientID string, cc *connCtx) (string, bool) {
+	hello := helloMessage{
+		Type:        "hello",
+		Version:     controlVersion,
+		DataTypes:   dataTypes,
+		Batching:    p.cfg.WSBatchWindow > 0,
+		Targets:     len(p.cfg.TargetAllow) > 0 && !cc.backendFixed,
+		Resume:      p.resumes != nil,
+		MaxDatagram: cc.udpBufSize,
+	}
+	if cc.dataClaimed {
+		hello.DataTypes = []string{cc.dataType}
+	}
+	if err := c.WriteJSON(hello); err != nil {
+		slog.Warn("send hello error", "client", clientID, "error", err)
+		return "", false
+	}
+
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	msgType, msg, err := c.ReadMessage()
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		slog.Warn("read options error", "client", clientID, "error", err)
+		return "", false
+	}
+	opts, err := p.checkOptions(msgType, msg, cc)
+	if err != nil {
+		metricHandshakesRejected.inc()
+		slog.Info("client options rejected", "client", clientID, "error", err)
+		c.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()),
+			time.Now().Add(time.Second),
+		)
+		return "", false
+	}
+	if opts.Data != "" {
+		cc.dataType = opts.Data
+	}
+	if opts.Batch != nil && !*opts.Batch {
+		cc.noBatch = true
+	}
+	ready := readyMessage{
+		Type:   "ready",
+		Data:   cc.dataType,
+		Batch:  p.cfg.WSBatchWindow > 0 && cc.dataType == DataTypeBinary && !cc.noBatch,
+		Target: opts.Target,
+	}
+	if err := c.WriteJSON(ready); err != nil {
+		slog.Warn("send ready error", "client", clientID, "error", err)
+		return "", false
+	}
+	return opts.Target, true
+}
+
+// checkOptions parses and checks the client's options message.
+func (p *Proxy) checkOptions(msgType int, msg []byte, cc *connCtx) (optionsMessage, error) {
+	var opts optionsMessage
+	if msgType != websocket.TextMessage {
+		return opts, errors.New("options must be a text message")
+	}
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&opts); err != nil {
+		return opts, errors.New("invalid options: " + err.Error())
+	}
+	if opts.Type != "options" {
+		return opts, errors.New("options expected")
+	}
+	if opts.Data != "" {
+		opts.Data = canonicalDataType(opts.Data)
+		if !isDataType(opts.Data) {
+			return opts, errors.New("unsupported data type " + opts.Data)
+		}
+		if cc.dataClaimed && opts.Data != cc.dataType {
+			return opts, errors.New("data type conflicts with the token's data claim")
+		}
+	}
+	if opts.Target != "" {
+		if len(p.cfg.TargetAllow) == 0 || cc.backendFixed ||
+			!targetAllowed(p.cfg.TargetAllow, opts.Target) || !p.targetAddrAllowed(opts.Target) {
+			return opts, errors.New("target not allowed")
+		}
+	}
+	return opts, nil
+}
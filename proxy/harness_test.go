@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fastws "github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// maxDatagram is the largest UDP payload over IPv4.
+	maxDatagram = 65507
+	// testIOTimeout bounds every read and write, so a lost datagram fails
+	// a test rather than hanging it.
+	testIOTimeout = 5 * time.Second
+	// settleTimeout bounds the wait for the proxy to notice closed
+	// clients, checked every settlePoll.
+	settleTimeout = 2 * time.Second
+	settlePoll    = 10 * time.Millisecond
+	// echoReadBuffer is the socket receive buffer the echo server asks for.
+	echoReadBuffer = 4 << 20
+)
+
+// TestMain keeps the log of every session the tests open quiet, unless
+// go test -v asks for it.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	os.Exit(m.Run())
+}
+
+// harness is a proxy serving on a loopback port, with an echo server on
+// another as its one backend.
+type harness struct {
+	p    *Proxy
+	echo *net.UDPConn
+	url  string
+}
+
+// startHarness starts a proxy configured by cfg, whose Backends it sets to
+// a fresh echo server. Both are stopped when tb ends.
+func startHarness(tb testing.TB, cfg Config) *harness {
+	tb.Helper()
+	echo := startEcho(tb)
+	cfg.Backends = []string{echo.LocalAddr().String()}
+	h := startProxy(tb, cfg)
+	h.echo = echo
+	return h
+}
+
+// startProxy starts a proxy configured by cfg as it is, stopped when tb
+// ends.
+func startProxy(tb testing.TB, cfg Config) *harness {
+	tb.Helper()
+	p, err := New(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		p.Close()
+		tb.Fatal(err)
+	}
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	p.RegisterRoutes(app, "/")
+	go app.Listener(ln)
+	tb.Cleanup(func() {
+		p.Close()
+		app.Shutdown()
+	})
+	return &harness{p: p, url: "ws://" + ln.Addr().String() + "/"}
+}
+
+// startEcho starts a UDP server sending every datagram back where it came
+// from, until tb ends or its socket is closed.
+func startEcho(tb testing.TB) *net.UDPConn {
+	tb.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	// Concurrent clients burst into the one socket, which drops datagrams
+	// once its receive buffer is full.
+	conn.SetReadBuffer(echoReadBuffer)
+	tb.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+// session returns the one session the proxy has, once it has one.
+func (h *harness) session(tb testing.TB) *session {
+	tb.Helper()
+	deadline := time.Now().Add(settleTimeout)
+	for {
+		if sessions := h.p.sessions.snapshot(); len(sessions) == 1 {
+			return sessions[0]
+		}
+		if time.Now().After(deadline) {
+			tb.Fatal("no session")
+		}
+		time.Sleep(settlePoll)
+	}
+}
+
+func (h *harness) dial(tb testing.TB) *fastws.Conn {
+	tb.Helper()
+	conn, _, err := fastws.DefaultDialer.Dial(h.url, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return conn
+}
+
+// waitIdle waits for the proxy to have no connections left, to the
+// backend as well as from clients, and its handlers to have returned.
+func (h *harness) waitIdle(tb testing.TB) {
+	tb.Helper()
+	if err := h.waitIdleWithin(settleTimeout); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func (h *harness) waitIdleWithin(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		stats := h.p.Stats()
+		open := 0
+		for _, n := range stats.BackendConnections {
+			open += n
+		}
+		handlers := atomic.LoadInt32(&h.p.handlers)
+		if stats.ActiveConnections == 0 && open == 0 && handlers == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d connections, %d backend connections and %d handlers left after %s",
+				stats.ActiveConnections, open, handlers, timeout)
+		}
+		time.Sleep(settlePoll)
+	}
+}
+
+// closeNormally closes conn the way a well-behaved client does.
+func closeNormally(conn *fastws.Conn) {
+	conn.WriteControl(
+		fastws.CloseMessage,
+		fastws.FormatCloseMessage(fastws.CloseNormalClosure, ""),
+		time.Now().Add(time.Second),
+	)
+	conn.Close()
+}
+
+// exchange sends msgs as msgType messages, at most window of them awaiting
+// their echo at a time, and checks the echoes come back in order, of
+// wantType and equal to want(msg).
+func exchange(conn *fastws.Conn, msgType, wantType int, msgs [][]byte, window int, want func([]byte) []byte) error {
+	inFlight := make(chan struct{}, window)
+	done := make(chan struct{})
+	defer close(done)
+	sendErr := make(chan error, 1)
+	go func() {
+		for _, msg := range msgs {
+			select {
+			case inFlight <- struct{}{}:
+			case <-done:
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(testIOTimeout))
+			if err := conn.WriteMessage(msgType, msg); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- nil
+	}()
+	for i, msg := range msgs {
+		conn.SetReadDeadline(time.Now().Add(testIOTimeout))
+		gotType, got, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("datagram %d: %w", i, err)
+		}
+		<-inFlight
+		if gotType != wantType {
+			return fmt.Errorf("datagram %d: message type %d, want %d", i, gotType, wantType)
+		}
+		if w := want(msg); !bytes.Equal(got, w) {
+			for j := i + 1; j < len(msgs); j++ {
+				if bytes.Equal(got, want(msgs[j])) {
+					return fmt.Errorf("datagram %d lost", i)
+				}
+			}
+			return fmt.Errorf("datagram %d: got %d bytes, want %d bytes as sent", i, len(got), len(w))
+		}
+	}
+	return <-sendErr
+}
+
+func same(msg []byte) []byte { return msg }
+
+// checkClose checks err is the proxy closing the connection with code.
+func checkClose(err error, code int) error {
+	var closeErr *fastws.CloseError
+	if !errors.As(err, &closeErr) {
+		return fmt.Errorf("want close %d, got %v", code, err)
+	}
+	if closeErr.Code != code {
+		return fmt.Errorf("want close %d, got %d %s", code, closeErr.Code, closeErr.Text)
+	}
+	return nil
+}
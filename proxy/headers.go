@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequiredHeader is a request header an upgrade must carry. An empty Value
+// accepts any non-empty value.
+type RequiredHeader struct {
+	Name, Value string
+}
+
+// ParseRequiredHeaders parses a comma-separated list of header names, each
+// optionally with the value it must have, e.g. "X-Tenant-ID,X-Via=gateway".
+func ParseRequiredHeaders(s string) ([]RequiredHeader, error) {
+	var headers []RequiredHeader
+	for _, part := range strings.Split(s, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" || strings.ContainsAny(name, " \t:") {
+			return nil, fmt.Errorf("invalid required header %q", part)
+		}
+		headers = append(headers, RequiredHeader{Name: name, Value: value})
+	}
+	return headers, nil
+}
+
+// checkRequiredHeaders returns the values of Config.RequireHeaders on the
+// upgrade request as attributes for the connect log, or a 400 error naming
+// the first one missing or mismatched.
+func (p *Proxy) checkRequiredHeaders(c *fiber.Ctx) ([]any, error) {
+	var values []any
+	for _, h := range p.cfg.RequireHeaders {
+		v := c.Get(h.Name)
+		if v == "" {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "header "+h.Name+" required")
+		}
+		if h.Value != "" && v != h.Value {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "header "+h.Name+" not allowed")
+		}
+		values = append(values, slog.String(h.Name, v))
+	}
+	return values, nil
+}
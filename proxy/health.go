@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// backendHealth caches the reachability of each backend, refreshed by a
+// background prober, so upgrades can be refused cheaply while a backend is
+// down.
+type backendHealth struct {
+	proxy *Proxy
+	state map[string]*int32
+}
+
+func newBackendHealth(p *Proxy, addrs []string) *backendHealth {
+	h := &backendHealth{
+		proxy: p,
+		state: make(map[string]*int32, len(addrs)),
+	}
+	for _, addr := range addrs {
+		up := int32(1)
+		h.state[addr] = &up
+	}
+	return h
+}
+
+// run probes every backend once, then again every interval until done is
+// closed.
+func (h *backendHealth) run(interval time.Duration, done <-chan struct{}) {
+	h.probeAll()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.probeAll()
+		case <-done:
+			return
+		}
+	}
+}
+
+// backendUp reports whether addr is up according to the health probes, and
+// true without them.
+func (p *Proxy) backendUp(addr string) bool {
+	return p.health == nil || p.health.healthy(addr)
+}
+
+func (h *backendHealth) healthy(addr string) bool {
+	up, ok := h.state[addr]
+	return !ok || atomic.LoadInt32(up) == 1
+}
+
+func (h *backendHealth) probeAll() {
+	for addr, up := range h.state {
+		err := h.probe(addr)
+		was := atomic.SwapInt32(up, boolToInt32(err == nil))
+		switch {
+		case err != nil && was == 1:
+			slog.Warn("backend is down", "backend", addr, "error", err)
+		case err == nil && was == 0:
+			slog.Info("backend is up again", "backend", addr)
+		}
+	}
+}
+
+// probe sends the probe payload and waits briefly for an answer. UDP gives
+// no positive acknowledgement, so silence counts as reachable and only a
+// resolve failure or an ICMP unreachable (ECONNREFUSED) marks it down.
+// Stream backends are up when they accept a connection.
+func (h *backendHealth) probe(addr string) error {
+	conn, _, err := h.proxy.dialBackendName(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if proto := h.proxy.cfg.BackendProto; proto == BackendProtoTCP || proto == BackendProtoUnix {
+		// Accepting the connection is answer enough.
+		return nil
+	}
+
+	if _, err = conn.Write(h.proxy.cfg.ProbePayload); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(h.proxy.cfg.ProbeTimeout))
+	_, err = conn.Read(make([]byte, h.proxy.cfg.UDPBufferSize))
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	return err
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
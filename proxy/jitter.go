@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// jitterQueueSize bounds how many datagrams one connection's jitter buffer
+// holds before the backend read loop blocks.
+const jitterQueueSize = 1024
+
+type jitterPacket struct {
+	payload   []byte
+	arrival   time.Time
+	heartbeat bool
+}
+
+// jitterBuffer delays backend datagrams so bursts reach the client at a
+// steadier pace. Datagrams are released at the average inter-arrival gap
+// after the previous one, but never later than delay after their own
+// arrival, so the added latency stays bounded by delay.
+type jitterBuffer struct {
+	delay time.Duration
+	queue chan jitterPacket
+
+	lastArrival time.Time
+
+	mu     sync.Mutex
+	avgGap time.Duration
+	err    error
+}
+
+func newJitterBuffer(delay time.Duration) *jitterBuffer {
+	return &jitterBuffer{
+		delay: delay,
+		queue: make(chan jitterPacket, jitterQueueSize),
+	}
+}
+
+// push queues a copy of payload, returning the error that stopped the
+// release loop, if any. It must only be called from one goroutine.
+func (j *jitterBuffer) push(payload []byte, heartbeat bool) error {
+	now := time.Now()
+	j.mu.Lock()
+	err := j.err
+	if !heartbeat && !j.lastArrival.IsZero() {
+		// Exponentially weighted moving average over roughly 16 datagrams.
+		j.avgGap += (now.Sub(j.lastArrival) - j.avgGap) / 16
+	}
+	j.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if !heartbeat {
+		j.lastArrival = now
+	}
+
+	metricJitterDepth.add(1)
+	j.queue <- jitterPacket{
+		payload:   append([]byte(nil), payload...),
+		arrival:   now,
+		heartbeat: heartbeat,
+	}
+	return nil
+}
+
+// close stops the release loop once it has drained the queue.
+func (j *jitterBuffer) close() {
+	close(j.queue)
+}
+
+// run releases queued datagrams through write until the queue is closed or
+// write fails.
+func (j *jitterBuffer) run(write func(pkt jitterPacket) error) {
+	var lastRelease time.Time
+	for pkt := range j.queue {
+		metricJitterDepth.add(-1)
+
+		j.mu.Lock()
+		due := lastRelease.Add(j.avgGap)
+		j.mu.Unlock()
+		if due.Before(pkt.arrival) {
+			due = pkt.arrival
+		}
+		if latest := pkt.arrival.Add(j.delay); due.After(latest) {
+			due = latest
+		}
+		time.Sleep(time.Until(due))
+		lastRelease = due
+
+		if err := write(pkt); err != nil {
+			j.mu.Lock()
+			j.err = err
+			j.mu.Unlock()
+			// Drain so pushes never block on a dead connection.
+			for range j.queue {
+				metricJitterDepth.add(-1)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// jitterRelease is a datagram as a jitter buffer released it.
+type jitterRelease struct {
+	pkt jitterPacket
+	at  time.Time
+}
+
+// runJitter pushes a datagram after each of gaps through a buffer of
+// delay, and returns them as released.
+func runJitter(t *testing.T, delay time.Duration, gaps []time.Duration) []jitterRelease {
+	t.Helper()
+	j := newJitterBuffer(delay)
+	released := make(chan jitterRelease, len(gaps))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		j.run(func(pkt jitterPacket) error {
+			released <- jitterRelease{pkt: pkt, at: time.Now()}
+			return nil
+		})
+	}()
+	payload := make([]byte, 2)
+	for i, gap := range gaps {
+		time.Sleep(gap)
+		payload[0], payload[1] = byte(i>>8), byte(i)
+		if err := j.push(payload, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.close()
+	<-done
+	close(released)
+	var got []jitterRelease
+	for r := range released {
+		got = append(got, r)
+	}
+	return got
+}
+
+func repeatGap(n int, gap time.Duration) []time.Duration {
+	gaps := make([]time.Duration, n)
+	for i := range gaps {
+		gaps[i] = gap
+	}
+	return gaps
+}
+
+func TestJitterBuffer(t *testing.T) {
+	const (
+		gap   = 20 * time.Millisecond
+		delay = 150 * time.Millisecond
+		// slack allows for the scheduler waking a sleeper late.
+		slack = 30 * time.Millisecond
+	)
+	tests := []struct {
+		name  string
+		gaps  []time.Duration
+		delay time.Duration
+		// paced is the index from which releases must be spaced by at
+		// least minSpacing, though they arrived together.
+		paced      int
+		minSpacing time.Duration
+	}{{
+		name:  "steady",
+		gaps:  repeatGap(10, gap),
+		delay: delay,
+	}, {
+		name:  "burst from the start",
+		gaps:  repeatGap(10, 0),
+		delay: delay,
+	}, {
+		// After steady traffic the average gap is near gap, so the burst
+		// is spread out rather than sent at once.
+		name:       "burst after steady traffic",
+		gaps:       append(repeatGap(30, gap), repeatGap(5, 0)...),
+		delay:      delay,
+		paced:      30,
+		minSpacing: gap / 4,
+	}, {
+		// A short delay caps the pacing of the same burst.
+		name:  "burst capped by the delay",
+		gaps:  append(repeatGap(30, gap), repeatGap(20, 0)...),
+		delay: 30 * time.Millisecond,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := runJitter(t, tt.delay, tt.gaps)
+			if len(got) != len(tt.gaps) {
+				t.Fatalf("%d datagrams released, want %d", len(got), len(tt.gaps))
+			}
+			for i, r := range got {
+				if id := int(r.pkt.payload[0])<<8 | int(r.pkt.payload[1]); id != i {
+					t.Fatalf("datagram %d released as %d", id, i)
+				}
+				if r.at.Before(r.pkt.arrival) {
+					t.Errorf("datagram %d released before it arrived", i)
+				}
+				if held := r.at.Sub(r.pkt.arrival); held > tt.delay+slack {
+					t.Errorf("datagram %d held %s, over the %s delay", i, held, tt.delay)
+				}
+				if tt.paced > 0 && i > tt.paced {
+					if spacing := r.at.Sub(got[i-1].at); spacing < tt.minSpacing {
+						t.Errorf("datagram %d released %s after the previous, want at least %s", i, spacing, tt.minSpacing)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestJitterBufferCopies(t *testing.T) {
+	j := newJitterBuffer(time.Millisecond)
+	payload := []byte("first")
+	j.push(payload, false)
+	copy(payload, "xxxxx")
+	j.close()
+	j.run(func(pkt jitterPacket) error {
+		if string(pkt.payload) != "first" {
+			t.Errorf("released %q, want the payload as pushed", pkt.payload)
+		}
+		return nil
+	})
+}
+
+func TestJitterBufferHeartbeats(t *testing.T) {
+	j := newJitterBuffer(time.Millisecond)
+	for i := 0; i < 4; i++ {
+		time.Sleep(5 * time.Millisecond)
+		j.push(nil, true)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.avgGap != 0 {
+		t.Errorf("heartbeats moved the average gap to %s", j.avgGap)
+	}
+	if !j.lastArrival.IsZero() {
+		t.Error("heartbeats counted as arrivals")
+	}
+}
+
+func TestJitterBufferWriteError(t *testing.T) {
+	j := newJitterBuffer(time.Millisecond)
+	errGone := errors.New("client gone")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		j.run(func(jitterPacket) error { return errGone })
+	}()
+	if err := j.push([]byte("a"), false); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(testIOTimeout)
+	var err error
+	// Pushes past the queue size must not block once run has failed.
+	for i := 0; err == nil; i++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("push still succeeding after %d datagrams", i)
+		}
+		err = j.push([]byte("b"), false)
+	}
+	if err != errGone {
+		t.Errorf("push error %v, want %v", err, errGone)
+	}
+	j.close()
+	<-done
+}
@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // SHA-256 for HS256, RS256 and ES256
+	_ "crypto/sha512" // SHA-384 and SHA-512 for the other variants
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// jwksRefreshInterval limits how often an unknown key ID triggers a JWKS
+// refetch, so clients cannot make the proxy hammer the key server.
+const jwksRefreshInterval = time.Minute
+
+var errInvalidToken = errors.New("invalid token")
+
+// jwtClaims are the claims the proxy routes on. Backend and Data are
+// optional; when absent the usual backend selection and configured data type
+// apply.
+type jwtClaims struct {
+	Backend string  `json:"backend"`
+	Data    string  `json:"data"`
+	Exp     float64 `json:"exp"`
+	Nbf     float64 `json:"nbf"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtVerifier checks HMAC tokens against a shared secret and RSA or ECDSA
+// tokens against a JWKS.
+type jwtVerifier struct {
+	secret []byte
+	jwks   *jwksCache
+	now    func() time.Time
+}
+
+// tokenFromRequest takes a bearer token from Authorization, falling back to
+// the token query parameter for browsers, which cannot set headers on
+// WebSocket upgrades.
+func tokenFromRequest(c *fiber.Ctx) string {
+	auth := c.Get(fiber.HeaderAuthorization)
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return c.Query("token")
+}
+
+func (v *jwtVerifier) verify(token string) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errInvalidToken
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errInvalidToken
+	}
+	if err = v.verifySignature(header, parts[0]+"."+parts[1], sig); err != nil {
+		return claims, err
+	}
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return claims, err
+	}
+	now := float64(v.now().Unix())
+	if claims.Exp != 0 && now >= claims.Exp {
+		return claims, errors.New("token expired")
+	}
+	if claims.Nbf != 0 && now < claims.Nbf {
+		return claims, errors.New("token not valid yet")
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errInvalidToken
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+func (v *jwtVerifier) verifySignature(header jwtHeader, signed string, sig []byte) error {
+	unsupported := fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	if len(header.Alg) != 5 {
+		return unsupported
+	}
+	family := header.Alg[:2]
+	hash, ok := jwtHashes[header.Alg[2:]]
+	if !ok {
+		return unsupported
+	}
+
+	switch family {
+	case "HS":
+		if len(v.secret) == 0 {
+			return unsupported
+		}
+		mac := hmac.New(hash.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errInvalidToken
+		}
+		return nil
+	case "RS", "ES":
+		if v.jwks == nil {
+			return unsupported
+		}
+		key, err := v.jwks.key(header.Kid)
+		if err != nil {
+			return err
+		}
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest := h.Sum(nil)
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if family == "RS" && rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if family == "ES" && len(sig) == 2*size &&
+				ecdsa.Verify(key, digest,
+					new(big.Int).SetBytes(sig[:size]),
+					new(big.Int).SetBytes(sig[size:])) {
+				return nil
+			}
+		}
+		return errInvalidToken
+	}
+	return unsupported
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// jwksCache holds the keys of a JWKS endpoint by key ID. The endpoint is
+// fetched outside mu, so a slow one only holds up the tokens signed with
+// a key the cache does not have yet.
+type jwksCache struct {
+	url string
+	now func() time.Time
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	// fetching is closed when the refetch under way, if any, is done.
+	fetching chan struct{}
+	fetchErr error
+}
+
+func newJWKSCache(url string, now func() time.Time) (*jwksCache, error) {
+	c := &jwksCache{url: url, now: now, fetchedAt: now()}
+	keys, err := c.fetch()
+	if err != nil {
+		return nil, err
+	}
+	c.keys = keys
+	return c, nil
+}
+
+// key returns the key for kid, refetching the set at most once per
+// jwksRefreshInterval when kid is unknown, e.g. after a key rotation.
+// Callers wanting a key while a refetch is under way wait for it rather
+// than starting another.
+func (c *jwksCache) key(kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	if key, ok := c.keys[kid]; ok {
+		c.mu.Unlock()
+		return key, nil
+	}
+	fetching := c.fetching
+	if fetching == nil && c.now().Sub(c.fetchedAt) >= jwksRefreshInterval {
+		fetching = make(chan struct{})
+		c.fetching = fetching
+		c.fetchedAt = c.now()
+		c.mu.Unlock()
+		keys, err := c.fetch()
+		c.mu.Lock()
+		if err == nil {
+			c.keys = keys
+		}
+		c.fetchErr = err
+		c.fetching = nil
+		close(fetching)
+		c.mu.Unlock()
+	} else {
+		c.mu.Unlock()
+		if fetching != nil {
+			<-fetching
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	if fetching != nil && c.fetchErr != nil {
+		return nil, c.fetchErr
+	}
+	return nil, fmt.Errorf("unknown token key %q", kid)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch gets the key set from the endpoint. It touches none of c's
+// guarded state, so it runs without mu.
+func (c *jwksCache) fetch() (map[string]crypto.PublicKey, error) {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(c.url)
+	if err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch jwks: %s", resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("parse jwks: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// signedToken returns a token of header and claims, signed by sign over
+// its first two segments.
+func signedToken(t *testing.T, header jwtHeader, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64.EncodeToString(h) + "." + b64.EncodeToString(c)
+	return signed + "." + b64.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func es256(t *testing.T, key *ecdsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+}
+
+func rs256(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+// tampered swaps the claims of token for claims, keeping its signature.
+func tampered(t *testing.T, token string, claims map[string]interface{}) string {
+	t.Helper()
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	return parts[0] + "." + b64.EncodeToString(c) + "." + parts[2]
+}
+
+func TestJWTVerifySecret(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	secret := []byte("s3cret")
+	hs := jwtHeader{Alg: "HS256"}
+	valid := map[string]interface{}{"backend": "10.0.0.1:9000", "data": "binary", "exp": now.Unix() + 60}
+	validToken := signedToken(t, hs, valid, hs256(secret))
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"valid", validToken, ""},
+		{"no expiry", signedToken(t, hs, map[string]interface{}{"backend": "b"}, hs256(secret)), ""},
+		{"expired", signedToken(t, hs, map[string]interface{}{"exp": now.Unix() - 1}, hs256(secret)), "token expired"},
+		{"expires now", signedToken(t, hs, map[string]interface{}{"exp": now.Unix()}, hs256(secret)), "token expired"},
+		{"not valid yet", signedToken(t, hs, map[string]interface{}{"nbf": now.Unix() + 60}, hs256(secret)), "token not valid yet"},
+		{"bad signature", signedToken(t, hs, valid, hs256([]byte("other"))), "invalid token"},
+		{"tampered claims", tampered(t, validToken, map[string]interface{}{"backend": "evil:53", "exp": now.Unix() + 60}), "invalid token"},
+		{"alg none", signedToken(t, jwtHeader{Alg: "none"}, valid, func([]byte) []byte { return nil }), "unsupported token algorithm"},
+		{"RS256 without JWKS", signedToken(t, jwtHeader{Alg: "RS256"}, valid, hs256(secret)), "unsupported token algorithm"},
+		{"two segments", "a.b", "invalid token"},
+		{"bad base64", "!!.!!.!!", "invalid token"},
+	}
+	v := &jwtVerifier{secret: secret, now: func() time.Time { return now }}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.verify(tt.token)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.name == "valid" && (claims.Backend != "10.0.0.1:9000" || claims.Data != "binary") {
+				t.Errorf("claims %+v", claims)
+			}
+		})
+	}
+}
+
+// jwksServer serves a key set that tests can swap, and can be made to
+// hold requests until released.
+type jwksServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    []jwk
+	fetches int
+	hold    chan struct{}
+}
+
+func newJWKSServer(t *testing.T, keys ...jwk) *jwksServer {
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.fetches++
+		hold, keys := s.hold, s.keys
+		s.mu.Unlock()
+		if hold != nil {
+			<-hold
+		}
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) set(keys ...jwk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) jwk {
+	return jwk{
+		Kty: "EC", Kid: kid, Crv: "P-256",
+		X: b64.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y: b64.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) jwk {
+	return jwk{
+		Kty: "RSA", Kid: kid,
+		N: b64.EncodeToString(key.N.Bytes()),
+		E: b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// fakeClock is a settable time, for the JWKS refresh interval and the
+// proxy's Config.Clock.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func TestJWTVerifyJWKS(t *testing.T) {
+	ec1, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ec2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsa1, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newJWKSServer(t, ecJWK("ec1", ec1), rsaJWK("rsa1", rsa1))
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	jwks, err := newJWKSCache(srv.URL, clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &jwtVerifier{jwks: jwks, now: clock.now}
+	claims := map[string]interface{}{"backend": "b"}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"ES256", signedToken(t, jwtHeader{Alg: "ES256", Kid: "ec1"}, claims, es256(t, ec1)), true},
+		{"RS256", signedToken(t, jwtHeader{Alg: "RS256", Kid: "rsa1"}, claims, rs256(t, rsa1)), true},
+		{"ES256 by another key", signedToken(t, jwtHeader{Alg: "ES256", Kid: "ec1"}, claims, es256(t, ec2)), false},
+		{"ES256 under an RSA key", signedToken(t, jwtHeader{Alg: "ES256", Kid: "rsa1"}, claims, es256(t, ec1)), false},
+		{"HS256 without secret", signedToken(t, jwtHeader{Alg: "HS256"}, claims, hs256([]byte("x"))), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := v.verify(tt.token); (err == nil) != tt.ok {
+				t.Errorf("error %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+
+	t.Run("rotation", func(t *testing.T) {
+		srv.set(ecJWK("ec2", ec2))
+		rotated := signedToken(t, jwtHeader{Alg: "ES256", Kid: "ec2"}, claims, es256(t, ec2))
+		// The set was fetched just now, so the new key is not looked for.
+		if _, err := v.verify(rotated); err == nil {
+			t.Fatal("key ec2 found before the refresh interval passed")
+		}
+		clock.advance(jwksRefreshInterval)
+		if _, err := v.verify(rotated); err != nil {
+			t.Fatalf("after rotation: %v", err)
+		}
+		old := signedToken(t, jwtHeader{Alg: "ES256", Kid: "ec1"}, claims, es256(t, ec1))
+		if _, err := v.verify(old); err == nil {
+			t.Error("key ec1 still accepted after it was rotated out")
+		}
+	})
+}
+
+// TestJWKSFetchOutsideLock checks a hanging JWKS endpoint only holds up
+// tokens needing the refetch, not ones signed by a key already cached.
+func TestJWKSFetchOutsideLock(t *testing.T) {
+	ec1, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ec2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	srv := newJWKSServer(t, ecJWK("ec1", ec1))
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	jwks, err := newJWKSCache(srv.URL, clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &jwtVerifier{jwks: jwks, now: clock.now}
+	claims := map[string]interface{}{}
+	known := signedToken(t, jwtHeader{Alg: "ES256", Kid: "ec1"}, claims, es256(t, ec1))
+	unknown := signedToken(t, jwtHeader{Alg: "ES256", Kid: "ec2"}, claims, es256(t, ec2))
+
+	hold := make(chan struct{})
+	release := sync.OnceFunc(func() { close(hold) })
+	// A failure must not leave the server's handlers held.
+	t.Cleanup(release)
+	srv.mu.Lock()
+	srv.hold = hold
+	srv.keys = []jwk{ecJWK("ec1", ec1), ecJWK("ec2", ec2)}
+	srv.mu.Unlock()
+	clock.advance(jwksRefreshInterval)
+
+	const waiters = 4
+	results := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			_, err := v.verify(unknown)
+			results <- err
+		}()
+	}
+	// Let the refetch get under way.
+	deadline := time.Now().Add(time.Second)
+	for {
+		srv.mu.Lock()
+		started := srv.fetches == 2
+		srv.mu.Unlock()
+		if started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refetch did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := v.verify(known)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("token with a cached key waited for the JWKS fetch")
+	}
+
+	release()
+	for i := 0; i < waiters; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("waiter: %v", err)
+		}
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.fetches != 2 {
+		t.Errorf("%d fetches, want 2: waiters should share one refetch", srv.fetches)
+	}
+}
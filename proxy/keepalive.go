@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// pong records a pong from the client, for keepAlive.
+func (s *session) pong(string) error {
+	atomic.StoreInt64(&s.lastPong, s.proxy.now().UnixNano())
+	return nil
+}
+
+// keepAlive pings the client every PingInterval and kills the session with
+// ClosePongTimeout once a ping has gone unanswered for PongTimeout, which
+// catches clients whose connection died without a FIN, such as behind an
+// expired NAT mapping, long before a write would fail. A ping is only sent
+// when the previous one was answered. It returns once ctx is done.
+func (s *session) keepAlive(ctx context.Context) {
+	cfg := &s.proxy.cfg
+	ticker := time.NewTicker(cfg.PingInterval)
+	defer ticker.Stop()
+	var pingSent int64
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		now := s.proxy.now()
+		if pingSent != 0 && atomic.LoadInt64(&s.lastPong) < pingSent {
+			if now.Sub(time.Unix(0, pingSent)) < cfg.PongTimeout {
+				continue
+			}
+			metricPongTimeouts.inc()
+			slog.Info("client did not answer a ping", "client", s.id, "pong_timeout", cfg.PongTimeout)
+			s.lose(ClosePongTimeout, "pong timeout")
+			return
+		}
+		pingSent = now.UnixNano()
+		// A failed write surfaces in the forwarding goroutines.
+		s.writeControl(websocket.PingMessage, nil, now.Add(cfg.PongTimeout))
+	}
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// slotClaimTimeout is how long a slot reserved by the middleware waits for
+// the handler. The upgrade can still fail after the middleware is done, e.g.
+// when writing the 101 response, and then the handler never runs.
+const slotClaimTimeout = 10 * time.Second
+
+var (
+	errBackendFull       = errors.New("backend at its connection limit")
+	errTooManyConns      = errors.New("too many connections")
+	errTooManyHandshakes = errors.New("too many pending handshakes")
+)
+
+// connLimiter enforces Config.MaxConns and Config.BackendMaxConns and
+// tracks the active connections per backend. When the global limit is
+// reached, upgrades queue per backend and freed slots go round-robin across
+// the backends with waiters, so a flood to one backend only delays the
+// others by its fair share.
+type connLimiter struct {
+	global    int
+	byBackend map[string]int
+	backends  []string
+
+	mu     sync.Mutex
+	active int
+	counts map[string]int
+	queues map[string][]chan struct{}
+	next   int
+}
+
+func newConnLimiter(backends []string, global int, byBackend map[string]int) *connLimiter {
+	l := &connLimiter{
+		global:    global,
+		byBackend: byBackend,
+		backends:  backends,
+		counts:    make(map[string]int, len(backends)),
+		queues:    make(map[string][]chan struct{}),
+	}
+	for _, b := range backends {
+		metricBackendActive.set(b, 0)
+	}
+	return l
+}
+
+// acquire reserves a slot for a connection to backend, waiting up to wait
+// for a global slot.
+func (l *connLimiter) acquire(backend string, wait time.Duration) (*connSlot, error) {
+	l.mu.Lock()
+	if limit := l.byBackend[backend]; limit > 0 &&
+		l.counts[backend]+len(l.queues[backend]) >= limit {
+		l.mu.Unlock()
+		return nil, errBackendFull
+	}
+	if l.global == 0 || l.active < l.global {
+		l.admitLocked(backend)
+		l.mu.Unlock()
+		return l.newSlot(backend), nil
+	}
+	if wait <= 0 {
+		l.mu.Unlock()
+		return nil, errTooManyConns
+	}
+	ready := make(chan struct{})
+	l.queues[backend] = append(l.queues[backend], ready)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return l.newSlot(backend), nil
+	case <-timer.C:
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	queue := l.queues[backend]
+	for i, ch := range queue {
+		if ch == ready {
+			l.queues[backend] = append(queue[:i:i], queue[i+1:]...)
+			return nil, errTooManyConns
+		}
+	}
+	// Granted between the timeout and taking the lock.
+	return l.newSlot(backend), nil
+}
+
+func (l *connLimiter) admitLocked(backend string) {
+	l.active++
+	l.counts[backend]++
+	metricBackendActive.set(backend, int64(l.counts[backend]))
+}
+
+// release frees a slot of backend and hands it to the next backend in turn
+// that has a waiter.
+func (l *connLimiter) release(backend string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.counts[backend]--
+	metricBackendActive.set(backend, int64(l.counts[backend]))
+	l.wakeLocked()
+}
+
+// wakeLocked admits the waiter of the next backend in turn that has one,
+// and reports whether there was any.
+func (l *connLimiter) wakeLocked() bool {
+	for range l.backends {
+		b := l.backends[l.next%len(l.backends)]
+		l.next++
+		if queue := l.queues[b]; len(queue) > 0 {
+			l.queues[b] = queue[1:]
+			l.admitLocked(b)
+			close(queue[0])
+			return true
+		}
+	}
+	return false
+}
+
+// setGlobal changes the global limit, admitting waiters a higher one has
+// room for.
+func (l *connLimiter) setGlobal(global int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.global = global
+	for l.global == 0 || l.active < l.global {
+		if !l.wakeLocked() {
+			return
+		}
+	}
+}
+
+// count returns the active connections to backend, including slots
+// reserved for upgrades still in progress.
+func (l *connLimiter) count(backend string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counts[backend]
+}
+
+// snapshot copies the active connections per backend.
+func (l *connLimiter) snapshot() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counts := make(map[string]int, len(l.backends))
+	for _, b := range l.backends {
+		counts[b] = l.counts[b]
+	}
+	return counts
+}
+
+func (l *connLimiter) newSlot(backend string) *connSlot {
+	s := &connSlot{limiter: l, backend: backend}
+	time.AfterFunc(slotClaimTimeout, s.expire)
+	return s
+}
+
+// connSlot is a reserved connection. The handler claims it and releases it
+// when the connection ends; a slot nobody claims in time expires.
+type connSlot struct {
+	limiter *connLimiter
+	backend string
+	state   int32 // 0 reserved, 1 claimed, 2 released
+}
+
+// claim reports whether the slot was still reserved and is now the
+// caller's to release.
+func (s *connSlot) claim() bool {
+	return atomic.CompareAndSwapInt32(&s.state, 0, 1)
+}
+
+// release frees a claimed slot, or an unclaimed one if the upgrade failed.
+func (s *connSlot) release() {
+	if atomic.CompareAndSwapInt32(&s.state, 1, 2) ||
+		atomic.CompareAndSwapInt32(&s.state, 0, 2) {
+		s.limiter.release(s.backend)
+	}
+}
+
+func (s *connSlot) expire() {
+	if atomic.CompareAndSwapInt32(&s.state, 0, 2) {
+		s.limiter.release(s.backend)
+	}
+}
+
+// handshakeGate enforces Config.MaxPendingHandshakes, counting upgrades
+// from the middleware until the handler starts. A nil gate admits all.
+type handshakeGate struct {
+	max     int32
+	pending int32
+}
+
+func newHandshakeGate(max int) *handshakeGate {
+	if max <= 0 {
+		return nil
+	}
+	return &handshakeGate{max: int32(max)}
+}
+
+// enter takes a handshake slot, returning the func handing it back, or
+// errTooManyHandshakes. Like a connection slot, one the handler never
+// hands back is freed after slotClaimTimeout.
+func (g *handshakeGate) enter() (func(), error) {
+	if g == nil {
+		return func() {}, nil
+	}
+	if atomic.AddInt32(&g.pending, 1) > g.max {
+		atomic.AddInt32(&g.pending, -1)
+		metricHandshakesShed.inc()
+		return nil, errTooManyHandshakes
+	}
+	metricPendingHandshakes.add(1)
+	var once sync.Once
+	var timer *time.Timer
+	done := func() {
+		once.Do(func() {
+			timer.Stop()
+			atomic.AddInt32(&g.pending, -1)
+			metricPendingHandshakes.add(-1)
+		})
+	}
+	timer = time.AfterFunc(slotClaimTimeout, done)
+	return done, nil
+}
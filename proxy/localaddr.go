@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ParsePortRange parses an inclusive port range such as 40000-40999, or a
+// single port, for Config.UDPPortMin and Config.UDPPortMax.
+func ParsePortRange(s string) (lo, hi int, err error) {
+	loStr, hiStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hiStr = loStr
+	}
+	lo, err = strconv.Atoi(loStr)
+	if err == nil {
+		hi, err = strconv.Atoi(hiStr)
+	}
+	if err != nil || lo < 1 || hi > 65535 || hi < lo {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return lo, hi, nil
+}
+
+// bindLocal calls bind with the local address backend sockets should
+// have: Config.UDPBindAddr, nil when unset, and a port from
+// Config.UDPPortMin to UDPPortMax, 0 when unset. Ports are tried from a
+// random one on, until one is not in use.
+func (p *Proxy) bindLocal(bind func(ip net.IP, port int) error) error {
+	if p.cfg.UDPPortMin == 0 {
+		return bind(p.bindIP, 0)
+	}
+	n := p.cfg.UDPPortMax - p.cfg.UDPPortMin + 1
+	start := rand.Intn(n)
+	var err error
+	for i := 0; i < n; i++ {
+		port := p.cfg.UDPPortMin + (start+i)%n
+		if err = bind(p.bindIP, port); !errors.Is(err, syscall.EADDRINUSE) {
+			return err
+		}
+	}
+	return fmt.Errorf("no free source port in %d-%d: %w", p.cfg.UDPPortMin, p.cfg.UDPPortMax, err)
+}
+
+// localHostPort is the address to listen on for bindLocal's ip and port.
+func localHostPort(ip net.IP, port int) string {
+	if ip == nil {
+		return net.JoinHostPort("", strconv.Itoa(port))
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
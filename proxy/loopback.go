@@ -0,0 +1,48 @@
+package proxy
+
+import "time"
+
+// defaultLoopbackRate caps looped datagrams per connection and second.
+const defaultLoopbackRate = 100
+
+// loopbackLimiter is a token bucket holding up to one second's worth of
+// looped datagrams. It keeps a backend that answers every loopback with
+// another datagram from turning the proxy into an amplifier.
+type loopbackLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newLoopbackLimiter(rate int, now time.Time) *loopbackLimiter {
+	return &loopbackLimiter{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+func (l *loopbackLimiter) allow(now time.Time) bool {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// loopback sends a copy of a backend datagram straight back to the backend,
+// for protocols that expect an acknowledgment of each one. It is best
+// effort: copies over the rate or failing to send are only counted as
+// dropped, since the datagram itself still goes to the client.
+func (s *session) loopback(limiter *loopbackLimiter, payload []byte) {
+	if !limiter.allow(s.proxy.now()) {
+		metricLoopbackDropped.inc()
+		return
+	}
+	if _, err := s.udpConn.Write(payload); err != nil {
+		metricLoopbackDropped.inc()
+		return
+	}
+	metricLoopback.inc()
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// magicTimeout is how long a client has to send its first datagram when
+// Config.RequireMagic is set.
+const magicTimeout = 10 * time.Second
+
+// checkMagic reads the client's first datagram and checks it for
+// Config.RequireMagic, closing the connection if it lacks the prefix. It
+// returns the datagram to forward, nil if there is none left after
+// stripping the prefix, and whether the connection may go on.
+func (p *Proxy) checkMagic(c clientConn, clientID string, dataType string) ([]byte, bool) {
+	c.SetReadDeadline(time.Now().Add(magicTimeout))
+	msg, err := readClientMessage(c, dataType, clientMsgType(&p.cfg, dataType))
+	c.SetReadDeadline(time.Time{})
+
+	code, reason := websocket.ClosePolicyViolation, "magic prefix required"
+	switch {
+	case errors.Is(err, errWrongDataType):
+		code, reason = websocket.CloseUnsupportedData, err.Error()
+	case errors.Is(err, errBadEncoding):
+		code, reason = websocket.CloseInvalidFramePayloadData, err.Error()
+	case err != nil:
+		slog.Warn("first message error", "client", clientID, "error", err)
+	case !bytes.HasPrefix(msg, p.cfg.RequireMagic):
+		metricMagicRejected.inc()
+		slog.Info("first message lacks the magic prefix", "client", clientID)
+	default:
+		if !p.cfg.StripMagic {
+			return msg, true
+		}
+		if msg = msg[len(p.cfg.RequireMagic):]; len(msg) == 0 {
+			return nil, true
+		}
+		return msg, true
+	}
+	c.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(time.Second),
+	)
+	return nil, false
+}
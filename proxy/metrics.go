@@ -0,0 +1,450 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// counter is a monotonically increasing Prometheus counter.
+type counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+func (m *counter) inc()         { atomic.AddUint64(&m.value, 1) }
+func (m *counter) add(n uint64) { atomic.AddUint64(&m.value, n) }
+func (m *counter) load() uint64 { return atomic.LoadUint64(&m.value) }
+func (m *counter) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+		m.name, m.help, m.name, m.name, m.load())
+}
+
+// gauge is a Prometheus gauge that can go up and down.
+type gauge struct {
+	name  string
+	help  string
+	value int64
+}
+
+func (m *gauge) add(n int64) { atomic.AddInt64(&m.value, n) }
+func (m *gauge) load() int64 { return atomic.LoadInt64(&m.value) }
+func (m *gauge) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n",
+		m.name, m.help, m.name, m.name, m.load())
+}
+
+// gaugeVec is a Prometheus gauge with one label, whose values are added as
+// they are first set.
+type gaugeVec struct {
+	name  string
+	help  string
+	label string
+
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+func (m *gaugeVec) set(value string, n int64) {
+	m.mu.Lock()
+	m.values[value] = n
+	m.mu.Unlock()
+}
+
+// add changes the value by n.
+func (m *gaugeVec) add(value string, n int64) {
+	m.mu.Lock()
+	m.values[value] += n
+	m.mu.Unlock()
+}
+
+func (m *gaugeVec) write(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s{%s=%q} %d\n", m.name, m.label, k, m.values[k])
+	}
+}
+
+// funcGaugeVec is a Prometheus gauge with one label whose values are read
+// from funcs at scrape time, for values that live elsewhere and come and go.
+type funcGaugeVec struct {
+	name  string
+	help  string
+	label string
+
+	mu    sync.Mutex
+	funcs map[string]func() float64
+}
+
+func (m *funcGaugeVec) set(value string, f func() float64) {
+	m.mu.Lock()
+	m.funcs[value] = f
+	m.mu.Unlock()
+}
+
+func (m *funcGaugeVec) delete(value string) {
+	m.mu.Lock()
+	delete(m.funcs, value)
+	m.mu.Unlock()
+}
+
+func (m *funcGaugeVec) write(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+	keys := make([]string, 0, len(m.funcs))
+	for k := range m.funcs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s{%s=%q} %g\n", m.name, m.label, k, m.funcs[k]())
+	}
+}
+
+// histogram is a Prometheus histogram with a fixed set of label values,
+// each registered up front with series.
+type histogram struct {
+	name   string
+	help   string
+	bounds []float64
+	series []*histogramSeries
+}
+
+// histogramSeries is one label set of a histogram. counts[i] counts
+// observations up to bounds[i], the last slot is for the +Inf bucket.
+type histogramSeries struct {
+	h        *histogram
+	labels   string
+	counts   []uint64
+	sumNanos uint64
+}
+
+func (m *histogram) with(labels string) *histogramSeries {
+	s := &histogramSeries{h: m, labels: labels, counts: make([]uint64, len(m.bounds)+1)}
+	m.series = append(m.series, s)
+	return s
+}
+
+func (s *histogramSeries) observe(d time.Duration) {
+	i, secs := 0, d.Seconds()
+	for i < len(s.h.bounds) && secs > s.h.bounds[i] {
+		i++
+	}
+	atomic.AddUint64(&s.counts[i], 1)
+	atomic.AddUint64(&s.sumNanos, uint64(d))
+}
+
+// since observes the time elapsed from start.
+func (s *histogramSeries) since(start time.Time) { s.observe(time.Since(start)) }
+
+func (m *histogram) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", m.name, m.help, m.name)
+	for _, s := range m.series {
+		var cum uint64
+		for i, bound := range m.bounds {
+			cum += atomic.LoadUint64(&s.counts[i])
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"%s\"} %d\n",
+				m.name, s.labels, strconv.FormatFloat(bound, 'g', -1, 64), cum)
+		}
+		cum += atomic.LoadUint64(&s.counts[len(m.bounds)])
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", m.name, s.labels, cum)
+		fmt.Fprintf(b, "%s_sum{%s} %g\n", m.name, s.labels,
+			time.Duration(atomic.LoadUint64(&s.sumNanos)).Seconds())
+		fmt.Fprintf(b, "%s_count{%s} %d\n", m.name, s.labels, cum)
+	}
+}
+
+type metric interface {
+	write(b *strings.Builder)
+}
+
+// metrics lists everything served on /metrics, in output order.
+var metrics []metric
+
+func newCounter(name string, help string) *counter {
+	m := &counter{name: name, help: help}
+	metrics = append(metrics, m)
+	return m
+}
+
+func newGauge(name string, help string) *gauge {
+	m := &gauge{name: name, help: help}
+	metrics = append(metrics, m)
+	return m
+}
+
+func newGaugeVec(name string, help string, label string) *gaugeVec {
+	m := &gaugeVec{name: name, help: help, label: label, values: make(map[string]int64)}
+	metrics = append(metrics, m)
+	return m
+}
+
+func newFuncGaugeVec(name string, help string, label string) *funcGaugeVec {
+	m := &funcGaugeVec{name: name, help: help, label: label, funcs: make(map[string]func() float64)}
+	metrics = append(metrics, m)
+	return m
+}
+
+func newHistogram(name string, help string, bounds []float64) *histogram {
+	m := &histogram{name: name, help: help, bounds: bounds}
+	metrics = append(metrics, m)
+	return m
+}
+
+// latencyBounds spans 10µs to 1s, which covers everything from a local
+// syscall to a client on a congested link.
+var latencyBounds = []float64{
+	0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1,
+}
+
+var (
+	metricConnsActive = newGauge(
+		"udpwsproxy_connections_active",
+		"Clients currently forwarding.",
+	)
+	metricDraining = newGauge(
+		"udpwsproxy_draining",
+		"1 while shutting down and waiting for connections to end.",
+	)
+	metricConnsTotal = newCounter(
+		"udpwsproxy_connections_total",
+		"Clients that started forwarding.",
+	)
+	metricBytesToBackend = newCounter(
+		"udpwsproxy_client_to_backend_bytes_total",
+		"Payload bytes forwarded from clients to backends.",
+	)
+	metricBytesToClient = newCounter(
+		"udpwsproxy_backend_to_client_bytes_total",
+		"Payload bytes forwarded from backends to clients.",
+	)
+	metricDatagramsToBackend = newCounter(
+		"udpwsproxy_client_to_backend_datagrams_total",
+		"Datagrams forwarded from clients to backends.",
+	)
+	metricDatagramsToClient = newCounter(
+		"udpwsproxy_backend_to_client_datagrams_total",
+		"Datagrams forwarded from backends to clients.",
+	)
+	metricResolveErrors = newCounter(
+		"udpwsproxy_backend_resolve_errors_total",
+		"Backend addresses that failed to resolve when a client connected.",
+	)
+	metricDropped = newCounter(
+		"udpwsproxy_dropped_datagrams_total",
+		"Client datagrams dropped on transient backend write errors.",
+	)
+	metricSizeRejected = newCounter(
+		"udpwsproxy_size_rejected_datagrams_total",
+		"Client datagrams rejected for a length outside allowed-sizes.",
+	)
+	metricRateLimited = newCounter(
+		"udpwsproxy_rate_limited_datagrams_total",
+		"Datagrams dropped for going over a client or global rate limit.",
+	)
+	metricPauseDropped = newCounter(
+		"udpwsproxy_pause_dropped_datagrams_total",
+		"Client datagrams dropped while paused, over pause-buffer.",
+	)
+	metricMagicRejected = newCounter(
+		"udpwsproxy_magic_rejected_total",
+		"Connections closed because their first datagram lacked require-magic.",
+	)
+	metricBackendSessions = newCounter(
+		"udpwsproxy_backend_session_ids_total",
+		"Backend session IDs taken from first backend replies.",
+	)
+	metricBackendSessionShort = newCounter(
+		"udpwsproxy_backend_session_id_short_total",
+		"First backend replies too short to hold a backend session ID.",
+	)
+	metricFlowRecords = newCounter(
+		"udpwsproxy_flow_records_total",
+		"Flow records sent to the flow collector.",
+	)
+	metricFlowErrors = newCounter(
+		"udpwsproxy_flow_record_errors_total",
+		"Flow records that could not be sent to the flow collector.",
+	)
+	metricPSKRejected = newCounter(
+		"udpwsproxy_udp_psk_rejected_datagrams_total",
+		"Backend datagrams dropped for failing authentication with the UDP PSK.",
+	)
+	metricCloseFlushDropped = newCounter(
+		"udpwsproxy_close_flush_dropped_total",
+		"Queued backend datagrams dropped when their connection closed.",
+	)
+	metricBackendErrors = newCounter(
+		"udpwsproxy_backend_errors_total",
+		"Connections whose backend could not be reached or failed mid-session.",
+	)
+	metricQuotaExceeded = newCounter(
+		"udpwsproxy_quota_exceeded_total",
+		"Connections closed for exceeding max-bytes-per-conn.",
+	)
+	metricClientTooSlow = newCounter(
+		"udpwsproxy_slow_client_disconnects_total",
+		"Connections closed for exceeding send-highwater.",
+	)
+	metricStuckReads = newCounter(
+		"udpwsproxy_stuck_backend_reads_total",
+		"Backend sockets closed by the read watchdog.",
+	)
+	metricBackendReconnects = newCounter(
+		"udpwsproxy_backend_reconnects_total",
+		"Backend sockets re-dialed by udp-reconnect after a transient error.",
+	)
+	metricBackendMigrations = newCounter(
+		"udpwsproxy_backend_migrations_total",
+		"Backend sockets moved to a backend's new address by resolve-migrate.",
+	)
+	metricClientsDenied = newCounter(
+		"udpwsproxy_clients_denied_total",
+		"Upgrades refused with 403 by allow-client, deny-client, allow-cert or deny-cert.",
+	)
+	metricBackendsDenied = newCounter(
+		"udpwsproxy_backends_denied_total",
+		"Dials to client-chosen backends outside allow-backend refused.",
+	)
+	metricSessionsParked = newGauge(
+		"udpwsproxy_sessions_parked",
+		"Backend sockets kept for their dropped client to resume.",
+	)
+	metricResumed = newCounter(
+		"udpwsproxy_sessions_resumed_total",
+		"Upgrades that took over a parked backend socket with a resume token.",
+	)
+	metricResumeExpired = newCounter(
+		"udpwsproxy_sessions_resume_expired_total",
+		"Parked backend sockets closed with no client resuming them in time.",
+	)
+	metricSendDropped = newCounter(
+		"udpwsproxy_send_queue_dropped_total",
+		"Backend datagrams dropped for slow clients by send-policy.",
+	)
+	metricSessionLogErrors = newCounter(
+		"udpwsproxy_session_log_errors_total",
+		"Session log records that could not be written.",
+	)
+	metricFilterDropped = newCounter(
+		"udpwsproxy_filter_dropped_total",
+		"Datagrams dropped by a filter.",
+	)
+	metricWebTransportSessions = newCounter(
+		"udpwsproxy_webtransport_sessions_total",
+		"WebTransport sessions accepted.",
+	)
+	metricWebTransportTooLarge = newCounter(
+		"udpwsproxy_webtransport_too_large_total",
+		"Datagrams to WebTransport clients dropped as too large for the path.",
+	)
+	metricBackendFailovers = newCounter(
+		"udpwsproxy_backend_failovers_total",
+		"Backend sockets moved to a udp-failover address once re-dials gave up.",
+	)
+	metricHandshakesRejected = newCounter(
+		"udpwsproxy_handshakes_rejected_total",
+		"Control protocol clients closed for options the proxy refused.",
+	)
+	metricLoopback = newCounter(
+		"udpwsproxy_backend_loopback_total",
+		"Backend datagrams looped back to the backend.",
+	)
+	metricLoopbackDropped = newCounter(
+		"udpwsproxy_backend_loopback_dropped_total",
+		"Backend datagrams not looped back, over the rate or failing to send.",
+	)
+	metricJitterDepth = newGauge(
+		"udpwsproxy_jitter_buffer_depth",
+		"Backend datagrams currently held in jitter buffers.",
+	)
+	metricPendingHandshakes = newGauge(
+		"udpwsproxy_pending_handshakes",
+		"Upgrades past the request headers but not yet WebSocket connections.",
+	)
+	metricHandshakesShed = newCounter(
+		"udpwsproxy_handshakes_shed_total",
+		"Upgrades refused with 503 for too many pending handshakes.",
+	)
+	metricPongTimeouts = newCounter(
+		"udpwsproxy_pong_timeouts_total",
+		"Connections closed for not answering a ping within the pong timeout.",
+	)
+	metricUDPTruncated = newCounter(
+		"udpwsproxy_udp_truncated_datagrams_total",
+		"Backend datagrams or stream frames longer than the UDP buffer, cut to its size.",
+	)
+	metricBackendActive = newGaugeVec(
+		"udpwsproxy_backend_active_connections",
+		"Connections per backend, including upgrades in progress.",
+		"backend",
+	)
+	metricRouteActive = newGaugeVec(
+		"udpwsproxy_route_active_connections",
+		"Connections per WebSocket path.",
+		"route",
+	)
+	metricBreakerState = newGaugeVec(
+		"udpwsproxy_backend_breaker_state",
+		"Backend circuit breaker state: 0 closed, 1 open, 2 half-open.",
+		"backend",
+	)
+	metricSeqDatagrams = newCounter(
+		"udpwsproxy_seq_datagrams_total",
+		"Backend datagrams whose sequence number was checked.",
+	)
+	metricSeqLoss = newFuncGaugeVec(
+		"udpwsproxy_seq_loss_ratio",
+		"Estimated loss over each connection's latest backend sequence numbers.",
+		"client",
+	)
+	metricSeqGaps = newCounter(
+		"udpwsproxy_seq_gaps_total",
+		"Sequence numbers skipped by backend datagrams, lost or arriving late.",
+	)
+	metricSeqReordered = newCounter(
+		"udpwsproxy_seq_reordered_total",
+		"Backend datagrams arriving after a higher sequence number.",
+	)
+	metricSeqDuplicates = newCounter(
+		"udpwsproxy_seq_duplicates_total",
+		"Backend datagrams repeating a recent sequence number.",
+	)
+	metricSeqMalformed = newCounter(
+		"udpwsproxy_seq_malformed_total",
+		"Backend datagrams too short to carry a sequence number.",
+	)
+	metricIOLatency = newHistogram(
+		"udpwsproxy_io_latency_seconds",
+		"Time spent in socket calls; udp_read includes waiting for the backend to send.",
+		latencyBounds,
+	)
+	latencyUDPWrite = metricIOLatency.with(`op="udp_write",direction="client_to_backend"`)
+	latencyUDPRead  = metricIOLatency.with(`op="udp_read",direction="backend_to_client"`)
+	latencyWSWrite  = metricIOLatency.with(`op="ws_write",direction="backend_to_client"`)
+)
+
+// MetricsHandler serves all metrics in the Prometheus text format.
+func MetricsHandler(c *fiber.Ctx) error {
+	var b strings.Builder
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4")
+	return c.SendString(b.String())
+}
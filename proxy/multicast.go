@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// groupConn is the backend socket for a multicast group or a broadcast
+// address. It is not connected, so it takes datagrams from every sender,
+// and writes go to the group.
+type groupConn struct {
+	*net.UDPConn
+	group *net.UDPAddr
+}
+
+func (c *groupConn) Read(b []byte) (int, error) {
+	n, _, err := c.UDPConn.ReadFromUDP(b)
+	return n, err
+}
+
+func (c *groupConn) Write(b []byte) (int, error) {
+	return c.UDPConn.WriteToUDP(b, c.group)
+}
+
+func (c *groupConn) RemoteAddr() net.Addr {
+	return c.group
+}
+
+// dialGroup opens a backend socket for addr, a multicast group, joined on
+// Config.MulticastInterface, or with Config.UDPBroadcast a broadcast
+// address. Every client's socket joins the group on its own, so each gets
+// all of the group's traffic.
+func (p *Proxy) dialGroup(addr *net.UDPAddr) (backendConn, error) {
+	if p.psk != nil || p.cfg.BackendDTLS != nil {
+		return nil, errors.New("udp psk and dtls do not apply to multicast and broadcast backends")
+	}
+	var conn *net.UDPConn
+	var err error
+	if addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", p.multicastIf, addr)
+	} else {
+		conn, err = p.listenBroadcast()
+	}
+	if err != nil {
+		return nil, err
+	}
+	gc := &groupConn{UDPConn: conn, group: addr}
+	p.applyDSCP(gc)
+	p.applyTTL(gc)
+	p.applyBufferSizes(conn)
+	return gc, nil
+}
+
+// listenBroadcast opens an IPv4 socket allowed to send to broadcast
+// addresses, on the local address bindLocal picks.
+func (p *Proxy) listenBroadcast() (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if p.cfg.UDPBindDevice != "" {
+			if err := bindToDevice(p.cfg.UDPBindDevice)(network, address, c); err != nil {
+				return err
+			}
+		}
+		return allowBroadcast(network, address, c)
+	}}
+	var pc net.PacketConn
+	err := p.bindLocal(func(ip net.IP, port int) error {
+		var err error
+		pc, err = lc.ListenPacket(context.Background(), "udp4", localHostPort(ip, port))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
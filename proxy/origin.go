@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ParseOriginPatterns parses a comma-separated list of origin patterns for
+// Config.AllowedOrigins. A pattern is a glob, such as
+// https://*.example.com, whose * matches any run of characters, or a
+// regular expression between slashes, such as /^https://app[0-9]+\.example$/.
+// Globs match the whole origin, case-insensitively.
+func ParseOriginPatterns(s string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		expr := part
+		if len(part) > 2 && strings.HasPrefix(part, "/") && strings.HasSuffix(part, "/") {
+			expr = part[1 : len(part)-1]
+		} else {
+			expr = "(?i)^" + strings.ReplaceAll(regexp.QuoteMeta(part), `\*`, ".*") + "$"
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin pattern %q: %v", part, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// originAllowed reports whether the upgrade may go on as far as its Origin
+// header goes. Requests without one are not from a browser and always may.
+func (p *Proxy) originAllowed(c *fiber.Ctx) bool {
+	rc := p.reloadable()
+	origin := c.Get(fiber.HeaderOrigin)
+	if len(rc.AllowedOrigins) == 0 || rc.SkipOriginCheck || origin == "" {
+		return true
+	}
+	for _, re := range rc.AllowedOrigins {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
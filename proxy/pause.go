@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultPauseBuffer is how many client datagrams a paused connection holds
+// by default.
+const defaultPauseBuffer = 64
+
+// pauseGate holds back a connection's client datagrams while forwarding is
+// paused, up to limit of them, and sends them on in order on resume.
+// Datagrams over the limit are dropped.
+type pauseGate struct {
+	limit int
+
+	mu      sync.Mutex
+	paused  bool
+	held    [][]byte
+	forward func(msg []byte) error
+	fail    func(err error)
+}
+
+func newPauseGate(limit int, paused bool) *pauseGate {
+	return &pauseGate{limit: limit, paused: paused}
+}
+
+// attach sets how datagrams are sent to the backend, and what happens when
+// sending the held ones on resume fails.
+func (g *pauseGate) attach(forward func(msg []byte) error, fail func(err error)) {
+	g.mu.Lock()
+	g.forward, g.fail = forward, fail
+	g.mu.Unlock()
+}
+
+// pass forwards msg, or holds it while paused. Holding the lock while
+// forwarding keeps held datagrams from being overtaken by newer ones.
+func (g *pauseGate) pass(msg []byte) (held bool, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		return false, g.forward(msg)
+	}
+	if len(g.held) < g.limit {
+		g.held = append(g.held, msg)
+	} else {
+		metricPauseDropped.inc()
+	}
+	return true, nil
+}
+
+func (g *pauseGate) isPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// set pauses or resumes forwarding and reports whether that changed
+// anything.
+func (g *pauseGate) set(paused bool) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused == paused {
+		return false
+	}
+	g.paused = paused
+	if paused {
+		return true
+	}
+	held := g.held
+	g.held = nil
+	for _, msg := range held {
+		if err := g.forward(msg); err != nil {
+			g.fail(err)
+			break
+		}
+	}
+	return true
+}
+
+// notifyPause tells the client forwarding was paused or resumed, with
+// Config.PauseMessage or Config.ResumeMessage. Notices for quick successive
+// changes collapse into one for the final state, so they cannot arrive out
+// of order.
+func (s *session) notifyPause() {
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+	paused := s.pause.isPaused()
+	if paused == s.notifiedPaused || s.clientWrite == nil {
+		return
+	}
+	s.notifiedPaused = paused
+	msg := s.proxy.cfg.ResumeMessage
+	if paused {
+		msg = s.proxy.cfg.PauseMessage
+	}
+	if len(msg) > 0 {
+		s.clientWrite(msg)
+	}
+}
+
+// Pause holds back client datagrams on the connections with the given
+// client IDs, or on all connections, including new ones, when none are
+// given. It returns the number of connections paused.
+func (p *Proxy) Pause(ids ...string) int {
+	if len(ids) == 0 {
+		atomic.StoreInt32(&p.paused, 1)
+	}
+	return p.setPaused(true, ids)
+}
+
+// Resume undoes Pause, sending the held datagrams on. Without IDs it
+// resumes every connection.
+func (p *Proxy) Resume(ids ...string) int {
+	if len(ids) == 0 {
+		atomic.StoreInt32(&p.paused, 0)
+	}
+	return p.setPaused(false, ids)
+}
+
+func (p *Proxy) setPaused(paused bool, ids []string) int {
+	var matched []*session
+	if len(ids) == 0 {
+		matched = p.sessions.snapshot()
+	} else {
+		for _, id := range ids {
+			if s := p.sessions.get(id); s != nil {
+				matched = append(matched, s)
+			}
+		}
+	}
+	for _, s := range matched {
+		if s.pause.set(paused) {
+			// A client that stopped reading must not hold up the others.
+			go s.notifyPause()
+		}
+	}
+	return len(matched)
+}
+
+// pauseHandler serves the pause and resume endpoints. The optional id query
+// parameter is a comma-separated list of client IDs.
+func (p *Proxy) pauseHandler(paused bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var ids []string
+		if list := c.Query("id"); list != "" {
+			ids = strings.Split(list, ",")
+		}
+		var n int
+		if paused {
+			n = p.Pause(ids...)
+		} else {
+			n = p.Resume(ids...)
+		}
+		if n == 0 && len(ids) > 0 {
+			return fiber.NewError(fiber.StatusNotFound, "no such client")
+		}
+		return c.JSON(fiber.Map{"connections": n})
+	}
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"math/rand"
+)
+
+const (
+	dirToBackend = "client->backend"
+	dirToClient  = "backend->client"
+
+	defaultPayloadLogMax = 64
+)
+
+// logPayload hex-dumps a sampled fraction of datagrams, truncated to
+// PayloadLogMax bytes. Payloads may contain credentials or personal data,
+// which is why this is strictly opt-in.
+func (s *session) logPayload(dir string, payload []byte) {
+	cfg := &s.proxy.cfg
+	if cfg.PayloadLogSample <= 0 || rand.Float64() >= cfg.PayloadLogSample {
+		return
+	}
+	shown := payload
+	if len(shown) > cfg.PayloadLogMax {
+		shown = shown[:cfg.PayloadLogMax]
+	}
+	slog.Info("payload", "client", s.id, "direction", dir, "bytes", len(payload),
+		"shown", len(shown), "dump", hex.Dump(shown))
+}
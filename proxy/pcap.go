@@ -0,0 +1,335 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// pcapng (draft-ietf-opsawg-pcapng) block types and options written by
+// pcapFile, all little-endian.
+const (
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterface      = 1
+	pcapngEnhancedPacket = 6
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	pcapngOptEnd         = 0
+	pcapngOptName        = 2 // if_name
+	pcapngOptDescription = 3 // if_description
+	pcapngOptUserAppl    = 4 // shb_userappl
+	pcapngOptFlags       = 2 // epb_flags
+	pcapngFlagInbound    = 1
+	pcapngFlagOutbound   = 2
+	pcapLinkTypeRaw      = 101
+	pcapSnapLen          = 65535
+	ipv4HeaderSize       = 20
+	ipv6HeaderSize       = 40
+	udpHeaderSize        = 8
+	defaultPcapHopLimit  = 64
+)
+
+var (
+	errCaptureEnded = errors.New("the session has ended")
+	errNoPcapDir    = errors.New("no capture directory configured")
+	errNoSuchClient = errors.New("no such client")
+)
+
+// pcapFile is a pcapng capture of one session's backend socket, each
+// datagram wrapped in an IP and UDP header between the socket's local
+// address and the backend's, so Wireshark dissects it like traffic on the
+// wire. Datagrams to the backend are marked outbound, the others inbound.
+// Non-IP backends are shown between unspecified addresses. The first
+// write error sticks and is logged on close.
+type pcapFile struct {
+	path          string
+	file          *os.File
+	w             *bufio.Writer
+	local, remote netip.AddrPort
+	err           error
+}
+
+// openPcap appends a new section for s to its capture file under
+// Config.PcapDir, so a capture restarted for the same client, or a
+// resumed session, adds to the file rather than replacing it.
+func (p *Proxy) openPcap(s *session) (*pcapFile, error) {
+	path := filepath.Join(p.cfg.PcapDir, s.id+".pcapng")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	pf := &pcapFile{
+		path:   path,
+		file:   file,
+		w:      bufio.NewWriter(file),
+		local:  addrPortOf(s.udpConn.LocalAddr().String()),
+		remote: addrPortOf(s.udpConn.RemoteAddr().String()),
+	}
+	// A packet has to be all IPv4 or all IPv6.
+	if pf.local.Addr().Is4() != pf.remote.Addr().Is4() {
+		pf.local = netip.AddrPortFrom(netip.AddrFrom16(pf.local.Addr().As16()), pf.local.Port())
+		pf.remote = netip.AddrPortFrom(netip.AddrFrom16(pf.remote.Addr().As16()), pf.remote.Port())
+	}
+	pf.writeBlock(pcapngSectionHeader, func(b []byte) []byte {
+		b = binary.LittleEndian.AppendUint32(b, pcapngByteOrderMagic)
+		b = binary.LittleEndian.AppendUint16(b, 1) // major version
+		b = binary.LittleEndian.AppendUint16(b, 0) // minor version
+		// The section length is not known up front.
+		b = binary.LittleEndian.AppendUint64(b, ^uint64(0))
+		b = appendPcapngOption(b, pcapngOptUserAppl, []byte("udpwsproxy"))
+		return appendPcapngOption(b, pcapngOptEnd, nil)
+	})
+	pf.writeBlock(pcapngInterface, func(b []byte) []byte {
+		b = binary.LittleEndian.AppendUint16(b, pcapLinkTypeRaw)
+		b = binary.LittleEndian.AppendUint16(b, 0) // reserved
+		b = binary.LittleEndian.AppendUint32(b, pcapSnapLen)
+		b = appendPcapngOption(b, pcapngOptName, []byte("udpwsproxy"))
+		b = appendPcapngOption(b, pcapngOptDescription,
+			[]byte("client "+s.id+" backend "+s.udpConn.RemoteAddr().String()))
+		return appendPcapngOption(b, pcapngOptEnd, nil)
+	})
+	if pf.err != nil {
+		file.Close()
+		return nil, pf.err
+	}
+	return pf, nil
+}
+
+// write adds a datagram that went dir at t.
+func (pf *pcapFile) write(dir byte, t time.Time, payload []byte) {
+	src, dst, flags := pf.local, pf.remote, uint32(pcapngFlagOutbound)
+	if dir == CaptureToClient {
+		src, dst, flags = dst, src, pcapngFlagInbound
+	}
+	headerSize := ipv4HeaderSize + udpHeaderSize
+	if !src.Addr().Is4() {
+		headerSize = ipv6HeaderSize + udpHeaderSize
+	}
+	origLen := headerSize + len(payload)
+	if len(payload) > pcapSnapLen-headerSize {
+		payload = payload[:pcapSnapLen-headerSize]
+	}
+	micros := uint64(t.UnixMicro())
+	pf.writeBlock(pcapngEnhancedPacket, func(b []byte) []byte {
+		b = binary.LittleEndian.AppendUint32(b, 0) // interface ID
+		b = binary.LittleEndian.AppendUint32(b, uint32(micros>>32))
+		b = binary.LittleEndian.AppendUint32(b, uint32(micros))
+		b = binary.LittleEndian.AppendUint32(b, uint32(headerSize+len(payload)))
+		b = binary.LittleEndian.AppendUint32(b, uint32(origLen))
+		b = appendIPUDP(b, src, dst, payload)
+		b = pad32(b)
+		var opt [4]byte
+		binary.LittleEndian.PutUint32(opt[:], flags)
+		b = appendPcapngOption(b, pcapngOptFlags, opt[:])
+		return appendPcapngOption(b, pcapngOptEnd, nil)
+	})
+}
+
+// writeBlock writes a block whose body body appends, framed by its type
+// and total length.
+func (pf *pcapFile) writeBlock(blockType uint32, body func(b []byte) []byte) {
+	if pf.err != nil {
+		return
+	}
+	b := make([]byte, 8, 64)
+	b = body(b)
+	total := uint32(len(b) + 4)
+	binary.LittleEndian.PutUint32(b, blockType)
+	binary.LittleEndian.PutUint32(b[4:], total)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	_, pf.err = pf.w.Write(b)
+}
+
+func (pf *pcapFile) close(id string) {
+	err := pf.err
+	if err == nil {
+		err = pf.w.Flush()
+	}
+	if closeErr := pf.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		slog.Warn("capture error", "client", id, "path", pf.path, "error", err)
+	}
+}
+
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return pad32(b)
+}
+
+func pad32(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// appendIPUDP appends payload as a UDP datagram from src to dst, with its
+// IPv4 or IPv6 header and checksums.
+func appendIPUDP(b []byte, src, dst netip.AddrPort, payload []byte) []byte {
+	be := binary.BigEndian
+	udpLen := udpHeaderSize + len(payload)
+	srcIP, dstIP := src.Addr().AsSlice(), dst.Addr().AsSlice()
+	if src.Addr().Is4() {
+		ip := len(b)
+		b = append(b, 0x45, 0)
+		b = be.AppendUint16(b, uint16(ipv4HeaderSize+udpLen))
+		b = append(b, 0, 0, 0x40, 0) // ID, don't fragment
+		b = append(b, defaultPcapHopLimit, protocolUDP, 0, 0)
+		b = append(b, srcIP...)
+		b = append(b, dstIP...)
+		be.PutUint16(b[ip+10:], ^onesSum(0, b[ip:]))
+	} else {
+		b = append(b, 0x60, 0, 0, 0)
+		b = be.AppendUint16(b, uint16(udpLen))
+		b = append(b, protocolUDP, defaultPcapHopLimit)
+		b = append(b, srcIP...)
+		b = append(b, dstIP...)
+	}
+	udp := len(b)
+	b = be.AppendUint16(b, src.Port())
+	b = be.AppendUint16(b, dst.Port())
+	b = be.AppendUint16(b, uint16(udpLen))
+	b = be.AppendUint16(b, 0)
+	b = append(b, payload...)
+
+	// The checksum covers a pseudo-header of the addresses, protocol and
+	// length, then the UDP header and payload.
+	var pseudo [4]byte
+	be.PutUint16(pseudo[:2], protocolUDP)
+	be.PutUint16(pseudo[2:], uint16(udpLen))
+	sum := onesSum(0, srcIP)
+	sum = onesSum(sum, dstIP)
+	sum = onesSum(sum, pseudo[:])
+	sum = onesSum(sum, b[udp:])
+	checksum := ^sum
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	be.PutUint16(b[udp+6:], checksum)
+	return b
+}
+
+// onesSum adds data to sum in ones' complement arithmetic, the Internet
+// checksum before its final inversion.
+func onesSum(sum uint16, data []byte) uint16 {
+	s := uint32(sum)
+	for len(data) >= 2 {
+		s += uint32(data[0])<<8 | uint32(data[1])
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		s += uint32(data[0]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
+
+// startPcap starts capturing s, unless it already is, and returns the
+// capture file's path.
+func (s *session) startPcap() (string, error) {
+	s.pcapMu.Lock()
+	defer s.pcapMu.Unlock()
+	if s.pcapEnded {
+		return "", errCaptureEnded
+	}
+	if s.pcap != nil {
+		return s.pcap.path, nil
+	}
+	pf, err := s.proxy.openPcap(s)
+	if err != nil {
+		return "", err
+	}
+	s.pcap = pf
+	atomic.StoreInt32(&s.pcapping, 1)
+	return pf.path, nil
+}
+
+// stopPcap ends the capture of s, reporting whether there was one. With
+// ended, no capture can start afterwards.
+func (s *session) stopPcap(ended bool) bool {
+	s.pcapMu.Lock()
+	defer s.pcapMu.Unlock()
+	s.pcapEnded = s.pcapEnded || ended
+	pf := s.pcap
+	if pf == nil {
+		return false
+	}
+	s.pcap = nil
+	atomic.StoreInt32(&s.pcapping, 0)
+	pf.close(s.id)
+	return true
+}
+
+// recordPcap adds a datagram to the capture of s, if there is one.
+func (s *session) recordPcap(dir byte, payload []byte) {
+	if atomic.LoadInt32(&s.pcapping) == 0 {
+		return
+	}
+	s.pcapMu.Lock()
+	defer s.pcapMu.Unlock()
+	if s.pcap != nil {
+		s.pcap.write(dir, s.proxy.now(), payload)
+	}
+}
+
+// StartCapture starts a pcapng capture of the connection with the given
+// client ID under Config.PcapDir and returns the file's path.
+func (p *Proxy) StartCapture(id string) (string, error) {
+	if p.cfg.PcapDir == "" {
+		return "", errNoPcapDir
+	}
+	s := p.sessions.get(id)
+	if s == nil {
+		return "", errNoSuchClient
+	}
+	path, err := s.startPcap()
+	if err == nil {
+		slog.Info("capture started", "client", id, "path", path)
+	}
+	return path, err
+}
+
+// StopCapture stops the capture of the connection with the given client
+// ID, reporting whether it was being captured.
+func (p *Proxy) StopCapture(id string) bool {
+	s := p.sessions.get(id)
+	if s == nil || !s.stopPcap(false) {
+		return false
+	}
+	slog.Info("capture stopped", "client", id)
+	return true
+}
+
+// captureHandler starts or, for DELETE, stops the capture of the
+// connection with the client ID in the path.
+func (p *Proxy) captureHandler(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if c.Method() == fiber.MethodDelete {
+		if !p.StopCapture(id) {
+			return fiber.NewError(fiber.StatusNotFound, "no such capture")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+	path, err := p.StartCapture(id)
+	switch {
+	case errors.Is(err, errNoSuchClient), errors.Is(err, errCaptureEnded):
+		return fiber.NewError(fiber.StatusNotFound, "no such client")
+	case err != nil:
+		slog.Error("capture error", "client", id, "error", err)
+		return fiber.ErrInternalServerError
+	}
+	return c.JSON(fiber.Map{"file": path})
+}
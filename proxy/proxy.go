@@ -0,0 +1,1943 @@
+// Package proxy bridges WebSocket clients to UDP backends. Each WebSocket
+// connection gets its own connected UDP socket; client messages are sent to
+// the backend as datagrams and backend datagrams come back as messages.
+package proxy
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	fastws "github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/pion/dtls/v2"
+)
+
+const (
+	DataTypeText          = "text"
+	DataTypeBinary        = "binary"
+	WriteErrorPolicyClose = "close"
+	WriteErrorPolicyDrop  = "drop"
+
+	// maxConsecutiveWriteErrors is how many transient backend write errors
+	// in a row the drop policy tolerates before treating them as persistent.
+	maxConsecutiveWriteErrors = 32
+
+	// defaultUDPBufferSize fits the largest UDP payload over IPv4.
+	defaultUDPBufferSize = 65535
+
+	defaultAffinityTTL    = 5 * time.Minute
+	defaultProbeTimeout   = time.Second
+	defaultReaperInterval = 10 * time.Second
+
+	defaultCompressionMinSize = 256
+)
+
+// Config configures a Proxy. Apart from Backends or Routes, the zero value
+// of every field selects the default or leaves the feature disabled.
+type Config struct {
+	// Backends are the UDP addresses clients are spread across round-robin.
+	Backends []string
+	// Routes maps URL paths to backends, to serve several UDP services on
+	// one listener: RegisterRoutes mounts each path, ahead of its own, and
+	// clients upgrading on it go to its backend. Backends may be empty
+	// when Routes is set, and then RegisterRoutes mounts only the routes,
+	// unless TargetAllow is set too.
+	Routes map[string]string
+	// RouteOptions overrides DataType, UDPBufferSize and IdleTimeout for
+	// the clients upgrading on a path, a Routes path or the one given to
+	// RegisterRoutes, and lets them pick their own within limits.
+	RouteOptions map[string]RouteOptions
+	// TargetAllow lets clients pick their own backend with a target=host:port
+	// query parameter, among the targets these rules allow; others get 403.
+	// Connections to such targets are counted under the backend "target"
+	// for the connection limits, Stats and metrics. Without rules the
+	// parameter is ignored; without Backends it is required.
+	TargetAllow []TargetRule
+	// AllowClients, when set, admits upgrades only from client IPs in
+	// these prefixes, and DenyClients refuses those in its own, winning
+	// over AllowClients. Refused clients get 403 before the upgrade. The
+	// client IP is that of c.IP(), so with RealIP the one a trusted proxy
+	// passed on.
+	AllowClients []netip.Prefix
+	DenyClients  []netip.Prefix
+	// AllowCerts, when set, admits upgrades only from clients whose
+	// verified TLS certificate identity, its common name or else first
+	// DNS or email SAN, matches one of these path.Match patterns, such as
+	// *.devices.example, and DenyCerts refuses those matching its own,
+	// winning over AllowCerts. Refused clients get 403 before the
+	// upgrade. Certificates are verified by the listener, see the
+	// tls.Config ClientCAs.
+	AllowCerts []string
+	DenyCerts  []string
+	// AllowBackends, when set, is where clients may steer the proxy: a
+	// TargetAllow target or a Redirect reply must resolve into one of
+	// these prefixes, checked on every dial so a name that resolves
+	// elsewhere later is refused too. Backends and Routes are trusted and
+	// not checked.
+	AllowBackends []netip.Prefix
+	// DataType is how backend datagrams are sent to the client and client
+	// messages are expected: DataTypeText (default), DataTypeBinary, or
+	// text messages encoded as DataTypeBase64 or DataTypeJSON.
+	DataType string
+	// DataFromClient, when set, is the only message type accepted from the
+	// client; others close the connection with 1003. Empty accepts both.
+	// It only applies to the text and binary data types.
+	DataFromClient string
+	// DataSubprotocols lets clients pick their data type by offering a
+	// subprotocol, udpproxy.text, udpproxy.binary, udpproxy.base64 or
+	// udpproxy.json, which is selected on the upgrade. Clients offering
+	// none get DataType; offering an unknown udpproxy.* gets 400.
+	DataSubprotocols bool
+
+	// Affinity sends a reconnecting client to the backend it used last,
+	// keyed by AffinitySession or AffinityIP, for AffinityTTL (default 5m).
+	Affinity    string
+	AffinityTTL time.Duration
+	// LBStrategy is LBRoundRobin (default) or LBHash, which hashes the
+	// Affinity key onto a consistent hash ring for sharded backends: a
+	// key always maps to the same backend, and a change to Backends only
+	// remaps the keys of the backends added or removed. Clients without a
+	// key are spread round-robin. LBLeastConn sends each new client to
+	// the backend with the fewest active connections.
+	LBStrategy string
+	// GeoIPDB is the path of a MaxMind DB file, such as GeoLite2-Country,
+	// to look clients' IPs up in. A client whose region, its continent or
+	// country code by RegionBy (default RegionByContinent), has an entry
+	// in RegionBackends goes to that backend, which must be one of
+	// Backends; the others, and clients the database does not know, are
+	// spread across Backends as usual. A token's backend claim wins.
+	GeoIPDB        string
+	RegionBy       string
+	RegionBackends map[string]string
+
+	// WriteErrorPolicy decides what a transient backend write error does:
+	// WriteErrorPolicyClose (default) or WriteErrorPolicyDrop.
+	WriteErrorPolicy string
+	// AllowedSizes, when set, are the only client datagram lengths sent to
+	// the backend. Others are dropped and counted under SizePolicyDrop
+	// (default) or close the connection with 1008 under SizePolicyClose.
+	AllowedSizes []SizeRange
+	SizePolicy   string
+	// BatchReads reads up to this many backend datagrams per syscall on
+	// Linux.
+	BatchReads int
+	// UDPBufferSize is the largest backend datagram relayed in full
+	// (default 65535); longer ones are cut to it. Each connection holds
+	// BatchReads buffers of this size, or one without batching.
+	UDPBufferSize int
+
+	// TxCoalesceWindow combines client messages arriving within this
+	// window into one length-prefixed backend datagram, see txCoalescer.
+	// Only for backends that parse that framing.
+	TxCoalesceWindow time.Duration
+	// WSBatchWindow combines backend datagrams arriving within this window
+	// into one binary client message, framed like TxCoalesceWindow, and
+	// splits client messages back into datagrams. It applies to sessions
+	// of the binary data type only.
+	WSBatchWindow time.Duration
+
+	// HeartbeatPayload is sent to the client after HeartbeatInterval of
+	// backend silence.
+	HeartbeatInterval time.Duration
+	HeartbeatPayload  []byte
+	// PingInterval pings the client this often. A client whose pong is
+	// PongTimeout (default PingInterval) overdue is taken for dead and
+	// closed with ClosePongTimeout, freeing its backend socket.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// JitterBuffer smooths bursty backend traffic by pacing datagrams to
+	// the client, adding up to this much latency.
+	JitterBuffer time.Duration
+
+	// SeqSize enables observing a big-endian sequence number of 1, 2, 4 or
+	// 8 bytes at SeqOffset in backend datagrams, counting gaps, reordering
+	// and duplicates. Datagrams are never reordered. SeqLittleEndian reads
+	// the number as little-endian instead. SeqLossWindow is how many of the
+	// latest sequence numbers each connection's loss estimate covers
+	// (default 1024), rounded up to a power of two.
+	SeqOffset       int
+	SeqSize         int
+	SeqLittleEndian bool
+	SeqLossWindow   int
+
+	// SendHighWater disconnects clients with more than this many bytes of
+	// backend datagrams queued but not yet written to them. SendPolicy
+	// says what a datagram that does not fit does: SendPolicyClose
+	// (default) disconnects, SendPolicyDropOldest drops queued datagrams,
+	// oldest first, to make room, and SendPolicyDropNewest drops the new
+	// one. Either way the backend read loop never waits on the client.
+	SendHighWater int
+	SendPolicy    string
+	// CloseFlushMax is how many backend datagrams still queued by the
+	// jitter buffer or send queue are delivered when the backend side of a
+	// connection ends, within one second, before it closes. The rest are
+	// dropped; zero drops them all.
+	CloseFlushMax int
+
+	// PayloadLogSample hex-dumps this fraction (0-1) of datagrams in each
+	// direction, at most PayloadLogMax bytes each (default 64). Off by
+	// default since payloads may be sensitive.
+	PayloadLogSample float64
+	PayloadLogMax    int
+
+	// BackendProto is BackendProtoUDP (default), BackendProtoTCP,
+	// BackendProtoQUIC, BackendProtoUnix or BackendProtoUnixgram. TCP and
+	// unix stream backends get one connection per client, in TCPFraming
+	// (default TCPFramingRaw). QUIC backends are reached in QUICMode
+	// (default QUICModeDatagram) with QUICTLS, whose NextProtos defaults
+	// to "udpwsproxy". Unix socket backends are paths; unixgram needs
+	// Linux.
+	BackendProto string
+	TCPFraming   string
+	QUICMode     string
+	QUICTLS      *tls.Config
+
+	// WarmPool keeps this many pre-dialed sockets per UDP backend, so new
+	// clients skip resolving and dialing.
+	WarmPool int
+
+	// UDPBindDevice pins backend sockets to a network interface (Linux).
+	UDPBindDevice string
+	// DSCP marks backend datagrams with this code point, see ParseDSCP.
+	DSCP int
+	// TTL is the IP TTL, or IPv6 hop limit, of backend datagrams. Zero
+	// keeps the system default.
+	TTL int
+	// UDPBindAddr is the local IP backend sockets are bound to, for hosts
+	// with several addresses. UDPPortMin and UDPPortMax, when set, bind
+	// them to a free port in that inclusive range instead of an ephemeral
+	// one, for firewalls that admit only those; a range smaller than the
+	// number of connections runs out.
+	UDPBindAddr string
+	UDPPortMin  int
+	UDPPortMax  int
+	// MulticastInterface is the network interface to join multicast
+	// backends on, the system's choice when empty. A backend whose address
+	// is a multicast group gets each client a socket of its own joined to
+	// the group, which receives all of the group's datagrams and sends
+	// the client's to it.
+	MulticastInterface string
+	// UDPBroadcast makes the backend addresses broadcast addresses, such
+	// as 192.168.1.255, sent to with SO_BROADCAST, with replies taken from
+	// any host (Linux).
+	UDPBroadcast bool
+	// UDPPSK, when set, is a 32-byte key every backend datagram is sealed
+	// and opened with, by XChaCha20-Poly1305: a random 24-byte nonce, then
+	// the ciphertext and 16-byte tag, with the one byte 0x01 toward the
+	// backend or 0x02 from it as additional data. Datagrams failing
+	// authentication are dropped. They rule out BatchReads; UDP backends
+	// only.
+	UDPPSK []byte
+	// BackendDTLS, when set, secures every backend socket with DTLS under
+	// this config, authenticating by its PSK or certificates. The
+	// handshake is part of the dial. It rules out UDPPSK and BatchReads;
+	// UDP backends only.
+	BackendDTLS *dtls.Config
+	// UDPRcvBuf and UDPSndBuf, when set, size the kernel receive and send
+	// buffers of backend sockets, SO_RCVBUF and SO_SNDBUF. The kernel may
+	// clamp them; the sizes granted are logged for the first socket.
+	UDPRcvBuf int
+	UDPSndBuf int
+
+	// ProbeInterval enables the backend prober; upgrades to a backend it
+	// found down are refused with 503. ProbeTimeout defaults to 1s.
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+	ProbePayload  []byte
+
+	// BreakerThreshold enables a circuit breaker per backend: after this
+	// many consecutive resolve, dial or init failures within BreakerWindow
+	// (default 30s), upgrades to it get 503 for BreakerCooldown (default
+	// 10s) before one probe connection is let through.
+	BreakerThreshold int
+	BreakerWindow    time.Duration
+	BreakerCooldown  time.Duration
+
+	// MaxConns caps concurrent connections. Upgrades over it wait up to
+	// AdmissionWait for a slot in a queue per backend, served round-robin,
+	// and then get 503. BackendMaxConns caps the connections, waiting ones
+	// included, to single backends, which get 503 right away when full.
+	MaxConns        int
+	BackendMaxConns map[string]int
+	AdmissionWait   time.Duration
+	// MaxPendingHandshakes caps the upgrades in progress, from their
+	// request headers being read until the WebSocket is established, so
+	// stalling clients cannot pile up; upgrades over it get 503.
+	MaxPendingHandshakes int
+
+	// MaxBytesPerConn closes connections that forwarded more than this many
+	// bytes, counted per direction or combined according to MaxBytesMode.
+	MaxBytesPerConn uint64
+	MaxBytesMode    string
+
+	// ClientRateLimit caps the datagrams and bytes per second each client
+	// IP, all its connections together, forwards in each direction, and
+	// GlobalRateLimit those of all clients. Datagrams over a limit are
+	// dropped, as a congested link would.
+	ClientRateLimit RateLimit
+	GlobalRateLimit RateLimit
+
+	// InitPacket is sent to the backend right after dialing. With Redirect
+	// set, the backend's first reply within RedirectTimeout (default 2s) is
+	// checked for a redirect and, if it is one, consumed instead of
+	// forwarded.
+	InitPacket      []byte
+	Redirect        RedirectFunc
+	RedirectTimeout time.Duration
+
+	// SendClientInfo sends the backend a PROXY protocol v2 header as the
+	// very first datagram, ahead of InitPacket, naming the client's address,
+	// its client ID and the values of ClientInfoHeaders it sent on the
+	// upgrade, since the backend only sees the proxy's address otherwise.
+	SendClientInfo    bool
+	ClientInfoHeaders []string
+
+	// RequireMagic makes the proxy read the client's first datagram before
+	// dialing the backend and close the connection with 1008 unless it
+	// starts with these bytes, keeping scanners and stray probes off the
+	// backend. StripMagic removes the prefix before forwarding; a first
+	// datagram that is only the prefix is then not forwarded at all.
+	RequireMagic []byte
+	StripMagic   bool
+
+	// FinalPacket is sent to the backend when a connection ends, so it can
+	// drop the client's state without waiting for its own timeout. {id},
+	// {code} and {reason} are replaced with the client ID and the close
+	// code and reason.
+	FinalPacket []byte
+
+	// RecordDir, when set, is where every session is recorded to a capture
+	// file named after the client ID, see CaptureWriter. The files contain
+	// full payloads.
+	RecordDir string
+
+	// PcapDir, when set, is where sessions are captured to pcapng files
+	// named after the client ID, with every datagram to and from the
+	// backend as UDP on the backend socket. Every session is captured
+	// unless PcapOnDemand, which leaves it to StartCapture and the admin
+	// API.
+	PcapDir      string
+	PcapOnDemand bool
+
+	// UDPReconnect re-dials the backend socket, with backoff, up to this
+	// many times between two datagrams from the backend, when it fails
+	// with a transient error such as ECONNREFUSED while the backend
+	// rebinds. The client stays connected. It rules out BatchReads, and
+	// InitPacket is not sent again. UDP backends only.
+	UDPReconnect int
+	// UDPFailover maps backends to a secondary address that their
+	// sessions' sockets move to for good once UDPReconnect re-dials gave
+	// up, or on the first such error without any. The secondary gets as
+	// many re-dials. Clients whose socket gives up are closed with
+	// CloseBackendError and a reason saying so. UDP backends only.
+	UDPFailover map[string]string
+
+	// DialRetries retries resolving and dialing a client's backend up to
+	// this many times when it fails transiently, such as a DNS timeout,
+	// waiting DialBackoff (default 100ms) before the first retry and twice
+	// as long before each further one. Other failures close the client
+	// with CloseBackendUnavailable right away; no failure affects the
+	// other connections.
+	DialRetries int
+	DialBackoff time.Duration
+
+	// ResolveInterval, when set, re-resolves the backends that often and
+	// dials new sockets to the latest address instead of looking it up
+	// for each. A changed address empties the warm pool, and with
+	// ResolveMigrate the live sessions on the old address move their
+	// socket to the new one, which rules out BatchReads. Both apply to
+	// UDP backends only.
+	ResolveInterval time.Duration
+	ResolveMigrate  bool
+
+	// BackendLoopback sends a copy of every backend datagram back to the
+	// backend, for protocols expecting acknowledgments, at most
+	// BackendLoopbackRate (default 100) per second and connection. UDP
+	// backends only.
+	BackendLoopback     bool
+	BackendLoopbackRate int
+
+	// BackendSessionLength, when set, takes that many bytes at
+	// BackendSessionOffset of the backend's first reply as its session ID,
+	// which is logged and listed by the admin API in hex. The reply is
+	// forwarded as usual.
+	BackendSessionOffset int
+	BackendSessionLength int
+
+	// ReportRelayAddr sends the client the local backend-side UDP address
+	// as its first message.
+	ReportRelayAddr bool
+
+	// ResumeGrace, when set, lets clients that drop off come back to the
+	// same backend socket, and so the same source port, within this
+	// long. Each connection is sent a {"type":"session","token":...}
+	// message, after the relay address if reported, and an upgrade with
+	// ?resume=<token> takes the socket over, under the same client ID.
+	// Sockets are kept when the client's connection breaks, not when it
+	// closes cleanly or the proxy ends it, and a pong timeout keeps it
+	// too. Backend datagrams meanwhile wait in the socket's receive
+	// buffer, as many as fit. An unknown or expired token gets a fresh
+	// socket.
+	ResumeGrace time.Duration
+
+	// IdleTimeout and MaxLifetime are enforced by a reaper running every
+	// ReaperInterval (default 10s). StartupGrace counts as activity after
+	// connect, so slow-starting sessions are not idle until it is over.
+	IdleTimeout    time.Duration
+	MaxLifetime    time.Duration
+	ReaperInterval time.Duration
+	StartupGrace   time.Duration
+
+	// ReadWatchdog closes the backend socket when a read is still blocked
+	// this long after it should have returned, logging a stack snapshot.
+	// It guards against platform bugs leaking connections; zero disables it.
+	ReadWatchdog time.Duration
+
+	// JWTSecret and JWKSURL require clients to present a JWT, signed with
+	// HMAC using the secret or with a key from the JWKS. Its backend claim,
+	// which must be one of Backends, and data claim override the usual
+	// backend selection and DataType. Invalid or expired tokens get 401.
+	JWTSecret []byte
+	JWKSURL   string
+	// AuthToken requires clients to present this static token, the same
+	// ways as a JWT. With a JWT verifier as well, either will do, and
+	// the static token carries no claims.
+	AuthToken string
+	// AuthWebhook, when set, is called for every upgrade that passed the
+	// token checks, see checkAuthWebhook.
+	AuthWebhook string
+
+	// MetricsPath, when set, is where RegisterRoutes serves Prometheus
+	// metrics.
+	MetricsPath string
+
+	// ReadyPath, when set, is where RegisterRoutes serves a readiness
+	// probe: 200, or 503 once LameDuck or Shutdown was called, or while
+	// every backend is down according to the health probes or open
+	// circuit breakers. LivePath serves a liveness probe, 200 as long as
+	// the process answers HTTP.
+	ReadyPath string
+	LivePath  string
+
+	// AdminPath, when set, is where RegisterRoutes serves the admin API,
+	// GET <AdminPath>/connections and POST <AdminPath>/pause and
+	// <AdminPath>/resume, to requests with an "Authorization: Bearer
+	// <AdminToken>" header. See Proxy.Pause.
+	AdminPath  string
+	AdminToken string
+	// PauseBuffer is how many client datagrams a paused connection holds
+	// for resume (default 64); later ones are dropped. PauseMessage and
+	// ResumeMessage, when set, are sent to clients as data messages on
+	// pause and resume.
+	PauseBuffer   int
+	PauseMessage  []byte
+	ResumeMessage []byte
+
+	// CORSOrigins are the origins, or "*" for any, that get CORS headers on
+	// the upgrade response and an answer to preflight requests on the
+	// WebSocket path. Other origins are not refused, only not given the
+	// headers.
+	CORSOrigins []string
+	// AllowedOrigins, from ParseOriginPatterns, refuse upgrades with 403
+	// when their Origin header matches none of the patterns, so pages on
+	// other sites cannot open tunnels from a visitor's browser. Requests
+	// without an Origin pass. SkipOriginCheck turns the check off while
+	// keeping the list, for development.
+	AllowedOrigins  []*regexp.Regexp
+	SkipOriginCheck bool
+
+	// WSReadBuffer and WSWriteBuffer size the per-connection WebSocket I/O
+	// buffers, 1024 bytes each by default. They do not limit message size;
+	// larger buffers mean fewer syscalls for big messages, smaller ones
+	// less memory per connection.
+	WSReadBuffer  int
+	WSWriteBuffer int
+
+	// Compression negotiates permessage-deflate (RFC 7692) with clients
+	// offering it. Messages to such clients are compressed from
+	// CompressionMinSize bytes (default 256) on, since deflate only makes
+	// small ones longer; client messages are taken compressed or not.
+	Compression        bool
+	CompressionMinSize int
+
+	// RequireSubprotocol refuses upgrades not offering this subprotocol
+	// with 400 and selects it for those that do.
+	RequireSubprotocol string
+	// ControlProtocol selects ControlSubprotocol for clients offering it,
+	// which then open with a JSON handshake: the proxy's hello listing
+	// what it supports, the client's options, such as a target or data
+	// type, and the proxy's ready. Clients offering only other
+	// udp-proxy-v* versions get 400, and clients offering none connect as
+	// usual, unless RequireSubprotocol is ControlSubprotocol. WebTransport
+	// has no subprotocols and never uses it.
+	ControlProtocol bool
+
+	// RequireHeaders refuses upgrades lacking any of these headers, or
+	// carrying a different value than required, with 400. The values seen
+	// are logged with the connection.
+	RequireHeaders []RequiredHeader
+
+	// FlowCollector is the host:port of an IPFIX collector that gets a
+	// flow record over UDP for every closed connection.
+	FlowCollector string
+	// SessionLog is a file that gets a line per closed session, in
+	// SessionLogFormat: SessionLogJSON, the default, or SessionLogCLF.
+	// Once it grows past SessionLogMaxSize bytes it is rotated, keeping
+	// SessionLogMaxFiles old files; a zero size never rotates.
+	SessionLog         string
+	SessionLogFormat   string
+	SessionLogMaxSize  int64
+	SessionLogMaxFiles int
+
+	// Filters make the filters every session's datagrams pass through, in
+	// order, see Filter. RegisterFilter and LookupFilter name them.
+	Filters []NewFilter
+
+	// OnConnError, when set, is called with every connection that ended on
+	// an error instead of a clean close, meant for tests asserting a clean
+	// run. Clean closes are the client's with 1000, 1001 or no status, and
+	// the proxy's own for idle timeouts, max lifetime and shutdown.
+	OnConnError func(clientID string, err error)
+
+	// Clock and IDGenerator default to the real clock and time-based IDs.
+	Clock       Clock
+	IDGenerator IDGenerator
+}
+
+// Proxy is a WebSocket to UDP bridge that can be mounted on a Fiber app.
+type Proxy struct {
+	cfg      Config
+	backends *backendPool
+	health   *backendHealth
+	sessions *sessionRegistry
+	jwt      *jwtVerifier
+	limiter  *connLimiter
+	pending  *handshakeGate
+	breakers map[string]*circuitBreaker
+	pools    map[string]*warmPool
+	resolver *backendResolver
+	flows    *flowExporter
+	psk      cipher.AEAD
+	geo      *geoDB
+	rates    *rateLimiter
+	// live holds the *ReloadConfig in effect.
+	live atomic.Value
+	// allBackends are Config.Backends and the Config.Routes backends.
+	allBackends []string
+	// resumes is nil unless Config.ResumeGrace is set.
+	resumes *resumeStore
+	// bindIP is Config.UDPBindAddr, nil when unset, and multicastIf
+	// Config.MulticastInterface.
+	bindIP      net.IP
+	multicastIf *net.Interface
+	// sessionLog is nil unless Config.SessionLog is set.
+	sessionLog *sessionLogger
+
+	// paused is 1 while Pause without IDs is in effect, so new connections
+	// start paused too.
+	paused int32
+	// draining is 1 once Shutdown was called, lameDuck once LameDuck was.
+	draining int32
+	lameDuck int32
+
+	// server is the app ListenAndServe runs, stopped by Shutdown.
+	serverMu sync.Mutex
+	server   *fiber.App
+
+	// handlers counts the running WebSocket handlers, for Shutdown to
+	// wait on the ones it closed.
+	handlers int32
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// New validates cfg and starts the proxy's background work: the backend
+// prober and the reaper, when enabled. Call Close to stop it.
+func New(cfg Config) (*Proxy, error) {
+	if len(cfg.Backends) == 0 && len(cfg.Routes) == 0 && len(cfg.TargetAllow) == 0 {
+		return nil, errors.New("missing backend")
+	}
+	allBackends := append([]string(nil), cfg.Backends...)
+	for path, addr := range cfg.Routes {
+		if !strings.HasPrefix(path, "/") || addr == "" {
+			return nil, fmt.Errorf("invalid route %s=%s", path, addr)
+		}
+		if !containsAddr(allBackends, addr) {
+			allBackends = append(allBackends, addr)
+		}
+	}
+	if cfg.DataType == "" {
+		cfg.DataType = DataTypeText
+	}
+	cfg.DataType = canonicalDataType(cfg.DataType)
+	if !isDataType(cfg.DataType) {
+		return nil, fmt.Errorf("unsupported data type %q", cfg.DataType)
+	}
+	if cfg.DataFromClient != "" &&
+		cfg.DataFromClient != DataTypeText && cfg.DataFromClient != DataTypeBinary {
+		return nil, fmt.Errorf("unsupported client data type %q", cfg.DataFromClient)
+	}
+	if cfg.Affinity != AffinityNone &&
+		cfg.Affinity != AffinitySession &&
+		cfg.Affinity != AffinityIP {
+		return nil, fmt.Errorf("unsupported affinity %q", cfg.Affinity)
+	}
+	if cfg.AffinityTTL == 0 {
+		cfg.AffinityTTL = defaultAffinityTTL
+	}
+	if cfg.LBStrategy == "" {
+		cfg.LBStrategy = LBRoundRobin
+	}
+	if cfg.LBStrategy != LBRoundRobin && cfg.LBStrategy != LBHash &&
+		cfg.LBStrategy != LBLeastConn {
+		return nil, fmt.Errorf("unsupported lb strategy %q", cfg.LBStrategy)
+	}
+	if cfg.LBStrategy == LBHash && cfg.Affinity == AffinityNone {
+		return nil, errors.New("hash lb strategy needs an affinity key to hash")
+	}
+	if cfg.WriteErrorPolicy == "" {
+		cfg.WriteErrorPolicy = WriteErrorPolicyClose
+	}
+	if cfg.WriteErrorPolicy != WriteErrorPolicyClose &&
+		cfg.WriteErrorPolicy != WriteErrorPolicyDrop {
+		return nil, fmt.Errorf("unsupported write error policy %q", cfg.WriteErrorPolicy)
+	}
+	for _, r := range cfg.AllowedSizes {
+		if r.Min < 0 || r.Max < r.Min {
+			return nil, fmt.Errorf("invalid allowed size range %d-%d", r.Min, r.Max)
+		}
+	}
+	if cfg.SizePolicy == "" {
+		cfg.SizePolicy = SizePolicyDrop
+	}
+	if cfg.SizePolicy != SizePolicyDrop && cfg.SizePolicy != SizePolicyClose {
+		return nil, fmt.Errorf("unsupported size policy %q", cfg.SizePolicy)
+	}
+	if cfg.UDPBufferSize < 0 {
+		return nil, errors.New("udp buffer size must not be negative")
+	}
+	if cfg.UDPBufferSize == 0 {
+		cfg.UDPBufferSize = defaultUDPBufferSize
+	}
+	if cfg.BatchReads < 0 {
+		return nil, errors.New("batch reads must not be negative")
+	}
+	if cfg.BatchReads > 1 && !batchReadsSupported {
+		slog.Warn("batch reads are not supported on this platform, using plain reads")
+	}
+	if cfg.TxCoalesceWindow < 0 {
+		return nil, errors.New("tx coalesce window must not be negative")
+	}
+	if cfg.WSBatchWindow < 0 {
+		return nil, errors.New("ws batch window must not be negative")
+	}
+	if cfg.WSBatchWindow > 0 && cfg.UDPBufferSize > 0xffff {
+		return nil, errors.New("ws batch window needs a udp buffer size of at most 65535")
+	}
+	if err := checkRouteOptions(&cfg); err != nil {
+		return nil, err
+	}
+	if cfg.PingInterval < 0 || cfg.PongTimeout < 0 {
+		return nil, errors.New("ping interval and pong timeout must not be negative")
+	}
+	if cfg.PongTimeout == 0 {
+		cfg.PongTimeout = cfg.PingInterval
+	}
+	if cfg.HeartbeatInterval < 0 {
+		return nil, errors.New("heartbeat interval must not be negative")
+	}
+	if cfg.JitterBuffer < 0 {
+		return nil, errors.New("jitter buffer must not be negative")
+	}
+	if cfg.SeqSize != 0 && cfg.SeqSize != 1 && cfg.SeqSize != 2 &&
+		cfg.SeqSize != 4 && cfg.SeqSize != 8 {
+		return nil, errors.New("sequence size must be 1, 2, 4 or 8")
+	}
+	if cfg.SeqOffset < 0 {
+		return nil, errors.New("sequence offset must not be negative")
+	}
+	if cfg.SeqLossWindow < 0 {
+		return nil, errors.New("sequence loss window must not be negative")
+	}
+	if cfg.SeqLossWindow == 0 {
+		cfg.SeqLossWindow = defaultSeqLossWindow
+	}
+	if cfg.MaxPendingHandshakes < 0 {
+		return nil, errors.New("max pending handshakes must not be negative")
+	}
+	if cfg.SendHighWater < 0 {
+		return nil, errors.New("send high-water mark must not be negative")
+	}
+	if cfg.SendPolicy == "" {
+		cfg.SendPolicy = SendPolicyClose
+	}
+	if cfg.SendPolicy != SendPolicyClose && cfg.SendPolicy != SendPolicyDropOldest &&
+		cfg.SendPolicy != SendPolicyDropNewest {
+		return nil, fmt.Errorf("unsupported send policy %q", cfg.SendPolicy)
+	}
+	if cfg.SendPolicy != SendPolicyClose && cfg.SendHighWater == 0 {
+		return nil, errors.New("send policy needs a send high-water mark")
+	}
+	if cfg.CloseFlushMax < 0 {
+		return nil, errors.New("close flush max must not be negative")
+	}
+	if cfg.PayloadLogSample < 0 || cfg.PayloadLogSample > 1 {
+		return nil, errors.New("payload log sample must be 0-1")
+	}
+	if cfg.PayloadLogMax < 0 {
+		return nil, errors.New("payload log max must not be negative")
+	}
+	if cfg.PayloadLogMax == 0 {
+		cfg.PayloadLogMax = defaultPayloadLogMax
+	}
+	if cfg.BackendProto == "" {
+		cfg.BackendProto = BackendProtoUDP
+	}
+	if cfg.BackendProto != BackendProtoUDP && cfg.BackendProto != BackendProtoTCP &&
+		cfg.BackendProto != BackendProtoQUIC && !isUnixProto(cfg.BackendProto) {
+		return nil, fmt.Errorf("unsupported backend protocol %q", cfg.BackendProto)
+	}
+	if cfg.TCPFraming == "" {
+		cfg.TCPFraming = TCPFramingRaw
+	}
+	if cfg.TCPFraming != TCPFramingRaw && cfg.TCPFraming != TCPFramingLength16 &&
+		cfg.TCPFraming != TCPFramingNewline {
+		return nil, fmt.Errorf("unsupported tcp framing %q", cfg.TCPFraming)
+	}
+	if cfg.TCPFraming == TCPFramingNewline && cfg.DataType == DataTypeBinary {
+		return nil, errors.New("tcp framing newline sends text messages and needs a text data type")
+	}
+	if cfg.QUICMode == "" {
+		cfg.QUICMode = QUICModeDatagram
+	}
+	if cfg.QUICMode != QUICModeDatagram && cfg.QUICMode != QUICModeStream {
+		return nil, fmt.Errorf("unsupported quic mode %q", cfg.QUICMode)
+	}
+	if cfg.QUICTLS == nil {
+		cfg.QUICTLS = &tls.Config{}
+	}
+	if len(cfg.QUICTLS.NextProtos) == 0 {
+		cfg.QUICTLS = cfg.QUICTLS.Clone()
+		cfg.QUICTLS.NextProtos = []string{defaultQUICALPN}
+	}
+	if cfg.WarmPool < 0 {
+		return nil, errors.New("warm pool size must not be negative")
+	}
+	if cfg.WarmPool > 0 && cfg.BackendProto != BackendProtoUDP {
+		return nil, errors.New("warm pool is only supported for udp backends")
+	}
+	if cfg.UDPRcvBuf < 0 || cfg.UDPSndBuf < 0 {
+		return nil, errors.New("udp socket buffer sizes must not be negative")
+	}
+	if cfg.UDPBindDevice != "" && !bindToDeviceSupported {
+		return nil, errors.New("binding to a device is only supported on Linux")
+	}
+	if cfg.DSCP < 0 || cfg.DSCP > 63 {
+		return nil, errors.New("dscp must be 0-63")
+	}
+	if cfg.TTL < 0 || cfg.TTL > 255 {
+		return nil, errors.New("ttl must be 0-255")
+	}
+	var bindIP net.IP
+	if cfg.UDPBindAddr != "" {
+		if bindIP = net.ParseIP(cfg.UDPBindAddr); bindIP == nil {
+			return nil, fmt.Errorf("invalid udp bind address %q", cfg.UDPBindAddr)
+		}
+	}
+	if (cfg.UDPPortMin != 0 || cfg.UDPPortMax != 0) &&
+		(cfg.UDPPortMin < 1 || cfg.UDPPortMax > 65535 || cfg.UDPPortMax < cfg.UDPPortMin) {
+		return nil, errors.New("udp port range must be within 1-65535, lowest first")
+	}
+	if cfg.SessionLogFormat == "" {
+		cfg.SessionLogFormat = SessionLogJSON
+	}
+	if cfg.SessionLogFormat != SessionLogJSON && cfg.SessionLogFormat != SessionLogCLF {
+		return nil, fmt.Errorf("unsupported session log format %q", cfg.SessionLogFormat)
+	}
+	if cfg.SessionLogMaxSize < 0 || cfg.SessionLogMaxFiles < 0 {
+		return nil, errors.New("session log max size and files must not be negative")
+	}
+	var multicastIf *net.Interface
+	if cfg.MulticastInterface != "" {
+		var err error
+		if multicastIf, err = net.InterfaceByName(cfg.MulticastInterface); err != nil {
+			return nil, fmt.Errorf("multicast interface: %w", err)
+		}
+	}
+	if cfg.UDPBroadcast && !broadcastSupported {
+		return nil, errors.New("udp broadcast is only supported on Linux")
+	}
+	if cfg.UDPBroadcast && (cfg.BackendProto != BackendProtoUDP || len(cfg.UDPPSK) > 0 || cfg.BackendDTLS != nil) {
+		return nil, errors.New("udp broadcast needs a UDP backend without psk or dtls")
+	}
+	if (bindIP != nil || cfg.UDPPortMin != 0) && isUnixProto(cfg.BackendProto) {
+		return nil, errors.New("udp bind address and ports need IP backends, not unix sockets")
+	}
+	if cfg.ProbeInterval < 0 || cfg.ProbeTimeout < 0 {
+		return nil, errors.New("probe interval and timeout must not be negative")
+	}
+	if cfg.ProbeTimeout == 0 {
+		cfg.ProbeTimeout = defaultProbeTimeout
+	}
+	if cfg.BreakerThreshold < 0 || cfg.BreakerWindow < 0 || cfg.BreakerCooldown < 0 {
+		return nil, errors.New("breaker threshold, window and cooldown must not be negative")
+	}
+	if cfg.BreakerWindow == 0 {
+		cfg.BreakerWindow = defaultBreakerWindow
+	}
+	if cfg.BreakerCooldown == 0 {
+		cfg.BreakerCooldown = defaultBreakerCooldown
+	}
+	if cfg.UDPReconnect < 0 {
+		return nil, errors.New("udp reconnect attempts must not be negative")
+	}
+	if cfg.UDPReconnect > 0 && cfg.BackendProto != BackendProtoUDP {
+		return nil, errors.New("udp reconnect needs a UDP backend")
+	}
+	if len(cfg.UDPFailover) > 0 && cfg.BackendProto != BackendProtoUDP {
+		return nil, errors.New("udp failover needs a UDP backend")
+	}
+	if cfg.ResolveInterval < 0 {
+		return nil, errors.New("resolve interval must not be negative")
+	}
+	if cfg.BackendDTLS != nil && (cfg.BackendProto != BackendProtoUDP || len(cfg.UDPPSK) > 0) {
+		return nil, errors.New("dtls needs a UDP backend and no udp psk")
+	}
+	if cfg.ResolveInterval > 0 && isUnixProto(cfg.BackendProto) {
+		return nil, errors.New("unix socket backends have no addresses to re-resolve")
+	}
+	if len(cfg.AllowBackends) > 0 && isUnixProto(cfg.BackendProto) {
+		return nil, errors.New("allow backends needs IP backends, not unix sockets")
+	}
+	if cfg.ResolveMigrate && (cfg.ResolveInterval == 0 || cfg.BackendProto != BackendProtoUDP) {
+		return nil, errors.New("resolve migrate needs a resolve interval and a UDP backend")
+	}
+	if cfg.DialRetries < 0 || cfg.DialBackoff < 0 {
+		return nil, errors.New("dial retries and backoff must not be negative")
+	}
+	if cfg.DialBackoff == 0 {
+		cfg.DialBackoff = defaultDialBackoff
+	}
+	if cfg.BackendLoopbackRate < 0 {
+		return nil, errors.New("backend loopback rate must not be negative")
+	}
+	if cfg.BackendLoopbackRate == 0 {
+		cfg.BackendLoopbackRate = defaultLoopbackRate
+	}
+	if cfg.BackendLoopback && cfg.BackendProto != BackendProtoUDP {
+		return nil, errors.New("backend loopback needs a UDP backend")
+	}
+	if cfg.MaxConns < 0 || cfg.AdmissionWait < 0 {
+		return nil, errors.New("max conns and admission wait must not be negative")
+	}
+	if err := checkCertPatterns(cfg.AllowCerts, cfg.DenyCerts); err != nil {
+		return nil, err
+	}
+	for addr, failover := range cfg.UDPFailover {
+		if !containsAddr(allBackends, addr) || failover == "" {
+			return nil, fmt.Errorf("invalid udp failover %s=%s", addr, failover)
+		}
+	}
+	for addr, limit := range cfg.BackendMaxConns {
+		if limit <= 0 {
+			return nil, fmt.Errorf("connection limit for backend %s must be positive", addr)
+		}
+		if !containsAddr(allBackends, addr) &&
+			(addr != targetLimitKey || len(cfg.TargetAllow) == 0) {
+			return nil, fmt.Errorf("connection limit for unknown backend %s", addr)
+		}
+	}
+	if cfg.RegionBy == "" {
+		cfg.RegionBy = RegionByContinent
+	}
+	if cfg.RegionBy != RegionByContinent && cfg.RegionBy != RegionByCountry {
+		return nil, fmt.Errorf("unsupported region by %q", cfg.RegionBy)
+	}
+	if len(cfg.RegionBackends) > 0 && cfg.GeoIPDB == "" {
+		return nil, errors.New("region backends need a GeoIP database")
+	}
+	for region, addr := range cfg.RegionBackends {
+		if !containsAddr(cfg.Backends, addr) {
+			return nil, fmt.Errorf("region %s has unknown backend %s", region, addr)
+		}
+	}
+	if cfg.MaxBytesMode == "" {
+		cfg.MaxBytesMode = QuotaModeEach
+	}
+	if cfg.MaxBytesMode != QuotaModeEach && cfg.MaxBytesMode != QuotaModeCombined {
+		return nil, fmt.Errorf("unsupported max bytes mode %q", cfg.MaxBytesMode)
+	}
+	if cfg.BackendSessionOffset < 0 || cfg.BackendSessionLength < 0 {
+		return nil, errors.New("backend session offset and length must not be negative")
+	}
+	if cfg.StripMagic && len(cfg.RequireMagic) == 0 {
+		return nil, errors.New("strip magic needs a magic prefix")
+	}
+	if len(cfg.ClientInfoHeaders) > 0 && !cfg.SendClientInfo {
+		return nil, errors.New("client info headers require sending client info")
+	}
+	if cfg.PcapOnDemand && cfg.PcapDir == "" {
+		return nil, errors.New("capture on demand needs a capture directory")
+	}
+	if cfg.Redirect != nil && len(cfg.InitPacket) == 0 {
+		return nil, errors.New("redirect needs an init packet")
+	}
+	if cfg.RedirectTimeout < 0 {
+		return nil, errors.New("redirect timeout must not be negative")
+	}
+	if cfg.RedirectTimeout == 0 {
+		cfg.RedirectTimeout = defaultRedirectTimeout
+	}
+	if strings.ContainsAny(cfg.RequireSubprotocol, ", ") {
+		return nil, errors.New("required subprotocol must be a single token")
+	}
+	if cfg.WSReadBuffer < 0 || cfg.WSWriteBuffer < 0 {
+		return nil, errors.New("websocket buffer sizes must not be negative")
+	}
+	if cfg.CompressionMinSize < 0 {
+		return nil, errors.New("compression min size must not be negative")
+	}
+	if cfg.CompressionMinSize == 0 {
+		cfg.CompressionMinSize = defaultCompressionMinSize
+	}
+	if cfg.DataSubprotocols && cfg.RequireSubprotocol != "" {
+		return nil, errors.New("data subprotocols and a required subprotocol are mutually exclusive")
+	}
+	if cfg.ControlProtocol && (cfg.DataSubprotocols ||
+		(cfg.RequireSubprotocol != "" && cfg.RequireSubprotocol != ControlSubprotocol)) {
+		return nil, errors.New("the control protocol excludes data subprotocols and other required subprotocols")
+	}
+	if cfg.IdleTimeout < 0 || cfg.MaxLifetime < 0 || cfg.ReaperInterval < 0 {
+		return nil, errors.New("idle timeout, max lifetime and reaper interval must not be negative")
+	}
+	if cfg.ResumeGrace < 0 {
+		return nil, errors.New("resume grace must not be negative")
+	}
+	if cfg.StartupGrace < 0 {
+		return nil, errors.New("startup grace must not be negative")
+	}
+	if cfg.ReadWatchdog < 0 {
+		return nil, errors.New("read watchdog must not be negative")
+	}
+	if cfg.ReaperInterval == 0 {
+		cfg.ReaperInterval = defaultReaperInterval
+	}
+	if cfg.AdminPath != "" && cfg.AdminToken == "" {
+		return nil, errors.New("admin api needs a token")
+	}
+	if cfg.PauseBuffer < 0 {
+		return nil, errors.New("pause buffer must not be negative")
+	}
+	if cfg.PauseBuffer == 0 {
+		cfg.PauseBuffer = defaultPauseBuffer
+	}
+
+	p := &Proxy{
+		cfg:      cfg,
+		sessions: &sessionRegistry{byID: make(map[string]*session)},
+		done:     make(chan struct{}),
+	}
+	p.allBackends = allBackends
+	p.bindIP, p.multicastIf = bindIP, multicastIf
+	if cfg.ResumeGrace > 0 {
+		p.resumes = newResumeStore(p)
+	}
+	p.live.Store(reloadConfigOf(&cfg))
+	p.rates = newRateLimiter(cfg.ClientRateLimit, cfg.GlobalRateLimit, p.now())
+	if len(cfg.JWTSecret) > 0 || cfg.JWKSURL != "" {
+		p.jwt = &jwtVerifier{secret: cfg.JWTSecret, now: p.now}
+		if cfg.JWKSURL != "" {
+			jwks, err := newJWKSCache(cfg.JWKSURL, p.now)
+			if err != nil {
+				return nil, err
+			}
+			p.jwt.jwks = jwks
+		}
+	}
+	limited := allBackends
+	if len(cfg.TargetAllow) > 0 {
+		limited = append(limited[:len(limited):len(limited)], targetLimitKey)
+	}
+	p.limiter = newConnLimiter(limited, cfg.MaxConns, cfg.BackendMaxConns)
+	p.pending = newHandshakeGate(cfg.MaxPendingHandshakes)
+	p.backends = newBackendPool(cfg.Backends, cfg.LBStrategy, cfg.Affinity,
+		cfg.AffinityTTL, p.now, p.limiter.count, p.backendUp)
+	if cfg.BreakerThreshold > 0 {
+		p.breakers = newCircuitBreakers(allBackends, cfg.BreakerThreshold,
+			cfg.BreakerWindow, cfg.BreakerCooldown, p.now)
+	}
+	if len(cfg.UDPPSK) > 0 {
+		if cfg.BackendProto == BackendProtoQUIC {
+			return nil, errors.New("udp psk is for UDP backends, QUIC encrypts already")
+		}
+		if cfg.BackendProto != BackendProtoUDP {
+			return nil, errors.New("udp psk is for UDP backends")
+		}
+		psk, err := newPSKCipher(cfg.UDPPSK)
+		if err != nil {
+			return nil, err
+		}
+		p.psk = psk
+	}
+	if cfg.GeoIPDB != "" {
+		geo, err := openGeoDB(cfg.GeoIPDB)
+		if err != nil {
+			return nil, err
+		}
+		p.geo = geo
+	}
+	if cfg.FlowCollector != "" {
+		flows, err := newFlowExporter(cfg.FlowCollector)
+		if err != nil {
+			return nil, err
+		}
+		p.flows = flows
+	}
+	if cfg.SessionLog != "" {
+		sessionLog, err := newSessionLogger(cfg.SessionLog, cfg.SessionLogFormat,
+			cfg.SessionLogMaxSize, cfg.SessionLogMaxFiles)
+		if err != nil {
+			if p.flows != nil {
+				p.flows.conn.Close()
+			}
+			return nil, err
+		}
+		p.sessionLog = sessionLog
+	}
+	// Background work starts only once nothing above can fail, so a
+	// failed New leaves nothing running.
+	if cfg.WarmPool > 0 {
+		p.pools = make(map[string]*warmPool, len(allBackends))
+		for _, addr := range allBackends {
+			pool := newWarmPool(p, addr, cfg.WarmPool)
+			p.pools[addr] = pool
+			go pool.run(p.done)
+		}
+	}
+	if cfg.ResolveInterval > 0 {
+		p.resolver = newBackendResolver(p, allBackends)
+		go p.resolver.run(cfg.ResolveInterval, p.done)
+	}
+	if cfg.ProbeInterval > 0 {
+		p.health = newBackendHealth(p, allBackends)
+		go p.health.run(cfg.ProbeInterval, p.done)
+	}
+	if hasIdleTimeouts(&cfg) || cfg.MaxLifetime > 0 {
+		go p.reap(cfg.ReaperInterval)
+	}
+	return p, nil
+}
+
+// Close stops the proxy's background work and closes live connections with
+// CloseShuttingDown.
+func (p *Proxy) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		for _, s := range p.sessions.snapshot() {
+			s.kill(CloseShuttingDown, "shutting down")
+		}
+		if p.resumes != nil {
+			p.resumes.closeAll()
+		}
+	})
+	return nil
+}
+
+// RegisterRoutes mounts the WebSocket upgrade route at path on app, and one
+// for each of Config.Routes, plus the metrics endpoint, probes and admin
+// API when Config.MetricsPath, Config.ReadyPath, Config.LivePath and
+// Config.AdminPath are set. Middleware the caller added to app beforehand
+// runs ahead of the upgrade.
+func (p *Proxy) RegisterRoutes(app *fiber.App, path string) {
+	if p.cfg.MetricsPath != "" {
+		app.Get(p.cfg.MetricsPath, MetricsHandler)
+	}
+	if p.cfg.ReadyPath != "" {
+		app.Get(p.cfg.ReadyPath, p.readyHandler)
+	}
+	if p.cfg.LivePath != "" {
+		app.Get(p.cfg.LivePath, liveHandler)
+	}
+	if p.cfg.AdminPath != "" {
+		p.registerAdminRoutes(app)
+	}
+	wsCfg := websocket.Config{
+		ReadBufferSize:    p.cfg.WSReadBuffer,
+		WriteBufferSize:   p.cfg.WSWriteBuffer,
+		EnableCompression: p.cfg.Compression,
+	}
+	if p.cfg.RequireSubprotocol != "" {
+		wsCfg.Subprotocols = []string{p.cfg.RequireSubprotocol}
+	}
+	if p.cfg.DataSubprotocols {
+		wsCfg.Subprotocols = dataSubprotocols()
+	}
+	if p.cfg.ControlProtocol {
+		wsCfg.Subprotocols = []string{ControlSubprotocol}
+	}
+	ws := websocket.New(p.wsHandler, wsCfg)
+	for route, backend := range p.cfg.Routes {
+		p.registerWSRoute(app, route, backend, ws)
+	}
+	if len(p.cfg.Backends) > 0 || len(p.cfg.TargetAllow) > 0 {
+		p.registerWSRoute(app, path, "", ws)
+	}
+}
+
+// registerWSRoute mounts the WebSocket path, sending its clients to backend,
+// or spreading them across Config.Backends when backend is "".
+func (p *Proxy) registerWSRoute(app *fiber.App, path, backend string, ws fiber.Handler) {
+	// Fiber routes HEAD to Get handlers too; probes get it answered here
+	// instead of a 426 from the upgrade check.
+	app.Head(path, func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderAllow, allowedMethods)
+		if !p.isReady() {
+			return c.SendStatus(fiber.StatusServiceUnavailable)
+		}
+		return c.SendStatus(fiber.StatusOK)
+	})
+	app.Options(path, p.optionsHandler)
+	metricRouteActive.set(path, 0)
+	app.Get(path, p.wsCheckMiddleware(path, backend), webTransportUpgrade, ws)
+}
+
+// allowedMethods are the methods the WebSocket path answers.
+const allowedMethods = "GET, HEAD, OPTIONS"
+
+// optionsHandler answers OPTIONS with the allowed methods, or as a CORS
+// preflight when CORS is configured and the request comes from an origin.
+func (p *Proxy) optionsHandler(c *fiber.Ctx) error {
+	if len(p.cfg.CORSOrigins) > 0 && c.Get(fiber.HeaderOrigin) != "" {
+		return p.corsPreflight(c)
+	}
+	c.Set(fiber.HeaderAllow, allowedMethods)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// wsCheckMiddleware vets upgrades, and WebTransport session requests, and
+// picks their backend: a token's backend claim, else the client's allowed
+// target, else route, the backend of a Config.Routes path, else one by
+// region or from Config.Backends.
+func (p *Proxy) wsCheckMiddleware(path, route string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if len(p.cfg.CORSOrigins) > 0 {
+			p.setCORSHeaders(c)
+		}
+		wt := webTransportRequestOf(c)
+		if wt == nil && !websocket.IsWebSocketUpgrade(c) {
+			return fiber.ErrUpgradeRequired
+		}
+		if !p.clientAllowed(c) {
+			metricClientsDenied.inc()
+			return fiber.NewError(fiber.StatusForbidden, "client not allowed")
+		}
+		if !p.certAllowed(clientCertIdentity(c)) {
+			metricClientsDenied.inc()
+			return fiber.NewError(fiber.StatusForbidden, "client certificate not allowed")
+		}
+		if !p.originAllowed(c) {
+			return fiber.NewError(fiber.StatusForbidden, "origin not allowed")
+		}
+		if p.isDraining() {
+			return errDraining
+		}
+		handshakeDone, err := p.pending.enter()
+		if err != nil {
+			return fiber.NewError(fiber.StatusServiceUnavailable, err.Error())
+		}
+		upgrading := false
+		var resumed *parkedConn
+		defer func() {
+			if !upgrading {
+				handshakeDone()
+				if resumed != nil {
+					// Refused after all; the client may try again.
+					p.resumes.park(resumed)
+				}
+			}
+		}()
+		// WebTransport has no subprotocols to require.
+		if p.cfg.RequireSubprotocol != "" && wt == nil &&
+			!offersSubprotocol(c, p.cfg.RequireSubprotocol) {
+			return fiber.NewError(fiber.StatusBadRequest,
+				"subprotocol "+p.cfg.RequireSubprotocol+" required")
+		}
+		headers, err := p.checkRequiredHeaders(c)
+		if err != nil {
+			return err
+		}
+		control := false
+		if p.cfg.ControlProtocol && wt == nil {
+			if control, err = offersControl(c); err != nil {
+				return err
+			}
+		}
+		var claims jwtClaims
+		authToken := p.reloadable().AuthToken
+		staticToken := authToken != "" && p.hasAuthToken(c, authToken)
+		if authToken != "" && !staticToken && p.jwt == nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid token")
+		}
+		if p.jwt != nil && !staticToken {
+			if claims, err = p.jwt.verify(tokenFromRequest(c)); err != nil {
+				return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+			}
+			if claims.Backend != "" && !p.backends.has(claims.Backend) {
+				return fiber.NewError(fiber.StatusForbidden, "backend not allowed")
+			}
+			if claims.Data != "" && !isDataType(claims.Data) {
+				return fiber.NewError(fiber.StatusUnauthorized, "unsupported data claim")
+			}
+		}
+		if p.cfg.AuthWebhook != "" {
+			if err := p.checkAuthWebhook(c); err != nil {
+				return err
+			}
+		}
+		if token := c.Query("resume"); token != "" && p.resumes != nil {
+			resumed = p.resumes.take(token)
+		}
+		var affinityKey string
+		backend := claims.Backend
+		limitKey := ""
+		if resumed != nil {
+			backend, limitKey = resumed.backend, resumed.limitKey
+		}
+		if target := c.Query("target"); backend == "" && target != "" &&
+			len(p.cfg.TargetAllow) > 0 {
+			if !targetAllowed(p.cfg.TargetAllow, target) || !p.targetAddrAllowed(target) {
+				return fiber.NewError(fiber.StatusForbidden, "target not allowed")
+			}
+			backend, limitKey = target, targetLimitKey
+		}
+		if backend == "" {
+			backend = route
+		}
+		region := p.clientRegion(c)
+		if backend == "" {
+			backend = p.cfg.RegionBackends[region]
+		}
+		if backend == "" && len(p.cfg.Backends) == 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "target required")
+		}
+		if backend == "" {
+			switch p.cfg.Affinity {
+			case AffinitySession:
+				affinityKey = c.Query("session")
+			case AffinityIP:
+				affinityKey = c.IP()
+			}
+			backend = p.backends.pick(affinityKey)
+		}
+		if p.health != nil && !p.health.healthy(backend) {
+			return fiber.ErrServiceUnavailable
+		}
+		if b := p.breakers[backend]; b != nil && !b.allow() {
+			return fiber.ErrServiceUnavailable
+		}
+		settings, err := p.sessionSettingsOf(c, path)
+		if err != nil {
+			return err
+		}
+		// A token's data claim wins over the client's own choice, which
+		// must then agree with it, since the upgrade echoes the latter.
+		// A data query must agree with both.
+		dataType := settings.dataType
+		if settings.queriedData && claims.Data != "" && dataType != claims.Data {
+			return fiber.NewError(fiber.StatusBadRequest,
+				"data query conflicts with the token's data claim")
+		}
+		if p.cfg.DataSubprotocols {
+			offered, err := offeredDataType(c)
+			if err != nil {
+				return err
+			}
+			if offered != "" && claims.Data != "" && offered != claims.Data {
+				return fiber.NewError(fiber.StatusBadRequest,
+					"subprotocol conflicts with the token's data claim")
+			}
+			if offered != "" && settings.queriedData && offered != dataType {
+				return fiber.NewError(fiber.StatusBadRequest,
+					"subprotocol conflicts with the data query")
+			}
+			if offered != "" {
+				dataType = offered
+			}
+		}
+		if claims.Data != "" {
+			dataType = claims.Data
+		}
+		if wt != nil {
+			// Datagrams carry the raw bytes.
+			dataType = DataTypeBinary
+		}
+		if limitKey == "" {
+			limitKey = backend
+		}
+		slot, err := p.limiter.acquire(limitKey, p.cfg.AdmissionWait)
+		if err != nil {
+			return fiber.NewError(fiber.StatusServiceUnavailable, err.Error())
+		}
+		c.Locals(localKeyConn, &connCtx{
+			backend:     backend,
+			limitKey:    limitKey,
+			route:       path,
+			affinityKey: affinityKey,
+			region:      region,
+			clientIP:    c.IP(),
+			dataType:    dataType,
+			dataClaimed: claims.Data != "",
+			udpBufSize:  settings.udpBufferSize,
+			idleTimeout: settings.idleTimeout,
+			control:     control,
+			// A token's backend claim wins over a target, and a resumed
+			// socket stays where it is.
+			backendFixed: claims.Backend != "" || resumed != nil,
+			identity:     clientCertIdentity(c),
+			info:         p.newClientInfo(c, headers),
+			slot:         slot,
+			resumed:      resumed,
+			// Handed back by the handler once the upgrade is done.
+			handshakeDone: handshakeDone,
+		})
+		if err = c.Next(); err != nil {
+			slot.release()
+		} else {
+			upgrading = true
+		}
+		return err
+	}
+}
+
+// wsHandler is a method, not handed the proxy through Locals, because
+// fasthttp closes every io.Closer among a request's user values when it
+// resets the request, which would close the proxy after each connection.
+func (p *Proxy) wsHandler(c *websocket.Conn) {
+	cc := connCtxOf(c)
+	if cc == nil {
+		slog.Error("websocket handler mounted without the proxy middleware")
+		c.Close()
+		return
+	}
+	// The session binds the connection's methods, which on the pooled
+	// wrapper would follow it to its next request.
+	p.serveClient(c.Conn, cc)
+}
+
+// serveClient runs the session of a client the middleware let through,
+// over a WebSocket or a WebTransport session, until it ends.
+func (p *Proxy) serveClient(c clientConn, cc *connCtx) {
+	cc.handshakeDone()
+	_, webTransport := c.(*webTransportConn)
+	atomic.AddInt32(&p.handlers, 1)
+	defer atomic.AddInt32(&p.handlers, -1)
+	metricRouteActive.add(cc.route, 1)
+	defer metricRouteActive.add(cc.route, -1)
+	clientID := p.newClientID()
+	var token string
+	if p.resumes != nil {
+		token = newResumeToken()
+	}
+	resumed := cc.resumed
+	isResumed := resumed != nil
+	if isResumed {
+		clientID, token = resumed.clientID, resumed.token
+		defer func() {
+			// Failing before taking the socket over leaves it parked.
+			if resumed != nil {
+				p.resumes.park(resumed)
+			}
+		}()
+	}
+	// sess is set once forwarding starts, for the totals on the disconnect
+	// line.
+	var sess *session
+	defer func() {
+		c.Close()
+		attrs := []any{slog.String("client", clientID), slog.String("remote", cc.info.remoteAddr),
+			slog.String("backend", cc.backend)}
+		if sess != nil {
+			attrs = append(attrs,
+				slog.Uint64("bytes_to_backend", atomic.LoadUint64(&sess.bytesToBackend)),
+				slog.Uint64("bytes_to_client", atomic.LoadUint64(&sess.bytesToClient)),
+				slog.Uint64("packets_to_backend", atomic.LoadUint64(&sess.packetsToBackend)),
+				slog.Uint64("packets_to_client", atomic.LoadUint64(&sess.packetsToClient)),
+				slog.Float64("duration_seconds", p.now().Sub(sess.startedAt).Seconds()))
+		}
+		slog.Info("client disconnected", attrs...)
+	}()
+
+	url := cc.backend
+	defer p.backends.release(cc.affinityKey, url)
+
+	slot := cc.slot
+	defer func() { slot.release() }()
+	if !slot.claim() {
+		slog.Warn("connection slot expired during the upgrade", "client", clientID)
+		c.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "try again later"),
+			time.Now().Add(time.Second),
+		)
+		p.connFailed(clientID, errors.New("connection slot expired"))
+		return
+	}
+
+	if cc.control {
+		target, ok := p.handshake(c, clientID, cc)
+		if !ok {
+			p.connFailed(clientID, errors.New("handshake failed"))
+			return
+		}
+		if target != "" {
+			// Counted under the targets from now on.
+			targetSlot, err := p.limiter.acquire(targetLimitKey, p.cfg.AdmissionWait)
+			if err != nil {
+				slog.Info("no slot for the client's target", "client", clientID, "error", err)
+				c.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()),
+					time.Now().Add(time.Second),
+				)
+				p.connFailed(clientID, err)
+				return
+			}
+			targetSlot.claim()
+			slot.release()
+			slot, url, cc.limitKey = targetSlot, target, targetLimitKey
+		}
+	}
+
+	var first []byte
+	if len(p.cfg.RequireMagic) > 0 {
+		var ok bool
+		if first, ok = p.checkMagic(c, clientID, cc.dataType); !ok {
+			p.connFailed(clientID, errors.New("first message rejected"))
+			return
+		}
+	}
+
+	// Failing to reach the backend counts toward its circuit breaker.
+	breaker := p.breakers[url]
+	backendFailed := func(step string, err error) {
+		if breaker != nil {
+			breaker.failure()
+		}
+		metricBackendErrors.inc()
+		slog.Warn(step+" backend error", "client", clientID, "backend", url, "error", err)
+		c.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(CloseBackendUnavailable, "backend unavailable"),
+			time.Now().Add(time.Second),
+		)
+		p.connFailed(clientID, fmt.Errorf("%s backend: %w", step, err))
+	}
+
+	var udpConn backendConn
+	var err error
+	if resumed != nil {
+		udpConn, resumed = resumed.conn, nil
+		// The last handler's teardown left the deadlines in the past.
+		udpConn.SetDeadline(time.Time{})
+	} else if pool := p.pools[url]; pool != nil {
+		udpConn = pool.get()
+	}
+	if udpConn == nil {
+		var step string
+		if udpConn, step, err = p.connectBackend(clientID, url); err != nil {
+			if step == "resolve" {
+				metricResolveErrors.inc()
+			}
+			backendFailed(step, err)
+			return
+		}
+	}
+	dialedAddr := udpConn.RemoteAddr().String()
+	var opening [][]byte
+	if p.cfg.SendClientInfo {
+		opening = append(opening, clientInfoPacket(clientID, cc.info))
+	}
+	if len(p.cfg.InitPacket) > 0 {
+		opening = append(opening, p.cfg.InitPacket)
+	}
+	var firstReply []byte
+	if len(opening) > 0 && !isResumed {
+		udpConn, firstReply, err = p.initBackend(udpConn, opening)
+		if err != nil {
+			udpConn.Close()
+			backendFailed("init", err)
+			return
+		}
+		if udpConn.RemoteAddr().String() != dialedAddr {
+			slog.Info("client redirected", "client", clientID, "backend_addr", udpConn.RemoteAddr())
+		}
+	}
+	if breaker != nil {
+		breaker.success()
+	}
+
+	// The connect line waits for the dial, so it can name the address the
+	// backend resolved to.
+	attrs := []any{slog.String("client", clientID)}
+	if cc.identity != "" {
+		attrs = append(attrs, slog.String("identity", cc.identity))
+	}
+	compressed := p.cfg.Compression && offersDeflate(cc.info.extensions)
+	attrs = append(attrs, cc.info.attrs(c.Subprotocol(), compressed)...)
+	attrs = append(attrs, slog.String("backend", url),
+		slog.String("backend_addr", udpConn.RemoteAddr().String()))
+	if cc.region != "" {
+		attrs = append(attrs, slog.String("region", cc.region))
+	}
+	if webTransport {
+		attrs = append(attrs, slog.Bool("webtransport", true))
+	}
+	if isResumed {
+		metricResumed.inc()
+		attrs = append(attrs, slog.Bool("resumed", true))
+	}
+	slog.Info("client connected", attrs...)
+	if (p.cfg.UDPReconnect > 0 || p.cfg.UDPFailover[url] != "" || p.cfg.ResolveMigrate) && !isResumed {
+		udpConn = p.newReconnectingConn(clientID, url, udpConn)
+	}
+	// parked is set when the socket outlives the connection for the
+	// client to resume.
+	parked := false
+	defer func() {
+		if !parked {
+			udpConn.Close()
+		}
+	}()
+
+	clientErrChan := make(chan error, 1)
+	backendErrChan := make(chan error, 1)
+
+	if compressed {
+		// Off until writeClient finds a message worth compressing.
+		c.EnableWriteCompression(false)
+	}
+	if p.cfg.ReportRelayAddr {
+		err = c.WriteJSON(relayAddrMessage{
+			Type: "relay-addr",
+			Addr: udpConn.LocalAddr().String(),
+		})
+		if err != nil {
+			slog.Warn("report relay address error", "client", clientID, "error", err)
+			return
+		}
+	}
+	if token != "" {
+		err = c.WriteJSON(sessionMessage{Type: "session", Token: token, Resumed: isResumed})
+		if err != nil {
+			slog.Warn("send resume token error", "client", clientID, "error", err)
+			return
+		}
+	}
+
+	if firstReply != nil {
+		msgType, data := encodeMessage(cc.dataType, firstReply)
+		if err = writeClient(c, &p.cfg, msgType, data); err != nil {
+			return
+		}
+	}
+
+	sess = &session{
+		id:           clientID,
+		proxy:        p,
+		startedAt:    p.now(),
+		dataType:     cc.dataType,
+		udpBufSize:   cc.udpBufSize,
+		idleTimeout:  cc.idleTimeout,
+		udpConn:      udpConn,
+		writeControl: c.WriteControl,
+		closeWS:      c.Close,
+		remoteAddr:   cc.info.remoteAddr,
+		backend:      url,
+		identity:     cc.identity,
+		firstMessage: first,
+		batched: p.cfg.WSBatchWindow > 0 && cc.dataType == DataTypeBinary &&
+			!webTransport && !cc.noBatch,
+	}
+	if firstReply != nil && p.cfg.BackendSessionLength > 0 {
+		sess.observeBackendSession(firstReply)
+	}
+	sess.filters = p.newFilterChain(SessionInfo{
+		ClientID: clientID,
+		ClientIP: cc.clientIP,
+		Route:    cc.route,
+		Backend:  url,
+	})
+	if p.cfg.SeqSize > 0 {
+		sess.seq = newSeqTracker(p.cfg.SeqOffset, p.cfg.SeqSize,
+			p.cfg.SeqLittleEndian, p.cfg.SeqLossWindow)
+		metricSeqLoss.set(clientID, sess.seq.lossRatio)
+		defer metricSeqLoss.delete(clientID)
+	}
+	if p.cfg.RecordDir != "" {
+		framing := FramingNone
+		if p.cfg.TxCoalesceWindow > 0 {
+			framing = FramingLength16
+		}
+		sess.capture = p.openCapture(sess, CaptureHeader{
+			Client:         clientID,
+			Backend:        udpConn.RemoteAddr().String(),
+			Started:        sess.startedAt,
+			DataFromClient: p.cfg.DataFromClient,
+			DataToClient:   cc.dataType,
+			Framing:        framing,
+		})
+		if sess.capture != nil {
+			defer sess.capture.close(clientID)
+		}
+	}
+	if p.cfg.PcapDir != "" {
+		// Registered before the session is, so no capture can start
+		// once this has run.
+		defer sess.stopPcap(true)
+		if !p.cfg.PcapOnDemand {
+			if _, err := sess.startPcap(); err != nil {
+				slog.Warn("capture error", "client", clientID, "error", err)
+			}
+		}
+	}
+	sess.rate = p.rates.acquire(cc.clientIP, p.now())
+	defer p.rates.release(cc.clientIP)
+	sess.touch()
+	sess.pause = newPauseGate(p.cfg.PauseBuffer, atomic.LoadInt32(&p.paused) == 1)
+	p.sessions.add(sess)
+	defer p.sessions.remove(sess)
+	if p.flows != nil {
+		defer func() { p.flows.export(flowRecordOf(sess, p.now())) }()
+	}
+	if atomic.LoadInt32(&p.paused) == 1 {
+		// Paused between creating the gate and registering the session.
+		sess.pause.set(true)
+	}
+	metricConnsTotal.inc()
+	metricConnsActive.add(1)
+	defer metricConnsActive.add(-1)
+
+	// Whichever side ends first cancels ctx, which unblocks the other side;
+	// the handler returns only after both goroutines are done, since the
+	// client connection must not be used once it does.
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		forwardWS2UDP(ctx, c, udpConn, clientErrChan, sess)
+	}()
+	go func() {
+		defer wg.Done()
+		forwardUDP2WS(ctx, udpConn, c, backendErrChan, sess)
+	}()
+	go func() {
+		defer wg.Done()
+		cancelOnDone(ctx, c, udpConn)
+	}()
+	if p.cfg.PingInterval > 0 {
+		c.SetPongHandler(sess.pong)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess.keepAlive(ctx)
+		}()
+	}
+	if p.cfg.ReadWatchdog > 0 {
+		// Not part of wg: it is what ends a read that keeps wg.Wait blocked.
+		watchdogDone := make(chan struct{})
+		defer close(watchdogDone)
+		go sess.watchReads(ctx, watchdogDone)
+	}
+
+	var msg string
+	var clientSide bool
+
+	select {
+	case err = <-clientErrChan:
+		msg = "forward client to backend server error"
+		clientSide = true
+	case err = <-backendErrChan:
+		msg = "forward backend to client server error"
+	}
+	// A session the reaper or Close killed ends on whatever error closing
+	// it caused.
+	killedBefore := atomic.LoadInt32(&sess.killCode) != 0
+	// The close frame has to go out before cancel poisons the write
+	// deadline.
+	quotaExceeded := errors.Is(err, errQuotaExceeded)
+	tooSlow := errors.Is(err, errClientTooSlow)
+	var backendErr backendError
+	isBackendErr := errors.As(err, &backendErr)
+	var filterErr filterError
+	var reconnectErr reconnectError
+	// A stream backend closing its end is how its sessions normally end.
+	backendClosed := isBackendErr && errors.Is(err, io.EOF)
+	switch {
+	case errors.Is(err, errWrongDataType):
+		sess.kill(websocket.CloseUnsupportedData, err.Error())
+	case errors.Is(err, errBadEncoding), errors.Is(err, errTruncatedFrame):
+		sess.kill(websocket.CloseInvalidFramePayloadData, err.Error())
+	case errors.Is(err, errSizeNotAllowed):
+		sess.kill(websocket.ClosePolicyViolation, err.Error())
+	case errors.As(err, &filterErr):
+		sess.kill(websocket.ClosePolicyViolation, err.Error())
+	case quotaExceeded:
+		sess.kill(CloseQuotaExceeded, err.Error())
+	case tooSlow:
+		sess.kill(CloseClientTooSlow, err.Error())
+	case backendClosed:
+		sess.kill(websocket.CloseNormalClosure, "backend closed")
+	case isBackendErr && errors.As(err, &reconnectErr):
+		sess.kill(CloseBackendError, reconnectErr.reason())
+	case isBackendErr:
+		sess.kill(CloseBackendError, "backend error")
+	}
+	cancel()
+	wg.Wait()
+	// A client whose connection broke, rather than closed, may come back
+	// for its socket, if nothing else ended the session.
+	lost := atomic.LoadInt32(&sess.lost) == 1
+	if p.resumes != nil && (lost || (clientSide &&
+		atomic.LoadInt32(&sess.killCode) == 0 && !closedCleanly(err))) {
+		code, reason := closeCodeOf(err)
+		parked = p.resumes.park(&parkedConn{
+			token:    token,
+			clientID: clientID,
+			backend:  url,
+			limitKey: cc.limitKey,
+			conn:     udpConn,
+			deadline: time.Now().Add(p.cfg.ResumeGrace),
+			sess:     sess,
+			code:     code,
+			reason:   reason,
+		})
+	}
+	if parked {
+		slog.Info("backend socket kept for the client to resume", "client", clientID,
+			"grace", p.cfg.ResumeGrace)
+	} else {
+		sess.sendFinalPacket(closeCodeOf(err))
+	}
+	if p.sessionLog != nil {
+		p.sessionLog.log(sessionRecordOf(sess, cc.clientIP, cc.route, err, p.now()))
+	}
+	if !killedBefore && !closedCleanly(err) && !backendClosed {
+		p.connFailed(clientID, err)
+	}
+
+	if t := sess.seq; t != nil && t.datagrams > 0 {
+		slog.Info("backend sequence", "client", clientID, "datagrams", t.datagrams,
+			"gaps", t.gaps, "reordered", t.reordered, "duplicates", t.duplicates,
+			"malformed", t.malformed, "recent_loss", fmt.Sprintf("%.1f%%", 100*t.lossRatio()))
+	}
+	if n := atomic.LoadUint64(&sess.dropped); n > 0 {
+		slog.Warn("datagrams dropped on transient backend write errors",
+			"client", clientID, "datagrams", n)
+	}
+	if n := atomic.LoadUint64(&sess.sendDropped); n > 0 {
+		slog.Warn("datagrams dropped for a slow client",
+			"client", clientID, "datagrams", n, "policy", p.cfg.SendPolicy)
+	}
+
+	if quotaExceeded {
+		metricQuotaExceeded.inc()
+		slog.Info("client exceeded the byte quota", "client", clientID, "bytes", p.reloadable().MaxBytesPerConn)
+		return
+	}
+	if tooSlow {
+		metricClientTooSlow.inc()
+		slog.Warn("client too slow", "client", clientID, "pending_over", p.cfg.SendHighWater)
+		return
+	}
+
+	if backendClosed {
+		slog.Info("backend closed the connection", "client", clientID)
+		return
+	}
+	if isBackendErr {
+		metricBackendErrors.inc()
+		slog.Warn("backend error", "client", clientID, "error", backendErr)
+		return
+	}
+
+	if websocket.IsUnexpectedCloseError(
+		err,
+		websocket.CloseGoingAway,
+		websocket.CloseNoStatusReceived) {
+		slog.Warn(msg, "client", clientID, "error", err)
+	}
+}
+
+// closedCleanly reports whether err is the client closing the connection
+// as intended.
+func closedCleanly(err error) bool {
+	return websocket.IsCloseError(err,
+		websocket.CloseNormalClosure,
+		websocket.CloseGoingAway,
+		websocket.CloseNoStatusReceived)
+}
+
+// connFailed reports a connection that ended on err to Config.OnConnError.
+func (p *Proxy) connFailed(clientID string, err error) {
+	if p.cfg.OnConnError != nil {
+		p.cfg.OnConnError(clientID, err)
+	}
+}
+
+// closeCodeOf describes how a connection ended for the final packet when it
+// was not killed with an explicit code: the client's close frame if it sent
+// one, an abnormal closure otherwise.
+func closeCodeOf(err error) (int, string) {
+	var closeErr *fastws.CloseError
+	if errors.As(err, &closeErr) {
+		return closeErr.Code, closeErr.Text
+	}
+	return websocket.CloseAbnormalClosure, err.Error()
+}
+
+// relayAddrMessage tells the client which local address the proxy uses
+// toward the backend, for NAT traversal signaling.
+type relayAddrMessage struct {
+	Type string `json:"type"`
+	Addr string `json:"addr"`
+}
+
+// warnDSCPOnce keeps an unsupported DSCP from logging on every connection,
+// and warnTTLOnce an unsupported TTL.
+var warnDSCPOnce, warnTTLOnce sync.Once
+
+// dialBackendName resolves and dials the backend addr, a path for unix
+// socket backends. On error, step names what failed, resolve or dial.
+func (p *Proxy) dialBackendName(addr string) (conn backendConn, step string, err error) {
+	if isUnixProto(p.cfg.BackendProto) {
+		if conn, err = p.dialUnix(addr); err != nil {
+			return nil, "dial", err
+		}
+		return conn, "", nil
+	}
+	udpAddr, err := p.resolveBackend(addr)
+	if err != nil {
+		return nil, "resolve", err
+	}
+	if !p.backendAllowed(addr, udpAddr) {
+		metricBackendsDenied.inc()
+		return nil, "dial", fmt.Errorf("backend address %s not allowed", udpAddr)
+	}
+	if conn, err = p.dialBackend(udpAddr); err != nil {
+		return nil, "dial", err
+	}
+	return conn, "", nil
+}
+
+// dialBackend opens the backend connection for one client over the
+// configured backend protocol.
+func (p *Proxy) dialBackend(addr *net.UDPAddr) (backendConn, error) {
+	switch p.cfg.BackendProto {
+	case BackendProtoQUIC:
+		return p.dialQUIC(addr)
+	case BackendProtoTCP:
+		return p.dialTCP(addr)
+	}
+	if addr.IP.IsMulticast() || p.cfg.UDPBroadcast {
+		return p.dialGroup(addr)
+	}
+	var dialer net.Dialer
+	if p.cfg.UDPBindDevice != "" {
+		dialer.Control = bindToDevice(p.cfg.UDPBindDevice)
+	}
+	var conn net.Conn
+	err := p.bindLocal(func(ip net.IP, port int) error {
+		if ip != nil || port != 0 {
+			dialer.LocalAddr = &net.UDPAddr{IP: ip, Port: port}
+		}
+		var err error
+		conn, err = dialer.Dial("udp", addr.String())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	udpConn := conn.(*net.UDPConn)
+	p.applyDSCP(udpConn)
+	p.applyTTL(udpConn)
+	p.applyBufferSizes(udpConn)
+	if p.psk != nil {
+		return newSealedConn(udpConn, p.psk), nil
+	}
+	if p.cfg.BackendDTLS != nil {
+		return p.dtlsClient(udpConn)
+	}
+	return udpConn, nil
+}
+
+// logBufferSizesOnce reports the granted socket buffer sizes for the first
+// backend socket only; the rest get the same.
+var logBufferSizesOnce sync.Once
+
+// applyBufferSizes sets the configured socket buffer sizes on udpConn.
+func (p *Proxy) applyBufferSizes(udpConn *net.UDPConn) {
+	if p.cfg.UDPRcvBuf == 0 && p.cfg.UDPSndBuf == 0 {
+		return
+	}
+	var err error
+	if p.cfg.UDPRcvBuf > 0 {
+		err = udpConn.SetReadBuffer(p.cfg.UDPRcvBuf)
+	}
+	if p.cfg.UDPSndBuf > 0 && err == nil {
+		err = udpConn.SetWriteBuffer(p.cfg.UDPSndBuf)
+	}
+	logBufferSizesOnce.Do(func() {
+		if err != nil {
+			slog.Warn("udp socket buffer sizes not applied", "error", err)
+			return
+		}
+		rcv, snd, err := socketBufferSizes(udpConn)
+		if err != nil {
+			slog.Warn("udp socket buffer sizes granted unknown", "error", err)
+			return
+		}
+		slog.Info("udp socket buffers granted", "rcvbuf", rcv, "sndbuf", snd,
+			"requested_rcvbuf", p.cfg.UDPRcvBuf, "requested_sndbuf", p.cfg.UDPSndBuf)
+	})
+}
+
+// applyTTL sets the configured TTL on conn, warning once if it cannot.
+func (p *Proxy) applyTTL(conn net.Conn) {
+	if p.cfg.TTL == 0 {
+		return
+	}
+	if err := setTTL(conn, p.cfg.TTL); err != nil {
+		warnTTLOnce.Do(func() {
+			slog.Warn("ttl not applied", "error", err)
+		})
+	}
+}
+
+// applyDSCP marks conn with the configured DSCP. Failing to do so is
+// only worth a warning.
+func (p *Proxy) applyDSCP(conn net.Conn) {
+	if p.cfg.DSCP == 0 {
+		return
+	}
+	if err := setDSCP(conn, p.cfg.DSCP); err != nil {
+		warnDSCPOnce.Do(func() {
+			slog.Warn("dscp marking not applied", "error", err)
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 fields used by the client info datagram and
+// ProxyProtocolListener.
+const (
+	proxyV2Command     = 0x21 // version 2, PROXY
+	proxyV2Local       = 0x20 // version 2, LOCAL: the proxy's own connection
+	proxyV2UnspecDgram = 0x02 // unknown family, e.g. a Unix socket client
+	proxyV2Inet4Dgram  = 0x12
+	proxyV2Inet6Dgram  = 0x22
+	proxyV2TypeUnique  = 0x05 // PP2_TYPE_UNIQUE_ID
+	proxyV2TypeSSL     = 0x20 // PP2_TYPE_SSL
+	proxyV2SSLVersion  = 0x21 // PP2_SUBTYPE_SSL_VERSION
+	proxyV2SSLCN       = 0x22 // PP2_SUBTYPE_SSL_CN
+	proxyV2ClientSSL   = 0x01 // PP2_CLIENT_SSL
+	// proxyV2ClientCert is PP2_CLIENT_CERT_CONN and PP2_CLIENT_CERT_SESS:
+	// the client presented a certificate, on this connection.
+	proxyV2ClientCert = 0x06
+	// proxyV2TypeHeader is the first custom TLV type (PP2_TYPE_MIN_CUSTOM),
+	// used for each Config.ClientInfoHeaders entry present.
+	proxyV2TypeHeader = 0xe0
+)
+
+// clientInfoPacket is the datagram Config.SendClientInfo sends ahead of
+// everything else: a PROXY protocol v2 header for a datagram flow from the
+// client's address to the one it reached the proxy on, followed by the
+// client ID, the TLS details for a client over TLS and the configured
+// headers as TLVs. Header TLVs hold "Name: value". The TLS details are an
+// SSL TLV with the version and, for a verified client certificate, its
+// identity as the CN.
+func clientInfoPacket(clientID string, info clientInfo) []byte {
+	src, dst := addrPortOf(info.remoteAddr), addrPortOf(info.localAddr)
+	if src.Addr().Is6() != dst.Addr().Is6() {
+		// Only one family fits; the client's address matters more.
+		dst = netip.AddrPortFrom(netip.IPv6Unspecified(), 0)
+		if src.Addr().Is4() {
+			dst = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+		}
+	}
+
+	b := append([]byte(nil), proxyV2Signature...)
+	b = append(b, proxyV2Command)
+	switch {
+	case src.Addr().IsUnspecified() && src.Port() == 0:
+		b = append(b, proxyV2UnspecDgram, 0, 0)
+	case src.Addr().Is4():
+		b = append(b, proxyV2Inet4Dgram, 0, 0)
+	default:
+		b = append(b, proxyV2Inet6Dgram, 0, 0)
+	}
+	if b[13] != proxyV2UnspecDgram {
+		b = append(b, src.Addr().AsSlice()...)
+		b = append(b, dst.Addr().AsSlice()...)
+		b = binary.BigEndian.AppendUint16(b, src.Port())
+		b = binary.BigEndian.AppendUint16(b, dst.Port())
+	}
+	b = appendTLV(b, proxyV2TypeUnique, clientID)
+	if info.tlsVersion != "" {
+		b = appendSSLTLV(b, info)
+	}
+	for _, h := range info.clientInfoHeaders {
+		b = appendTLV(b, proxyV2TypeHeader, h)
+	}
+	binary.BigEndian.PutUint16(b[14:], uint16(len(b)-16))
+	return b
+}
+
+// appendSSLTLV appends the SSL TLV of a client over TLS: its flags, a
+// verify result of 0, since only verified certificates are let through,
+// and the sub-TLVs.
+func appendSSLTLV(b []byte, info clientInfo) []byte {
+	flags := byte(proxyV2ClientSSL)
+	if info.certIdentity != "" {
+		flags |= proxyV2ClientCert
+	}
+	value := []byte{flags, 0, 0, 0, 0}
+	value = appendTLV(value, proxyV2SSLVersion, info.tlsVersion)
+	if info.certIdentity != "" {
+		value = appendTLV(value, proxyV2SSLCN, info.certIdentity)
+	}
+	return appendTLV(b, proxyV2TypeSSL, string(value))
+}
+
+func appendTLV(b []byte, typ byte, value string) []byte {
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+// Limits of the inbound PROXY protocol header.
+const (
+	proxyV1MaxLen         = 107
+	proxyHeaderTimeout    = 5 * time.Second
+	proxyV2Inet4Stream    = 0x11
+	proxyV2Inet6Stream    = 0x21
+	proxyV2AddrLenInet4   = 12
+	proxyV2AddrLenInet6   = 36
+	proxyV2MaxHeaderBytes = 1 << 12
+)
+
+// ProxyProtocolListener wraps ln so that connections from the trusted
+// proxies, or from every peer when trusted is empty, must begin with a
+// PROXY protocol v1 or v2 header, as load balancers such as HAProxy and
+// AWS NLB send. The address in it becomes the connection's RemoteAddr,
+// so the client is the one logged, rate limited and checked by the ACLs.
+// Connections from other peers are passed through as they are.
+//
+// The header is read on the connection's first Read or RemoteAddr, in its
+// own goroutine, so a slow peer does not hold up Accept. One that sends
+// none, or a malformed one, within 5 seconds fails its reads and is closed.
+func ProxyProtocolListener(ln net.Listener, trusted []netip.Prefix) net.Listener {
+	return &proxyProtocolListener{Listener: ln, trusted: trusted}
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if len(l.trusted) > 0 && !trustedAddr(conn.RemoteAddr(), l.trusted) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	once   sync.Once
+	remote net.Addr
+	err    error
+
+	// deadline is the last read deadline set before the header was read,
+	// put back once it has been.
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	c.remote, c.err = readProxyHeader(c.Conn)
+	c.mu.Lock()
+	c.Conn.SetReadDeadline(c.deadline)
+	c.mu.Unlock()
+	if c.err != nil {
+		slog.Warn("PROXY protocol header error", "remote", c.Conn.RemoteAddr().String(), "error", c.err)
+	}
+}
+
+// readProxyHeader reads a PROXY protocol header off r, not a byte more,
+// and returns the client address in it. A nil address with no error is a
+// header that names none, such as a health check's LOCAL or UNKNOWN.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(r, b[:8]); err != nil {
+		return nil, fmt.Errorf("read PROXY header: %w", err)
+	}
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return readProxyV1(r, b[:8])
+	}
+	if !bytes.Equal(b[:8], proxyV2Signature[:8]) {
+		return nil, errors.New("missing PROXY protocol header")
+	}
+	if _, err := io.ReadFull(r, b[8:]); err != nil {
+		return nil, fmt.Errorf("read PROXY header: %w", err)
+	}
+	if !bytes.Equal(b[:12], proxyV2Signature) || b[12]>>4 != 2 {
+		return nil, errors.New("invalid PROXY protocol v2 header")
+	}
+	n := int(binary.BigEndian.Uint16(b[14:]))
+	if n > proxyV2MaxHeaderBytes {
+		return nil, errors.New("PROXY protocol v2 header too long")
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("read PROXY header: %w", err)
+	}
+	if b[12] == proxyV2Local {
+		return nil, nil
+	}
+	if b[12] != proxyV2Command {
+		return nil, fmt.Errorf("unknown PROXY protocol v2 command %#x", b[12])
+	}
+	switch {
+	case b[13] == proxyV2Inet4Stream && n >= proxyV2AddrLenInet4:
+		return &net.TCPAddr{IP: net.IP(body[:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case b[13] == proxyV2Inet6Stream && n >= proxyV2AddrLenInet6:
+		return &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
+
+// readProxyV1 reads the rest of the text header that began with start,
+// such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1(r io.Reader, start []byte) (net.Addr, error) {
+	line := append([]byte(nil), start...)
+	c := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("PROXY protocol v1 header too long")
+		}
+		if _, err := io.ReadFull(r, c); err != nil {
+			return nil, fmt.Errorf("read PROXY header: %w", err)
+		}
+		line = append(line, c[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	port, perr := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil || perr != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), uint16(port))), nil
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Additional data binding a sealed datagram to its direction, so a
+// datagram cannot be reflected back to where it came from.
+var (
+	pskToBackend = []byte{0x01}
+	pskToProxy   = []byte{0x02}
+)
+
+// pskOverhead is what sealing adds to a datagram: the nonce and the tag.
+const pskOverhead = chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+
+// newPSKCipher returns the XChaCha20-Poly1305 AEAD for Config.UDPPSK.
+func newPSKCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, fmt.Errorf("udp psk must be %d bytes, got %d", chacha20poly1305.KeySize, len(key))
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// sealedConn encrypts every datagram written to the backend and decrypts
+// every one read from it. A datagram read that fails authentication is
+// dropped and counted, and the read goes on with the next one.
+type sealedConn struct {
+	backendConn
+	aead cipher.AEAD
+	buf  []byte
+}
+
+func newSealedConn(conn backendConn, aead cipher.AEAD) *sealedConn {
+	return &sealedConn{backendConn: conn, aead: aead}
+}
+
+// Write sends nonce || ciphertext || tag, with a random 24-byte nonce.
+func (c *sealedConn) Write(b []byte) (int, error) {
+	out := make([]byte, chacha20poly1305.NonceSizeX, pskOverhead+len(b))
+	if _, err := rand.Read(out); err != nil {
+		return 0, err
+	}
+	out = c.aead.Seal(out, out, b, pskToBackend)
+	if _, err := c.backendConn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *sealedConn) Read(b []byte) (int, error) {
+	if len(c.buf) < len(b)+pskOverhead {
+		c.buf = make([]byte, len(b)+pskOverhead)
+	}
+	for {
+		n, err := c.backendConn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < pskOverhead {
+			metricPSKRejected.inc()
+			continue
+		}
+		nonce, sealed := c.buf[:chacha20poly1305.NonceSizeX], c.buf[chacha20poly1305.NonceSizeX:n]
+		plain, err := c.aead.Open(b[:0], nonce, sealed, pskToProxy)
+		if err != nil {
+			metricPSKRejected.inc()
+			continue
+		}
+		return len(plain), nil
+	}
+}
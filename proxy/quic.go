@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Backend protocols for Config.BackendProto.
+const (
+	BackendProtoUDP      = "udp"
+	BackendProtoTCP      = "tcp"
+	BackendProtoQUIC     = "quic"
+	BackendProtoUnix     = "unix"
+	BackendProtoUnixgram = "unixgram"
+)
+
+// QUIC modes for Config.QUICMode.
+const (
+	// QUICModeDatagram maps each message to an unreliable QUIC datagram
+	// (RFC 9221), keeping the proxy's usual UDP semantics.
+	QUICModeDatagram = "datagram"
+	// QUICModeStream sends messages over one bidirectional stream, each
+	// framed by a 2-byte big-endian length. Delivery is reliable and in
+	// order.
+	QUICModeStream = "stream"
+)
+
+const (
+	defaultQUICALPN        = "udpwsproxy"
+	defaultQUICDialTimeout = 5 * time.Second
+	quicKeepAlivePeriod    = 15 * time.Second
+)
+
+// dialQUIC connects to a QUIC backend from a fresh UDP socket, so the
+// local address, device binding, DSCP marking and TTL of UDP backends
+// apply to QUIC as well.
+func (p *Proxy) dialQUIC(addr *net.UDPAddr) (backendConn, error) {
+	lc := net.ListenConfig{}
+	if p.cfg.UDPBindDevice != "" {
+		lc.Control = bindToDevice(p.cfg.UDPBindDevice)
+	}
+	var pc net.PacketConn
+	err := p.bindLocal(func(ip net.IP, port int) error {
+		var err error
+		pc, err = lc.ListenPacket(context.Background(), "udp", localHostPort(ip, port))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	udpConn := pc.(*net.UDPConn)
+	p.applyDSCP(udpConn)
+	p.applyTTL(udpConn)
+
+	tr := &quic.Transport{Conn: udpConn}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQUICDialTimeout)
+	defer cancel()
+	conn, err := tr.Dial(ctx, addr, p.cfg.QUICTLS, &quic.Config{
+		EnableDatagrams: p.cfg.QUICMode == QUICModeDatagram,
+		KeepAlivePeriod: quicKeepAlivePeriod,
+	})
+	if err != nil {
+		tr.Close()
+		udpConn.Close()
+		return nil, fmt.Errorf("quic dial %s: %w", addr, err)
+	}
+	base := quicBase{conn: conn, tr: tr, udpConn: udpConn}
+
+	if p.cfg.QUICMode == QUICModeDatagram {
+		if !conn.ConnectionState().SupportsDatagrams {
+			base.Close()
+			return nil, fmt.Errorf("quic backend %s does not support datagrams", addr)
+		}
+		return &quicDatagramConn{quicBase: base}, nil
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		base.Close()
+		return nil, fmt.Errorf("quic open stream %s: %w", addr, err)
+	}
+	return &quicStreamConn{quicBase: base, stream: stream}, nil
+}
+
+// quicBase holds what both QUIC modes need to tear down.
+type quicBase struct {
+	conn    quic.Connection
+	tr      *quic.Transport
+	udpConn *net.UDPConn
+}
+
+func (b quicBase) LocalAddr() net.Addr  { return b.conn.LocalAddr() }
+func (b quicBase) RemoteAddr() net.Addr { return b.conn.RemoteAddr() }
+
+func (b quicBase) Close() error {
+	err := b.conn.CloseWithError(0, "")
+	b.tr.Close()
+	b.udpConn.Close()
+	return err
+}
+
+// quicDatagramConn exchanges messages as QUIC datagrams. ReceiveDatagram
+// takes a context rather than honoring deadlines, so deadlines are mapped
+// onto a context per Read, and SetReadDeadline cancels a pending one.
+type quicDatagramConn struct {
+	quicBase
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	cancelRead   context.CancelFunc
+}
+
+func (c *quicDatagramConn) Write(b []byte) (int, error) {
+	if err := c.conn.SendDatagram(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *quicDatagramConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		ctx, cancel := context.WithCancel(context.Background())
+		if !deadline.IsZero() {
+			ctx, cancel = context.WithDeadline(context.Background(), deadline)
+		}
+		c.cancelRead = cancel
+		c.mu.Unlock()
+
+		msg, err := c.conn.ReceiveDatagram(ctx)
+		cancel()
+		if err == nil {
+			return copy(b, msg), nil
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if errors.Is(err, context.Canceled) {
+			// The deadline moved, read again with the new one.
+			continue
+		}
+		return 0, err
+	}
+}
+
+func (c *quicDatagramConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if c.cancelRead != nil {
+		c.cancelRead()
+	}
+	return nil
+}
+
+func (c *quicDatagramConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// quicStreamConn frames messages on a single bidirectional QUIC stream.
+type quicStreamConn struct {
+	quicBase
+	stream quic.Stream
+	frames frameReader
+}
+
+func (c *quicStreamConn) Write(b []byte) (int, error) {
+	return writeFrame(c.stream, b)
+}
+
+func (c *quicStreamConn) Read(b []byte) (int, error) {
+	n, err := c.frames.read(c.stream, b)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *quicStreamConn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *quicStreamConn) SetDeadline(t time.Time) error {
+	return c.stream.SetDeadline(t)
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit caps forwarding per second: up is client to backend, down is
+// backend to client. A zero field is no cap.
+type RateLimit struct {
+	UpPackets   int
+	UpBytes     int
+	DownPackets int
+	DownBytes   int
+}
+
+// ParseRateLimit parses a comma-separated list of key=n entries, the keys
+// being up-packets, up-bytes, down-packets and down-bytes. Missing keys are
+// no cap.
+func ParseRateLimit(s string) (RateLimit, error) {
+	var l RateLimit
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(part, "=")
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return RateLimit{}, fmt.Errorf("invalid rate limit %q", part)
+		}
+		switch key {
+		case "up-packets":
+			l.UpPackets = n
+		case "up-bytes":
+			l.UpBytes = n
+		case "down-packets":
+			l.DownPackets = n
+		case "down-bytes":
+			l.DownBytes = n
+		default:
+			return RateLimit{}, fmt.Errorf("unknown rate limit %q", key)
+		}
+	}
+	return l, nil
+}
+
+// tokenBucket holds up to one second's worth of tokens. A full bucket
+// admits any amount, going into debt, so datagrams larger than a byte rate
+// still pass at that average. A nil bucket admits everything.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	if rate == 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+func (b *tokenBucket) take(n int, now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	if b.tokens < float64(n) && b.tokens < b.rate {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// refund gives back what take took, when a later bucket refused.
+func (b *tokenBucket) refund(n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.tokens += float64(n)
+	b.mu.Unlock()
+}
+
+// rateBuckets are the buckets for one RateLimit.
+type rateBuckets struct {
+	upPackets, upBytes     *tokenBucket
+	downPackets, downBytes *tokenBucket
+}
+
+func newRateBuckets(l RateLimit, now time.Time) *rateBuckets {
+	return &rateBuckets{
+		upPackets:   newTokenBucket(l.UpPackets, now),
+		upBytes:     newTokenBucket(l.UpBytes, now),
+		downPackets: newTokenBucket(l.DownPackets, now),
+		downBytes:   newTokenBucket(l.DownBytes, now),
+	}
+}
+
+// take admits one datagram of n bytes in the given direction, or takes
+// nothing.
+func (r *rateBuckets) take(up bool, n int, now time.Time) bool {
+	packets, bytes := r.downPackets, r.downBytes
+	if up {
+		packets, bytes = r.upPackets, r.upBytes
+	}
+	if !packets.take(1, now) {
+		return false
+	}
+	if !bytes.take(n, now) {
+		packets.refund(1)
+		return false
+	}
+	return true
+}
+
+func (r *rateBuckets) refund(up bool, n int) {
+	if up {
+		r.upPackets.refund(1)
+		r.upBytes.refund(n)
+	} else {
+		r.downPackets.refund(1)
+		r.downBytes.refund(n)
+	}
+}
+
+// rateLimiter enforces Config.ClientRateLimit, shared by all connections
+// from one client IP, and Config.GlobalRateLimit across all of them. The
+// buckets are swapped whole when Reload changes the limits.
+type rateLimiter struct {
+	global atomic.Value // *rateBuckets
+
+	mu        sync.Mutex
+	perClient RateLimit
+	clients   map[string]*clientRate
+}
+
+// clientRate is one client IP's buckets, kept while it has connections.
+type clientRate struct {
+	limiter *rateLimiter
+	buckets atomic.Value // *rateBuckets
+	refs    int
+}
+
+func newRateLimiter(perClient, global RateLimit, now time.Time) *rateLimiter {
+	l := &rateLimiter{
+		perClient: perClient,
+		clients:   make(map[string]*clientRate),
+	}
+	l.global.Store(newRateBuckets(global, now))
+	return l
+}
+
+// set replaces the limits, refilling every bucket.
+func (l *rateLimiter) set(perClient, global RateLimit, now time.Time) {
+	l.global.Store(newRateBuckets(global, now))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.perClient = perClient
+	for _, cr := range l.clients {
+		cr.buckets.Store(newRateBuckets(perClient, now))
+	}
+}
+
+// acquire returns ip's buckets for a new connection, to hand back with
+// release when it ends.
+func (l *rateLimiter) acquire(ip string, now time.Time) *clientRate {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cr := l.clients[ip]
+	if cr == nil {
+		cr = &clientRate{limiter: l}
+		cr.buckets.Store(newRateBuckets(l.perClient, now))
+		l.clients[ip] = cr
+	}
+	cr.refs++
+	return cr
+}
+
+func (l *rateLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cr := l.clients[ip]; cr != nil {
+		if cr.refs--; cr.refs == 0 {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// allow reports whether a datagram of n bytes may go on in the given
+// direction under both the client's and the global limits. A nil
+// clientRate allows everything.
+func (cr *clientRate) allow(up bool, n int, now time.Time) bool {
+	if cr == nil {
+		return true
+	}
+	buckets := cr.buckets.Load().(*rateBuckets)
+	if !buckets.take(up, n, now) {
+		return false
+	}
+	if !cr.limiter.global.Load().(*rateBuckets).take(up, n, now) {
+		buckets.refund(up, n)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// trustedAddr reports whether addr is in one of the prefixes. Peers on a
+// Unix socket are local and always trusted.
+func trustedAddr(addr net.Addr, trusted []netip.Prefix) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	return ok && prefixesContain(trusted, ip)
+}
+
+// RealIP returns middleware that, on requests from the trusted proxies,
+// takes the client's address from header, X-Forwarded-For or X-Real-IP,
+// so that c.IP() and everything built on it, rate limits, ACLs and logs,
+// see the client instead of the proxy in front. X-Forwarded-For is read
+// from the right, skipping trusted proxies, so a client cannot pose as
+// another by sending the header itself. Install it before every other
+// handler.
+func RealIP(header string, trusted []netip.Prefix) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx := c.Context()
+		if !trustedAddr(ctx.RemoteAddr(), trusted) {
+			return c.Next()
+		}
+		if ip, ok := realIP(c.Get(header), trusted); ok {
+			ctx.SetRemoteAddr(&net.TCPAddr{IP: ip.AsSlice()})
+		}
+		return c.Next()
+	}
+}
+
+// realIP picks the client out of a list of addresses, the nearest hop
+// last: the last one that is not a trusted proxy itself.
+func realIP(value string, trusted []netip.Prefix) (netip.Addr, bool) {
+	hops := strings.Split(value, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		if i == 0 || !prefixesContain(trusted, ip) {
+			return ip.Unmap(), true
+		}
+	}
+	return netip.Addr{}, false
+}
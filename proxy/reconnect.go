@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reconnectBackoff is the wait before the first re-dial; it doubles with
+// every further attempt.
+const reconnectBackoff = 50 * time.Millisecond
+
+// isReconnectable reports whether a backend socket error means the backend
+// went away for a moment, e.g. the ICMP port unreachable a connected UDP
+// socket reports as ECONNREFUSED while the backend rebinds. Deadlines and
+// closing the socket ourselves are never reconnectable.
+func isReconnectable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.ENETDOWN)
+}
+
+// reconnectError is how a session's backend socket fails once re-dials,
+// and the failover if any, gave up, for the client's close reason.
+type reconnectError struct {
+	attempts   int
+	failedOver bool
+	err        error
+}
+
+func (e reconnectError) Error() string {
+	return fmt.Sprintf("gave up reconnecting after %d attempts: %v", e.attempts, e.err)
+}
+
+func (e reconnectError) Unwrap() error { return e.err }
+
+// reason is the close reason sent to the client.
+func (e reconnectError) reason() string {
+	if e.failedOver {
+		return "backend and failover unreachable"
+	}
+	return "backend unreachable"
+}
+
+// reconnectingConn re-dials the backend when its socket fails with a
+// reconnectable error and retries the operation on the new socket, so the
+// client stays connected across a backend blip. Up to maxAttempts re-dials
+// are made between two datagrams received from the backend; after those,
+// the socket moves to failover, when set, which gets as many. migrate
+// swaps the socket the same way when the backend's address changes.
+type reconnectingConn struct {
+	proxy       *Proxy
+	id          string
+	addr        *net.UDPAddr
+	maxAttempts int
+	failover    string
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	// dialMu serializes reconnects and migrations, so both forwarding
+	// directions failing at once cause a single re-dial. addr is only
+	// changed under it.
+	dialMu sync.Mutex
+
+	mu            sync.Mutex
+	conn          backendConn
+	gen           int
+	attempts      int
+	failedOver    bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (p *Proxy) newReconnectingConn(id, backend string, conn backendConn) *reconnectingConn {
+	return &reconnectingConn{
+		proxy:       p,
+		id:          id,
+		addr:        conn.RemoteAddr().(*net.UDPAddr),
+		maxAttempts: p.cfg.UDPReconnect,
+		failover:    p.cfg.UDPFailover[backend],
+		closed:      make(chan struct{}),
+		conn:        conn,
+	}
+}
+
+func (c *reconnectingConn) current() (backendConn, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn, c.gen
+}
+
+func (c *reconnectingConn) Read(b []byte) (int, error) {
+	for {
+		conn, gen := c.current()
+		n, err := conn.Read(b)
+		if err == nil {
+			c.mu.Lock()
+			c.attempts = 0
+			c.mu.Unlock()
+			return n, nil
+		}
+		if err = c.reconnect(gen, err); err != nil {
+			return n, err
+		}
+	}
+}
+
+func (c *reconnectingConn) Write(b []byte) (int, error) {
+	for {
+		conn, gen := c.current()
+		n, err := conn.Write(b)
+		if err == nil {
+			return n, nil
+		}
+		if err = c.reconnect(gen, err); err != nil {
+			return n, err
+		}
+	}
+}
+
+// reconnect replaces the socket of generation gen after it failed with err
+// and returns nil if the operation should be retried, else the error to
+// fail it with.
+func (c *reconnectingConn) reconnect(gen int, err error) error {
+	c.mu.Lock()
+	swapped := c.gen != gen
+	c.mu.Unlock()
+	if swapped {
+		// Migrated meanwhile, which closed the socket that failed.
+		return nil
+	}
+	if (c.maxAttempts == 0 && c.failover == "") || !isReconnectable(err) {
+		return err
+	}
+	c.dialMu.Lock()
+	defer c.dialMu.Unlock()
+
+	c.mu.Lock()
+	if c.gen != gen {
+		// The other direction already reconnected.
+		c.mu.Unlock()
+		return nil
+	}
+	if c.attempts >= c.maxAttempts {
+		if c.failover != "" && !c.failedOver {
+			c.failedOver, c.attempts = true, 0
+			c.mu.Unlock()
+			return c.failOver(err)
+		}
+		attempts, failedOver := c.attempts, c.failedOver
+		c.mu.Unlock()
+		slog.Warn("giving up reconnecting to the backend", "client", c.id,
+			"attempts", attempts, "failed_over", failedOver)
+		return reconnectError{attempts: attempts, failedOver: failedOver, err: err}
+	}
+	c.attempts++
+	wait := reconnectBackoff << (c.attempts - 1)
+	c.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.closed:
+		return err
+	}
+
+	conn, dialErr := c.proxy.dialBackend(c.addr)
+	if dialErr != nil {
+		slog.Warn("reconnect backend error", "client", c.id, "error", dialErr)
+		// Retrying fails again on the old socket and counts an attempt.
+		return nil
+	}
+	if !c.swap(conn) {
+		return err
+	}
+	metricBackendReconnects.inc()
+	slog.Info("reconnected to the backend", "client", c.id, "after", err)
+	return nil
+}
+
+// failOver moves the socket to the failover address for good, after the
+// backend failed with err and re-dials gave up. Called with dialMu held.
+func (c *reconnectingConn) failOver(err error) error {
+	addr, resolveErr := c.proxy.resolveBackend(c.failover)
+	if resolveErr != nil {
+		slog.Warn("resolve failover backend error", "client", c.id, "error", resolveErr)
+		return reconnectError{attempts: c.maxAttempts, failedOver: true, err: err}
+	}
+	c.addr = addr
+	conn, dialErr := c.proxy.dialBackend(addr)
+	if dialErr != nil {
+		slog.Warn("dial failover backend error", "client", c.id, "error", dialErr)
+		// As for a re-dial, the retry fails on the old socket and the
+		// failover's own re-dials take over.
+		return nil
+	}
+	if !c.swap(conn) {
+		return err
+	}
+	metricBackendFailovers.inc()
+	slog.Info("failed over to another backend", "client", c.id,
+		"backend_addr", addr.String(), "after", err)
+	return nil
+}
+
+// migrate moves the session to a new socket connected to addr. Datagrams
+// the backend still sends to the old one are lost.
+func (c *reconnectingConn) migrate(addr *net.UDPAddr) error {
+	c.dialMu.Lock()
+	defer c.dialMu.Unlock()
+	conn, err := c.proxy.dialBackend(addr)
+	if err != nil {
+		return err
+	}
+	if !c.swap(conn) {
+		return net.ErrClosed
+	}
+	c.addr = addr
+	return nil
+}
+
+// swap replaces the socket with conn, carrying the deadlines over, and
+// closes the old one, which makes operations blocked on it retry on conn.
+// It reports false, closing conn instead, once c is closed.
+func (c *reconnectingConn) swap(conn backendConn) bool {
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		c.mu.Unlock()
+		conn.Close()
+		return false
+	default:
+	}
+	old := c.conn
+	c.conn = conn
+	c.gen++
+	// backendConn has no SetWriteDeadline; SetDeadline sets it along with
+	// the read deadline, which is then put back.
+	conn.SetDeadline(c.writeDeadline)
+	conn.SetReadDeadline(c.readDeadline)
+	c.mu.Unlock()
+	old.Close()
+	return true
+}
+
+func (c *reconnectingConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.Close()
+}
+
+func (c *reconnectingConn) LocalAddr() net.Addr {
+	conn, _ := c.current()
+	return conn.LocalAddr()
+}
+
+func (c *reconnectingConn) RemoteAddr() net.Addr {
+	conn, _ := c.current()
+	return conn.RemoteAddr()
+}
+
+func (c *reconnectingConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	return c.conn.SetDeadline(t)
+}
+
+func (c *reconnectingConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.conn.SetReadDeadline(t)
+}
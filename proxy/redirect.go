@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"time"
+)
+
+const defaultRedirectTimeout = 2 * time.Second
+
+// RedirectFunc inspects the backend's first reply to the init packet and
+// returns the address to re-dial when the reply is a redirect.
+type RedirectFunc func(reply []byte) (addr string, ok bool)
+
+// RedirectPattern returns a RedirectFunc matching replies against re, whose
+// first capture group is the host:port to redirect to.
+func RedirectPattern(re *regexp.Regexp) RedirectFunc {
+	return func(reply []byte) (string, bool) {
+		m := re.FindSubmatch(reply)
+		if len(m) < 2 || len(m[1]) == 0 {
+			return "", false
+		}
+		return string(m[1]), true
+	}
+}
+
+// initBackend sends the opening packets, the client info and init packet,
+// and, with a redirect hook configured, waits for the first reply. A
+// redirect reply is consumed: the proxy dials the indicated address, sends
+// the opening packets there, and returns the new socket. Any other reply is
+// returned so it can be forwarded to the client. Only one redirect is
+// followed.
+func (p *Proxy) initBackend(udpConn backendConn, packets [][]byte) (backendConn, []byte, error) {
+	if err := writePackets(udpConn, packets); err != nil {
+		return udpConn, nil, err
+	}
+	if p.cfg.Redirect == nil {
+		return udpConn, nil, nil
+	}
+
+	buf := make([]byte, p.cfg.UDPBufferSize)
+	udpConn.SetReadDeadline(time.Now().Add(p.cfg.RedirectTimeout))
+	n, err := udpConn.Read(buf)
+	udpConn.SetReadDeadline(time.Time{})
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return udpConn, nil, nil
+	}
+	if err != nil {
+		return udpConn, nil, err
+	}
+
+	addr, ok := p.cfg.Redirect(buf[:n])
+	if !ok {
+		return udpConn, buf[:n], nil
+	}
+	redirected, _, err := p.dialBackendName(addr)
+	if err != nil {
+		return udpConn, nil, err
+	}
+	udpConn.Close()
+	if err := writePackets(redirected, packets); err != nil {
+		return redirected, nil, err
+	}
+	return redirected, nil, nil
+}
+
+func writePackets(conn backendConn, packets [][]byte) error {
+	for _, pkt := range packets {
+		if _, err := conn.Write(pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
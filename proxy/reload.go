@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"errors"
+	"regexp"
+)
+
+// ReloadConfig holds the Config fields Reload can change while the proxy
+// runs. Everything else, listeners, backends and routes included, is fixed
+// at New.
+type ReloadConfig struct {
+	AuthToken       string
+	AllowedOrigins  []*regexp.Regexp
+	SkipOriginCheck bool
+	MaxConns        int
+	MaxBytesPerConn uint64
+	ClientRateLimit RateLimit
+	GlobalRateLimit RateLimit
+}
+
+func reloadConfigOf(cfg *Config) *ReloadConfig {
+	return &ReloadConfig{
+		AuthToken:       cfg.AuthToken,
+		AllowedOrigins:  cfg.AllowedOrigins,
+		SkipOriginCheck: cfg.SkipOriginCheck,
+		MaxConns:        cfg.MaxConns,
+		MaxBytesPerConn: cfg.MaxBytesPerConn,
+		ClientRateLimit: cfg.ClientRateLimit,
+		GlobalRateLimit: cfg.GlobalRateLimit,
+	}
+}
+
+// Reload applies rc to new upgrades and, for the byte quota and rate
+// limits, to the live connections too, without closing any. A lower
+// MaxConns only refuses new upgrades; connections over it stay.
+func (p *Proxy) Reload(rc ReloadConfig) error {
+	if rc.MaxConns < 0 {
+		return errors.New("max conns must not be negative")
+	}
+	p.live.Store(&rc)
+	p.limiter.setGlobal(rc.MaxConns)
+	p.rates.set(rc.ClientRateLimit, rc.GlobalRateLimit, p.now())
+	return nil
+}
+
+// reloadable returns the settings in effect, as of New or the last Reload.
+func (p *Proxy) reloadable() *ReloadConfig {
+	return p.live.Load().(*ReloadConfig)
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// backendResolver re-resolves the configured backends every
+// Config.ResolveInterval and keeps the latest address of each, for new
+// sockets to dial without waiting on DNS. When a backend's address
+// changes, its warm pool is emptied and, with Config.ResolveMigrate, the
+// sessions on the old address move to the new one.
+type backendResolver struct {
+	p     *Proxy
+	names []string
+
+	mu    sync.Mutex
+	addrs map[string]*net.UDPAddr
+}
+
+func newBackendResolver(p *Proxy, names []string) *backendResolver {
+	return &backendResolver{p: p, names: names, addrs: make(map[string]*net.UDPAddr, len(names))}
+}
+
+// resolveBackend returns the address to dial for the backend addr: the
+// latest the resolver found, or a fresh lookup for backends it does not
+// know or has not resolved yet.
+func (p *Proxy) resolveBackend(addr string) (*net.UDPAddr, error) {
+	if p.resolver != nil {
+		p.resolver.mu.Lock()
+		udpAddr := p.resolver.addrs[addr]
+		p.resolver.mu.Unlock()
+		if udpAddr != nil {
+			return udpAddr, nil
+		}
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
+
+func (r *backendResolver) run(interval time.Duration, done <-chan struct{}) {
+	r.refreshAll()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.refreshAll()
+		case <-done:
+			return
+		}
+	}
+}
+
+func (r *backendResolver) refreshAll() {
+	for _, name := range r.names {
+		r.refresh(name)
+	}
+}
+
+// refresh resolves name again. A failed lookup keeps the address it had.
+func (r *backendResolver) refresh(name string) {
+	addr, err := net.ResolveUDPAddr("udp", name)
+	if err != nil {
+		metricResolveErrors.inc()
+		slog.Warn("re-resolve backend error", "backend", name, "error", err)
+		return
+	}
+	r.mu.Lock()
+	old := r.addrs[name]
+	r.addrs[name] = addr
+	r.mu.Unlock()
+	if old == nil || old.String() == addr.String() {
+		return
+	}
+	slog.Info("backend address changed", "backend", name, "old", old.String(), "new", addr.String())
+	if pool := r.p.pools[name]; pool != nil {
+		pool.flush()
+	}
+	if r.p.cfg.ResolveMigrate {
+		r.p.migrateSessions(name, old, addr)
+	}
+}
+
+// migrateSessions moves the sockets of the sessions on backend name that
+// are connected to from over to to. Sessions a redirect sent elsewhere
+// stay where they are.
+func (p *Proxy) migrateSessions(name string, from, to *net.UDPAddr) {
+	for _, s := range p.sessions.snapshot() {
+		conn, ok := s.udpConn.(*reconnectingConn)
+		if !ok || s.backend != name || conn.RemoteAddr().String() != from.String() {
+			continue
+		}
+		if err := conn.migrate(to); err != nil {
+			slog.Warn("migrate backend socket error", "client", s.id, "backend_addr", to.String(), "error", err)
+			continue
+		}
+		metricBackendMigrations.inc()
+		slog.Info("backend socket migrated", "client", s.id, "backend_addr", to.String())
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// resumeTokenBytes is the size of a resume token before hex encoding.
+const resumeTokenBytes = 16
+
+// sessionMessage gives the client the token to resume its backend socket
+// with, see Config.ResumeGrace. Resumed tells it whether the upgrade took
+// over a parked socket or got a fresh one.
+type sessionMessage struct {
+	Type    string `json:"type"`
+	Token   string `json:"token"`
+	Resumed bool   `json:"resumed"`
+}
+
+func newResumeToken() string {
+	b := make([]byte, resumeTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// parkedConn is a backend socket whose client dropped off, kept for it to
+// come back within Config.ResumeGrace.
+type parkedConn struct {
+	token    string
+	clientID string
+	backend  string
+	limitKey string
+	conn     backendConn
+	deadline time.Time
+	// sess is the session that parked the socket, for the final packet
+	// should the client not come back, and code and reason how it ended.
+	sess   *session
+	code   int
+	reason string
+
+	timer *time.Timer
+}
+
+// resumeStore holds the parked backend sockets by resume token.
+type resumeStore struct {
+	p      *Proxy
+	mu     sync.Mutex
+	parked map[string]*parkedConn
+}
+
+func newResumeStore(p *Proxy) *resumeStore {
+	return &resumeStore{p: p, parked: make(map[string]*parkedConn)}
+}
+
+// park keeps pc until its deadline, when it is closed unless take claimed
+// it first. It reports false, having closed pc, once the proxy is closed.
+func (s *resumeStore) park(pc *parkedConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.p.done:
+		pc.conn.Close()
+		return false
+	default:
+	}
+	s.parked[pc.token] = pc
+	pc.timer = time.AfterFunc(time.Until(pc.deadline), func() { s.expire(pc) })
+	metricSessionsParked.add(1)
+	return true
+}
+
+// take claims the socket parked under token, or returns nil when there is
+// none or it expired.
+func (s *resumeStore) take(token string) *parkedConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pc := s.parked[token]
+	if pc == nil || !pc.timer.Stop() {
+		return nil
+	}
+	delete(s.parked, token)
+	metricSessionsParked.add(-1)
+	return pc
+}
+
+func (s *resumeStore) expire(pc *parkedConn) {
+	s.mu.Lock()
+	if s.parked[pc.token] != pc {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.parked, pc.token)
+	s.mu.Unlock()
+	metricSessionsParked.add(-1)
+	metricResumeExpired.inc()
+	slog.Info("parked backend socket expired", "client", pc.clientID)
+	pc.sess.sendFinalPacket(pc.code, pc.reason)
+	pc.conn.Close()
+}
+
+// closeAll closes every parked socket, when the proxy is closed.
+func (s *resumeStore) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, pc := range s.parked {
+		pc.timer.Stop()
+		pc.conn.Close()
+		delete(s.parked, token)
+		metricSessionsParked.add(-1)
+	}
+}
@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	fastws "github.com/fasthttp/websocket"
+)
+
+const (
+	defaultReverseIdleTimeout = 2 * time.Minute
+	// reverseQueueSize is how many datagrams from a peer wait for its
+	// WebSocket connection, while dialing or behind a slow write.
+	reverseQueueSize   = 64
+	reverseDialTimeout = 10 * time.Second
+)
+
+// ReverseConfig configures a Reverse tunnel end.
+type ReverseConfig struct {
+	// WSBackend is the ws:// or wss:// URL of the udpwsproxy, or any
+	// WebSocket endpoint speaking the same framing, to tunnel to.
+	WSBackend string
+	// DataType is how datagrams are framed on the WebSocket, as in
+	// Config.DataType. It is also offered as a udpproxy.* subprotocol, so
+	// a far end with Config.DataSubprotocols follows it.
+	DataType string
+	// IdleTimeout closes a peer's WebSocket connection after no datagram
+	// in either direction for this long (default 2m).
+	IdleTimeout time.Duration
+	// TLS configures wss:// connections, nil verifies against the system
+	// roots.
+	TLS *tls.Config
+	// Header is added to every upgrade request, e.g. for a token.
+	Header http.Header
+	// UDPBufferSize is the largest datagram read from peers (default
+	// 65535).
+	UDPBufferSize int
+}
+
+// Reverse is the other end of a tunnel: it receives datagrams on a UDP
+// socket and gives each source address, a peer, a WebSocket connection of
+// its own to ReverseConfig.WSBackend, sending the peer's datagrams over it
+// and the messages coming back to the peer.
+type Reverse struct {
+	cfg    ReverseConfig
+	dialer *fastws.Dialer
+
+	mu    sync.Mutex
+	conn  net.PacketConn
+	peers map[string]*reversePeer
+
+	// ctx is canceled by Close.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// reversePeer is one UDP source address and its WebSocket connection.
+type reversePeer struct {
+	addr   net.Addr
+	queue  chan []byte
+	last   int64 // unix nanoseconds of the last datagram either way
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewReverse validates cfg.
+func NewReverse(cfg ReverseConfig) (*Reverse, error) {
+	u, err := url.Parse(cfg.WSBackend)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("ws backend %q is not a ws:// or wss:// URL", cfg.WSBackend)
+	}
+	if cfg.DataType == "" {
+		cfg.DataType = DataTypeText
+	}
+	cfg.DataType = canonicalDataType(cfg.DataType)
+	if !isDataType(cfg.DataType) {
+		return nil, fmt.Errorf("unsupported data type %q", cfg.DataType)
+	}
+	if cfg.IdleTimeout < 0 || cfg.UDPBufferSize < 0 {
+		return nil, errors.New("idle timeout and udp buffer size must not be negative")
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = defaultReverseIdleTimeout
+	}
+	if cfg.UDPBufferSize == 0 {
+		cfg.UDPBufferSize = defaultUDPBufferSize
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Reverse{
+		cfg: cfg,
+		dialer: &fastws.Dialer{
+			HandshakeTimeout: reverseDialTimeout,
+			TLSClientConfig:  cfg.TLS,
+			Subprotocols:     []string{dataSubprotocolPrefix + cfg.DataType},
+		},
+		peers:  make(map[string]*reversePeer),
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// Serve reads datagrams from conn until Close, or until reading fails.
+func (r *Reverse) Serve(conn net.PacketConn) error {
+	r.mu.Lock()
+	r.conn = conn
+	r.mu.Unlock()
+	go r.sweep()
+
+	buf := make([]byte, r.cfg.UDPBufferSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		peer := r.peer(addr)
+		atomic.StoreInt64(&peer.last, time.Now().UnixNano())
+		// Datagrams beyond the queue are dropped, as the network would.
+		select {
+		case peer.queue <- append([]byte(nil), buf[:n]...):
+		default:
+		}
+	}
+}
+
+// peer returns addr's peer, starting it on its first datagram.
+func (r *Reverse) peer(addr net.Addr) *reversePeer {
+	key := addr.String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if peer := r.peers[key]; peer != nil {
+		return peer
+	}
+	peer := &reversePeer{
+		addr:   addr,
+		queue:  make(chan []byte, reverseQueueSize),
+		closed: make(chan struct{}),
+	}
+	r.peers[key] = peer
+	r.wg.Add(1)
+	go r.run(peer)
+	return peer
+}
+
+func (peer *reversePeer) close() {
+	peer.once.Do(func() { close(peer.closed) })
+}
+
+// run dials the peer's WebSocket connection and relays until the peer goes
+// idle, the connection fails, or the tunnel closes. A peer whose dial
+// fails is dropped along with its queued datagrams, and its next datagram
+// dials again.
+func (r *Reverse) run(peer *reversePeer) {
+	defer r.wg.Done()
+	defer func() {
+		r.mu.Lock()
+		delete(r.peers, peer.addr.String())
+		r.mu.Unlock()
+	}()
+
+	ws, _, err := r.dialer.DialContext(r.ctx, r.cfg.WSBackend, r.cfg.Header)
+	if err != nil {
+		slog.Warn("udp peer dial error", "peer", peer.addr, "ws_backend", r.cfg.WSBackend, "error", err)
+		return
+	}
+	slog.Info("udp peer tunneled", "peer", peer.addr, "ws_backend", r.cfg.WSBackend)
+	defer slog.Info("udp peer disconnected", "peer", peer.addr)
+
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			msgType, msg, err := ws.ReadMessage()
+			if err == nil {
+				msg, err = decodeMessage(r.cfg.DataType, msgType, msg)
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+			atomic.StoreInt64(&peer.last, time.Now().UnixNano())
+			if _, err := r.conn.WriteTo(msg, peer.addr); err != nil && r.ctx.Err() == nil {
+				slog.Warn("udp peer write error", "peer", peer.addr, "error", err)
+			}
+		}
+	}()
+
+	code, reason := fastws.CloseNormalClosure, ""
+	for err == nil {
+		select {
+		case msg := <-peer.queue:
+			if err = ws.WriteMessage(encodeMessage(r.cfg.DataType, msg)); err != nil {
+				slog.Warn("udp peer websocket write error", "peer", peer.addr, "error", err)
+			}
+		case err = <-readErr:
+			if !closedCleanly(err) {
+				slog.Warn("udp peer websocket read error", "peer", peer.addr, "error", err)
+			}
+		case <-peer.closed:
+			err = errIdle
+		case <-r.ctx.Done():
+			code, reason = fastws.CloseGoingAway, "shutting down"
+			err = net.ErrClosed
+		}
+	}
+	ws.WriteControl(fastws.CloseMessage,
+		fastws.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	ws.Close()
+}
+
+// errIdle ends a peer that went quiet for ReverseConfig.IdleTimeout.
+var errIdle = errors.New("idle")
+
+// sweep closes the peers idle for longer than the idle timeout.
+func (r *Reverse) sweep() {
+	ticker := time.NewTicker(r.cfg.IdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return
+		}
+		cutoff := time.Now().Add(-r.cfg.IdleTimeout).UnixNano()
+		r.mu.Lock()
+		for _, peer := range r.peers {
+			if atomic.LoadInt64(&peer.last) < cutoff {
+				peer.close()
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// Close stops Serve, closing the UDP socket, and closes every peer's
+// WebSocket connection with 1001 once its pending write is done.
+func (r *Reverse) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		r.cancel()
+		r.mu.Lock()
+		if r.conn != nil {
+			err = r.conn.Close()
+		}
+		r.mu.Unlock()
+		r.wg.Wait()
+	})
+	return err
+}
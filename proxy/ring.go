@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is how many points each backend gets on the hash ring. More
+// points spread keys more evenly across backends.
+const ringReplicas = 160
+
+// hashRing maps keys to backends by consistent hashing: each backend owns
+// the arcs of the ring ending at its points, so adding or removing one only
+// moves the keys on its own arcs.
+type hashRing struct {
+	points []uint64
+	owners map[uint64]string
+}
+
+func newHashRing(addrs []string) *hashRing {
+	r := &hashRing{owners: make(map[uint64]string, len(addrs)*ringReplicas)}
+	for _, addr := range addrs {
+		for i := 0; i < ringReplicas; i++ {
+			h := ringHash(addr + "#" + strconv.Itoa(i))
+			if _, taken := r.owners[h]; taken {
+				continue
+			}
+			r.owners[h] = addr
+			r.points = append(r.points, h)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// get returns the backend owning key: the one with the first point at or
+// after the key's hash, wrapping around.
+func (r *hashRing) get(key string, up func(addr string) bool) string {
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	// A backend that is down hands its keys to the next one up the ring,
+	// and only those: the others keep their backend.
+	for j := 0; j < len(r.points); j++ {
+		if owner := r.owners[r.points[(i+j)%len(r.points)]]; up(owner) {
+			return owner
+		}
+	}
+	return r.owners[r.points[i]]
+}
+
+// ringHash is FNV-1a followed by the splitmix64 finalizer, since FNV alone
+// spreads similar strings such as "host:port#1" and "host:port#2" poorly.
+func ringHash(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	h := f.Sum64()
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
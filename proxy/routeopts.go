@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RouteOptions overrides settings for the clients upgrading on one path,
+// see Config.RouteOptions. Zero fields keep the Config setting.
+type RouteOptions struct {
+	DataType      string
+	UDPBufferSize int
+	IdleTimeout   time.Duration
+
+	// ClientDataTypes are the data types clients may ask for with a
+	// data=type query parameter. MaxUDPBufferSize and MaxIdleTimeout let
+	// clients ask for their own buffer=bytes and idle=duration, up to
+	// that much. Asking for anything these do not allow gets 400; on a
+	// path without RouteOptions the parameters are ignored.
+	ClientDataTypes  []string
+	MaxUDPBufferSize int
+	MaxIdleTimeout   time.Duration
+}
+
+// sessionSettings are what a connection got from Config, its path's
+// RouteOptions and its own query.
+type sessionSettings struct {
+	dataType      string
+	udpBufferSize int
+	idleTimeout   time.Duration
+	// queriedData is set when dataType is the client's data= choice.
+	queriedData bool
+}
+
+// checkRouteOptions validates cfg.RouteOptions, in a copy with canonical
+// data types, once the rest of cfg has its defaults.
+func checkRouteOptions(cfg *Config) error {
+	if len(cfg.RouteOptions) == 0 {
+		return nil
+	}
+	all := make(map[string]RouteOptions, len(cfg.RouteOptions))
+	for path, opts := range cfg.RouteOptions {
+		if opts.DataType != "" {
+			opts.DataType = canonicalDataType(opts.DataType)
+			if !isDataType(opts.DataType) {
+				return fmt.Errorf("route %s: unsupported data type %q", path, opts.DataType)
+			}
+		}
+		types := make([]string, len(opts.ClientDataTypes))
+		for i, t := range opts.ClientDataTypes {
+			if types[i] = canonicalDataType(t); !isDataType(types[i]) {
+				return fmt.Errorf("route %s: unsupported client data type %q", path, t)
+			}
+		}
+		opts.ClientDataTypes = types
+		if opts.UDPBufferSize < 0 || opts.MaxUDPBufferSize < 0 ||
+			opts.IdleTimeout < 0 || opts.MaxIdleTimeout < 0 {
+			return fmt.Errorf("route %s: buffer sizes and idle timeouts must not be negative", path)
+		}
+		if cfg.WSBatchWindow > 0 && (opts.UDPBufferSize > 0xffff || opts.MaxUDPBufferSize > 0xffff) {
+			return fmt.Errorf("route %s: ws batch window needs a udp buffer size of at most 65535", path)
+		}
+		all[path] = opts
+	}
+	cfg.RouteOptions = all
+	return nil
+}
+
+// hasIdleTimeouts reports whether any session can get an idle timeout.
+func hasIdleTimeouts(cfg *Config) bool {
+	if cfg.IdleTimeout > 0 {
+		return true
+	}
+	for _, opts := range cfg.RouteOptions {
+		if opts.IdleTimeout > 0 || opts.MaxIdleTimeout > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionSettingsOf applies the options of path and what the client asked
+// for in its query.
+func (p *Proxy) sessionSettingsOf(c *fiber.Ctx, path string) (sessionSettings, error) {
+	s := sessionSettings{
+		dataType:      p.cfg.DataType,
+		udpBufferSize: p.cfg.UDPBufferSize,
+		idleTimeout:   p.cfg.IdleTimeout,
+	}
+	opts, ok := p.cfg.RouteOptions[path]
+	if !ok {
+		return s, nil
+	}
+	if opts.DataType != "" {
+		s.dataType = opts.DataType
+	}
+	if opts.UDPBufferSize > 0 {
+		s.udpBufferSize = opts.UDPBufferSize
+	}
+	if opts.IdleTimeout > 0 {
+		s.idleTimeout = opts.IdleTimeout
+	}
+	if v := c.Query("data"); v != "" {
+		v = canonicalDataType(v)
+		allowed := false
+		for _, t := range opts.ClientDataTypes {
+			allowed = allowed || t == v
+		}
+		if !allowed {
+			return s, fiber.NewError(fiber.StatusBadRequest, "data type not allowed")
+		}
+		s.dataType, s.queriedData = v, true
+	}
+	if v := c.Query("buffer"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > opts.MaxUDPBufferSize {
+			return s, fiber.NewError(fiber.StatusBadRequest, "buffer size not allowed")
+		}
+		s.udpBufferSize = n
+	}
+	if v := c.Query("idle"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > opts.MaxIdleTimeout {
+			return s, fiber.NewError(fiber.StatusBadRequest, "idle timeout not allowed")
+		}
+		s.idleTimeout = d
+	}
+	return s, nil
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+)
+
+// Send policies for Config.SendPolicy.
+const (
+	SendPolicyClose      = "close"
+	SendPolicyDropOldest = "drop-oldest"
+	SendPolicyDropNewest = "drop-newest"
+)
+
+var errClientTooSlow = errors.New("client too slow")
+
+// sendQueue decouples backend reads from client writes so a stalled client
+// can be detected: bytes handed to push count as pending until their write
+// returns, and a push that would take them past limit fails with
+// errClientTooSlow, or under a drop policy makes room by dropping
+// datagrams, reported to dropped.
+type sendQueue struct {
+	limit   int
+	policy  string
+	dropped func(n int)
+	ready   chan struct{}
+
+	mu      sync.Mutex
+	pkts    []jitterPacket
+	pending int
+	closed  bool
+	err     error
+}
+
+func newSendQueue(limit int, policy string, dropped func(n int)) *sendQueue {
+	return &sendQueue{limit: limit, policy: policy, dropped: dropped, ready: make(chan struct{}, 1)}
+}
+
+// push queues a copy of payload, returning the error that stopped the write
+// loop, if any.
+func (q *sendQueue) push(payload []byte, heartbeat bool) error {
+	q.mu.Lock()
+	if q.err != nil {
+		defer q.mu.Unlock()
+		return q.err
+	}
+	if q.pending+len(payload) > q.limit {
+		if q.policy == SendPolicyClose {
+			q.mu.Unlock()
+			return errClientTooSlow
+		}
+		n := 0
+		// The datagram being written cannot be taken back, so even
+		// dropping all the queued ones may not make room.
+		for q.policy == SendPolicyDropOldest && len(q.pkts) > 0 && q.pending+len(payload) > q.limit {
+			q.pending -= len(q.pkts[0].payload)
+			q.pkts[0] = jitterPacket{}
+			q.pkts = q.pkts[1:]
+			n++
+		}
+		if q.pending+len(payload) > q.limit {
+			q.mu.Unlock()
+			q.dropped(n + 1)
+			return nil
+		}
+		defer q.dropped(n)
+	}
+	q.pkts = append(q.pkts, jitterPacket{
+		payload:   append([]byte(nil), payload...),
+		heartbeat: heartbeat,
+	})
+	q.pending += len(payload)
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// close stops the write loop once it has drained the queue.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run writes queued datagrams through write until the queue is closed or
+// write fails.
+func (q *sendQueue) run(write func(payload []byte, heartbeat bool) error) {
+	for {
+		q.mu.Lock()
+		if len(q.pkts) == 0 {
+			closed := q.closed
+			q.mu.Unlock()
+			if closed {
+				return
+			}
+			<-q.ready
+			continue
+		}
+		pkt := q.pkts[0]
+		q.pkts[0] = jitterPacket{}
+		q.pkts = q.pkts[1:]
+		q.mu.Unlock()
+
+		err := write(pkt.payload, pkt.heartbeat)
+
+		q.mu.Lock()
+		q.pending -= len(pkt.payload)
+		if err != nil {
+			q.err = err
+			q.pkts = nil
+		}
+		q.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
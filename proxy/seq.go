@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"math"
+	"sync/atomic"
+)
+
+// seqWindow is how many sequence numbers below the highest one seen are
+// remembered to tell duplicates from late arrivals.
+const seqWindow = 64
+
+// defaultSeqLossWindow is how many of the latest sequence numbers the loss
+// estimate covers by default.
+const defaultSeqLossWindow = 1024
+
+// seqTracker watches a sequence number the backend protocol carries at a
+// fixed offset of each datagram and counts gaps, reordering and duplicates.
+// It only observes; datagrams are forwarded as they arrive. Comparisons use
+// serial number arithmetic (RFC 1982), so wrap-around is no gap.
+//
+// It also estimates the loss over the latest sequence numbers: the share of
+// them not received, counting late arrivals once they come in.
+type seqTracker struct {
+	offset int
+	size   int
+	order  binary.ByteOrder
+
+	started bool
+	highest uint64
+	// seen has bit i set when highest-i was received.
+	seen uint64
+
+	datagrams, gaps, reordered, duplicates, malformed uint64
+
+	// lossRing has the bit for s%lossWindow set when s was received, for
+	// the span sequence numbers up to highest. received counts the set
+	// bits. loss is the resulting ratio as math.Float64bits, read by the
+	// admin listing and metrics while the backend read loop writes it.
+	lossRing   []uint64
+	lossWindow uint64
+	span       uint64
+	received   uint64
+	loss       uint64
+}
+
+// newSeqTracker tracks a size byte sequence number at offset, estimating
+// loss over window numbers. The window is rounded up to a power of two and
+// capped at half the sequence space, so wrap-around cannot confuse it.
+func newSeqTracker(offset, size int, littleEndian bool, window int) *seqTracker {
+	t := &seqTracker{offset: offset, size: size, order: binary.BigEndian}
+	if littleEndian {
+		t.order = binary.LittleEndian
+	}
+	w := uint64(64)
+	for w < uint64(window) {
+		w <<= 1
+	}
+	if half := uint64(1) << (8*size - 1); w > half {
+		w = half
+	}
+	t.lossWindow = w
+	t.lossRing = make([]uint64, (w+63)/64)
+	return t
+}
+
+func (t *seqTracker) observe(payload []byte) {
+	if len(payload) < t.offset+t.size {
+		t.malformed++
+		metricSeqMalformed.inc()
+		return
+	}
+	seq := t.read(payload[t.offset:])
+	t.datagrams++
+	metricSeqDatagrams.inc()
+	if !t.started {
+		t.started, t.highest, t.seen = true, seq, 1
+		t.span = 1
+		t.mark(seq)
+		t.updateLoss()
+		return
+	}
+	defer t.updateLoss()
+
+	// diff is seq-highest as a signed number of size bytes.
+	bits := uint(8 * t.size)
+	diff := int64((seq-t.highest)<<(64-bits)) >> (64 - bits)
+	switch {
+	case diff > 0:
+		if missing := uint64(diff - 1); missing > 0 {
+			t.gaps += missing
+			metricSeqGaps.add(missing)
+		}
+		if diff >= seqWindow {
+			t.seen = 0
+		} else {
+			t.seen <<= uint(diff)
+		}
+		t.seen |= 1
+		t.advance(seq, uint64(diff))
+	case -diff < seqWindow && t.seen&(1<<uint(-diff)) != 0:
+		t.duplicates++
+		metricSeqDuplicates.inc()
+	default:
+		t.reordered++
+		metricSeqReordered.inc()
+		if -diff < seqWindow {
+			t.seen |= 1 << uint(-diff)
+		}
+		if uint64(-diff) < t.span {
+			t.mark(seq)
+		}
+	}
+}
+
+// advance moves the loss window up by diff to end at seq, forgetting the
+// numbers that fall out of it.
+func (t *seqTracker) advance(seq uint64, diff uint64) {
+	for i := uint64(1); i <= diff && i <= t.lossWindow; i++ {
+		t.clear(t.highest + i)
+	}
+	t.highest = seq
+	if t.span += diff; t.span > t.lossWindow {
+		t.span = t.lossWindow
+	}
+	t.mark(seq)
+}
+
+func (t *seqTracker) mark(seq uint64) {
+	i := seq % t.lossWindow
+	if bit := uint64(1) << (i % 64); t.lossRing[i/64]&bit == 0 {
+		t.lossRing[i/64] |= bit
+		t.received++
+	}
+}
+
+func (t *seqTracker) clear(seq uint64) {
+	i := seq % t.lossWindow
+	if bit := uint64(1) << (i % 64); t.lossRing[i/64]&bit != 0 {
+		t.lossRing[i/64] &^= bit
+		t.received--
+	}
+}
+
+func (t *seqTracker) updateLoss() {
+	ratio := float64(t.span-t.received) / float64(t.span)
+	atomic.StoreUint64(&t.loss, math.Float64bits(ratio))
+}
+
+// lossRatio returns the estimated loss over the latest sequence numbers,
+// from 0 to 1. It is safe to call from any goroutine.
+func (t *seqTracker) lossRatio() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&t.loss))
+}
+
+func (t *seqTracker) read(b []byte) uint64 {
+	switch t.size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(t.order.Uint16(b))
+	case 4:
+		return uint64(t.order.Uint32(b))
+	default:
+		return t.order.Uint64(b)
+	}
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// serverShutdownTimeout bounds the wait for in-flight HTTP requests on the
+// server ListenAndServe started, once Shutdown has drained the connections.
+const serverShutdownTimeout = 5 * time.Second
+
+// ListenAndServe runs the proxy as a server of its own on addr, with the
+// WebSocket route at path and the other routes as by RegisterRoutes. It
+// returns once Shutdown has drained the connections and stopped the
+// server, or when listening fails. To add the bridge to an existing app
+// instead, use RegisterRoutes.
+func (p *Proxy) ListenAndServe(addr, path string) error {
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	p.RegisterRoutes(app, path)
+	p.serverMu.Lock()
+	if p.isDraining() {
+		p.serverMu.Unlock()
+		return errDraining
+	}
+	p.server = app
+	p.serverMu.Unlock()
+	return app.Listen(addr)
+}
+
+// stopServer stops the server ListenAndServe started, if any.
+func (p *Proxy) stopServer() {
+	p.serverMu.Lock()
+	app := p.server
+	p.server = nil
+	p.serverMu.Unlock()
+	if app == nil {
+		return
+	}
+	if err := app.ShutdownWithTimeout(serverShutdownTimeout); err != nil {
+		slog.Error("shutdown http server error", "error", err)
+	}
+}
@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// Quota modes for Config.MaxBytesMode.
+const (
+	QuotaModeEach     = "each"
+	QuotaModeCombined = "combined"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// finalPacketTimeout bounds the write of Config.FinalPacket.
+const finalPacketTimeout = 100 * time.Millisecond
+
+// session is the per-connection state shared by the forwarding goroutines.
+type session struct {
+	id        string
+	proxy     *Proxy
+	startedAt time.Time
+	dataType  string
+	// udpBufSize and idleTimeout replace Config.UDPBufferSize and
+	// Config.IdleTimeout for this session.
+	udpBufSize  int
+	idleTimeout time.Duration
+	udpConn     backendConn
+	// remoteAddr is the client's address and backend the configured
+	// backend address, for the admin listing.
+	remoteAddr string
+	backend    string
+	// identity is the client certificate's, "" without one.
+	identity string
+
+	// The underlying connection's methods are bound up front because the
+	// websocket.Conn wrapper is pooled and reset once the handler returns.
+	writeControl func(messageType int, data []byte, deadline time.Time) error
+	closeWS      func() error
+	killOnce     sync.Once
+	finalOnce    sync.Once
+	// killCode is the close code kill sent, zero until then, and
+	// killReason its reason, set before it.
+	killCode   int32
+	killReason string
+	// lost is set when lose ended the session, leaving the backend socket
+	// open.
+	lost int32
+
+	lastActive int64
+	// readSince is when the pending backend read started, zero between
+	// reads; only maintained when the read watchdog is enabled.
+	readSince int64
+	// lastPong is when the client last answered a ping, in unix
+	// nanoseconds.
+	lastPong int64
+
+	bytesToBackend   uint64
+	bytesToClient    uint64
+	packetsToBackend uint64
+	packetsToClient  uint64
+	dropped          uint64
+	// sendDropped counts backend datagrams Config.SendPolicy dropped.
+	sendDropped uint64
+
+	// firstMessage is the client's first datagram when the handler already
+	// read it, for the client to backend loop to forward first.
+	firstMessage []byte
+	// batched is set when WSBatchWindow applies: to binary clients over
+	// WebSocket that did not opt out.
+	batched bool
+
+	// pause holds back client datagrams while forwarding is paused.
+	pause *pauseGate
+	// filters are made from Config.Filters for this session.
+	filters filterChain
+
+	// pcap is the session's pcapng capture, if any, and pcapping is 1
+	// while there is one. pcapEnded keeps captures from starting once the
+	// session is over.
+	pcapMu    sync.Mutex
+	pcap      *pcapFile
+	pcapping  int32
+	pcapEnded bool
+
+	// wsMu serializes data messages to the client between the backend read
+	// loop and pause notices. clientWrite is set while that loop runs.
+	wsMu           sync.Mutex
+	clientWrite    func(payload []byte) error
+	notifiedPaused bool
+
+	// backendSession is the hex ID taken from the first backend reply,
+	// see observeBackendSession.
+	backendSessionOnce sync.Once
+	backendSession     atomic.Value
+
+	// capture is nil unless the session is being recorded.
+	capture *sessionCapture
+
+	// seq is only used by the backend read loop; nil unless sequence
+	// tracking is enabled.
+	seq *seqTracker
+
+	// rate is the client IP's share of the rate limits, nil without any.
+	rate *clientRate
+}
+
+// addToBackend accounts a datagram of n bytes forwarded to the backend and
+// reports errQuotaExceeded once the connection is over its byte cap.
+func (s *session) addToBackend(n int) error {
+	metricBytesToBackend.add(uint64(n))
+	metricDatagramsToBackend.inc()
+	atomic.AddUint64(&s.packetsToBackend, 1)
+	return s.checkQuota(atomic.AddUint64(&s.bytesToBackend, uint64(n)),
+		atomic.LoadUint64(&s.bytesToClient))
+}
+
+// addToClient is addToBackend for the opposite direction.
+func (s *session) addToClient(n int) error {
+	metricBytesToClient.add(uint64(n))
+	metricDatagramsToClient.inc()
+	atomic.AddUint64(&s.packetsToClient, 1)
+	return s.checkQuota(atomic.AddUint64(&s.bytesToClient, uint64(n)),
+		atomic.LoadUint64(&s.bytesToBackend))
+}
+
+func (s *session) checkQuota(this uint64, other uint64) error {
+	limit := s.proxy.reloadable().MaxBytesPerConn
+	if limit == 0 {
+		return nil
+	}
+	used := this
+	if s.proxy.cfg.MaxBytesMode == QuotaModeCombined {
+		used += other
+	}
+	if used > limit {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// sessionRegistry tracks a proxy's live connections.
+type sessionRegistry struct {
+	mu   sync.Mutex
+	byID map[string]*session
+}
+
+func (r *sessionRegistry) add(s *session) {
+	r.mu.Lock()
+	r.byID[s.id] = s
+	r.mu.Unlock()
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.mu.Lock()
+	delete(r.byID, s.id)
+	r.mu.Unlock()
+}
+
+func (r *sessionRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.byID)
+}
+
+func (r *sessionRegistry) get(id string) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.byID[id]
+}
+
+func (r *sessionRegistry) snapshot() []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]*session, 0, len(r.byID))
+	for _, s := range r.byID {
+		list = append(list, s)
+	}
+	return list
+}
+
+// touch records forwarding activity for idle tracking.
+func (s *session) touch() {
+	atomic.StoreInt64(&s.lastActive, s.proxy.now().UnixNano())
+}
+
+// idleFor is how long the session has been without activity. The startup
+// grace counts as activity, so the idle clock only starts once it is over.
+func (s *session) idleFor() time.Duration {
+	last := time.Unix(0, atomic.LoadInt64(&s.lastActive))
+	if graceEnd := s.startedAt.Add(s.proxy.cfg.StartupGrace); graceEnd.After(last) {
+		last = graceEnd
+	}
+	return s.proxy.now().Sub(last)
+}
+
+// kill sends the client a close frame and closes both sockets, which makes
+// the forwarding goroutines and the handler return.
+func (s *session) kill(code int, reason string) {
+	s.killOnce.Do(func() {
+		s.killReason = reason
+		atomic.StoreInt32(&s.killCode, int32(code))
+		s.writeControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, reason),
+			time.Now().Add(time.Second),
+		)
+		s.closeWS()
+		s.sendFinalPacket(code, reason)
+		s.udpConn.Close()
+	})
+}
+
+// lose ends a session whose client stopped answering. With
+// Config.ResumeGrace, only the WebSocket is closed, leaving the backend
+// socket for the handler to keep for the client to resume; otherwise it
+// is kill.
+func (s *session) lose(code int, reason string) {
+	if s.proxy.resumes == nil {
+		s.kill(code, reason)
+		return
+	}
+	s.killOnce.Do(func() {
+		s.killReason = reason
+		atomic.StoreInt32(&s.killCode, int32(code))
+		atomic.StoreInt32(&s.lost, 1)
+		s.writeControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, reason),
+			time.Now().Add(time.Second),
+		)
+		s.closeWS()
+	})
+}
+
+// sendFinalPacket sends the configured final packet to the backend, at most
+// once per session, with the placeholders filled in. It is best effort: the
+// write gets finalPacketTimeout, and errors are only logged.
+func (s *session) sendFinalPacket(code int, reason string) {
+	if len(s.proxy.cfg.FinalPacket) == 0 {
+		return
+	}
+	s.finalOnce.Do(func() {
+		pkt := strings.NewReplacer(
+			"{id}", s.id,
+			"{code}", strconv.Itoa(code),
+			"{reason}", reason,
+		).Replace(string(s.proxy.cfg.FinalPacket))
+		// Teardown may have set a deadline in the past.
+		s.udpConn.SetDeadline(time.Now().Add(finalPacketTimeout))
+		if _, err := s.udpConn.Write([]byte(pkt)); err != nil {
+			slog.Warn("send final packet error", "client", s.id, "error", err)
+		}
+	})
+}
+
+// reap closes sessions over the idle timeout or maximum lifetime every
+// interval. Sessions have no timers or read deadlines of their own for
+// either, so this is what enforces them, up to interval late.
+func (p *Proxy) reap(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+		for _, s := range p.sessions.snapshot() {
+			var code int
+			var reason string
+			switch {
+			case p.cfg.MaxLifetime > 0 && p.now().Sub(s.startedAt) > p.cfg.MaxLifetime:
+				code, reason = CloseMaxLifetime, "max lifetime exceeded"
+			case s.idleTimeout > 0 && s.idleFor() > s.idleTimeout:
+				code, reason = CloseIdleTimeout, "idle timeout"
+			default:
+				continue
+			}
+			slog.Info("reaping client", "client", s.id, "reason", reason)
+			s.kill(code, reason)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session log formats for Config.SessionLogFormat.
+const (
+	SessionLogJSON = "json"
+	// SessionLogCLF is a Common Log Format-like line, see sessionRecord.
+	SessionLogCLF = "clf"
+)
+
+// clfTime is the timestamp layout of the Common Log Format.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// sessionRecord is one closed session in the session log.
+type sessionRecord struct {
+	Time             time.Time `json:"time"`
+	ClientIP         string    `json:"client_ip"`
+	Client           string    `json:"client"`
+	Route            string    `json:"route"`
+	Backend          string    `json:"backend"`
+	BackendAddr      string    `json:"backend_addr"`
+	DurationSeconds  float64   `json:"duration_seconds"`
+	BytesToBackend   uint64    `json:"bytes_to_backend"`
+	PacketsToBackend uint64    `json:"packets_to_backend"`
+	BytesToClient    uint64    `json:"bytes_to_client"`
+	PacketsToClient  uint64    `json:"packets_to_client"`
+	CloseCode        int       `json:"close_code"`
+	CloseReason      string    `json:"close_reason"`
+}
+
+// sessionRecordOf describes s, which ended on err at end. The close code
+// is the one the proxy sent, or else the client's.
+func sessionRecordOf(s *session, clientIP, route string, err error, end time.Time) sessionRecord {
+	code, reason := closeCodeOf(err)
+	if killed := atomic.LoadInt32(&s.killCode); killed != 0 {
+		code, reason = int(killed), s.killReason
+	}
+	return sessionRecord{
+		Time:             end,
+		ClientIP:         clientIP,
+		Client:           s.id,
+		Route:            route,
+		Backend:          s.backend,
+		BackendAddr:      s.udpConn.RemoteAddr().String(),
+		DurationSeconds:  end.Sub(s.startedAt).Seconds(),
+		BytesToBackend:   atomic.LoadUint64(&s.bytesToBackend),
+		PacketsToBackend: atomic.LoadUint64(&s.packetsToBackend),
+		BytesToClient:    atomic.LoadUint64(&s.bytesToClient),
+		PacketsToClient:  atomic.LoadUint64(&s.packetsToClient),
+		CloseCode:        code,
+		CloseReason:      reason,
+	}
+}
+
+// appendCLF appends r as
+//
+//	client_ip - client [time] "route backend backend_addr" close_code
+//	bytes_to_backend bytes_to_client packets_to_backend packets_to_client
+//	duration_seconds "close_reason"
+//
+// all on one line.
+func (r sessionRecord) appendCLF(b []byte) []byte {
+	b = append(b, r.ClientIP...)
+	b = append(b, " - "...)
+	b = append(b, r.Client...)
+	b = append(b, " ["...)
+	b = r.Time.AppendFormat(b, clfTime)
+	b = append(b, "] \""...)
+	b = append(b, r.Route...)
+	b = append(b, ' ')
+	b = append(b, r.Backend...)
+	b = append(b, ' ')
+	b = append(b, r.BackendAddr...)
+	b = append(b, "\" "...)
+	b = strconv.AppendInt(b, int64(r.CloseCode), 10)
+	for _, n := range []uint64{r.BytesToBackend, r.BytesToClient, r.PacketsToBackend, r.PacketsToClient} {
+		b = append(b, ' ')
+		b = strconv.AppendUint(b, n, 10)
+	}
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, r.DurationSeconds, 'f', 3, 64)
+	b = append(b, ' ')
+	b = strconv.AppendQuote(b, r.CloseReason)
+	return append(b, '\n')
+}
+
+// sessionLogger appends session records to a file, renaming it to
+// path.1, path.1 to path.2 and so on once it grows past maxSize, and
+// keeping at most maxFiles of those. A failed write is logged and
+// counted, and does not hold up the session.
+type sessionLogger struct {
+	path     string
+	format   string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newSessionLogger(path, format string, maxSize int64, maxFiles int) (*sessionLogger, error) {
+	l := &sessionLogger{path: path, format: format, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *sessionLogger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+func (l *sessionLogger) log(r sessionRecord) {
+	var line []byte
+	if l.format == SessionLogCLF {
+		line = r.appendCLF(nil)
+	} else {
+		line, _ = json.Marshal(r)
+		line = append(line, '\n')
+	}
+	l.mu.Lock()
+	err := l.writeLocked(line)
+	l.mu.Unlock()
+	if err != nil {
+		metricSessionLogErrors.inc()
+		slog.Error("session log error", "path", l.path, "error", err)
+	}
+}
+
+func (l *sessionLogger) writeLocked(line []byte) error {
+	if l.f == nil {
+		// A failed rotation left no file open; try again.
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotateLocked moves the current file out of the way and starts a new one.
+func (l *sessionLogger) rotateLocked() error {
+	l.f.Close()
+	l.f = nil
+	if l.maxFiles <= 0 {
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return l.open()
+	}
+	os.Remove(rotatedName(l.path, l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		os.Rename(rotatedName(l.path, i), rotatedName(l.path, i+1))
+	}
+	if err := os.Rename(l.path, rotatedName(l.path, 1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func rotatedName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
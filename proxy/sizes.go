@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// What a client datagram outside Config.AllowedSizes does.
+const (
+	SizePolicyDrop  = "drop"
+	SizePolicyClose = "close"
+)
+
+var errSizeNotAllowed = errors.New("datagram size not allowed")
+
+// SizeRange is an inclusive range of datagram lengths in bytes.
+type SizeRange struct {
+	Min, Max int
+}
+
+// ParseSizeRanges parses a comma-separated list of lengths and inclusive
+// ranges, e.g. "20-1200,1472".
+func ParseSizeRanges(s string) ([]SizeRange, error) {
+	var ranges []SizeRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi, isRange := strings.Cut(part, "-")
+		min, err := strconv.Atoi(lo)
+		if err != nil || min < 0 {
+			return nil, fmt.Errorf("invalid size %q", part)
+		}
+		max := min
+		if isRange {
+			if max, err = strconv.Atoi(hi); err != nil || max < min {
+				return nil, fmt.Errorf("invalid size range %q", part)
+			}
+		}
+		ranges = append(ranges, SizeRange{Min: min, Max: max})
+	}
+	return ranges, nil
+}
+
+// sizeAllowed reports whether a datagram of n bytes falls in one of ranges.
+func sizeAllowed(ranges []SizeRange, n int) bool {
+	for _, r := range ranges {
+		if n >= r.Min && n <= r.Max {
+			return true
+		}
+	}
+	return false
+}
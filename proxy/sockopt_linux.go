@@ -0,0 +1,95 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+const (
+	bindToDeviceSupported = true
+	broadcastSupported    = true
+)
+
+// bindToDevice returns a dialer control hook that pins the socket to the
+// given network interface via SO_BINDTODEVICE.
+func bindToDevice(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(
+				int(fd),
+				syscall.SOL_SOCKET,
+				syscall.SO_BINDTODEVICE,
+				device,
+			)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// allowBroadcast is a listen control hook setting SO_BROADCAST, without
+// which sending to a broadcast address fails.
+func allowBroadcast(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// socketBufferSizes returns the receive and send buffer sizes the kernel
+// granted conn. Linux reports twice the usable size, the rest being
+// bookkeeping overhead.
+func socketBufferSizes(conn *net.UDPConn) (rcv, snd int, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if rcv, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); sockErr != nil {
+			return
+		}
+		snd, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return rcv, snd, sockErr
+}
+
+// dialUnixgram connects a datagram socket to the unix socket at path. The
+// socket is autobound to an abstract address first, which the backend
+// sees as the sender and can reply to.
+func dialUnixgram(path string) (*net.UnixConn, error) {
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	// An empty name is what asks the kernel to autobind.
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Connect(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+		syscall.Close(fd)
+		return nil, &net.OpError{Op: "dial", Net: "unixgram",
+			Addr: &net.UnixAddr{Name: path, Net: "unixgram"}, Err: os.NewSyscallError("connect", err)}
+	}
+	f := os.NewFile(uintptr(fd), "unixgram:"+path)
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UnixConn), nil
+}
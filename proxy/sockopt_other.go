@@ -0,0 +1,32 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+const (
+	bindToDeviceSupported = false
+	broadcastSupported    = false
+)
+
+func bindToDevice(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("udp-bind-device is only supported on Linux")
+	}
+}
+
+func allowBroadcast(network, address string, c syscall.RawConn) error {
+	return errors.New("udp-broadcast is only supported on Linux")
+}
+
+func socketBufferSizes(conn *net.UDPConn) (rcv, snd int, err error) {
+	return 0, 0, errors.New("reading socket buffer sizes is only supported on Linux")
+}
+
+func dialUnixgram(path string) (*net.UnixConn, error) {
+	return nil, errors.New("unixgram backends are only supported on Linux")
+}
@@ -0,0 +1,44 @@
+package proxy
+
+// Stats is a snapshot of the proxy's traffic counters, also served as JSON
+// on the admin API's /stats.
+type Stats struct {
+	// ActiveConnections are the clients currently forwarding;
+	// TotalConnections all that ever started forwarding.
+	ActiveConnections int64  `json:"active_connections"`
+	TotalConnections  uint64 `json:"total_connections"`
+	// MaxConnections is Config.MaxConns, 0 for no limit.
+	MaxConnections int `json:"max_connections"`
+
+	// BytesToBackend and BytesToClient count payload bytes forwarded.
+	BytesToBackend uint64 `json:"bytes_to_backend"`
+	BytesToClient  uint64 `json:"bytes_to_client"`
+
+	// DroppedDatagrams are client datagrams dropped on transient backend
+	// write errors under WriteErrorPolicyDrop.
+	DroppedDatagrams uint64 `json:"dropped_datagrams"`
+
+	// BackendErrors count connections whose backend could not be reached
+	// or failed mid-session.
+	BackendErrors uint64 `json:"backend_errors"`
+
+	// BackendConnections are this proxy's connections per backend address,
+	// upgrades in progress included.
+	BackendConnections map[string]int `json:"backend_connections"`
+}
+
+// Stats returns the current totals. Apart from BackendConnections, they are
+// read from the counters behind the Prometheus metrics, which are
+// process-wide, so they include every Proxy in the process.
+func (p *Proxy) Stats() Stats {
+	return Stats{
+		ActiveConnections:  metricConnsActive.load(),
+		TotalConnections:   metricConnsTotal.load(),
+		MaxConnections:     p.reloadable().MaxConns,
+		BytesToBackend:     metricBytesToBackend.load(),
+		BytesToClient:      metricBytesToClient.load(),
+		DroppedDatagrams:   metricDropped.load(),
+		BackendErrors:      metricBackendErrors.load(),
+		BackendConnections: p.limiter.snapshot(),
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	fastws "github.com/fasthttp/websocket"
+)
+
+func TestRequireSubprotocol(t *testing.T) {
+	const required = "udp-proxy.v1"
+	h := startHarness(t, Config{RequireSubprotocol: required})
+	tests := []struct {
+		name    string
+		offered []string
+		// status is the upgrade's HTTP status.
+		status int
+	}{
+		{"present", []string{required}, http.StatusSwitchingProtocols},
+		{"present among others", []string{"chat", required}, http.StatusSwitchingProtocols},
+		{"absent", nil, http.StatusBadRequest},
+		{"mismatched", []string{"udp-proxy.v2"}, http.StatusBadRequest},
+		{"wrong case", []string{strings.ToUpper(required)}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := fastws.Dialer{Subprotocols: tt.offered}
+			conn, resp, err := dialer.Dial(h.url, nil)
+			if resp == nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if conn == nil {
+				return
+			}
+			defer closeNormally(conn)
+			if got := conn.Subprotocol(); got != required {
+				t.Errorf("selected subprotocol %q, want %q", got, required)
+			}
+		})
+	}
+	h.waitIdle(t)
+}
+
+func TestRequireSubprotocolConfig(t *testing.T) {
+	for _, name := range []string{"a,b", "a b"} {
+		if _, err := New(Config{Backends: []string{"127.0.0.1:9"}, RequireSubprotocol: name}); err == nil {
+			t.Errorf("RequireSubprotocol %q accepted", name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// targetLimitKey is what connections to client-chosen targets are counted
+// under in the connection limits and per-backend figures, so that every
+// target does not get a bucket and a metric series of its own.
+const targetLimitKey = "target"
+
+// TargetRule allows client-chosen backends on ports MinPort to MaxPort of
+// either the host name Host, matched case-insensitively, or, when Host is
+// empty, the IP addresses in Prefix.
+type TargetRule struct {
+	Host             string
+	Prefix           netip.Prefix
+	MinPort, MaxPort int
+}
+
+// ParseTargetRules parses a comma-separated list of host:ports rules, where
+// host is a name, an IP address or a CIDR prefix, IPv6 ones in brackets, and
+// ports is a port, an inclusive range or *, e.g.
+// "10.0.0.0/8:1000-2000,dns.internal:53,[2001:db8::/32]:*".
+func ParseTargetRules(s string) ([]TargetRule, error) {
+	var rules []TargetRule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		host, ports, err := net.SplitHostPort(part)
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("invalid target rule %q", part)
+		}
+		var r TargetRule
+		if prefix, err := netip.ParsePrefix(host); err == nil {
+			r.Prefix = prefix.Masked()
+		} else if addr, err := netip.ParseAddr(host); err == nil {
+			r.Prefix = netip.PrefixFrom(addr, addr.BitLen())
+		} else {
+			r.Host = strings.ToLower(host)
+		}
+		if ports == "*" {
+			r.MinPort, r.MaxPort = 1, 65535
+		} else {
+			lo, hi, isRange := strings.Cut(ports, "-")
+			if !isRange {
+				hi = lo
+			}
+			r.MinPort, err = strconv.Atoi(lo)
+			if err == nil {
+				r.MaxPort, err = strconv.Atoi(hi)
+			}
+			if err != nil || r.MinPort < 1 || r.MaxPort > 65535 || r.MaxPort < r.MinPort {
+				return nil, fmt.Errorf("invalid ports in target rule %q", part)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// targetAllowed reports whether one of rules allows the host:port target.
+// Names are never resolved for this: a name only matches a rule for that
+// name, and prefixes only match IP address targets, so DNS cannot steer a
+// client into a range it was not allowed.
+func targetAllowed(rules []TargetRule, target string) bool {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	isAddr := err == nil
+	for _, r := range rules {
+		if port < r.MinPort || port > r.MaxPort {
+			continue
+		}
+		if isAddr && r.Host == "" && r.Prefix.Contains(addr.Unmap()) {
+			return true
+		}
+		if !isAddr && r.Host != "" && strings.EqualFold(r.Host, host) {
+			return true
+		}
+	}
+	return false
+}
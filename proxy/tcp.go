@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// TCP framings for Config.TCPFraming.
+const (
+	// TCPFramingRaw writes messages to the stream as they are and sends
+	// the client whatever each single Read returns, buf[:n], as soon as it
+	// arrives rather than waiting to fill the buffer, as websockify does.
+	// The chunks are arbitrary: message boundaries are not kept.
+	TCPFramingRaw = "raw"
+	// TCPFramingLength16 frames every message in both directions by a
+	// 2-byte big-endian length, as QUICModeStream does.
+	TCPFramingLength16 = "length16"
+	// TCPFramingNewline splits the stream on '\n', sending the client each
+	// line without it as a text message, and ends every client message
+	// with one, for line-based protocols.
+	TCPFramingNewline = "newline"
+)
+
+// maxLine is the longest line TCPFramingNewline buffers; longer ones go
+// to the client in pieces of at most this size.
+const maxLine = 0xffff
+
+const defaultTCPDialTimeout = 5 * time.Second
+
+// dialTCP connects to a TCP backend. The local address, device binding,
+// DSCP marking and TTL of UDP backends apply to it as well.
+func (p *Proxy) dialTCP(addr *net.UDPAddr) (backendConn, error) {
+	dialer := net.Dialer{Timeout: defaultTCPDialTimeout}
+	if p.cfg.UDPBindDevice != "" {
+		dialer.Control = bindToDevice(p.cfg.UDPBindDevice)
+	}
+	var conn net.Conn
+	err := p.bindLocal(func(ip net.IP, port int) error {
+		if ip != nil || port != 0 {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip, Port: port}
+		}
+		var err error
+		conn, err = dialer.Dial("tcp", addr.String())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.applyDSCP(conn)
+	p.applyTTL(conn)
+	return p.frameStream(conn), nil
+}
+
+// frameStream applies Config.TCPFraming to a stream backend connection.
+func (p *Proxy) frameStream(conn net.Conn) backendConn {
+	switch p.cfg.TCPFraming {
+	case TCPFramingLength16:
+		return &framedConn{Conn: conn}
+	case TCPFramingNewline:
+		return &lineConn{Conn: conn}
+	}
+	return conn
+}
+
+// framedConn frames messages on a stream connection.
+type framedConn struct {
+	net.Conn
+	frames frameReader
+}
+
+func (c *framedConn) Write(b []byte) (int, error) {
+	return writeFrame(c.Conn, b)
+}
+
+func (c *framedConn) Read(b []byte) (int, error) {
+	return c.frames.read(c.Conn, b)
+}
+
+// lineConn splits a stream connection into lines. A partially read line
+// survives a read deadline, as a frame does for framedConn. A line longer
+// than the caller's buffer, or than maxLine, goes out in pieces, and one
+// left without its '\n' when the stream ends is still delivered.
+type lineConn struct {
+	net.Conn
+	buf []byte
+	// start and end bound the bytes read but not yet delivered.
+	start, end int
+	// err is the error that ended the stream, returned once what was
+	// read before it is delivered.
+	err error
+}
+
+func (c *lineConn) Write(b []byte) (int, error) {
+	line := make([]byte, len(b)+1)
+	copy(line, b)
+	line[len(b)] = '\n'
+	if _, err := c.Conn.Write(line); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *lineConn) Read(b []byte) (int, error) {
+	if c.buf == nil {
+		c.buf = make([]byte, maxLine)
+	}
+	for {
+		pending := c.buf[c.start:c.end]
+		if i := bytes.IndexByte(pending, '\n'); i >= 0 {
+			n := copy(b, pending[:i])
+			c.start += n
+			if n == i {
+				// The rest of the line fit; drop its '\n'.
+				c.start++
+			}
+			return n, nil
+		}
+		if len(pending) > 0 && (len(pending) == len(c.buf) || c.err != nil) {
+			n := copy(b, pending)
+			c.start += n
+			return n, nil
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.end = copy(c.buf, pending)
+		c.start = 0
+		n, err := c.Conn.Read(c.buf[c.end:])
+		c.end += n
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, err
+		}
+		c.err = err
+	}
+}
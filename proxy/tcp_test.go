@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// readerConn is a connection whose reads come from r.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readerConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func TestLineConnRead(t *testing.T) {
+	deadline := os.ErrDeadlineExceeded
+	errReset := errors.New("connection reset")
+	long := strings.Repeat("x", maxLine+10)
+	tests := []struct {
+		name  string
+		reads []interface{}
+		// bufSize is the buffer read into, 64 bytes if zero.
+		bufSize int
+		// want holds the message read or the error got, in order.
+		want []interface{}
+	}{{
+		name:  "lines",
+		reads: []interface{}{[]byte("a\nbc\n\nd\n")},
+		want:  []interface{}{"a", "bc", "", "d", io.EOF},
+	}, {
+		name:  "lines split across reads",
+		reads: []interface{}{[]byte("a"), []byte("b\nc"), []byte("d\n")},
+		want:  []interface{}{"ab", "cd", io.EOF},
+	}, {
+		name:    "line longer than the buffer",
+		reads:   []interface{}{[]byte("abcdefgh\nij\n")},
+		bufSize: 3,
+		want:    []interface{}{"abc", "def", "gh", "ij", io.EOF},
+	}, {
+		name:    "line a multiple of the buffer",
+		reads:   []interface{}{[]byte("abcdef\ng\n")},
+		bufSize: 3,
+		want:    []interface{}{"abc", "def", "g", io.EOF},
+	}, {
+		name:  "partial last line before EOF",
+		reads: []interface{}{[]byte("a\nbcd")},
+		want:  []interface{}{"a", "bcd", io.EOF},
+	}, {
+		name:    "partial last line longer than the buffer",
+		reads:   []interface{}{[]byte("abcde")},
+		bufSize: 2,
+		want:    []interface{}{"ab", "cd", "e", io.EOF},
+	}, {
+		name:  "partial last line before an error",
+		reads: []interface{}{[]byte("a\nbc"), errReset},
+		want:  []interface{}{"a", "bc", errReset},
+	}, {
+		name:  "deadline inside a line",
+		reads: []interface{}{[]byte("ab"), deadline, []byte("c\n")},
+		want:  []interface{}{deadline, "abc", io.EOF},
+	}, {
+		name:    "line longer than maxLine",
+		reads:   []interface{}{[]byte(long + "\nz\n")},
+		bufSize: 2 * maxLine,
+		want:    []interface{}{long[:maxLine], long[maxLine:], "z", io.EOF},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.bufSize
+			if size == 0 {
+				size = 64
+			}
+			c := &lineConn{Conn: readerConn{r: &scriptedReader{reads: tt.reads}}}
+			buf := make([]byte, size)
+			for i, want := range tt.want {
+				n, err := c.Read(buf)
+				switch want := want.(type) {
+				case error:
+					if !errors.Is(err, want) {
+						t.Fatalf("read %d: error %v, want %v", i, err, want)
+					}
+				case string:
+					if err != nil {
+						t.Fatalf("read %d: %v, want %d bytes", i, err, len(want))
+					}
+					if string(buf[:n]) != want {
+						t.Fatalf("read %d: %q, want %q", i, truncate(buf[:n]), truncate([]byte(want)))
+					}
+				}
+			}
+		})
+	}
+}
+
+// truncate shortens long lines for failure messages.
+func truncate(b []byte) string {
+	if len(b) > 16 {
+		return string(b[:16]) + "..."
+	}
+	return string(b)
+}
+
+// writeRecorder is a connection recording what is written to it.
+type writeRecorder struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *writeRecorder) Write(b []byte) (int, error) { return c.written.Write(b) }
+
+func TestLineConnWrite(t *testing.T) {
+	w := &writeRecorder{}
+	c := &lineConn{Conn: w}
+	for _, msg := range []string{"hello", ""} {
+		if n, err := c.Write([]byte(msg)); err != nil || n != len(msg) {
+			t.Fatalf("Write(%q) = %d, %v", msg, n, err)
+		}
+	}
+	if got := w.written.String(); got != "hello\n\n" {
+		t.Errorf("wrote %q, want %q", got, "hello\n\n")
+	}
+}
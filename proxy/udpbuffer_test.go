@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	fastws "github.com/fasthttp/websocket"
+)
+
+// TestUDPBufferSize checks backend datagrams up to UDPBufferSize come back
+// whole, and longer ones are cut to it and counted, through single and
+// batched reads.
+func TestUDPBufferSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		size    int
+		wantLen int
+	}{
+		{"default, largest IPv4 datagram", Config{}, maxDatagram, maxDatagram},
+		{"default, DNS with EDNS", Config{}, 4096, 4096},
+		{"jumbo, fits", Config{UDPBufferSize: 9000}, 9000, 9000},
+		{"jumbo, one byte over", Config{UDPBufferSize: 9000}, 9001, 9000},
+		{"jumbo, batched, fits", Config{UDPBufferSize: 9000, BatchReads: 8}, 9000, 9000},
+		{"jumbo, batched, one byte over", Config{UDPBufferSize: 9000, BatchReads: 8}, 9001, 9000},
+		{"small", Config{UDPBufferSize: 512}, 1472, 512},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.DataType = DataTypeBinary
+			h := startHarness(t, tt.cfg)
+			conn := h.dial(t)
+			msg := randomBytes(rand.New(rand.NewSource(int64(tt.size))), tt.size)
+			before := atomic.LoadUint64(&metricUDPTruncated.value)
+			err := exchange(conn, fastws.BinaryMessage, fastws.BinaryMessage, [][]byte{msg}, 1,
+				func(msg []byte) []byte { return msg[:tt.wantLen] })
+			closeNormally(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			truncated := atomic.LoadUint64(&metricUDPTruncated.value) - before
+			want := uint64(0)
+			if tt.wantLen < tt.size {
+				want = 1
+			}
+			// Only platforms reporting MSG_TRUNC can tell.
+			if msgTrunc != 0 && truncated != want {
+				t.Errorf("%d datagrams counted truncated, want %d", truncated, want)
+			}
+			h.waitIdle(t)
+		})
+	}
+}
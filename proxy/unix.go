@@ -0,0 +1,22 @@
+package proxy
+
+import "net"
+
+// isUnixProto reports whether proto reaches the backend on a unix domain
+// socket, whose address is a path rather than host:port.
+func isUnixProto(proto string) bool {
+	return proto == BackendProtoUnix || proto == BackendProtoUnixgram
+}
+
+// dialUnix connects to the unix domain socket backend at path. Stream
+// sockets are framed like TCP backends.
+func (p *Proxy) dialUnix(path string) (backendConn, error) {
+	if p.cfg.BackendProto == BackendProtoUnixgram {
+		return dialUnixgram(path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return p.frameStream(conn), nil
+}
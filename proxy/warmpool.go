@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"log/slog"
+	"time"
+)
+
+// warmPoolRetryDelay spaces out refill attempts while the backend cannot be
+// resolved or dialed.
+const warmPoolRetryDelay = time.Second
+
+// warmPool keeps pre-dialed sockets for one backend so new clients skip
+// resolving and dialing. Sockets are connected, hence tied to the address
+// the backend resolved to when they were dialed; the refill resolves anew
+// for every socket, so DNS changes are picked up as the pool turns over,
+// or at once when the resolver notices them.
+type warmPool struct {
+	p     *Proxy
+	addr  string
+	conns chan backendConn
+}
+
+func newWarmPool(p *Proxy, addr string, size int) *warmPool {
+	return &warmPool{p: p, addr: addr, conns: make(chan backendConn, size)}
+}
+
+// get returns a pre-dialed socket, or nil when the pool is empty.
+func (w *warmPool) get() backendConn {
+	select {
+	case conn := <-w.conns:
+		return conn
+	default:
+		return nil
+	}
+}
+
+// run keeps the pool full until done is closed, then closes the sockets
+// still pooled.
+func (w *warmPool) run(done <-chan struct{}) {
+	defer w.flush()
+	for {
+		conn, err := w.dial()
+		if err != nil {
+			slog.Warn("warm pool error", "backend", w.addr, "error", err)
+			select {
+			case <-time.After(warmPoolRetryDelay):
+				continue
+			case <-done:
+				return
+			}
+		}
+		select {
+		case w.conns <- conn:
+		case <-done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// flush closes the pooled sockets. After the backend's address changed,
+// the refill dials the new one.
+func (w *warmPool) flush() {
+	for {
+		select {
+		case conn := <-w.conns:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (w *warmPool) dial() (backendConn, error) {
+	udpAddr, err := w.p.resolveBackend(w.addr)
+	if err != nil {
+		return nil, err
+	}
+	return w.p.dialBackend(udpAddr)
+}
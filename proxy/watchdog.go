@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// maxStackSnapshot caps the goroutine dump logged for a stuck read.
+const maxStackSnapshot = 64 << 10
+
+// beginRead and endRead bracket a backend read for the read watchdog.
+func (s *session) beginRead() {
+	atomic.StoreInt64(&s.readSince, s.proxy.now().UnixNano())
+}
+
+func (s *session) endRead() {
+	atomic.StoreInt64(&s.readSince, 0)
+}
+
+// readBound is how long a healthy backend read can block before something
+// else ends it: the heartbeat deadline, or else the reaper acting on the
+// idle timeout. Zero means a quiet backend may legitimately block a read
+// for as long as the client stays connected.
+func (s *session) readBound() time.Duration {
+	cfg := &s.proxy.cfg
+	if cfg.HeartbeatInterval > 0 {
+		return cfg.HeartbeatInterval
+	}
+	if s.idleTimeout > 0 {
+		return s.idleTimeout + cfg.ReaperInterval
+	}
+	return 0
+}
+
+// watchReads closes the backend socket when a read stays blocked for
+// ReadWatchdog past the point it should have returned: past readBound with
+// no activity on the session, or after ctx was canceled, which sets a
+// deadline in the past. Reads only outlive both on platform bugs, and the
+// forwarding goroutine, and with it the handler, would otherwise leak
+// silently. It returns once done is closed.
+func (s *session) watchReads(ctx context.Context, done <-chan struct{}) {
+	limit := s.proxy.cfg.ReadWatchdog
+	ticker := time.NewTicker(limit / 4)
+	defer ticker.Stop()
+
+	ctxDone := ctx.Done()
+	var canceledAt time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctxDone:
+			canceledAt = s.proxy.now()
+			ctxDone = nil
+			continue
+		case <-ticker.C:
+		}
+
+		since := atomic.LoadInt64(&s.readSince)
+		if since == 0 {
+			continue
+		}
+		now := s.proxy.now()
+		blocked := now.Sub(time.Unix(0, since))
+		var stuck bool
+		if !canceledAt.IsZero() {
+			stuck = now.Sub(canceledAt) >= limit
+		} else if bound := s.readBound(); bound > 0 {
+			stuck = blocked >= bound+limit && s.idleFor() >= bound+limit
+		}
+		if !stuck {
+			continue
+		}
+
+		metricStuckReads.inc()
+		stack := make([]byte, maxStackSnapshot)
+		stack = stack[:runtime.Stack(stack, true)]
+		slog.Warn("backend read stuck, closing the socket", "client", s.id,
+			"blocked", blocked.Round(time.Millisecond), "stack", string(stack))
+		s.udpConn.Close()
+		return
+	}
+}
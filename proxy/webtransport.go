@@ -0,0 +1,344 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	fastws "github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+	"github.com/valyala/fasthttp"
+)
+
+// localKeyWebTransport is the Locals key of a WebTransport request's
+// webTransportRequest. Only WebTransportServer sets it, so clients cannot
+// pass a request off as one.
+const localKeyWebTransport = "localKeyWebTransport"
+
+// WebTransportServer serves browsers over WebTransport (HTTP/3 over
+// QUIC), each client datagram a QUIC datagram, so latency-sensitive
+// traffic is not held up behind a lost TCP segment. The request opening a
+// session runs through app's routes like a WebSocket upgrade would, so the
+// client, origin and token checks, routes, limits and the app's own
+// middleware all apply, and the session then shares the proxy's
+// forwarding, admin API and metrics with WebSocket clients. Other HTTP/3
+// requests, such as a metrics scrape, are served by app as they are.
+type WebTransportServer struct {
+	p   *Proxy
+	app *fiber.App
+	wt  webtransport.Server
+
+	handlerOnce sync.Once
+	handler     fasthttp.RequestHandler
+}
+
+// NewWebTransportServer returns a server for the WebSocket routes p
+// registered on app, with TLS from tlsConfig, which QUIC requires.
+func (p *Proxy) NewWebTransportServer(app *fiber.App, tlsConfig *tls.Config) *WebTransportServer {
+	s := &WebTransportServer{p: p, app: app}
+	s.wt = webtransport.Server{
+		H3: http3.Server{
+			TLSConfig: tlsConfig,
+			QUICConfig: &quic.Config{
+				EnableDatagrams: true,
+				KeepAlivePeriod: quicKeepAlivePeriod,
+			},
+			Handler: http.HandlerFunc(s.serveHTTP),
+		},
+		// The proxy middleware checks the origin, as for WebSockets.
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	return s
+}
+
+// Serve serves QUIC connections arriving on conn until Close.
+func (s *WebTransportServer) Serve(conn net.PacketConn) error {
+	return s.wt.Serve(conn)
+}
+
+// Close closes the connections, ending their sessions, and stops Serve.
+func (s *WebTransportServer) Close() error {
+	return s.wt.Close()
+}
+
+// webTransportRequest is a WebTransport session request on its way
+// through the app, see webTransportUpgrade. It must not implement
+// io.Closer, see wsHandler.
+type webTransportRequest struct {
+	server *WebTransportServer
+	w      http.ResponseWriter
+	r      *http.Request
+	// sess and cc are set once the session is accepted.
+	sess *webtransport.Session
+	cc   *connCtx
+}
+
+func webTransportRequestOf(c *fiber.Ctx) *webTransportRequest {
+	req, _ := c.Locals(localKeyWebTransport).(*webTransportRequest)
+	return req
+}
+
+// webTransportUpgrade accepts the session of a WebTransport request the
+// middleware let through, leaving WebSocket upgrades to the next handler.
+func webTransportUpgrade(c *fiber.Ctx) error {
+	req := webTransportRequestOf(c)
+	if req == nil {
+		return c.Next()
+	}
+	sess, err := req.server.wt.Upgrade(req.w, req.r)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	req.sess = sess
+	req.cc, _ = c.Locals(localKeyConn).(*connCtx)
+	return nil
+}
+
+// serveHTTP runs r through the app. A session request is made a GET, so
+// it takes the WebSocket route, and once accepted is served right here:
+// the session ends when this returns.
+func (s *WebTransportServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handlerOnce.Do(func() { s.handler = s.app.Handler() })
+	var req *webTransportRequest
+	if r.Method == http.MethodConnect && r.Proto == "webtransport" {
+		req = &webTransportRequest{server: s, w: w, r: r}
+	}
+	ctx, err := requestCtxOf(r, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	s.handler(ctx)
+	if req != nil && req.sess != nil {
+		metricWebTransportSessions.inc()
+		s.p.serveClient(newWebTransportConn(req.sess, &s.p.cfg), req.cc)
+		return
+	}
+	ctx.Response.Header.VisitAll(func(key, value []byte) {
+		w.Header().Add(string(key), string(value))
+	})
+	w.WriteHeader(ctx.Response.StatusCode())
+	w.Write(ctx.Response.Body())
+}
+
+// requestCtxOf copies r into a fasthttp request for the app, with req, if
+// any, among its user values.
+func requestCtxOf(r *http.Request, req *webTransportRequest) (*fasthttp.RequestCtx, error) {
+	ctx := new(fasthttp.RequestCtx)
+	conn := h3Conn{remote: tcpAddrOf(r.RemoteAddr), local: &net.TCPAddr{}}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.local = tcpAddrOf(addr.String())
+	}
+	if r.TLS != nil {
+		conn.tls = *r.TLS
+	}
+	ctx.Init2(conn, fasthttpLogger{}, true)
+	method := r.Method
+	if req != nil {
+		method = fiber.MethodGet
+		ctx.SetUserValue(localKeyWebTransport, req)
+	}
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(r.URL.RequestURI())
+	ctx.Request.Header.SetHost(r.Host)
+	for key, values := range r.Header {
+		for _, value := range values {
+			ctx.Request.Header.Add(key, value)
+		}
+	}
+	if req == nil && r.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, fiber.DefaultBodyLimit+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > fiber.DefaultBodyLimit {
+			return nil, errors.New("request body too large")
+		}
+		ctx.Request.SetBody(body)
+	}
+	return ctx, nil
+}
+
+// h3Conn stands in for the connection of a request copied into fasthttp,
+// which takes the client's address and TLS state from it. Nothing reads
+// or writes it.
+type h3Conn struct {
+	net.Conn
+	local, remote net.Addr
+	tls           tls.ConnectionState
+}
+
+func (c h3Conn) LocalAddr() net.Addr                  { return c.local }
+func (c h3Conn) RemoteAddr() net.Addr                 { return c.remote }
+func (c h3Conn) Handshake() error                     { return nil }
+func (c h3Conn) ConnectionState() tls.ConnectionState { return c.tls }
+
+// tcpAddrOf parses a host:port as a *net.TCPAddr, the only kind of
+// address fasthttp takes a client IP from.
+func tcpAddrOf(addr string) *net.TCPAddr {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+type fasthttpLogger struct{}
+
+func (fasthttpLogger) Printf(format string, args ...interface{}) {
+	slog.Warn(fmt.Sprintf(format, args...))
+}
+
+// webTransportConn is a WebTransport session as a clientConn. Every
+// message is a datagram, which has no type of its own, so the ones read
+// count as the type Config.DataFromClient asks for. Datagrams too large
+// for the path are dropped rather than sent. JSON control messages, such
+// as the resume token, each go on a unidirectional stream of their own.
+// ReceiveDatagram takes a context rather than honoring deadlines, so
+// deadlines are mapped onto a context per read, as for quicDatagramConn.
+type webTransportConn struct {
+	sess    *webtransport.Session
+	msgType int
+	pong    func(appData string) error
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	cancelRead   context.CancelFunc
+}
+
+func newWebTransportConn(sess *webtransport.Session, cfg *Config) *webTransportConn {
+	msgType := websocket.BinaryMessage
+	if cfg.DataFromClient != "" {
+		msgType = wsMessageType(cfg.DataFromClient)
+	}
+	return &webTransportConn{sess: sess, msgType: msgType}
+}
+
+func (c *webTransportConn) ReadMessage() (int, []byte, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		ctx, cancel := context.WithCancel(c.sess.Context())
+		if !deadline.IsZero() {
+			ctx, cancel = context.WithDeadline(c.sess.Context(), deadline)
+		}
+		c.cancelRead = cancel
+		c.mu.Unlock()
+
+		msg, err := c.sess.ReceiveDatagram(ctx)
+		cancel()
+		switch {
+		case err == nil:
+			return c.msgType, msg, nil
+		case c.sess.Context().Err() != nil:
+			return 0, nil, c.closeError()
+		case errors.Is(err, context.DeadlineExceeded):
+			return 0, nil, os.ErrDeadlineExceeded
+		case errors.Is(err, context.Canceled):
+			// The deadline moved, read again with the new one.
+			continue
+		}
+		return 0, nil, err
+	}
+}
+
+// closeError returns how the session closed as a *websocket.CloseError,
+// so it is told apart from a failure as for WebSockets. A session closed
+// without a code counts as CloseNoStatusReceived.
+func (c *webTransportConn) closeError() error {
+	// AcceptStream is the one way to get at the close error.
+	_, err := c.sess.AcceptStream(context.Background())
+	var sessErr *webtransport.SessionError
+	if !errors.As(err, &sessErr) {
+		return err
+	}
+	code := int(sessErr.ErrorCode)
+	if code == 0 {
+		code = websocket.CloseNoStatusReceived
+	}
+	return &fastws.CloseError{Code: code, Text: sessErr.Message}
+}
+
+func (c *webTransportConn) WriteMessage(_ int, data []byte) error {
+	if c.sess.Context().Err() != nil {
+		return c.closeError()
+	}
+	err := c.sess.SendDatagram(data)
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		metricWebTransportTooLarge.inc()
+		return nil
+	}
+	return err
+}
+
+// WriteControl closes the session with a close message's code and reason.
+// QUIC keeps the connection alive and notices a dead peer itself, so a
+// ping counts as answered right away.
+func (c *webTransportConn) WriteControl(messageType int, data []byte, _ time.Time) error {
+	switch messageType {
+	case websocket.CloseMessage:
+		var code uint16
+		if len(data) >= 2 {
+			code, data = binary.BigEndian.Uint16(data), data[2:]
+		}
+		return c.sess.CloseWithError(webtransport.SessionErrorCode(code), string(data))
+	case websocket.PingMessage:
+		if c.pong != nil {
+			return c.pong(string(data))
+		}
+	}
+	return nil
+}
+
+func (c *webTransportConn) WriteJSON(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	str, err := c.sess.OpenUniStream()
+	if err != nil {
+		return err
+	}
+	if _, err = str.Write(msg); err != nil {
+		return err
+	}
+	return str.Close()
+}
+
+func (c *webTransportConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if c.cancelRead != nil {
+		c.cancelRead()
+	}
+	return nil
+}
+
+// SetWriteDeadline does nothing: sending a datagram does not wait for the
+// client.
+func (c *webTransportConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *webTransportConn) SetPongHandler(h func(appData string) error) { c.pong = h }
+func (c *webTransportConn) EnableWriteCompression(bool)                 {}
+func (c *webTransportConn) Subprotocol() string                         { return "" }
+
+func (c *webTransportConn) Close() error {
+	return c.sess.CloseWithError(0, "")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"udpwsproxy/proxy"
+)
+
+// serveReverse runs reverse mode: a UDP socket on addr whose peers are each
+// tunneled over a WebSocket connection to cfg.WSBackend, until SIGINT or
+// SIGTERM.
+func serveReverse(addr string, cfg proxy.ReverseConfig) {
+	r, err := proxy.NewReverse(cfg)
+	if err != nil {
+		log.Fatalln(err, "Use -h to help")
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("* Reverse mode, UDP on", conn.LocalAddr(), "tunneled to", cfg.WSBackend)
+	log.Println("* WebSocket data type:", cfg.DataType)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Println("* Shutting down, closing the tunnels")
+		r.Close()
+	}()
+	if err := r.Serve(conn); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("* Shutdown complete")
+}
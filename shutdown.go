@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"udpwsproxy/proxy"
+)
+
+// httpShutdownTimeout bounds the wait for in-flight HTTP requests, such as
+// a metrics scrape, once the drain is over.
+const httpShutdownTimeout = 5 * time.Second
+
+// httpServer is an app and the listener it serves, one per -listen, or
+// for a webtransport listener the WebTransport server on its UDP socket.
+type httpServer struct {
+	app *fiber.App
+	ln  net.Listener
+	wt  *proxy.WebTransportServer
+	pc  net.PacketConn
+}
+
+func (s httpServer) serve() error {
+	if s.wt != nil {
+		return s.wt.Serve(s.pc)
+	}
+	return s.app.Listener(s.ln)
+}
+
+// closeListener stops accepting. WebTransport sessions share the socket,
+// so for those it ends the sessions too.
+func (s httpServer) closeListener() {
+	if s.wt != nil {
+		s.wt.Close()
+		return
+	}
+	s.ln.Close()
+}
+
+func (s httpServer) shutdown() error {
+	if s.wt != nil {
+		return s.wt.Close()
+	}
+	return s.app.ShutdownWithTimeout(httpShutdownTimeout)
+}
+
+// serve runs every server until SIGINT or SIGTERM, then shuts down in order:
+// p reports not ready for lameDuck while still accepting connections, then
+// refuses new upgrades and drains for up to grace before closing the
+// remaining connections, and only then do the HTTP servers stop, which
+// also unlinks a Unix socket file. Metrics and the admin API therefore stay
+// reachable throughout the drain. Another signal cuts the current phase
+// short. handoffSignal instead closes the listeners right away and skips
+// the lame duck, leaving the sockets to whoever else has them open.
+func serve(servers []httpServer, p *proxy.Proxy, lameDuck, grace time.Duration) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	handoff := make(chan os.Signal, 1)
+	if handoffSignal != nil {
+		signal.Notify(handoff, handoffSignal)
+	}
+	errc := make(chan error, len(servers))
+	for _, s := range servers {
+		s := s
+		go func() {
+			errc <- s.serve()
+		}()
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	case <-sigs:
+	case <-handoff:
+		log.Println("* Handing the listeners over, no longer accepting")
+		for _, s := range servers {
+			s.closeListener()
+		}
+		servers, lameDuck = nil, 0
+	}
+
+	if lameDuck > 0 {
+		log.Println("* Lame duck for", lameDuck, "before draining")
+		p.LameDuck()
+		timer := time.NewTimer(lameDuck)
+		select {
+		case <-timer.C:
+		case <-sigs:
+		}
+		timer.Stop()
+	}
+	log.Println("* Shutting down, draining connections for up to", grace)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	go func() {
+		<-sigs
+		cancel()
+	}()
+	p.Shutdown(ctx)
+
+	if servers != nil {
+		log.Println("* Stopping the HTTP server")
+	}
+	for _, s := range servers {
+		if err := s.shutdown(); err != nil {
+			log.Println("shutdown http server error:", err)
+		}
+	}
+	log.Println("* Shutdown complete")
+}
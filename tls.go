@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/pion/dtls/v2"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newTLSConfig builds the listener TLS config. When clientCAFile is set,
+// client certificates are verified against it; requireClientCert makes
+// presenting one mandatory.
+func newTLSConfig(
+	certFile string,
+	keyFile string,
+	clientCAFile string,
+	requireClientCert bool,
+) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	// fasthttp only speaks HTTP/1.1, so ALPN steers clients that would
+	// prefer h2 to it rather than leaving them to guess.
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"http/1.1"},
+	}
+	return cfg, setClientCA(cfg, clientCAFile, requireClientCert)
+}
+
+// newAutocertTLSConfig builds a listener TLS config whose certificates for
+// domains are obtained from Let's Encrypt and renewed as needed, cached in
+// cacheDir. The ACME server validates through the TLS-ALPN-01 challenge,
+// which the listener answers itself, so it must be reachable on port 443.
+func newAutocertTLSConfig(
+	domains []string,
+	cacheDir string,
+	email string,
+	clientCAFile string,
+	requireClientCert bool,
+) (*tls.Config, error) {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+	// The challenge connections come without a client certificate, so
+	// they get a config of their own that does not ask for one.
+	challenge := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{"http/1.1"},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			for _, proto := range hello.SupportedProtos {
+				if proto == acme.ALPNProto {
+					return challenge, nil
+				}
+			}
+			return nil, nil
+		},
+	}
+	return cfg, setClientCA(cfg, clientCAFile, requireClientCert)
+}
+
+// setClientCA has cfg verify client certificates against clientCAFile,
+// when set; requireClientCert makes presenting one mandatory.
+func setClientCA(cfg *tls.Config, clientCAFile string, requireClientCert bool) error {
+	if clientCAFile == "" {
+		if requireClientCert {
+			return errors.New("require-client-cert needs client-ca")
+		}
+		return nil
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("no certificates found in " + clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+// newQUICTLSConfig builds the client TLS config for QUIC backends. The
+// backend certificate is checked against caFile when set, otherwise against
+// the system roots, unless insecure is set.
+func newQUICTLSConfig(
+	alpn string,
+	caFile string,
+	serverName string,
+	insecure bool,
+) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecure,
+	}
+	if alpn != "" {
+		cfg.NextProtos = []string{alpn}
+	}
+	if caFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}
+
+// newDTLSConfig builds the config for DTLS backends. With psk they are
+// authenticated by it and identity names the proxy. Otherwise their
+// certificates are verified against caFile, or the system roots, and must
+// match serverName unless insecure. certFile and keyFile, if set, are the
+// certificate the proxy presents when asked.
+func newDTLSConfig(
+	psk []byte,
+	identity string,
+	caFile string,
+	certFile string,
+	keyFile string,
+	serverName string,
+	insecure bool,
+) (*dtls.Config, error) {
+	cfg := &dtls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecure,
+	}
+	if psk != nil {
+		cfg.PSK = func([]byte) ([]byte, error) { return psk, nil }
+		cfg.PSKIdentityHint = []byte(identity)
+		// pion offers no PSK suites by default.
+		cfg.CipherSuites = []dtls.CipherSuiteID{
+			dtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+			dtls.TLS_PSK_WITH_AES_128_CCM,
+			dtls.TLS_PSK_WITH_AES_128_CCM_8,
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}
+
+// checkProtocols validates the -protocols list. Only h1 can be served:
+// fasthttp has no HTTP/2 or HTTP/3 server, so neither RFC 8441 nor RFC 9220
+// WebSockets are possible without replacing the HTTP stack.
+func checkProtocols(list string) error {
+	for _, proto := range strings.Split(list, ",") {
+		switch proto = strings.TrimSpace(proto); proto {
+		case "h1":
+		case "h2", "h3":
+			return errors.New(proto + " is not supported, the HTTP server only speaks HTTP/1.1")
+		default:
+			return errors.New("unknown protocol " + proto)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing test certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a certificate for name signed by ca, for a server when
+// server is set and a client otherwise.
+func (ca *testCA) issue(t *testing.T, name string, server bool) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writePEM writes blocks of typ to a file in dir and returns its path.
+func writePEM(t *testing.T, dir, name, typ string, blocks ...[]byte) string {
+	t.Helper()
+	var out []byte
+	for _, b := range blocks {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b})...)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, out, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test ca")
+	untrustedCA := newTestCA(t, "untrusted ca")
+	server := ca.issue(t, "server", true)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(server.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := writePEM(t, dir, "cert.pem", "CERTIFICATE", server.Certificate[0])
+	keyFile := writePEM(t, dir, "key.pem", "PRIVATE KEY", keyDER)
+	caFile := writePEM(t, dir, "ca.pem", "CERTIFICATE", ca.cert.Raw)
+	trusted := ca.issue(t, "trusted client", false)
+	untrusted := untrustedCA.issue(t, "untrusted client", false)
+
+	tests := []struct {
+		name    string
+		require bool
+		cert    *tls.Certificate
+		ok      bool
+	}{
+		{"required, valid", true, &trusted, true},
+		{"required, untrusted", true, &untrusted, false},
+		{"required, none", true, nil, false},
+		{"optional, valid", false, &trusted, true},
+		{"optional, untrusted", false, &untrusted, false},
+		{"optional, none", false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := newTLSConfig(certFile, keyFile, caFile, tt.require)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			handshake := make(chan error, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					handshake <- err
+					return
+				}
+				defer conn.Close()
+				handshake <- conn.(*tls.Conn).Handshake()
+			}()
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.cert)
+			conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+				RootCAs: roots,
+				// Certificates would hold back one the server's CAs did
+				// not sign, so it would never be checked.
+				GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					if tt.cert == nil {
+						return &tls.Certificate{}, nil
+					}
+					return tt.cert, nil
+				},
+			})
+			if err == nil {
+				defer conn.Close()
+			}
+			// Under TLS 1.3 the client finishes before the server has
+			// checked its certificate, so the server's side decides.
+			if err := <-handshake; (err == nil) != tt.ok {
+				t.Errorf("handshake error %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRequireClientCertNeedsCA(t *testing.T) {
+	if err := setClientCA(&tls.Config{}, "", true); err == nil {
+		t.Error("require-client-cert without client-ca accepted")
+	}
+}